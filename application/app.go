@@ -16,30 +16,35 @@ package application
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	"github.com/lightbitslabs/discovery-client/model"
 	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
+	"github.com/lightbitslabs/discovery-client/pkg/logging"
 	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmehost"
 	"github.com/lightbitslabs/discovery-client/service"
 )
 
 // App - the main application
 type App struct {
-	cfg    *model.AppConfig
-	cache  clientconfig.Cache
-	svc    service.Service
-	ctx    context.Context
-	cancel context.CancelFunc
-	log    *logrus.Entry
+	cfg         *model.AppConfig
+	cache       clientconfig.Cache
+	svc         service.Service
+	ctx         context.Context
+	cancel      context.CancelFunc
+	log         *logrus.Entry
+	debugServer *http.Server
 }
 
 // NewApp - Returns an App instance.
@@ -58,12 +63,8 @@ func (app *App) Start() error {
 	app.handleSignals()
 
 	// run a webserver to get the pprof webserver
-	go func() {
-		if len(app.cfg.Debug.Endpoint) > 0 {
-			http.Handle("/metrics", promhttp.Handler())
-			app.log.Infof("%v", http.ListenAndServe(app.cfg.Debug.Endpoint, nil))
-		}
-	}()
+	http.Handle("/metrics", promhttp.Handler())
+	app.startDebugServer(app.cfg.Debug.Endpoint)
 
 	dirs := make([]string, 2)
 	dirs[0] = app.cfg.ClientConfigDir
@@ -76,14 +77,25 @@ func (app *App) Start() error {
 			}
 		}
 	}
-	// if we can't find /dev/nvme-fabrics, we will not start the service
-	if _, err := os.Stat("/dev/nvme-fabrics"); os.IsNotExist(err) {
+	// the DH-CHAP key files are only accessible by root, and so is their directory.
+	if dir := app.cfg.DhChapKeyDir; dir != "" {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			app.log.Warnf("folder %q does not exists. creating it", dir)
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+		}
+	}
+	// if we can't find /dev/nvme-fabrics, we will not start the service, unless it runs in dry-run mode
+	if _, err := os.Stat("/dev/nvme-fabrics"); os.IsNotExist(err) && !app.cfg.DryRun {
 		app.log.WithError(err).Error("file /dev/nvme-fabrics does not exists." +
 			" you may need to load nvme-tcp by running 'modprobe -a nvme-tcp'" +
 			"NOTE: modprobe is not persist between reboot")
 		return err
 	}
 	app.cache = clientconfig.NewCache(app.ctx, app.cfg.ClientConfigDir, app.cfg.InternalDir, &app.cfg.AutoDetectEntries)
+	app.cache.SetHostnameResolveInterval(app.cfg.HostnameResolveInterval)
+	app.cache.SetMaxReferralDepth(app.cfg.MaxReferralDepth)
 	hostAPI := nvmehost.NewHostApi(app.cfg.LogPagePaginationEnabled, app.cfg.NvmeHostIDPath)
 	app.svc = service.NewServiceExtended(app.ctx, app.cache, hostAPI, *app.cfg)
 	if err := app.svc.Start(); err != nil {
@@ -125,14 +137,97 @@ func (app *App) handleSignals() chan bool {
 	cleanupDone := make(chan bool)
 	signal.Notify(signalChan, os.Interrupt, os.Kill, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	go func() {
-		sig := <-signalChan
-		switch sig {
-		case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT:
-			app.log.Infof("Received an \"%v\" signal, stopping services...", sig)
-			app.Stop()
-		default:
-			app.log.Infof("Received a \"%v\" signal. ignoring...", sig)
+		for sig := range signalChan {
+			switch sig {
+			case syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT:
+				app.log.Infof("Received an \"%v\" signal, stopping services...", sig)
+				app.Stop()
+				return
+			case syscall.SIGHUP:
+				app.log.Infof("Received a \"%v\" signal, reloading configuration...", sig)
+				app.reload()
+			default:
+				app.log.Infof("Received a \"%v\" signal. ignoring...", sig)
+			}
 		}
 	}()
 	return cleanupDone
 }
+
+// reload re-reads the configuration file and applies the settings that can be
+// changed without restarting the service. settings that require a restart keep
+// their current value and are reported.
+func (app *App) reload() {
+	daemon.SdNotify(false, "RELOADING=1")
+	status, err := app.reloadConfig()
+	if err != nil {
+		app.log.WithError(err).Errorf("failed to reload configuration, keeping current configuration")
+		status = fmt.Sprintf("configuration reload failed: %v", err)
+	}
+	daemon.SdNotify(false, fmt.Sprintf("READY=1\nSTATUS=%s", status))
+}
+
+func (app *App) reloadConfig() (string, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		return "", err
+	}
+	newCfg, err := model.LoadFromViper()
+	if err != nil {
+		return "", err
+	}
+	if app.svc == nil {
+		return "", fmt.Errorf("service is not running yet")
+	}
+	cfg, restartRequired := app.cfg.Reload(newCfg)
+	if cfg.Logging != app.cfg.Logging {
+		if err := logging.SetupLogging(cfg.Logging); err != nil {
+			return "", err
+		}
+		app.log.Infof("logging configuration reloaded: %+v", cfg.Logging)
+	}
+	if cfg.Debug.Endpoint != app.cfg.Debug.Endpoint {
+		app.log.Infof("debug endpoint changed from %q to %q", app.cfg.Debug.Endpoint, cfg.Debug.Endpoint)
+		app.stopDebugServer()
+		app.startDebugServer(cfg.Debug.Endpoint)
+	}
+	if cfg.HostnameResolveInterval != app.cfg.HostnameResolveInterval {
+		app.cache.SetHostnameResolveInterval(cfg.HostnameResolveInterval)
+	}
+	if cfg.MaxReferralDepth != app.cfg.MaxReferralDepth {
+		app.cache.SetMaxReferralDepth(cfg.MaxReferralDepth)
+	}
+	app.svc.Reload(cfg)
+	*app.cfg = cfg
+
+	status := "configuration reloaded"
+	if len(restartRequired) > 0 {
+		app.log.Warnf("the following settings changed and require a restart to take effect: %s",
+			strings.Join(restartRequired, ", "))
+		status = fmt.Sprintf("configuration reloaded, restart required to apply: %s", strings.Join(restartRequired, ", "))
+	}
+	app.log.Info(status)
+	return status, nil
+}
+
+// startDebugServer exposes pprof and metrics information on endpoint.
+// an empty endpoint disables the debug server.
+func (app *App) startDebugServer(endpoint string) {
+	if len(endpoint) == 0 {
+		return
+	}
+	server := &http.Server{Addr: endpoint}
+	app.debugServer = server
+	go func() {
+		app.log.Infof("%v", server.ListenAndServe())
+	}()
+}
+
+func (app *App) stopDebugServer() {
+	if app.debugServer == nil {
+		return
+	}
+	if err := app.debugServer.Close(); err != nil {
+		app.log.WithError(err).Warnf("failed to close debug server on %s", app.debugServer.Addr)
+	}
+	app.debugServer = nil
+}
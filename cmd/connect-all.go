@@ -61,6 +61,7 @@ func newConnectAllCmd() *cobra.Command {
 	cmd.Flags().IntP("kato", "k", 0, "kato")
 	viper.BindPFlag("connect-all.kato", cmd.Flags().Lookup("kato"))
 
+	addFabricsOptionsFlags(cmd, "connect-all")
 	return cmd
 }
 
@@ -69,18 +70,24 @@ func connectAllCmdFunc(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("traddr(-a) must be set")
 	}
 
+	ctrlLossTMO := viper.GetInt("connect-all.ctrl-loss-tmo")
+	fabricsOptions := fabricsOptionsFromViper("connect-all")
+	if err := fabricsOptions.Verify(); err != nil {
+		return err
+	}
 	entry := &hostapi.DiscoverRequest{
-		Traddr:    viper.GetString("connect-all.traddr"),
-		Trsvcid:   viper.GetInt("connect-all.trsvcid"),
-		Kato:      kato,
-		Hostnqn:   viper.GetString("connect-all.hostnqn"),
-		Transport: viper.GetString("connect-all.transport"),
+		Traddr:     viper.GetString("connect-all.traddr"),
+		Trsvcid:    viper.GetInt("connect-all.trsvcid"),
+		Kato:       kato,
+		Hostnqn:    viper.GetString("connect-all.hostnqn"),
+		Transport:  viper.GetString("connect-all.transport"),
+		HdrDigest:  fabricsOptions.HdrDigest,
+		DataDigest: fabricsOptions.DataDigest,
 	}
-	ctrlLossTMO := viper.GetInt("connect-all.ctrl-loss-tmo")
 	ctrls, err := nvmeclient.ConnectAll(entry,
 		viper.GetInt("connect-all.max-queues"),
 		viper.GetInt("connect-all.kato"),
-		&ctrlLossTMO)
+		&ctrlLossTMO, fabricsOptions)
 	if err != nil {
 		return err
 	}
@@ -64,6 +64,8 @@ specified by the --nqn option.`,
 
 	cmd.Flags().StringP("dhchap-ctrl-secret", "C", "", "user-defined dhchap controller key")
 	viper.BindPFlag("connect.dhchap-ctrl-secret", cmd.Flags().Lookup("dhchap-ctrl-secret"))
+
+	addFabricsOptionsFlags(cmd, "connect")
 	return cmd
 }
 
@@ -89,6 +91,10 @@ func connectCmdFunc(cmd *cobra.Command, args []string) error {
 		CtrlLossTMO:            viper.GetInt("connect.ctrl-loss-tmo"),
 		DhChapSecret:           viper.GetString("connect.dhchap-secret"),
 		DhChapControllerSecret: viper.GetString("connect.dhchap-ctrl-secret"),
+		FabricsOptions:         fabricsOptionsFromViper("connect"),
+	}
+	if err := request.FabricsOptions.Verify(); err != nil {
+		return err
 	}
 	ctrlID, err := nvmeclient.Connect(request)
 	if err != nil {
@@ -22,6 +22,7 @@ import (
 
 	"github.com/lightbitslabs/discovery-client/model"
 	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme"
 	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmehost"
 )
 
@@ -56,6 +57,27 @@ func newDiscoverCmd() *cobra.Command {
 	cmd.Flags().BoolP("persistant", "p", false, "persistant")
 	viper.BindPFlag("discover.persistant", cmd.Flags().Lookup("persistant"))
 
+	cmd.Flags().BoolP("hdr-digest", "g", false, "enable transport protocol header digest (TCP transport)")
+	viper.BindPFlag("discover.hdr-digest", cmd.Flags().Lookup("hdr-digest"))
+
+	cmd.Flags().BoolP("data-digest", "G", false, "enable transport protocol data digest (TCP transport)")
+	viper.BindPFlag("discover.data-digest", cmd.Flags().Lookup("data-digest"))
+
+	cmd.Flags().Bool("tls", false, "secure the connection with TLS 1.3, with the PSK of hostnqn and the discovery subsystem from the key file")
+	viper.BindPFlag("discover.tls", cmd.Flags().Lookup("tls"))
+
+	cmd.Flags().String("tls-key-file", model.DefaultTLSKeyFile, "file of the TLS PSKs, one '<hostnqn> <subnqn> <psk>' per line")
+	viper.BindPFlag("discover.tls-key-file", cmd.Flags().Lookup("tls-key-file"))
+
+	cmd.Flags().StringP("dhchap-secret", "S", "", "dhchap key the host authenticates with, if required by the discovery controller")
+	viper.BindPFlag("discover.dhchap-secret", cmd.Flags().Lookup("dhchap-secret"))
+
+	cmd.Flags().StringP("dhchap-ctrl-secret", "C", "", "dhchap controller key that authenticates the discovery controller")
+	viper.BindPFlag("discover.dhchap-ctrl-secret", cmd.Flags().Lookup("dhchap-ctrl-secret"))
+
+	cmd.Flags().Bool("identify", false, "print the Identify Controller data of the discovery controller along with the log page entries")
+	viper.BindPFlag("discover.identify", cmd.Flags().Lookup("identify"))
+
 	return cmd
 }
 
@@ -66,26 +88,45 @@ func discoverCmdFunc(cmd *cobra.Command, args []string) error {
 	if !viper.IsSet("discover.hostnqn") {
 		return fmt.Errorf("hostnqn(-q) must be set")
 	}
+	if viper.IsSet("discover.dhchap-ctrl-secret") && !viper.IsSet("discover.dhchap-secret") {
+		return fmt.Errorf("dhchap-secret must be specified when dhchap-ctrl-secret is set")
+	}
+
 	katoValue := kato
 	if !viper.GetBool("discover.persistent") {
 		katoValue = 0
 	}
 	entry := &hostapi.DiscoverRequest{
-		Traddr:    viper.GetString("discover.traddr"),
-		Trsvcid:   viper.GetInt("discover.trsvcid"),
-		Kato:      katoValue,
-		Hostnqn:   viper.GetString("discover.hostnqn"),
-		Hostid:    viper.GetString("discover.hostid"),
-		Transport: viper.GetString("discover.transport"),
+		Traddr:           viper.GetString("discover.traddr"),
+		Trsvcid:          viper.GetInt("discover.trsvcid"),
+		Kato:             katoValue,
+		Hostnqn:          viper.GetString("discover.hostnqn"),
+		Hostid:           viper.GetString("discover.hostid"),
+		Transport:        viper.GetString("discover.transport"),
+		HdrDigest:        viper.GetBool("discover.hdr-digest"),
+		DataDigest:       viper.GetBool("discover.data-digest"),
+		TLS:              viper.GetBool("discover.tls"),
+		DhChapSecret:     viper.GetString("discover.dhchap-secret"),
+		DhChapCtrlSecret: viper.GetString("discover.dhchap-ctrl-secret"),
+	}
+	if entry.TLS {
+		entry.TLSKeyFile = viper.GetString("discover.tls-key-file")
 	}
 
 	hostAPI := nvmehost.NewHostApi(true, model.DefaultHostIDPath)
-	logPageEntries, _, err := hostAPI.Discover(entry)
+	logPage, _, err := hostAPI.Discover(entry)
 	if err != nil {
 		return err
 	}
 
-	if err := print(logPageEntries, JSON); err != nil {
+	if viper.GetBool("discover.identify") {
+		output := struct {
+			Identify *nvme.IdentifyController     `json:"identify"`
+			Entries  []*hostapi.NvmeDiscPageEntry `json:"entries"`
+		}{Identify: logPage.Identify, Entries: logPage.Entries}
+		return print(output, JSON)
+	}
+	if err := print(logPage.Entries, JSON); err != nil {
 		return err
 	}
 
@@ -0,0 +1,83 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/lightbitslabs/discovery-client/model"
+)
+
+// addFabricsOptionsFlags adds the nvme-cli fabrics connect options to cmd, bound to
+// viper keys under prefix.
+func addFabricsOptionsFlags(cmd *cobra.Command, prefix string) {
+	cmd.Flags().IntP("nr-write-queues", "W", 0, "number of write queues to use")
+	viper.BindPFlag(prefix+".nr-write-queues", cmd.Flags().Lookup("nr-write-queues"))
+
+	cmd.Flags().IntP("nr-poll-queues", "P", 0, "number of poll queues to use")
+	viper.BindPFlag(prefix+".nr-poll-queues", cmd.Flags().Lookup("nr-poll-queues"))
+
+	cmd.Flags().IntP("queue-size", "Q", 0, "number of io queue elements to use, 0 for the driver default (128)")
+	viper.BindPFlag(prefix+".queue-size", cmd.Flags().Lookup("queue-size"))
+
+	cmd.Flags().IntP("reconnect-delay", "c", 0, "reconnect timeout period in seconds, 0 for the driver default (10)")
+	viper.BindPFlag(prefix+".reconnect-delay", cmd.Flags().Lookup("reconnect-delay"))
+
+	cmd.Flags().Int("fast_io_fail_tmo", -1, "fast I/O fail timeout in seconds, -1 disables it")
+	viper.BindPFlag(prefix+".fast_io_fail_tmo", cmd.Flags().Lookup("fast_io_fail_tmo"))
+
+	cmd.Flags().IntP("tos", "T", -1, "type of service, -1 for the driver default")
+	viper.BindPFlag(prefix+".tos", cmd.Flags().Lookup("tos"))
+
+	cmd.Flags().BoolP("hdr-digest", "g", false, "enable transport protocol header digest (TCP transport)")
+	viper.BindPFlag(prefix+".hdr-digest", cmd.Flags().Lookup("hdr-digest"))
+
+	cmd.Flags().BoolP("data-digest", "G", false, "enable transport protocol data digest (TCP transport)")
+	viper.BindPFlag(prefix+".data-digest", cmd.Flags().Lookup("data-digest"))
+
+	cmd.Flags().BoolP("duplicate-connect", "D", false, "allow duplicate connections between same transport host and subsystem port")
+	viper.BindPFlag(prefix+".duplicate-connect", cmd.Flags().Lookup("duplicate-connect"))
+
+	cmd.Flags().BoolP("disable-sqflow", "d", false, "disable controller sq flow control")
+	viper.BindPFlag(prefix+".disable-sqflow", cmd.Flags().Lookup("disable-sqflow"))
+
+	cmd.Flags().StringP("host-iface", "f", "", "host transport interface (e.g. IP eth1, enp2s0)")
+	viper.BindPFlag(prefix+".host-iface", cmd.Flags().Lookup("host-iface"))
+}
+
+// fabricsOptionsFromViper returns the fabrics connect options added by addFabricsOptionsFlags.
+func fabricsOptionsFromViper(prefix string) model.FabricsOptions {
+	opts := model.FabricsOptions{
+		NrWriteQueues:    viper.GetInt(prefix + ".nr-write-queues"),
+		NrPollQueues:     viper.GetInt(prefix + ".nr-poll-queues"),
+		QueueSize:        viper.GetInt(prefix + ".queue-size"),
+		ReconnectDelay:   viper.GetInt(prefix + ".reconnect-delay"),
+		HdrDigest:        viper.GetBool(prefix + ".hdr-digest"),
+		DataDigest:       viper.GetBool(prefix + ".data-digest"),
+		DuplicateConnect: viper.GetBool(prefix + ".duplicate-connect"),
+		DisableSqflow:    viper.GetBool(prefix + ".disable-sqflow"),
+		HostIface:        viper.GetString(prefix + ".host-iface"),
+	}
+	if viper.IsSet(prefix + ".fast_io_fail_tmo") {
+		fastIOFailTMO := viper.GetInt(prefix + ".fast_io_fail_tmo")
+		opts.FastIOFailTMO = &fastIOFailTMO
+	}
+	if viper.IsSet(prefix + ".tos") {
+		tos := viper.GetInt(prefix + ".tos")
+		opts.Tos = &tos
+	}
+	return opts
+}
@@ -37,7 +37,6 @@ func print(val interface{}, of outputFormat) error {
 	default:
 		return printJson(val)
 	}
-	return nil
 }
 
 func printJson(val interface{}) error {
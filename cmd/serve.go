@@ -75,15 +75,82 @@ func newServeCmd() *cobra.Command {
 	cmd.Flags().String("nvmeHostIDPath", model.DefaultHostIDPath, "file path containing nvme host id")
 	viper.BindPFlag("nvmeHostIDPath", cmd.Flags().Lookup("nvmeHostIDPath"))
 
+	cmd.Flags().String("tlsKeyFile", model.DefaultTLSKeyFile, "File of the PSKs of the discovery connections secured with TLS, one '<hostnqn> <subnqn> <psk>' per line")
+	viper.BindPFlag("tlsKeyFile", cmd.Flags().Lookup("tlsKeyFile"))
+
+	cmd.Flags().String("dhChapKeyDir", model.DefaultDhChapKeyDir, "Directory of the DH-CHAP key files of clusters and hosts, named after the cluster subsysnqn or the hostnqn, watched for secret rotations")
+	viper.BindPFlag("dhChapKeyDir", cmd.Flags().Lookup("dhChapKeyDir"))
+
 	cmd.Flags().Duration("pollingInterval", 5*time.Second, "Polling interval for querying the discovery service.")
 	viper.BindPFlag("pollingInterval", cmd.Flags().Lookup("pollingInterval"))
 
+	cmd.Flags().Duration("reconcileInterval", 30*time.Second, "Interval for verifying that the IO controllers of the last discovery log page are connected. A negative value disables it.")
+	viper.BindPFlag("reconcileInterval", cmd.Flags().Lookup("reconcileInterval"))
+
+	cmd.Flags().Duration("hostnameResolveInterval", model.DefaultHostnameResolveInterval, "Interval for resolving again the hostnames of the discovery endpoints. A negative value resolves them only once.")
+	viper.BindPFlag("hostnameResolveInterval", cmd.Flags().Lookup("hostnameResolveInterval"))
+	cmd.Flags().Int("maxReferralDepth", model.DefaultMaxReferralDepth, "Number of referrals to other discovery subsystems followed from the configured entries. A negative value doesn't follow them.")
+	viper.BindPFlag("maxReferralDepth", cmd.Flags().Lookup("maxReferralDepth"))
+
+	cmd.Flags().Duration("reconnectBackoff.initialDelay", 0, "Delay before the first retry to connect to a cluster. Defaults to reconnectInterval.")
+	viper.BindPFlag("reconnectBackoff.initialDelay", cmd.Flags().Lookup("reconnectBackoff.initialDelay"))
+
+	cmd.Flags().Float64("reconnectBackoff.multiplier", 2, "Factor by which the delay between retries to connect to a cluster grows.")
+	viper.BindPFlag("reconnectBackoff.multiplier", cmd.Flags().Lookup("reconnectBackoff.multiplier"))
+
+	cmd.Flags().Duration("reconnectBackoff.maxDelay", 5*time.Minute, "Maximum delay between retries to connect to a cluster.")
+	viper.BindPFlag("reconnectBackoff.maxDelay", cmd.Flags().Lookup("reconnectBackoff.maxDelay"))
+
+	cmd.Flags().Bool("reconnectBackoff.jitter", true, "Pick the delay between retries to connect to a cluster uniformly between half the initial delay and the backoff delay.")
+	viper.BindPFlag("reconnectBackoff.jitter", cmd.Flags().Lookup("reconnectBackoff.jitter"))
+
+	cmd.Flags().Int("reconnectBackoff.maxAttempts", 0, "Consecutive failed connects after which a cluster is put in alert state and no longer retried. Zero means no limit.")
+	viper.BindPFlag("reconnectBackoff.maxAttempts", cmd.Flags().Lookup("reconnectBackoff.maxAttempts"))
+
+	cmd.Flags().Int("discoveryConnections", 1, "Number of persistent discovery connections kept to each cluster, to different discovery servers.")
+	viper.BindPFlag("discoveryConnections", cmd.Flags().Lookup("discoveryConnections"))
+
+	cmd.Flags().Int("connectConcurrency.perCluster", model.DefaultConnectsPerCluster, "Number of IO controllers of a cluster connected in parallel.")
+	viper.BindPFlag("connectConcurrency.perCluster", cmd.Flags().Lookup("connectConcurrency.perCluster"))
+
+	cmd.Flags().Int("connectConcurrency.global", model.DefaultConnectsGlobal, "Number of IO controllers connected in parallel by all clusters.")
+	viper.BindPFlag("connectConcurrency.global", cmd.Flags().Lookup("connectConcurrency.global"))
+
+	cmd.Flags().String("endpointSelection.policy", string(model.EndpointSelectionRandom),
+		"Order in which the discovery endpoints of a cluster are tried. one of: random, sticky, latency")
+	viper.BindPFlag("endpointSelection.policy", cmd.Flags().Lookup("endpointSelection.policy"))
+
+	cmd.Flags().String("endpointSelection.locality", "", "Locality label of the host. Discovery endpoints with the same locality are tried first.")
+	viper.BindPFlag("endpointSelection.locality", cmd.Flags().Lookup("endpointSelection.locality"))
+
+	cmd.Flags().Duration("endpointSelection.probeInterval", 30*time.Second, "Interval between latency probes of the discovery endpoints, used by the latency policy.")
+	viper.BindPFlag("endpointSelection.probeInterval", cmd.Flags().Lookup("endpointSelection.probeInterval"))
+
 	cmd.Flags().Int("maxIOQueues", 0, "Overrides the default number of I/O queues create by the driver. Zero value means no override (default driver value is number of cores).")
 	viper.BindPFlag("maxIOQueues", cmd.Flags().Lookup("maxIOQueues"))
 
 	cmd.Flags().Int("kato", 10, "Host keep alive time out")
 	viper.BindPFlag("kato", cmd.Flags().Lookup("kato"))
 
+	cmd.Flags().String("ioControllersOnRemoval", string(model.IOControllersKeep),
+		"What to do with IO controllers of a cluster whose configuration file was removed. one of: keep, disconnect")
+	viper.BindPFlag("ioControllersOnRemoval", cmd.Flags().Lookup("ioControllersOnRemoval"))
+
+	cmd.Flags().StringSlice("ioControllersFilter.allowNqn", nil, "Connect only IO controllers whose subsystem nqn matches one of these patterns (glob, or regular expression prefixed by 're:').")
+	viper.BindPFlag("ioControllersFilter.allowNqn", cmd.Flags().Lookup("ioControllersFilter.allowNqn"))
+
+	cmd.Flags().StringSlice("ioControllersFilter.denyNqn", nil, "Don't connect IO controllers whose subsystem nqn matches one of these patterns.")
+	viper.BindPFlag("ioControllersFilter.denyNqn", cmd.Flags().Lookup("ioControllersFilter.denyNqn"))
+
+	cmd.Flags().StringSlice("ioControllersFilter.allowTraddr", nil, "Connect only IO controllers whose address matches one of these patterns.")
+	viper.BindPFlag("ioControllersFilter.allowTraddr", cmd.Flags().Lookup("ioControllersFilter.allowTraddr"))
+
+	cmd.Flags().StringSlice("ioControllersFilter.denyTraddr", nil, "Don't connect IO controllers whose address matches one of these patterns.")
+	viper.BindPFlag("ioControllersFilter.denyTraddr", cmd.Flags().Lookup("ioControllersFilter.denyTraddr"))
+
+	cmd.Flags().Bool("dry-run", false, "Run discovery without connecting or disconnecting IO controllers. The connects and disconnects are logged instead.")
+	viper.BindPFlag("dryRun", cmd.Flags().Lookup("dry-run"))
+
 	// auto detect configuration
 	cmd.Flags().BoolP("autoDetectEntries.enabled", "e", true, "should we detect")
 	viper.BindPFlag("autoDetectEntries.enabled", cmd.Flags().Lookup("autoDetectEntries.enabled"))
@@ -28,6 +28,32 @@ type DiscoveryClientMetrics struct {
 	FileEntries *prometheus.GaugeVec
 	// DiscoveryLogPageCount - count how much log pages we got for each hostnqn
 	DiscoveryLogPageCount *prometheus.GaugeVec
+	// IOControllersMissing - IO controllers in the last log page of a cluster that were not connected on the last reconciliation
+	IOControllersMissing *prometheus.GaugeVec
+	// IOControllersReconnects - IO controllers reconnected by the reconciliation, by result
+	IOControllersReconnects *prometheus.CounterVec
+	// ClusterState - the state of the connection to each cluster, 1 for the current state
+	ClusterState *prometheus.GaugeVec
+	// ClusterConnectFailures - consecutive failed attempts to connect to each cluster
+	ClusterConnectFailures *prometheus.GaugeVec
+	// ClusterBackoffSeconds - delay before the next attempt to connect to each cluster
+	ClusterBackoffSeconds *prometheus.GaugeVec
+	// ClusterDiscoveryConnections - persistent discovery connections to each cluster
+	ClusterDiscoveryConnections *prometheus.GaugeVec
+	// AENDuplicates - AENs whose log page generation was already processed
+	AENDuplicates *prometheus.CounterVec
+	// StaleLogPages - log pages older than the log page of another discovery server of the cluster
+	StaleLogPages *prometheus.CounterVec
+	// IOControllersFiltered - IO controllers in the last log page of a cluster that are filtered out
+	IOControllersFiltered *prometheus.GaugeVec
+	// SubsystemPaths - IO controllers connected on the host to a subsystem of the last log page of a cluster
+	SubsystemPaths *prometheus.GaugeVec
+	// SubsystemExpectedPaths - IO controllers of a subsystem of the last log page of a cluster times the host paths
+	SubsystemExpectedPaths *prometheus.GaugeVec
+	// DryRunActions - IO controllers connects and disconnects skipped by the dry-run mode
+	DryRunActions *prometheus.CounterVec
+	// DhChapRotations - IO controllers whose DH-CHAP secrets were replaced after their key file changed, by result
+	DhChapRotations *prometheus.CounterVec
 }
 
 var Metrics DiscoveryClientMetrics
@@ -61,10 +87,114 @@ func init() {
 		},
 		[]string{},
 	)
+	Metrics.IOControllersMissing = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_io_controllers_missing",
+			Help: "Number of IO controllers in the last discovery log page that were not connected on the last reconciliation",
+		},
+		[]string{"nqn", "hostnqn"},
+	)
+	Metrics.IOControllersReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_io_controllers_reconnects_total",
+			Help: "Number of IO controllers reconnected by the reconciliation",
+		},
+		[]string{"nqn", "hostnqn", "result"},
+	)
+	Metrics.ClusterState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_cluster_state",
+			Help: "State of the connection to the cluster (idle, connecting, connected, backing-off, alert). 1 for the current state",
+		},
+		[]string{"nqn", "hostnqn", "state"},
+	)
+	Metrics.ClusterConnectFailures = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_cluster_connect_failures",
+			Help: "Number of consecutive failed attempts to connect to the cluster",
+		},
+		[]string{"nqn", "hostnqn"},
+	)
+	Metrics.ClusterBackoffSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_cluster_backoff_seconds",
+			Help: "Delay before the next attempt to connect to the cluster, 0 if no attempt is scheduled",
+		},
+		[]string{"nqn", "hostnqn"},
+	)
+	Metrics.ClusterDiscoveryConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_cluster_discovery_connections",
+			Help: "Number of persistent discovery connections to the cluster",
+		},
+		[]string{"nqn", "hostnqn"},
+	)
+	Metrics.AENDuplicates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_aen_duplicates_total",
+			Help: "Number of AENs whose log page generation was already processed",
+		},
+		[]string{"nqn", "hostnqn"},
+	)
+	Metrics.StaleLogPages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_stale_log_pages_total",
+			Help: "Number of log pages older than the log page of another discovery server of the cluster",
+		},
+		[]string{"nqn", "hostnqn", "traddr"},
+	)
+	Metrics.DryRunActions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_dry_run_actions_total",
+			Help: "Number of IO controllers connects and disconnects that were not done because of the dry-run mode",
+		},
+		[]string{"action"},
+	)
+	Metrics.DhChapRotations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_dhchap_rotations_total",
+			Help: "Number of IO controllers whose DH-CHAP secrets were replaced after their key file changed, by result (rotated, unchanged, not-authenticated, failed)",
+		},
+		[]string{"nqn", "hostnqn", "result"},
+	)
+	Metrics.IOControllersFiltered = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_io_controllers_filtered",
+			Help: "Number of IO controllers in the last discovery log page that are not connected because of the IO controllers filters",
+		},
+		[]string{"nqn", "hostnqn"},
+	)
+	Metrics.SubsystemPaths = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_subsystem_paths",
+			Help: "Number of IO controllers connected on the host to a subsystem in the last discovery log page",
+		},
+		[]string{"nqn", "hostnqn", "subsysnqn"},
+	)
+	Metrics.SubsystemExpectedPaths = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovery_subsystem_expected_paths",
+			Help: "Number of IO controllers of a subsystem in the last discovery log page, times the host paths they are connected through",
+		},
+		[]string{"nqn", "hostnqn", "subsysnqn"},
+	)
 
 	// Metrics have to be registered to be exposed:
 	prometheus.MustRegister(Metrics.Connections)
 	prometheus.MustRegister(Metrics.ConnectionState)
 	prometheus.MustRegister(Metrics.EntriesTotal)
 	prometheus.MustRegister(Metrics.DiscoveryLogPageCount)
+	prometheus.MustRegister(Metrics.IOControllersMissing)
+	prometheus.MustRegister(Metrics.IOControllersReconnects)
+	prometheus.MustRegister(Metrics.ClusterState)
+	prometheus.MustRegister(Metrics.ClusterConnectFailures)
+	prometheus.MustRegister(Metrics.ClusterBackoffSeconds)
+	prometheus.MustRegister(Metrics.ClusterDiscoveryConnections)
+	prometheus.MustRegister(Metrics.AENDuplicates)
+	prometheus.MustRegister(Metrics.StaleLogPages)
+	prometheus.MustRegister(Metrics.DryRunActions)
+	prometheus.MustRegister(Metrics.DhChapRotations)
+	prometheus.MustRegister(Metrics.IOControllersFiltered)
+	prometheus.MustRegister(Metrics.SubsystemPaths)
+	prometheus.MustRegister(Metrics.SubsystemExpectedPaths)
 }
@@ -17,16 +17,21 @@ package model
 import (
 	"fmt"
 	"os"
+	"reflect"
 	"time"
 
 	"github.com/spf13/viper"
 
+	"github.com/lightbitslabs/discovery-client/pkg/hostroute"
+	"github.com/lightbitslabs/discovery-client/pkg/iofilter"
 	"github.com/lightbitslabs/discovery-client/pkg/logging"
 )
 
 const (
 	DiscoveryClientReservedPrefix = "tmp.dc."
 	DefaultHostIDPath             = "/etc/nvme/hostid"
+	DefaultTLSKeyFile             = "/etc/discovery-client/tls-keys"
+	DefaultDhChapKeyDir           = "/etc/discovery-client/dhchap-keys"
 )
 
 type DebugInfo struct {
@@ -35,6 +40,106 @@ type DebugInfo struct {
 	Metrics     bool   `yaml:"metrics,omitempty"`
 }
 
+// IOControllersPolicy decides what happens to the IO controllers of a cluster
+// once it is removed from the discovery-client configuration.
+type IOControllersPolicy string
+
+const (
+	// IOControllersKeep leaves the IO controllers connected.
+	IOControllersKeep IOControllersPolicy = "keep"
+	// IOControllersDisconnect disconnects all IO controllers of the cluster.
+	IOControllersDisconnect IOControllersPolicy = "disconnect"
+)
+
+// BackoffConfig controls the delay between failed attempts to connect to a cluster.
+// the delay after n consecutive failures is InitialDelay * Multiplier^(n-1), capped by
+// MaxDelay. with Jitter the actual delay is picked uniformly between InitialDelay/2 and
+// that value, so hosts that lost the same cluster don't retry in lockstep.
+type BackoffConfig struct {
+	// InitialDelay before the first retry. defaults to ReconnectInterval.
+	InitialDelay time.Duration `yaml:"initialDelay,omitempty"`
+	Multiplier   float64       `yaml:"multiplier,omitempty"`
+	MaxDelay     time.Duration `yaml:"maxDelay,omitempty"`
+	Jitter       bool          `yaml:"jitter"`
+	// MaxAttempts of consecutive failed connects before the cluster is put in
+	// alert state and no longer retried automatically. zero means no limit.
+	MaxAttempts int `yaml:"maxAttempts,omitempty"`
+}
+
+// EndpointSelectionPolicy decides in which order the discovery endpoints of a
+// cluster are tried when connecting to it.
+type EndpointSelectionPolicy string
+
+const (
+	// EndpointSelectionRandom tries the endpoints in a random order, weighted by the entry weights.
+	EndpointSelectionRandom EndpointSelectionPolicy = "random"
+	// EndpointSelectionSticky tries the endpoint the cluster was last connected through first.
+	EndpointSelectionSticky EndpointSelectionPolicy = "sticky"
+	// EndpointSelectionLatency tries the endpoints by the latency measured by background probes.
+	EndpointSelectionLatency EndpointSelectionPolicy = "latency"
+)
+
+type EndpointSelection struct {
+	Policy EndpointSelectionPolicy `yaml:"policy,omitempty"`
+	// Locality label of the host. endpoints with the same locality label are tried first.
+	Locality string `yaml:"locality,omitempty"`
+	// ProbeInterval between latency probes of the endpoints, used by the latency policy.
+	ProbeInterval time.Duration `yaml:"probeInterval,omitempty"`
+}
+
+const (
+	DefaultConnectsPerCluster = 8
+	DefaultConnectsGlobal     = 32
+)
+
+// DefaultHostnameResolveInterval between resolutions of the hostnames of the entries.
+const DefaultHostnameResolveInterval = time.Minute
+
+// DefaultMaxReferralDepth of the referrals to other discovery subsystems followed.
+const DefaultMaxReferralDepth = 4
+
+// ConnectConcurrency limits the IO controllers connected in parallel.
+type ConnectConcurrency struct {
+	// PerCluster is the number of IO controllers of a single log page connected in parallel.
+	PerCluster int `yaml:"perCluster,omitempty"`
+	// Global is the number of IO controllers connected in parallel by all clusters.
+	Global int `yaml:"global,omitempty"`
+}
+
+// IOControllersFilter selects the IO controllers of the discovery log pages the host
+// connects to, by glob patterns or regular expressions (prefixed by "re:") on their
+// subsystem NQN and transport address. deny patterns take precedence over allow patterns.
+type IOControllersFilter struct {
+	AllowNQN    []string `yaml:"allowNqn,omitempty" json:",omitempty"`
+	DenyNQN     []string `yaml:"denyNqn,omitempty" json:",omitempty"`
+	AllowTraddr []string `yaml:"allowTraddr,omitempty" json:",omitempty"`
+	DenyTraddr  []string `yaml:"denyTraddr,omitempty" json:",omitempty"`
+}
+
+// Compile returns the filter of the patterns.
+func (f *IOControllersFilter) Compile() (*iofilter.Filter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	return iofilter.New(f.AllowNQN, f.DenyNQN, f.AllowTraddr, f.DenyTraddr)
+}
+
+// HostTraddrSelection picks the host source address (host_traddr) of the IO and discovery
+// connections from the routing table of the host, among the allowed interfaces.
+type HostTraddrSelection struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Interfaces the connections may go through, glob patterns of interface names.
+	Interfaces []string `yaml:"interfaces,omitempty"`
+}
+
+// Compile returns the selector of the allowed interfaces, nil if the selection is disabled.
+func (h *HostTraddrSelection) Compile() (*hostroute.Selector, error) {
+	if !h.Enabled {
+		return nil, nil
+	}
+	return hostroute.New(h.Interfaces)
+}
+
 type AutoDetectEntries struct {
 	Enabled              bool   `yaml:"enabled,omitempty"`
 	Filename             string `yaml:"filename,omitempty"`
@@ -58,6 +163,44 @@ type AppConfig struct {
 	DhChapSecret             string            `yaml:"dhChapSecret,omitempty"`
 	DhChapCtrlSecret         string            `yaml:"dhChapCtrlSecret,omitempty"`
 	CtrlLossTMO              int               `yaml:"ctrlLossTMO"`
+	// IOControllersOnRemoval policy applied to IO controllers of a cluster whose
+	// configuration file was removed from ClientConfigDir.
+	IOControllersOnRemoval IOControllersPolicy `yaml:"ioControllersOnRemoval,omitempty"`
+	// ReconcileInterval between checks that the IO controllers of the last log page
+	// of every cluster are connected. a negative value disables the reconciliation.
+	ReconcileInterval time.Duration `yaml:"reconcileInterval,omitempty"`
+	// HostnameResolveInterval between resolutions of the hostnames of the entries in
+	// ClientConfigDir. a negative value resolves them only once.
+	HostnameResolveInterval time.Duration `yaml:"hostnameResolveInterval,omitempty"`
+	// MaxReferralDepth is the number of referrals to other discovery subsystems followed
+	// from the entries in ClientConfigDir. a negative value doesn't follow them.
+	MaxReferralDepth int `yaml:"maxReferralDepth,omitempty"`
+	// ReconnectBackoff between failed attempts to connect to a cluster.
+	ReconnectBackoff BackoffConfig `yaml:"reconnectBackoff,omitempty"`
+	// EndpointSelection of the discovery endpoint to connect to in each cluster.
+	EndpointSelection EndpointSelection `yaml:"endpointSelection,omitempty"`
+	// DiscoveryConnections is the number of persistent discovery connections
+	// kept to each cluster, each to a different discovery server.
+	DiscoveryConnections int `yaml:"discoveryConnections,omitempty"`
+	// ConnectConcurrency limits the IO controllers connected in parallel.
+	ConnectConcurrency ConnectConcurrency `yaml:"connectConcurrency,omitempty"`
+	// DryRun runs the service without connecting or disconnecting IO controllers,
+	// logging what it would have done instead.
+	DryRun bool `yaml:"dryRun,omitempty"`
+	// IOControllersFilter applies to the log pages of all clusters, on top of the
+	// filters of the entries in ClientConfigDir.
+	IOControllersFilter IOControllersFilter `yaml:"ioControllersFilter,omitempty"`
+	// FabricsOptions of the IO controllers of all clusters. options set by an entry
+	// in ClientConfigDir take precedence.
+	FabricsOptions FabricsOptions `yaml:"fabricsOptions,omitempty"`
+	// HostTraddrSelection of the connections that have no host path.
+	HostTraddrSelection HostTraddrSelection `yaml:"hostTraddrSelection,omitempty"`
+	// TLSKeyFile holds the PSKs of the TLS discovery connections of the entries that don't set
+	// their own key file.
+	TLSKeyFile string `yaml:"tlsKeyFile,omitempty"`
+	// DhChapKeyDir holds the DH-CHAP secrets of clusters and hosts, one key file named after the
+	// subsysnqn of the cluster or the hostnqn. they take precedence over DhChapSecret.
+	DhChapKeyDir string `yaml:"dhChapKeyDir,omitempty"`
 }
 
 func (cfg *AppConfig) verifyConfigurationIsValid() error {
@@ -67,6 +210,21 @@ func (cfg *AppConfig) verifyConfigurationIsValid() error {
 	if cfg.ReconnectInterval == 0 {
 		cfg.ReconnectInterval = 5 * time.Second
 	}
+	if cfg.ReconcileInterval == 0 {
+		cfg.ReconcileInterval = 30 * time.Second
+	}
+	if cfg.HostnameResolveInterval == 0 {
+		cfg.HostnameResolveInterval = DefaultHostnameResolveInterval
+	}
+	if cfg.MaxReferralDepth == 0 {
+		cfg.MaxReferralDepth = DefaultMaxReferralDepth
+	}
+	if cfg.MaxReferralDepth < 0 {
+		cfg.MaxReferralDepth = 0
+	}
+	if err := cfg.ReconnectBackoff.setDefaults(cfg.ReconnectInterval); err != nil {
+		return err
+	}
 
 	if cfg.DhChapSecret == "" && cfg.DhChapCtrlSecret != "" {
 		return fmt.Errorf("dhchapsecret is mandatory when using dhchapctrlsecret")
@@ -75,9 +233,131 @@ func (cfg *AppConfig) verifyConfigurationIsValid() error {
 	if cfg.CtrlLossTMO == 0 || cfg.CtrlLossTMO < -1 {
 		cfg.CtrlLossTMO = 600
 	}
+
+	if cfg.DiscoveryConnections == 0 {
+		cfg.DiscoveryConnections = 1
+	}
+	if cfg.DiscoveryConnections < 0 {
+		return fmt.Errorf("discoveryConnections must be positive, provided: %d", cfg.DiscoveryConnections)
+	}
+
+	if cfg.ConnectConcurrency.PerCluster == 0 {
+		cfg.ConnectConcurrency.PerCluster = DefaultConnectsPerCluster
+	}
+	if cfg.ConnectConcurrency.Global == 0 {
+		cfg.ConnectConcurrency.Global = DefaultConnectsGlobal
+	}
+	if cfg.ConnectConcurrency.PerCluster < 0 || cfg.ConnectConcurrency.Global < 0 {
+		return fmt.Errorf("connectConcurrency limits must be positive, provided: perCluster: %d, global: %d",
+			cfg.ConnectConcurrency.PerCluster, cfg.ConnectConcurrency.Global)
+	}
+
+	if _, err := cfg.IOControllersFilter.Compile(); err != nil {
+		return fmt.Errorf("invalid ioControllersFilter: %w", err)
+	}
+	if err := cfg.FabricsOptions.Verify(); err != nil {
+		return fmt.Errorf("invalid fabricsOptions: %w", err)
+	}
+	if _, err := cfg.HostTraddrSelection.Compile(); err != nil {
+		return fmt.Errorf("invalid hostTraddrSelection: %w", err)
+	}
+
+	switch cfg.EndpointSelection.Policy {
+	case "":
+		cfg.EndpointSelection.Policy = EndpointSelectionRandom
+	case EndpointSelectionRandom, EndpointSelectionSticky, EndpointSelectionLatency:
+	default:
+		return fmt.Errorf("invalid endpointSelection.policy parameter provided. supported values: [%s %s %s], provided: %s",
+			EndpointSelectionRandom, EndpointSelectionSticky, EndpointSelectionLatency, cfg.EndpointSelection.Policy)
+	}
+	if cfg.EndpointSelection.ProbeInterval <= 0 {
+		cfg.EndpointSelection.ProbeInterval = 30 * time.Second
+	}
+
+	switch cfg.IOControllersOnRemoval {
+	case "":
+		cfg.IOControllersOnRemoval = IOControllersKeep
+	case IOControllersKeep, IOControllersDisconnect:
+	default:
+		return fmt.Errorf("invalid ioControllersOnRemoval parameter provided. supported values: [%s %s], provided: %s",
+			IOControllersKeep, IOControllersDisconnect, cfg.IOControllersOnRemoval)
+	}
 	return cfg.Logging.IsValid()
 }
 
+func (b *BackoffConfig) setDefaults(reconnectInterval time.Duration) error {
+	if b.InitialDelay == 0 {
+		b.InitialDelay = reconnectInterval
+	}
+	if b.Multiplier == 0 {
+		b.Multiplier = 2
+	}
+	if b.MaxDelay == 0 {
+		b.MaxDelay = 5 * time.Minute
+	}
+	if b.InitialDelay < 0 || b.MaxDelay < 0 {
+		return fmt.Errorf("reconnectBackoff delays must be positive, provided: initialDelay: %s, maxDelay: %s", b.InitialDelay, b.MaxDelay)
+	}
+	if b.Multiplier < 1 {
+		return fmt.Errorf("reconnectBackoff.multiplier must be at least 1, provided: %v", b.Multiplier)
+	}
+	if b.MaxDelay < b.InitialDelay {
+		b.MaxDelay = b.InitialDelay
+	}
+	if b.MaxAttempts < 0 {
+		return fmt.Errorf("reconnectBackoff.maxAttempts must not be negative, provided: %d", b.MaxAttempts)
+	}
+	return nil
+}
+
+// Reload merges newCfg, loaded while the service is running, into the current configuration.
+// settings that can be applied on a running service are taken from newCfg. the other
+// settings keep their current value and are returned in restartRequired if they changed.
+func (cfg *AppConfig) Reload(newCfg *AppConfig) (reloaded AppConfig, restartRequired []string) {
+	reloaded = *newCfg
+	if !reflect.DeepEqual(cfg.Cores, newCfg.Cores) {
+		restartRequired = append(restartRequired, "cores")
+		reloaded.Cores = cfg.Cores
+	}
+	if cfg.ClientConfigDir != newCfg.ClientConfigDir {
+		restartRequired = append(restartRequired, "clientConfigDir")
+		reloaded.ClientConfigDir = cfg.ClientConfigDir
+	}
+	if cfg.InternalDir != newCfg.InternalDir {
+		restartRequired = append(restartRequired, "internalDir")
+		reloaded.InternalDir = cfg.InternalDir
+	}
+	if cfg.LogPagePaginationEnabled != newCfg.LogPagePaginationEnabled {
+		restartRequired = append(restartRequired, "logPagePaginationEnabled")
+		reloaded.LogPagePaginationEnabled = cfg.LogPagePaginationEnabled
+	}
+	if cfg.AutoDetectEntries != newCfg.AutoDetectEntries {
+		restartRequired = append(restartRequired, "autoDetectEntries")
+		reloaded.AutoDetectEntries = cfg.AutoDetectEntries
+	}
+	if cfg.NvmeHostIDPath != newCfg.NvmeHostIDPath {
+		restartRequired = append(restartRequired, "nvmeHostIDPath")
+		reloaded.NvmeHostIDPath = cfg.NvmeHostIDPath
+	}
+	if cfg.DryRun != newCfg.DryRun {
+		restartRequired = append(restartRequired, "dryRun")
+		reloaded.DryRun = cfg.DryRun
+	}
+	if cfg.AuxSuffix != newCfg.AuxSuffix {
+		restartRequired = append(restartRequired, "auxSuffix")
+		reloaded.AuxSuffix = cfg.AuxSuffix
+	}
+	if cfg.TLSKeyFile != newCfg.TLSKeyFile {
+		restartRequired = append(restartRequired, "tlsKeyFile")
+		reloaded.TLSKeyFile = cfg.TLSKeyFile
+	}
+	if cfg.DhChapKeyDir != newCfg.DhChapKeyDir {
+		restartRequired = append(restartRequired, "dhChapKeyDir")
+		reloaded.DhChapKeyDir = cfg.DhChapKeyDir
+	}
+	return reloaded, restartRequired
+}
+
 // LoadFromViper use viper package to load configuration from file cmd line and env.
 func LoadFromViper() (*AppConfig, error) {
 	appConfig := &AppConfig{}
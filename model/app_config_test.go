@@ -17,6 +17,7 @@ package model
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/lightbitslabs/discovery-client/pkg/logging"
 	"github.com/stretchr/testify/require"
@@ -64,6 +65,97 @@ func TestAppConfig(t *testing.T) {
 			},
 			err: fmt.Errorf("invalid logging.level parameter provided. supported levels: [debug info warn warning error fatal], provided: wrong_level"),
 		},
+		{
+			name: "illegal io controllers removal policy",
+			appConfig: &AppConfig{
+				Cores: []int{0},
+				Logging: logging.Config{
+					Level: "debug",
+				},
+				ClientConfigDir:        `/etc/discovery-client/discovery.d/`,
+				InternalDir:            `/etc/discovery-client/internal/`,
+				IOControllersOnRemoval: "delete",
+			},
+			err: fmt.Errorf("invalid ioControllersOnRemoval parameter provided. supported values: [keep disconnect], provided: delete"),
+		},
+		{
+			name: "illegal reconnect backoff multiplier",
+			appConfig: &AppConfig{
+				Cores: []int{0},
+				Logging: logging.Config{
+					Level: "debug",
+				},
+				ClientConfigDir:  `/etc/discovery-client/discovery.d/`,
+				InternalDir:      `/etc/discovery-client/internal/`,
+				ReconnectBackoff: BackoffConfig{Multiplier: 0.5},
+			},
+			err: fmt.Errorf("reconnectBackoff.multiplier must be at least 1, provided: 0.5"),
+		},
+		{
+			name: "illegal endpoint selection policy",
+			appConfig: &AppConfig{
+				Cores: []int{0},
+				Logging: logging.Config{
+					Level: "debug",
+				},
+				ClientConfigDir:   `/etc/discovery-client/discovery.d/`,
+				InternalDir:       `/etc/discovery-client/internal/`,
+				EndpointSelection: EndpointSelection{Policy: "fastest"},
+			},
+			err: fmt.Errorf("invalid endpointSelection.policy parameter provided. supported values: [random sticky latency], provided: fastest"),
+		},
+		{
+			name: "illegal discovery connections",
+			appConfig: &AppConfig{
+				Cores: []int{0},
+				Logging: logging.Config{
+					Level: "debug",
+				},
+				ClientConfigDir:      `/etc/discovery-client/discovery.d/`,
+				InternalDir:          `/etc/discovery-client/internal/`,
+				DiscoveryConnections: -1,
+			},
+			err: fmt.Errorf("discoveryConnections must be positive, provided: -1"),
+		},
+		{
+			name: "illegal connect concurrency",
+			appConfig: &AppConfig{
+				Cores: []int{0},
+				Logging: logging.Config{
+					Level: "debug",
+				},
+				ClientConfigDir:    `/etc/discovery-client/discovery.d/`,
+				InternalDir:        `/etc/discovery-client/internal/`,
+				ConnectConcurrency: ConnectConcurrency{PerCluster: -1},
+			},
+			err: fmt.Errorf("connectConcurrency limits must be positive, provided: perCluster: -1, global: 32"),
+		},
+		{
+			name: "illegal io controllers filter",
+			appConfig: &AppConfig{
+				Cores: []int{0},
+				Logging: logging.Config{
+					Level: "debug",
+				},
+				ClientConfigDir:     `/etc/discovery-client/discovery.d/`,
+				InternalDir:         `/etc/discovery-client/internal/`,
+				IOControllersFilter: IOControllersFilter{DenyNQN: []string{"re:tenant-("}},
+			},
+			err: fmt.Errorf("invalid ioControllersFilter: invalid regular expression \"re:tenant-(\": error parsing regexp: missing closing ): `^(?:tenant-()$`"),
+		},
+		{
+			name: "host traddr selection without interfaces",
+			appConfig: &AppConfig{
+				Cores: []int{0},
+				Logging: logging.Config{
+					Level: "debug",
+				},
+				ClientConfigDir:     `/etc/discovery-client/discovery.d/`,
+				InternalDir:         `/etc/discovery-client/internal/`,
+				HostTraddrSelection: HostTraddrSelection{Enabled: true},
+			},
+			err: fmt.Errorf("invalid hostTraddrSelection: no allowed interfaces"),
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -76,3 +168,59 @@ func TestAppConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestBackoffConfigDefaults(t *testing.T) {
+	cfg := &AppConfig{
+		Logging:           logging.Config{Level: "info"},
+		ClientConfigDir:   `/etc/discovery-client/discovery.d/`,
+		InternalDir:       `/etc/discovery-client/internal/`,
+		ReconnectInterval: 3 * time.Second,
+	}
+	require.NoError(t, cfg.verifyConfigurationIsValid())
+	require.Equal(t, BackoffConfig{
+		InitialDelay: 3 * time.Second,
+		Multiplier:   2,
+		MaxDelay:     5 * time.Minute,
+	}, cfg.ReconnectBackoff)
+
+	cfg.ReconnectBackoff = BackoffConfig{InitialDelay: time.Minute, MaxDelay: time.Second}
+	require.NoError(t, cfg.verifyConfigurationIsValid())
+	require.Equal(t, time.Minute, cfg.ReconnectBackoff.MaxDelay)
+}
+
+func TestAppConfigReload(t *testing.T) {
+	current := &AppConfig{
+		Cores:             []int{0},
+		Logging:           logging.Config{Level: "info"},
+		ClientConfigDir:   `/etc/discovery-client/discovery.d/`,
+		InternalDir:       `/etc/discovery-client/internal/`,
+		ReconnectInterval: 5 * time.Second,
+		Kato:              10,
+		CtrlLossTMO:       600,
+	}
+	newCfg := *current
+	newCfg.Cores = []int{1}
+	newCfg.InternalDir = `/var/lib/discovery-client/`
+	newCfg.Logging.Level = "debug"
+	newCfg.ReconnectInterval = time.Second
+	newCfg.Kato = 30
+	newCfg.CtrlLossTMO = -1
+	newCfg.DhChapSecret = "DHHC-1:00:secret:"
+	newCfg.TLSKeyFile = "/etc/discovery-client/other-tls-keys"
+	newCfg.DhChapKeyDir = "/etc/discovery-client/other-dhchap-keys"
+
+	reloaded, restartRequired := current.Reload(&newCfg)
+	require.Equal(t, []string{"cores", "internalDir", "tlsKeyFile", "dhChapKeyDir"}, restartRequired)
+	require.Equal(t, current.Cores, reloaded.Cores)
+	require.Equal(t, current.InternalDir, reloaded.InternalDir)
+	require.Equal(t, current.TLSKeyFile, reloaded.TLSKeyFile)
+	require.Equal(t, current.DhChapKeyDir, reloaded.DhChapKeyDir)
+	require.Equal(t, "debug", reloaded.Logging.Level)
+	require.Equal(t, time.Second, reloaded.ReconnectInterval)
+	require.Equal(t, 30, reloaded.Kato)
+	require.Equal(t, -1, reloaded.CtrlLossTMO)
+	require.Equal(t, "DHHC-1:00:secret:", reloaded.DhChapSecret)
+
+	_, restartRequired = current.Reload(current)
+	require.Empty(t, restartRequired)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FabricsOptions are the NVMe over Fabrics connect options of the IO controllers that
+// have no dedicated setting. unset options are left out of the connect request so the
+// kernel defaults apply.
+type FabricsOptions struct {
+	NrWriteQueues int `yaml:"nrWriteQueues,omitempty" json:",omitempty"`
+	NrPollQueues  int `yaml:"nrPollQueues,omitempty" json:",omitempty"`
+	QueueSize     int `yaml:"queueSize,omitempty" json:",omitempty"`
+	// ReconnectDelay in seconds between reconnect attempts of a lost controller.
+	ReconnectDelay int `yaml:"reconnectDelay,omitempty" json:",omitempty"`
+	// FastIOFailTMO in seconds after which IO fails while reconnecting, -1 to disable.
+	FastIOFailTMO *int `yaml:"fastIOFailTMO,omitempty" json:",omitempty"`
+	// Tos is the IP type of service of the connections, -1 for the kernel default.
+	Tos              *int   `yaml:"tos,omitempty" json:",omitempty"`
+	HdrDigest        bool   `yaml:"hdrDigest,omitempty" json:",omitempty"`
+	DataDigest       bool   `yaml:"dataDigest,omitempty" json:",omitempty"`
+	DuplicateConnect bool   `yaml:"duplicateConnect,omitempty" json:",omitempty"`
+	DisableSqflow    bool   `yaml:"disableSqflow,omitempty" json:",omitempty"`
+	HostIface        string `yaml:"hostIface,omitempty" json:",omitempty"`
+}
+
+// Verify returns an error if an option is out of the range the kernel accepts.
+func (o *FabricsOptions) Verify() error {
+	if o.NrWriteQueues < 0 || o.NrPollQueues < 0 {
+		return fmt.Errorf("nr-write-queues and nr-poll-queues must not be negative, provided: %d, %d",
+			o.NrWriteQueues, o.NrPollQueues)
+	}
+	if o.QueueSize != 0 && (o.QueueSize < 16 || o.QueueSize > 1024) {
+		return fmt.Errorf("queue-size must be between 16 and 1024, provided: %d", o.QueueSize)
+	}
+	if o.ReconnectDelay < 0 {
+		return fmt.Errorf("reconnect-delay must not be negative, provided: %d", o.ReconnectDelay)
+	}
+	if o.FastIOFailTMO != nil && *o.FastIOFailTMO < -1 {
+		return fmt.Errorf("fast_io_fail_tmo must be -1 or above, provided: %d", *o.FastIOFailTMO)
+	}
+	if o.Tos != nil && (*o.Tos < -1 || *o.Tos > 255) {
+		return fmt.Errorf("tos must be between -1 and 255, provided: %d", *o.Tos)
+	}
+	return nil
+}
+
+// Override returns the options with the options set in override replacing them.
+// a flag option set in either one is set.
+func (o FabricsOptions) Override(override FabricsOptions) FabricsOptions {
+	res := o
+	if override.NrWriteQueues > 0 {
+		res.NrWriteQueues = override.NrWriteQueues
+	}
+	if override.NrPollQueues > 0 {
+		res.NrPollQueues = override.NrPollQueues
+	}
+	if override.QueueSize > 0 {
+		res.QueueSize = override.QueueSize
+	}
+	if override.ReconnectDelay > 0 {
+		res.ReconnectDelay = override.ReconnectDelay
+	}
+	if override.FastIOFailTMO != nil {
+		res.FastIOFailTMO = override.FastIOFailTMO
+	}
+	if override.Tos != nil {
+		res.Tos = override.Tos
+	}
+	if override.HostIface != "" {
+		res.HostIface = override.HostIface
+	}
+	res.HdrDigest = o.HdrDigest || override.HdrDigest
+	res.DataDigest = o.DataDigest || override.DataDigest
+	res.DuplicateConnect = o.DuplicateConnect || override.DuplicateConnect
+	res.DisableSqflow = o.DisableSqflow || override.DisableSqflow
+	return res
+}
+
+// Options returns the set options as the comma prefixed key=value pairs of the kernel
+// fabrics connect string, e.g. ",nr_write_queues=4,hdr_digest".
+func (o *FabricsOptions) Options() string {
+	var sb strings.Builder
+	if o.NrWriteQueues > 0 {
+		sb.WriteString(fmt.Sprintf(",nr_write_queues=%d", o.NrWriteQueues))
+	}
+	if o.NrPollQueues > 0 {
+		sb.WriteString(fmt.Sprintf(",nr_poll_queues=%d", o.NrPollQueues))
+	}
+	if o.QueueSize > 0 {
+		sb.WriteString(fmt.Sprintf(",queue_size=%d", o.QueueSize))
+	}
+	if o.ReconnectDelay > 0 {
+		sb.WriteString(fmt.Sprintf(",reconnect_delay=%d", o.ReconnectDelay))
+	}
+	if o.FastIOFailTMO != nil && *o.FastIOFailTMO >= 0 {
+		sb.WriteString(fmt.Sprintf(",fast_io_fail_tmo=%d", *o.FastIOFailTMO))
+	}
+	if o.Tos != nil && *o.Tos >= 0 {
+		sb.WriteString(fmt.Sprintf(",tos=%d", *o.Tos))
+	}
+	if o.HostIface != "" {
+		sb.WriteString(fmt.Sprintf(",host_iface=%s", o.HostIface))
+	}
+	if o.HdrDigest {
+		sb.WriteString(",hdr_digest")
+	}
+	if o.DataDigest {
+		sb.WriteString(",data_digest")
+	}
+	if o.DuplicateConnect {
+		sb.WriteString(",duplicate_connect")
+	}
+	if o.DisableSqflow {
+		sb.WriteString(",disable_sqflow")
+	}
+	return sb.String()
+}
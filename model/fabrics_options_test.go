@@ -0,0 +1,82 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFabricsOptions(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	testCases := []struct {
+		name    string
+		opts    FabricsOptions
+		options string
+		err     bool
+	}{
+		{name: "empty", opts: FabricsOptions{}, options: ""},
+		{name: "kernel defaults", opts: FabricsOptions{FastIOFailTMO: intPtr(-1), Tos: intPtr(-1)}, options: ""},
+		{
+			name: "all options",
+			opts: FabricsOptions{
+				NrWriteQueues:    4,
+				NrPollQueues:     2,
+				QueueSize:        256,
+				ReconnectDelay:   3,
+				FastIOFailTMO:    intPtr(0),
+				Tos:              intPtr(8),
+				HdrDigest:        true,
+				DataDigest:       true,
+				DuplicateConnect: true,
+				DisableSqflow:    true,
+				HostIface:        "eth1",
+			},
+			options: ",nr_write_queues=4,nr_poll_queues=2,queue_size=256,reconnect_delay=3,fast_io_fail_tmo=0,tos=8," +
+				"host_iface=eth1,hdr_digest,data_digest,duplicate_connect,disable_sqflow",
+		},
+		{name: "queue size too small", opts: FabricsOptions{QueueSize: 8}, err: true},
+		{name: "tos out of range", opts: FabricsOptions{Tos: intPtr(256)}, err: true},
+		{name: "negative poll queues", opts: FabricsOptions{NrPollQueues: -1}, err: true},
+		{name: "invalid fast_io_fail_tmo", opts: FabricsOptions{FastIOFailTMO: intPtr(-2)}, err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opts.Verify()
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.options, tc.opts.Options())
+		})
+	}
+}
+
+func TestFabricsOptionsOverride(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	global := FabricsOptions{NrWriteQueues: 4, QueueSize: 128, Tos: intPtr(8), HdrDigest: true, HostIface: "eth0"}
+	entry := FabricsOptions{QueueSize: 256, Tos: intPtr(-1), DataDigest: true}
+	require.Equal(t, FabricsOptions{
+		NrWriteQueues: 4,
+		QueueSize:     256,
+		Tos:           intPtr(-1),
+		HdrDigest:     true,
+		DataDigest:    true,
+		HostIface:     "eth0",
+	}, global.Override(entry))
+	require.Equal(t, global, global.Override(FabricsOptions{}))
+}
@@ -0,0 +1,57 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+)
+
+// HostPath is a host network interface or a host source address an IO controller
+// connects through. connecting a subsystem through several paths gives native NVMe
+// multipath independent paths.
+type HostPath struct {
+	// Iface is the name of the host network interface (host_iface).
+	Iface string `json:",omitempty"`
+	// Traddr is the host source address (host_traddr).
+	Traddr string `json:",omitempty"`
+}
+
+// ParseHostPath returns the path of value, an IP address, possibly zone scoped, or an
+// interface name.
+func ParseHostPath(value string) (HostPath, error) {
+	if addr, _ := nvme.SplitZone(value); net.ParseIP(addr) != nil {
+		return HostPath{Traddr: value}, nil
+	}
+	// same rules as the kernel dev_valid_name.
+	if value == "" || len(value) > 15 || value == "." || value == ".." ||
+		strings.ContainsAny(value, "/: \t\n") {
+		return HostPath{}, fmt.Errorf("%q is not an IP address or a network interface name", value)
+	}
+	return HostPath{Iface: value}, nil
+}
+
+func (p HostPath) String() string {
+	if p.Iface != "" {
+		return p.Iface
+	}
+	return p.Traddr
+}
+
+// HostPaths of the IO controllers of a cluster.
+type HostPaths []HostPath
@@ -18,13 +18,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -35,10 +37,11 @@ import (
 )
 
 type ReferralKey struct {
-	Ip       string
-	Port     uint16
-	DPSubNqn string // Datapath subsystem nqn. The referral log page entry does not contain it but we need it to create a new connection based on the referral
-	Hostnqn  string // The referral log page entry does not contain it but we need it to create a new connection based on the referral
+	Transport string
+	Ip        string
+	Port      uint16
+	DPSubNqn  string // Datapath subsystem nqn of the connection group of the referral, the group of the reporting connection unless the referral points to another discovery subsystem
+	Hostnqn   string // The referral log page entry does not contain it but we need it to create a new connection based on the referral
 }
 
 type ReferralMap map[ReferralKey]*hostapi.NvmeDiscPageEntry
@@ -52,57 +55,216 @@ type TKey struct {
 	hostnqn string
 }
 
+// Port of the endpoint.
+func (k TKey) Port() int {
+	return k.port
+}
+
+// Connection is shared between the cache and the service workers.
+// the fields that may change after creation are guarded by mu and are
+// accessed through the getters and setters below.
 type Connection struct {
-	Hostnqn      string
-	Hostid       string
-	Key          TKey
-	Ctx          context.Context
-	cancel       context.CancelFunc
-	log          *logrus.Entry
-	AENChan      chan hostapi.AENStruct
-	ConnectionID hostapi.ConnectionID
-	State        bool
-	CtrlLossTMO  *int // seconds
-}
-
-func newConnection(ctx context.Context, key TKey, ctrlLossTMO *int) *Connection {
+	Hostnqn string
+	Key     TKey
+	Ctx     context.Context
+	cancel  context.CancelFunc
+	log     *logrus.Entry
+	AENChan chan hostapi.AENStruct
+	// Hostname the address of Key was resolved from, empty if the entry has an address.
+	Hostname string
+
+	mu           sync.Mutex
+	hostid       string
+	connectionID hostapi.ConnectionID
+	state        bool
+	ctrlLossTMO  *int // seconds
+	weight       int
+	locality     string
+	ioFilter     *model.IOControllersFilter
+	// connect parameters of the IO controllers, nil or empty if not set.
+	maxIOQueues      *int
+	kato             *int
+	dhChapSecret     Secret
+	dhChapCtrlSecret Secret
+	fabricsOptions   *model.FabricsOptions
+	hostPaths        *model.HostPaths
+	// TLS of the discovery connection, with the PSK in tlsKeyFile.
+	tls        bool
+	tlsKeyFile string
+}
+
+// IOConnectParams are the connect parameters of the IO controllers discovered through a
+// connection that override the service configuration. nil or empty values are not set.
+type IOConnectParams struct {
+	CtrlLossTMO      *int
+	MaxIOQueues      *int
+	Kato             *int
+	DhChapSecret     string
+	DhChapCtrlSecret string
+	FabricsOptions   *model.FabricsOptions
+	HostPaths        model.HostPaths
+}
+
+func newConnection(ctx context.Context, key TKey, entry *Entry) *Connection {
 	c := &Connection{
-		Key:         key,
-		log:         logrus.WithFields(logrus.Fields{"traddr": key.Ip, "trsvcid": key.port, "nqn": key.Nqn}),
-		AENChan:     make(chan hostapi.AENStruct),
-		CtrlLossTMO: ctrlLossTMO,
+		Key:     key,
+		Hostnqn: entry.Hostnqn,
+		AENChan: make(chan hostapi.AENStruct),
 	}
+	fields := logrus.Fields{"traddr": key.Ip, "trsvcid": key.port, "nqn": key.Nqn}
+	if entry.Traddr != key.Ip {
+		c.Hostname = entry.Traddr
+		fields["hostname"] = c.Hostname
+	}
+	c.log = logrus.WithFields(fields)
+	c.setConnectParams(entry)
 	c.Ctx, c.cancel = context.WithCancel(ctx)
 	c.SetState(false)
 	return c
 }
 
+func (c *Connection) GetHostid() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hostid
+}
+
+func (c *Connection) GetCtrlLossTMO() *int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ctrlLossTMO
+}
+
+// GetWeight returns the weight of the endpoint when picking the endpoint of the cluster to connect to.
+func (c *Connection) GetWeight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.weight <= 0 {
+		return 1
+	}
+	return c.weight
+}
+
+// GetLocality returns the locality label of the endpoint, empty if not set.
+func (c *Connection) GetLocality() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.locality
+}
+
+// GetIOFilter returns the filter of the IO controllers discovered through this connection, nil if not set.
+func (c *Connection) GetIOFilter() *model.IOControllersFilter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ioFilter
+}
+
+// GetIOConnectParams returns the connect parameters of the IO controllers discovered through this connection.
+func (c *Connection) GetIOConnectParams() IOConnectParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	params := IOConnectParams{
+		CtrlLossTMO:      c.ctrlLossTMO,
+		MaxIOQueues:      c.maxIOQueues,
+		Kato:             c.kato,
+		DhChapSecret:     string(c.dhChapSecret),
+		DhChapCtrlSecret: string(c.dhChapCtrlSecret),
+		FabricsOptions:   c.fabricsOptions,
+	}
+	if c.hostPaths != nil {
+		params.HostPaths = *c.hostPaths
+	}
+	return params
+}
+
+// setConnectParams updates the parameters of entry used when connecting to the
+// endpoint and to the IO controllers discovered through this connection.
+func (c *Connection) setConnectParams(entry *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hostid = entry.GetEffectiveHostId()
+	c.ctrlLossTMO = entry.CtrlLossTMO
+	c.weight = entry.Weight
+	c.locality = entry.Locality
+	c.ioFilter = entry.IOFilter
+	c.maxIOQueues = entry.MaxIOQueues
+	c.kato = entry.Kato
+	c.dhChapSecret = entry.DhChapSecret
+	c.dhChapCtrlSecret = entry.DhChapCtrlSecret
+	c.fabricsOptions = entry.FabricsOptions
+	c.hostPaths = entry.HostPaths
+	c.tls = entry.TLS
+	c.tlsKeyFile = entry.TLSKeyFile
+}
+
+func (c *Connection) GetConnectionID() hostapi.ConnectionID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connectionID
+}
+
+func (c *Connection) SetConnectionID(id hostapi.ConnectionID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connectionID = id
+}
+
+// ClearConnectionID returns the id of the persistent discovery connection and
+// clears it, so that only one caller disconnects it.
+func (c *Connection) ClearConnectionID() hostapi.ConnectionID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.connectionID
+	c.connectionID = ""
+	return id
+}
+
+func (c *Connection) GetState() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
 func (c *Connection) Stop() {
 	c.cancel()
 	close(c.AENChan)
 }
 
 func (c *Connection) GetDiscoveryRequest(kato time.Duration) *hostapi.DiscoverRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return &hostapi.DiscoverRequest{
-		Traddr:    c.Key.Ip,
-		Transport: c.Key.transport,
-		Trsvcid:   c.Key.port,
-		Hostnqn:   c.Hostnqn,
-		Kato:      kato,
-		AENChan:   c.AENChan,
+		Traddr:     c.Key.Ip,
+		Transport:  c.Key.transport,
+		Trsvcid:    c.Key.port,
+		Hostnqn:    c.Hostnqn,
+		Kato:       kato,
+		AENChan:    c.AENChan,
+		TLS:        c.tls,
+		TLSKeyFile: c.tlsKeyFile,
+	}
+}
+
+// Address returns the address of the endpoint, along with the hostname it was resolved from.
+func (c *Connection) Address() string {
+	if c.Hostname == "" {
+		return c.Key.Ip
 	}
+	return fmt.Sprintf("%s (%s)", c.Hostname, c.Key.Ip)
 }
 
 func (c *Connection) String() string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("connection: %s:%d, id: %s, subsystem nqn: %s, hostnqn: %s, hostid: %s",
-		c.Key.Ip, c.Key.port, c.ConnectionID, c.Key.Nqn, c.Hostnqn, c.Hostid))
+		c.Address(), c.Key.port, c.GetConnectionID(), c.Key.Nqn, c.Hostnqn, c.GetHostid()))
 	return sb.String()
 }
 
 func (c *Connection) SetState(newState bool) {
-	update := newState != c.State
-	c.State = newState
+	c.mu.Lock()
+	update := newState != c.state
+	c.state = newState
+	c.mu.Unlock()
 	if newState {
 		metrics.Metrics.ConnectionState.WithLabelValues(c.Key.transport, c.Key.Ip, strconv.Itoa(c.Key.port), c.Key.Nqn).Set(1)
 	} else {
@@ -119,18 +281,12 @@ type ClusterConnections struct {
 	ActiveConnection      *Connection
 }
 
-func (c ClusterConnections) GetRandomConnectionList() []*Connection {
-	clusterConnectionsList := make([]*Connection, len(c.ClusterConnectionsMap))
-	ind := 0
+// GetConnectionList returns the connections of the cluster in no particular order.
+func (c ClusterConnections) GetConnectionList() []*Connection {
+	clusterConnectionsList := make([]*Connection, 0, len(c.ClusterConnectionsMap))
 	for _, conn := range c.ClusterConnectionsMap {
-		clusterConnectionsList[ind] = conn
-		ind++
-	}
-	//Generate a random permutation of connections order to balance used target among clients
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(clusterConnectionsList), func(i, j int) {
-		clusterConnectionsList[i], clusterConnectionsList[j] = clusterConnectionsList[j], clusterConnectionsList[i]
-	})
+		clusterConnectionsList = append(clusterConnectionsList, conn)
+	}
 	return clusterConnectionsList
 }
 
@@ -159,19 +315,36 @@ func (cm ConnectionMap) AddConnection(key TKey, conn *Connection) {
 	cm[pair].ClusterConnectionsMap[key] = conn
 }
 
+// DeleteConnection removes the connection from the map, and the client-cluster
+// pair itself once it has no connections left.
 func (cm ConnectionMap) DeleteConnection(clientClusterPair ClientClusterPair, key TKey) {
 	delete(cm[clientClusterPair].ClusterConnectionsMap, key)
+	if len(cm[clientClusterPair].ClusterConnectionsMap) == 0 {
+		delete(cm, clientClusterPair)
+	}
 }
 
 func (cc ClusterConnections) Exists(c *Connection) bool {
 	for _, conn := range cc.ClusterConnectionsMap {
-		if reflect.DeepEqual(conn, c) {
+		if conn == c {
 			return true
 		}
 	}
 	return false
 }
 
+// copy returns a ClusterConnections with its own connections map.
+func (cc ClusterConnections) copy() ClusterConnections {
+	clusterConnections := ClusterConnections{
+		ClusterConnectionsMap: make(map[TKey]*Connection, len(cc.ClusterConnectionsMap)),
+		ActiveConnection:      cc.ActiveConnection,
+	}
+	for key, conn := range cc.ClusterConnectionsMap {
+		clusterConnections.ClusterConnectionsMap[key] = conn
+	}
+	return clusterConnections
+}
+
 type Cache interface {
 	// Run start watching for changes
 	Run(sync bool) error
@@ -180,10 +353,19 @@ type Cache interface {
 	// Clear clears the entries we have till now
 	Clear()
 	Connections() <-chan ConnectionMap
-	HandleReferrals(referrals ReferralMap) error
+	HandleReferrals(origin ReferralOrigin, referrals ReferralMap) error
+	// SetMaxReferralDepth sets the number of referrals to other connection groups followed
+	// from the user entries.
+	SetMaxReferralDepth(depth int)
+	// SetHostnameResolveInterval sets the interval between resolutions of the hostnames of
+	// the entries. a non positive interval stops resolving them again.
+	SetHostnameResolveInterval(interval time.Duration)
 }
 
 type cache struct {
+	// mu protects cacheEntries, connections and fileEntries, which are changed both
+	// by the watcher goroutine and by the service through HandleReferrals.
+	mu                sync.Mutex
 	userDirPath       string
 	cacheEntries      []*Entry
 	clearCh           chan bool
@@ -195,6 +377,16 @@ type cache struct {
 	internalDirPath   string
 	autoDetectEntries *model.AutoDetectEntries
 	nvmfHosts         NvmfHosts
+	// fileEntries maps each user file to the entries parsed from it.
+	// an entry may be shared by several files if they contain the same line.
+	fileEntries map[string][]*Entry
+	// resolved maps the hostnames of the entries to their addresses, one connection each.
+	resolved map[string][]string
+	// lookupHost resolves a hostname, replaced by tests.
+	lookupHost    func(ctx context.Context, host string) ([]string, error)
+	resolveTicker *time.Ticker
+	// maxReferralDepth of the referrals to other connection groups followed.
+	maxReferralDepth int
 }
 
 // NewCache return a Cache implementation.
@@ -207,6 +399,11 @@ func NewCache(ctx context.Context, userDirPath, internalDirPath string, autoDete
 		connectionsChan:   make(chan ConnectionMap),
 		internalDirPath:   internalDirPath,
 		autoDetectEntries: autoDetectEntries,
+		fileEntries:       make(map[string][]*Entry),
+		resolved:          make(map[string][]string),
+		lookupHost:        net.DefaultResolver.LookupHost,
+		resolveTicker:     time.NewTicker(model.DefaultHostnameResolveInterval),
+		maxReferralDepth:  model.DefaultMaxReferralDepth,
 	}
 	c.ctx, c.cancel = context.WithCancel(ctx)
 	c.nvmfHosts = GetNvmfHosts()
@@ -308,18 +505,45 @@ func (c *cache) sync() error {
 		2. Last change in the user folder (through which the user may add files with entries) is newer than our internal json.
 		In this case we disregard our internal json entries and rely on the user. After that we update the internal referrals file.	*/
 
+	if userFiles, err := os.ReadDir(c.userDirPath); err == nil {
+		for _, file := range userFiles {
+			if !file.IsDir() {
+				c.resolveFileHostnames(filepath.Join(c.userDirPath, file.Name()))
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	useJson, jsonEntries, err := c.useInternalJson()
 	if err != nil {
 		return err
 	}
 	changedPairs := []ClientClusterPair{} // a list of pairs with new connections
 	if useJson {
+		// the entries are loaded from the internal json, but we still need to know
+		// which user file each of them came from in order to handle file removal.
+		userFiles, err := os.ReadDir(c.userDirPath)
+		if err != nil {
+			return err
+		}
+		for _, file := range userFiles {
+			if file.IsDir() {
+				continue
+			}
+			c.trackFileEntries(filepath.Join(c.userDirPath, file.Name()))
+		}
+		// the internal json doesn't hold secrets. the user entries are added first and the
+		// referrals by their depth, each restores its secrets from those added before it.
+		sort.SliceStable(jsonEntries, func(i, j int) bool {
+			return secretsOrder(&jsonEntries[i]) < secretsOrder(&jsonEntries[j])
+		})
 		for _, e := range jsonEntries {
 			var entry = e
 			if err := entry.verify(); err != nil {
 				c.log.Errorf("Failed to form entry from json %+v", entry)
 				return err
 			}
+			c.restoreSecrets(&entry)
 			pair, _ := c.addEntry(&entry)
 			if !pair.isEmpty() {
 				changedPairs = append(changedPairs, pair)
@@ -394,21 +618,32 @@ func (c *cache) Run(sync bool) error {
 					continue
 				}
 				switch event.Op {
-				case Create, Rename:
-					pairs, _ := c.fileAdded(event.Name)
-					c.createReferralsFile()
-					if len(pairs) > 0 {
-						c.notifyChange(pairs)
+				case Create, Rename, Modify:
+					// a rename event is reported on the old name when a file is moved out
+					// of the directory, in this case we treat it as a removal.
+					stat, err := os.Stat(event.Name)
+					if event.Op == Rename && os.IsNotExist(err) {
+						c.handleFileRemoved(event.Name)
+						continue
+					}
+					// a file rewritten in place is truncated first. wait for its content
+					// instead of dropping all its entries in between.
+					if event.Op == Modify && err == nil && stat.Size() == 0 {
+						c.log.Debugf("file %s was truncated, waiting for its content", event.Name)
+						continue
 					}
+					c.handleFileAdded(event.Name)
 				case Remove:
-					// today we don't handle remove events knowingly,
-					// but we want to prevent the warn msg to log.
-					continue
+					c.handleFileRemoved(event.Name)
 				default:
 					c.log.Warnf("unhandled event for file: %q. op: %s", event.Name, event.Op)
 				}
+			case <-c.resolveTicker.C:
+				c.resolveHostnames()
 			case <-c.clearCh:
+				c.mu.Lock()
 				c.cacheEntries = nil
+				c.mu.Unlock()
 			case <-c.ctx.Done():
 				return
 			}
@@ -421,6 +656,7 @@ func (c *cache) notifyChange(changedClientClusterPairs []ClientClusterPair) {
 	//Alerts the service on clusters that changed
 	c.log.Debugf("Notifying change with pairs: %+v", changedClientClusterPairs)
 	changedPairs := make(ConnectionMap)
+	c.mu.Lock()
 	for _, pair := range changedClientClusterPairs {
 		if pair.isEmpty() {
 			c.log.Warn("Got an empty client cluster pair with changed connections")
@@ -428,17 +664,24 @@ func (c *cache) notifyChange(changedClientClusterPairs []ClientClusterPair) {
 		}
 		clusterConnections, ok := c.connections[pair]
 		if !ok {
-			c.log.Warnf("Attempted to notify on change at pair %+v but no connections on this pair were found", pair)
-			continue
+			// all connections of this pair were removed. we still notify the
+			// service with an empty connections map so it can tear the cluster down.
+			c.log.Debugf("No connections left on pair %+v", pair)
+			clusterConnections = ClusterConnections{
+				ClusterConnectionsMap: make(map[TKey]*Connection),
+			}
 		}
-		changedPairs[pair] = clusterConnections
+		// the service works on its own copy, the cache keeps changing its maps.
+		changedPairs[pair] = clusterConnections.copy()
 	}
+	c.mu.Unlock()
 	if len(changedPairs) > 0 {
 		c.connectionsChan <- changedPairs
 	}
 }
 
 func (c *cache) Stop() {
+	c.resolveTicker.Stop()
 	if c.cancel != nil {
 		c.cancel()
 		c.cancel = nil
@@ -450,10 +693,11 @@ func (c *cache) Clear() {
 }
 
 func (c *cache) fileAdded(filename string) ([]ClientClusterPair, error) {
-	// called if a user file was added or at startup when internal json entries file is outdated
-	// adds file entries to cache entries
+	// called if a user file was added or modified or at startup when internal json entries file is outdated
+	// adds file entries to cache entries and updates the entries that already exist
 	// adds connection if a new connection is required
-	// returns a list of pairs of connection subsystemNqn and hostNqn if new connections were added
+	// removes entries that were in a previous version of the file and are no longer in it
+	// returns a list of pairs of connection subsystemNqn and hostNqn if connections were added or removed
 	c.log.Debugf("Dealing with added file %s", filename)
 	pairsSet := map[ClientClusterPair]bool{}
 	newEntries, err := parse(filename)
@@ -462,8 +706,15 @@ func (c *cache) fileAdded(filename string) ([]ClientClusterPair, error) {
 		return nil, err
 	}
 	c.log.Debugf("Found %d entries in user file %s", len(newEntries), filename)
+	previousFileEntries := c.fileEntries[filename]
 	for _, newEntry := range newEntries {
 		newEntry.Persistent = true
+		if c.findEntry(newEntry, previousFileEntries) != nil && !c.existEntry(newEntry, c.cacheEntries) {
+			// the entry was already in the file and was removed from the cache because the
+			// discovery service did not report it as a referral. don't bring it back on every write.
+			c.log.Debugf("entry %+v was removed from cache - not adding it again", newEntry)
+			continue
+		}
 		pair, err := c.addEntry(newEntry)
 		if err != nil {
 			c.log.WithError(err).Errorf("Failed to deal with user file %s", filename)
@@ -473,6 +724,19 @@ func (c *cache) fileAdded(filename string) ([]ClientClusterPair, error) {
 			pairsSet[pair] = true
 		}
 	}
+	c.fileEntries[filename] = newEntries
+	staleEntries := []*Entry{}
+	for _, previousEntry := range previousFileEntries {
+		if c.findEntry(previousEntry, newEntries) == nil {
+			staleEntries = append(staleEntries, previousEntry)
+		}
+	}
+	if len(staleEntries) > 0 {
+		c.log.Infof("%d entries no longer found in user file %s", len(staleEntries), filename)
+		for pair := range c.dropUserEntries(staleEntries) {
+			pairsSet[pair] = true
+		}
+	}
 	pairs := []ClientClusterPair{}
 	for pair := range pairsSet {
 		pairs = append(pairs, pair)
@@ -481,100 +745,443 @@ func (c *cache) fileAdded(filename string) ([]ClientClusterPair, error) {
 	return pairs, nil
 }
 
-func (c *cache) existEntry(newEntry *Entry, entriesList []*Entry) bool {
+// secretsOrder is the order in which the entries of the internal json restore their secrets.
+func secretsOrder(entry *Entry) int {
+	if entry.EntrySource == EntrySourceUser {
+		return 0
+	}
+	if entry.Origin == nil {
+		return 1
+	}
+	return 1 + entry.Origin.Depth
+}
+
+// restoreSecrets sets the DH-CHAP secrets of entry, an entry of the internal json, which
+// doesn't hold secrets: a user entry takes those of its user file, a referral those of the
+// user entries of its cluster, otherwise those of the group that referred it.
+func (c *cache) restoreSecrets(entry *Entry) {
+	var from *Entry
+	if entry.EntrySource == EntrySourceUser {
+		for _, fileEntries := range c.fileEntries {
+			if from = c.findEntry(entry, fileEntries); from != nil {
+				break
+			}
+		}
+	} else {
+		from = c.fileEntryOfPair(entryPair(entry))
+		if from == nil && entry.Origin != nil {
+			if from = c.fileEntryOfPair(entry.Origin.pair()); from == nil {
+				from = c.inheritedParamsEntry(entry.Origin.pair())
+			}
+		}
+	}
+	if from != nil {
+		entry.DhChapSecret = from.DhChapSecret
+		entry.DhChapCtrlSecret = from.DhChapCtrlSecret
+	}
+}
+
+// fileEntryOfPair returns an entry of pair in the user files, nil if it has none.
+func (c *cache) fileEntryOfPair(pair ClientClusterPair) *Entry {
+	for _, fileEntries := range c.fileEntries {
+		for _, entry := range fileEntries {
+			if entryPair(entry) == pair {
+				return entry
+			}
+		}
+	}
+	return nil
+}
+
+// trackFileEntries records which entries are described by filename
+// without adding new entries to the cache.
+func (c *cache) trackFileEntries(filename string) {
+	entries, err := parse(filename)
+	if err != nil {
+		c.log.WithError(err).Errorf("parse file %s failed", filename)
+		return
+	}
+	for _, entry := range entries {
+		entry.Persistent = true
+	}
+	c.fileEntries[filename] = entries
+}
+
+func (c *cache) handleFileAdded(filename string) {
+	c.resolveFileHostnames(filename)
+	c.mu.Lock()
+	pairs, _ := c.fileAdded(filename)
+	c.createReferralsFile()
+	c.mu.Unlock()
+	if len(pairs) > 0 {
+		c.notifyChange(pairs)
+	}
+}
+
+func (c *cache) handleFileRemoved(filename string) {
+	c.mu.Lock()
+	pairs := c.fileRemoved(filename)
+	if len(pairs) > 0 {
+		c.createReferralsFile()
+	}
+	c.mu.Unlock()
+	if len(pairs) > 0 {
+		c.notifyChange(pairs)
+	}
+}
+
+func (c *cache) fileRemoved(filename string) []ClientClusterPair {
+	// called when a user file was deleted or moved out of the user directory.
+	// removes the entries that came only from this file.
+	// returns the pairs that were changed.
+	fileEntries, ok := c.fileEntries[filename]
+	if !ok {
+		c.log.Debugf("Removed file %s has no tracked entries", filename)
+		return nil
+	}
+	delete(c.fileEntries, filename)
+	c.log.Infof("User file %s removed, dropping %d entries", filename, len(fileEntries))
+
+	pairs := []ClientClusterPair{}
+	for pair := range c.dropUserEntries(fileEntries) {
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// dropUserEntries removes the given user entries unless another user file still
+// contains them. if no user entry is left for a client-cluster pair, the referral
+// entries of that pair are removed too.
+// returns the pairs that were changed.
+func (c *cache) dropUserEntries(entries []*Entry) map[ClientClusterPair]bool {
+	pairsSet := map[ClientClusterPair]bool{}
+	for _, entry := range entries {
+		if c.entryInUserFile(entry) {
+			c.log.Debugf("Entry %+v still found in other user files", entry)
+			continue
+		}
+		cachedEntry := c.findEntry(entry, c.cacheEntries)
+		if cachedEntry == nil || cachedEntry.EntrySource != EntrySourceUser {
+			// already removed, or also reported by the discovery service as a referral.
+			continue
+		}
+		if pair, err := c.deleteEntry(cachedEntry); err == nil {
+			pairsSet[pair] = true
+		}
+	}
+	for pair := range pairsSet {
+		if !c.hasUserEntries(pair) {
+			for _, entry := range c.entriesOfPair(pair) {
+				c.log.Debugf("Removing %s entry %+v of removed cluster %+v", entry.EntrySource, entry, pair)
+				c.deleteEntry(entry)
+			}
+		}
+	}
+	// the groups reached through the referrals of the removed clusters.
+	for pair := range c.dropOrphanReferrals() {
+		pairsSet[pair] = true
+	}
+	return pairsSet
+}
+
+func (c *cache) entryInUserFile(entry *Entry) bool {
+	for _, fileEntries := range c.fileEntries {
+		for _, fileEntry := range fileEntries {
+			if fileEntry.compare(entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *cache) hasUserEntries(pair ClientClusterPair) bool {
+	for _, entry := range c.entriesOfPair(pair) {
+		if entry.EntrySource == EntrySourceUser {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cache) entriesOfPair(pair ClientClusterPair) []*Entry {
+	entries := []*Entry{}
+	for _, entry := range c.cacheEntries {
+		if entry.Subsysnqn == pair.ClusterNqn && entry.Hostnqn == pair.HostNqn {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (c *cache) findEntry(newEntry *Entry, entriesList []*Entry) *Entry {
 	for _, inListEntry := range entriesList {
 		c.log.Tracef("[existEntry] new: %+v, existing entry: %s",
 			newEntry,
 			EntriesToString(entriesList))
 		if newEntry.compare(inListEntry) {
-			// TODO (LBM1-40307): check if we need to update the entry, and find a way to
-			// propagate the change to the cache connections.
-			// (for example, if the ctrlLossTMO changed)
-			return true
+			return inListEntry
 		}
 	}
-	return false
+	return nil
+}
+
+func (c *cache) existEntry(newEntry *Entry, entriesList []*Entry) bool {
+	return c.findEntry(newEntry, entriesList) != nil
+}
+
+// updateEntry applies the attributes of newEntry that are not part of the entry
+// identity (see Entry.compare) on cachedEntry and on its connection.
+// referral entries of the same cluster that inherited the connect parameters of
+// cachedEntry are updated as well.
+// returns true if cachedEntry was changed.
+func (c *cache) updateEntry(cachedEntry, newEntry *Entry) bool {
+	changed := false
+	if oldParams := cachedEntry.inheritedParams(); !reflect.DeepEqual(oldParams, newEntry.inheritedParams()) {
+		c.log.Infof("updating connect parameters of entry %+v: %s => %s", cachedEntry, oldParams, newEntry.inheritedParams())
+		cachedEntry.setInheritedParams(newEntry.inheritedParams())
+		pair := ClientClusterPair{ClusterNqn: cachedEntry.Subsysnqn, HostNqn: cachedEntry.Hostnqn}
+		for _, entry := range c.cacheEntries {
+			if entry.EntrySource != EntrySourceReferral || !reflect.DeepEqual(entry.inheritedParams(), oldParams) {
+				continue
+			}
+			// the referrals of the cluster, and of the groups reached through its referrals.
+			if entryPair := entryPair(entry); entryPair != pair && !c.ancestors(entryPair)[pair] {
+				continue
+			}
+			c.log.Debugf("updating inherited connect parameters of referral entry %+v", entry)
+			entry.setInheritedParams(newEntry.inheritedParams())
+			c.updateConnection(entry)
+		}
+		changed = true
+	}
+	if cachedEntry.Hostid != newEntry.Hostid {
+		c.log.Infof("updating hostid of entry %+v: %q => %q", cachedEntry, cachedEntry.Hostid, newEntry.Hostid)
+		cachedEntry.Hostid = newEntry.Hostid
+		cachedEntry.EffectiveHostid = ""
+		c.nvmfHosts.MaybeUpdateHostIDs(cachedEntry)
+		changed = true
+	}
+	if cachedEntry.Weight != newEntry.Weight || cachedEntry.Locality != newEntry.Locality {
+		c.log.Infof("updating weight and locality of entry %+v: %d/%q => %d/%q", cachedEntry,
+			cachedEntry.Weight, cachedEntry.Locality, newEntry.Weight, newEntry.Locality)
+		cachedEntry.Weight = newEntry.Weight
+		cachedEntry.Locality = newEntry.Locality
+		changed = true
+	}
+	if cachedEntry.Persistent != newEntry.Persistent {
+		c.log.Infof("updating persistence of entry %+v: %t => %t", cachedEntry, cachedEntry.Persistent, newEntry.Persistent)
+		cachedEntry.Persistent = newEntry.Persistent
+		changed = true
+	}
+	if cachedEntry.EntrySource != newEntry.EntrySource {
+		c.log.Infof("entry %+v is now provided by %s", cachedEntry, newEntry.EntrySource)
+		cachedEntry.EntrySource = newEntry.EntrySource
+		changed = true
+	}
+	if changed {
+		c.updateConnection(cachedEntry)
+	}
+	return changed
+}
+
+// updateConnection propagates the connect parameters of entry to its cache connections.
+func (c *cache) updateConnection(entry *Entry) {
+	pair := ClientClusterPair{ClusterNqn: entry.Subsysnqn, HostNqn: entry.Hostnqn}
+	for _, key := range c.entryKeys(entry) {
+		conn, ok := c.connections[pair].ClusterConnectionsMap[key]
+		if !ok {
+			c.log.Warnf("Failed to find a cache connection corresponding to updated entry %+v", entry)
+			continue
+		}
+		conn.setConnectParams(entry)
+		c.log.Debugf("Updated %s", conn)
+	}
+}
+
+func entryKey(entry *Entry) TKey {
+	return addressKey(entry, entry.Traddr)
+}
+
+// addressKey returns the key of the connection of entry to addr, one of its addresses.
+func addressKey(entry *Entry, addr string) TKey {
+	return TKey{transport: entry.Transport, Ip: addr,
+		port: entry.Trsvcid, Nqn: entry.Subsysnqn,
+		hostnqn: entry.Hostnqn}
+}
+
+// entryKeys returns the keys of the connections of entry, one per address of its hostname
+// if it has one.
+func (c *cache) entryKeys(entry *Entry) []TKey {
+	if !isHostname(entry.Traddr) {
+		return []TKey{entryKey(entry)}
+	}
+	keys := []TKey{}
+	for _, addr := range c.resolved[entry.Traddr] {
+		keys = append(keys, addressKey(entry, addr))
+	}
+	return keys
+}
+
+// syncConnections adds the connections of the entries of pair that are missing and deletes
+// those no entry has anymore. an address shared by several entries, e.g. a hostname entry
+// and a referral, has a single connection.
+// returns true if a connection was added or deleted.
+func (c *cache) syncConnections(pair ClientClusterPair) bool {
+	wanted := map[TKey]*Entry{}
+	for _, entry := range c.entriesOfPair(pair) {
+		for _, key := range c.entryKeys(entry) {
+			if _, ok := wanted[key]; !ok {
+				wanted[key] = entry
+			}
+		}
+	}
+	changed := false
+	for key, conn := range c.connections[pair].ClusterConnectionsMap {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		c.log.Debugf("Deleting %s from cache connections", conn)
+		c.connections.DeleteConnection(pair, key)
+		metrics.Metrics.Connections.WithLabelValues(key.transport, key.Ip, strconv.Itoa(key.port), key.Nqn, conn.Hostnqn).Dec()
+		changed = true
+	}
+	for key, entry := range wanted {
+		if _, ok := c.connections[pair].ClusterConnectionsMap[key]; ok {
+			continue
+		}
+		conn := newConnection(c.ctx, key, entry)
+		c.connections.AddConnection(key, conn)
+		metrics.Metrics.Connections.WithLabelValues(key.transport, key.Ip, strconv.Itoa(key.port), key.Nqn, conn.Hostnqn).Inc()
+		c.log.Debugf("Added %s to cache connections", conn)
+		changed = true
+	}
+	return changed
+}
+
+func intPtrToString(v *int) string {
+	if v == nil {
+		return "<nil>"
+	}
+	return strconv.Itoa(*v)
 }
 
 func (c *cache) addEntry(newEntry *Entry) (ClientClusterPair, error) {
-	if c.existEntry(newEntry, c.cacheEntries) {
+	if cachedEntry := c.findEntry(newEntry, c.cacheEntries); cachedEntry != nil {
+		// referrals carry no connect parameters of their own, only user entries
+		// may change the parameters of an existing entry.
+		if newEntry.EntrySource == EntrySourceUser {
+			c.updateEntry(cachedEntry, newEntry)
+		}
 		c.log.Debugf("entry %+v already found in cache - no need to add", newEntry)
 		return ClientClusterPair{}, nil
 	}
-	if newEntry.EntrySource == EntrySourceReferral && newEntry.CtrlLossTMO == nil {
-		for _, entry := range c.cacheEntries {
-			if entry.EntrySource == EntrySourceUser && entry.CtrlLossTMO != nil {
-				newEntry.CtrlLossTMO = entry.CtrlLossTMO
-				break
+	if newEntry.EntrySource == EntrySourceReferral {
+		// referrals carry no connect parameters, they inherit those of the user
+		// entries of their cluster.
+		// the first referral of another group inherits those of the group that referred it.
+		if inheritFrom := c.inheritedParamsEntry(entryPair(newEntry)); inheritFrom != nil {
+			newEntry.setInheritedParams(inheritFrom.inheritedParams())
+		} else if newEntry.Origin != nil {
+			if inheritFrom := c.inheritedParamsEntry(newEntry.Origin.pair()); inheritFrom != nil {
+				newEntry.setInheritedParams(inheritFrom.inheritedParams())
 			}
 		}
 	}
 	c.nvmfHosts.MaybeUpdateHostIDs(newEntry)
+	if isHostname(newEntry.Traddr) {
+		// the hostnames of the user files are resolved before c.mu is taken (see
+		// resolveFileHostnames). others get their addresses from resolveHostnames.
+		if _, ok := c.resolved[newEntry.Traddr]; !ok {
+			c.resolved[newEntry.Traddr] = nil
+		}
+	}
 	c.cacheEntries = append(c.cacheEntries, newEntry)
 	c.log.Infof("added cache (len=%d) entry: %+v", len(c.cacheEntries), newEntry)
 	metrics.Metrics.EntriesTotal.WithLabelValues().Inc()
 
-	key := TKey{transport: newEntry.Transport, Ip: newEntry.Traddr,
-		port: newEntry.Trsvcid, Nqn: newEntry.Subsysnqn,
-		hostnqn: newEntry.Hostnqn}
 	pair := ClientClusterPair{
 		ClusterNqn: newEntry.Subsysnqn,
 		HostNqn:    newEntry.Hostnqn,
 	}
-	conn, ok := c.connections[pair].ClusterConnectionsMap[key]
-	if !ok {
-		conn = newConnection(c.ctx, key, newEntry.CtrlLossTMO)
-		conn.Hostnqn = newEntry.Hostnqn
-		conn.Hostid = newEntry.GetEffectiveHostId()
-		c.connections.AddConnection(key, conn)
-		metrics.Metrics.Connections.WithLabelValues(key.transport, key.Ip, strconv.Itoa(key.port), key.Nqn, conn.Hostnqn).Inc()
-		c.log.Debugf("Added %s to cache connections", conn)
-		return pair, nil
+	if !c.syncConnections(pair) {
+		c.log.Debugf("entry %+v has no new connection", newEntry)
+		return ClientClusterPair{}, nil
 	}
-	err := fmt.Errorf("Entry %+v not cached, though connection '%s' is in cache",
-		newEntry, conn)
-	c.log.WithError(err).Error("Mismatch between cache entries and cache connections")
-	return ClientClusterPair{}, err
+	return pair, nil
 }
 
-func (c *cache) HandleReferrals(referrals ReferralMap) error {
+// HandleReferrals updates the entries referred by the discovery endpoint origin with the
+// referrals of its last log page. the referrals to the endpoints of its own group replace
+// the entries of the group. the referrals to other discovery subsystems create a group of
+// their own, followed up to the maximum referral depth and unless they lead back to a
+// group they were reached through.
+func (c *cache) HandleReferrals(origin ReferralOrigin, referrals ReferralMap) error {
 	if len(referrals) == 0 {
 		err := fmt.Errorf("handle referrals got empty referrals map. This should never happen")
 		c.log.WithError(err)
 		return err
 	}
-	c.log.Debugf("Handling %d referrals:", len(referrals))
+	c.log.Debugf("Handling %d referrals of %s:%d:", len(referrals), origin.Traddr, origin.Trsvcid)
 	for key := range referrals {
-		c.log.Debugf("%s:%d", key.Ip, key.Port)
+		c.log.Debugf("%s:%d %s", key.Ip, key.Port, key.DPSubNqn)
 	}
-	newConnectionsPairs, err := c.addConnectionsFromReferrals(referrals)
-	if err != nil {
-		c.log.WithError(err).Errorf("Failed to add new connections from referrals")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	originPair := origin.pair()
+	groups := map[ClientClusterPair]ReferralMap{}
+	for key, referral := range referrals {
+		pair := ClientClusterPair{ClusterNqn: key.DPSubNqn, HostNqn: key.Hostnqn}
+		if groups[pair] == nil {
+			groups[pair] = ReferralMap{}
+		}
+		groups[pair][key] = referral
 	}
-	removedConnectionsPairs, err := c.removeConnectionsNotInReferrals(referrals)
-	if err != nil {
-		c.log.WithError(err).Errorf("Failed to remove connections following referrals")
+	depth := c.groupDepth(originPair)
+	pairsSet := map[ClientClusterPair]bool{}
+	for pair, groupReferrals := range groups {
+		groupOrigin := origin
+		groupOrigin.Depth = depth
+		if pair != originPair {
+			groupOrigin.Depth = depth + 1
+			if err := c.followReferrals(originPair, pair, groupOrigin.Depth); err != nil {
+				c.log.WithError(err).Warnf("not following the referrals of %s:%d to %s", origin.Traddr, origin.Trsvcid, pair.ClusterNqn)
+				delete(groups, pair)
+				continue
+			}
+		}
+		for _, changed := range c.addConnectionsFromReferrals(groupOrigin, groupReferrals) {
+			pairsSet[changed] = true
+		}
+	}
+	for _, changed := range c.removeConnectionsNotInReferrals(originPair, groups) {
+		pairsSet[changed] = true
+	}
+	for changed := range c.dropOrphanReferrals() {
+		pairsSet[changed] = true
 	}
 
-	changedClientClusterPairs := append(newConnectionsPairs, removedConnectionsPairs...)
-	if len(changedClientClusterPairs) > 0 {
+	if len(pairsSet) > 0 {
+		changedClientClusterPairs := []ClientClusterPair{}
+		for pair := range pairsSet {
+			changedClientClusterPairs = append(changedClientClusterPairs, pair)
+		}
 		c.log.Debugf("Changes in connection map due to referrals update. Updating internal json and notifying service")
 		c.createReferralsFile()
 		go func() {
 			c.notifyChange(changedClientClusterPairs)
 		}()
 	}
-	return err
+	return nil
 }
 
-func (c *cache) addConnectionsFromReferrals(referrals ReferralMap) (newConnectionsPairs []ClientClusterPair, err error) {
+func (c *cache) addConnectionsFromReferrals(origin ReferralOrigin, referrals ReferralMap) []ClientClusterPair {
 	pairs := []ClientClusterPair{}
-	if len(referrals) == 0 {
-		return pairs, nil
-	}
 	c.log.Debugf("Checking if new entries are required from referrals")
 	for refKey, referral := range referrals {
 		newEntry := getEntryFromReferral(refKey, referral)
+		referralOrigin := origin
+		newEntry.Origin = &referralOrigin
 		pair, err := c.addEntry(newEntry)
 		if err != nil {
 			c.log.WithError(err).Errorf("Failed to add entry %v", newEntry)
@@ -586,40 +1193,34 @@ func (c *cache) addConnectionsFromReferrals(referrals ReferralMap) (newConnectio
 	}
 
 	c.log.Debugf("%d new connections added from referrals", len(pairs))
-	return pairs, nil
+	return pairs
 }
 
-func (c *cache) removeConnectionsNotInReferrals(referrals ReferralMap) (removedConnectionsPairs []ClientClusterPair, err error) {
+// removeConnectionsNotInReferrals removes the entries managed by originPair (see managerPair)
+// that are not in the referrals of their group, including the groups originPair no longer refers to.
+func (c *cache) removeConnectionsNotInReferrals(originPair ClientClusterPair, groups map[ClientClusterPair]ReferralMap) []ClientClusterPair {
 	pairs := []ClientClusterPair{}
 	c.log.Debugf("Checking if entries removal is needed due to referrals")
 	referralEntries := []*Entry{}
-	var prevPair, currentPair ClientClusterPair
-	for refKey, referral := range referrals {
-		referralEntries = append(referralEntries, getEntryFromReferral(refKey, referral))
-		currentPair = ClientClusterPair{
-			ClusterNqn: refKey.DPSubNqn,
-			HostNqn:    refKey.Hostnqn,
-		}
-		// All referrals were obtained from one discovery command with one connection. We expect all to have the same hostnqn and subsysnqn
-		if !prevPair.isEmpty() {
-			if !reflect.DeepEqual(prevPair, currentPair) {
-				return pairs, fmt.Errorf("found different client cluster pair in referrals: %+v and %+v", prevPair, currentPair)
-			}
+	for _, referrals := range groups {
+		for refKey, referral := range referrals {
+			referralEntries = append(referralEntries, getEntryFromReferral(refKey, referral))
 		}
-		prevPair = currentPair
 	}
 	entriesToRemove := []*Entry{}
 	for _, cachedEntry := range c.cacheEntries {
-		// We remove entries that are not in referrals if they share the same hostnqn and subsystemnqn as the referrals
-		// We use the last referral for hostnqn and subsystemnqn after we checked they are equal in all referrals
-		if !c.existEntry(cachedEntry, referralEntries) && cachedEntry.Hostnqn == currentPair.HostNqn && cachedEntry.Subsysnqn == currentPair.ClusterNqn {
+		// the addresses of a hostname entry follow its DNS records, which the referrals don't report.
+		if cachedEntry.EntrySource == EntrySourceUser && isHostname(cachedEntry.Traddr) {
+			continue
+		}
+		if managerPair(cachedEntry) == originPair && !c.existEntry(cachedEntry, referralEntries) {
 			c.log.Debugf("Cached entry %+v not found in referrals. Will be removed from cache", cachedEntry)
 			entriesToRemove = append(entriesToRemove, cachedEntry)
 		}
 	}
 	if len(entriesToRemove) == 0 {
 		c.log.Debug("No entries removal is required due to referrals")
-		return pairs, nil
+		return pairs
 	}
 	c.log.Debugf("Going to remove %d entries due to referrals", len(entriesToRemove))
 	for _, cachedEntryToRemove := range entriesToRemove {
@@ -627,14 +1228,14 @@ func (c *cache) removeConnectionsNotInReferrals(referrals ReferralMap) (removedC
 			pairs = append(pairs, pair)
 		}
 	}
-	return pairs, nil
+	return pairs
 }
 
 func getEntryFromReferral(refKey ReferralKey, referral *hostapi.NvmeDiscPageEntry) *Entry {
 	return &Entry{
-		Transport:   "tcp",
+		Transport:   refKey.Transport,
 		Trsvcid:     int(referral.TrsvcID),
-		Traddr:      referral.Traddr,
+		Traddr:      refKey.Ip,
 		Hostnqn:     refKey.Hostnqn,
 		Subsysnqn:   refKey.DPSubNqn,
 		Persistent:  true,
@@ -663,14 +1264,7 @@ func (c *cache) deleteEntry(entry *Entry) (connectionPair ClientClusterPair, err
 	}
 	pair.ClusterNqn = entry.Subsysnqn
 	pair.HostNqn = entry.Hostnqn
-	key := TKey{transport: entry.Transport, Ip: entry.Traddr, port: entry.Trsvcid, Nqn: entry.Subsysnqn, hostnqn: entry.Hostnqn}
-	conn, ok := c.connections[pair].ClusterConnectionsMap[key]
-	if ok {
-		c.log.Debugf("Deleting %s from cache connections", conn)
-		delete(c.connections[pair].ClusterConnectionsMap, key)
-	} else {
-		c.log.Warnf("Failed to find a cache connection corresponding to deleted entry")
-	}
+	c.syncConnections(pair)
 	return pair, nil
 }
 
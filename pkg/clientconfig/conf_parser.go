@@ -16,6 +16,7 @@ package clientconfig
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
@@ -25,7 +26,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 
-	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+	"github.com/lightbitslabs/discovery-client/model"
 )
 
 const (
@@ -41,6 +42,28 @@ const (
 	EntrySourceInternal EntrySource = "internal"
 )
 
+// Secret is a value that is not written to the logs nor to the internal json.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "redacted"
+}
+
+// MarshalJSON redacts the secret. the entries of the internal json take their secrets from
+// the user files again.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON ignores the secret, a json never holds it (see MarshalJSON).
+func (s *Secret) UnmarshalJSON([]byte) error {
+	*s = ""
+	return nil
+}
+
 type Entry struct {
 	Transport       string
 	Trsvcid         int
@@ -53,14 +76,100 @@ type Entry struct {
 	EntrySource     EntrySource
 	CtrlLossTMO     *int   // time in seconds - nil means not set.
 	EffectiveHostid string `json:"-"`
+	// Weight of the endpoint when picking the discovery endpoint of the cluster
+	// to connect to. 0 means the default weight of 1.
+	Weight int `json:",omitempty"`
+	// Locality label of the endpoint (e.g. a rack). endpoints with the locality of
+	// the host are preferred.
+	Locality string `json:",omitempty"`
+	// IOFilter selects the IO controllers of the cluster the host connects to.
+	// referrals inherit the filter of the user entries of their cluster.
+	IOFilter *model.IOControllersFilter `json:",omitempty"`
+	// connect parameters of the IO controllers of the cluster, overriding the
+	// service configuration. nil or empty means not set.
+	MaxIOQueues      *int   `json:",omitempty"`
+	Kato             *int   `json:",omitempty"` // time in seconds
+	DhChapSecret     Secret `json:",omitempty"`
+	DhChapCtrlSecret Secret `json:",omitempty"`
+	// FabricsOptions of the IO controllers of the cluster. options set here take
+	// precedence over the service configuration.
+	FabricsOptions *model.FabricsOptions `json:",omitempty"`
+	// HostPaths are the host interfaces or source addresses every IO controller of
+	// the cluster is connected through, one controller per path.
+	HostPaths *model.HostPaths `json:",omitempty"`
+	// TLS secures the discovery connections of the cluster with TLS 1.3, with the PSK of the
+	// host and the discovery subsystem in TLSKeyFile, the key file of the service if empty.
+	TLS        bool   `json:",omitempty"`
+	TLSKeyFile string `json:",omitempty"`
+	// Origin of a referral entry, the discovery endpoint that reported it.
+	Origin *ReferralOrigin `json:",omitempty"`
+}
+
+// inheritedParams are the attributes of a user entry that the referral entries of its cluster inherit.
+type inheritedParams struct {
+	CtrlLossTMO      *int
+	IOFilter         *model.IOControllersFilter
+	MaxIOQueues      *int
+	Kato             *int
+	DhChapSecret     Secret
+	DhChapCtrlSecret Secret
+	FabricsOptions   *model.FabricsOptions
+	HostPaths        *model.HostPaths
+	TLS              bool
+	TLSKeyFile       string
+}
+
+func (e *Entry) inheritedParams() inheritedParams {
+	return inheritedParams{
+		CtrlLossTMO:      e.CtrlLossTMO,
+		IOFilter:         e.IOFilter,
+		MaxIOQueues:      e.MaxIOQueues,
+		Kato:             e.Kato,
+		DhChapSecret:     e.DhChapSecret,
+		DhChapCtrlSecret: e.DhChapCtrlSecret,
+		FabricsOptions:   e.FabricsOptions,
+		HostPaths:        e.HostPaths,
+		TLS:              e.TLS,
+		TLSKeyFile:       e.TLSKeyFile,
+	}
+}
+
+func (e *Entry) setInheritedParams(params inheritedParams) {
+	e.CtrlLossTMO = params.CtrlLossTMO
+	e.IOFilter = params.IOFilter
+	e.MaxIOQueues = params.MaxIOQueues
+	e.Kato = params.Kato
+	e.DhChapSecret = params.DhChapSecret
+	e.DhChapCtrlSecret = params.DhChapCtrlSecret
+	e.FabricsOptions = params.FabricsOptions
+	e.HostPaths = params.HostPaths
+	e.TLS = params.TLS
+	e.TLSKeyFile = params.TLSKeyFile
+}
+
+// String of the parameters, showing the values of the pointers.
+func (p inheritedParams) String() string {
+	fabricsOptions := ""
+	if p.FabricsOptions != nil {
+		fabricsOptions = strings.TrimPrefix(p.FabricsOptions.Options(), ",")
+	}
+	var hostPaths model.HostPaths
+	if p.HostPaths != nil {
+		hostPaths = *p.HostPaths
+	}
+	return fmt.Sprintf("ctrl-loss-tmo: %s, nr-io-queues: %s, keep-alive-tmo: %s, dhchap-secret: %s, dhchap-ctrl-secret: %s, filter: %+v, fabrics options: %q, host paths: %v, tls: %t, tls key file: %q",
+		intPtrToString(p.CtrlLossTMO), intPtrToString(p.MaxIOQueues), intPtrToString(p.Kato),
+		p.DhChapSecret, p.DhChapCtrlSecret, p.IOFilter, fabricsOptions, hostPaths, p.TLS, p.TLSKeyFile)
 }
 
+// compare returns true if both entries describe the same discovery endpoint.
+// connect parameters (e.g. CtrlLossTMO, Hostid) and persistence are not part of
+// the identity of an entry and may be updated in place.
 func (e *Entry) compare(other *Entry) bool {
 	if other == nil {
 		return false
 	}
 	if e.Traddr == other.Traddr &&
-		e.Persistent == other.Persistent &&
 		e.Hostnqn == other.Hostnqn &&
 		e.Trsvcid == other.Trsvcid &&
 		e.Transport == other.Transport &&
@@ -89,9 +198,40 @@ func (e *Entry) verify() error {
 	if e.CtrlLossTMO != nil && *e.CtrlLossTMO < -1 {
 		return fmt.Errorf("CtrlLossTMO must be >= -1")
 	}
+	if e.Weight < 0 {
+		return fmt.Errorf("Weight must be >= 0")
+	}
+	if e.MaxIOQueues != nil && *e.MaxIOQueues < 0 {
+		return fmt.Errorf("MaxIOQueues must be >= 0")
+	}
+	if e.Kato != nil && *e.Kato < 0 {
+		return fmt.Errorf("Kato must be >= 0")
+	}
+	if e.DhChapSecret == "" && e.DhChapCtrlSecret != "" {
+		return fmt.Errorf("DhChapSecret is mandatory when using DhChapCtrlSecret")
+	}
+	if !e.TLS && e.TLSKeyFile != "" {
+		return fmt.Errorf("TLS is mandatory when using TLSKeyFile")
+	}
+	if _, err := e.IOFilter.Compile(); err != nil {
+		return fmt.Errorf("invalid IO controllers filter: %w", err)
+	}
+	if e.FabricsOptions != nil {
+		if err := e.FabricsOptions.Verify(); err != nil {
+			return fmt.Errorf("invalid fabrics options: %w", err)
+		}
+	}
 	return nil
 }
 
+// fabricsOptions returns the fabrics options of the entry, setting them if not set.
+func (e *Entry) fabricsOptions() *model.FabricsOptions {
+	if e.FabricsOptions == nil {
+		e.FabricsOptions = &model.FabricsOptions{}
+	}
+	return e.FabricsOptions
+}
+
 func (e *Entry) GetEffectiveHostId() string {
 	if e.EffectiveHostid != "" {
 		return e.EffectiveHostid
@@ -108,6 +248,14 @@ func EntriesToString(entries []*Entry) string {
 	return sb.String()
 }
 
+// missingValueError is returned for a flag that takes a value but ends its line.
+func missingValueError(flag string) *ParserError {
+	return &ParserError{
+		Msg:     "missing value",
+		Details: fmt.Sprintf("%s requires a value", flag),
+	}
+}
+
 func trimStringFromHashtag(s string) string {
 	if idx := strings.Index(s, "#"); idx != -1 {
 		return s[:idx]
@@ -122,8 +270,20 @@ func parse(filename string) ([]*Entry, error) {
 	}
 	defer file.Close()
 
-	splitSpacesAndEqualSign := func(c rune) bool {
-		return unicode.IsSpace(c) || string(c) == "="
+	// flags are separated from their values by spaces or by the first '=', values
+	// may contain '=' (e.g. base64 encoded DH-HMAC-CHAP secrets).
+	splitFields := func(line string) []string {
+		var fields []string
+		for _, field := range strings.FieldsFunc(line, unicode.IsSpace) {
+			if strings.HasPrefix(field, "-") {
+				if flag, value, found := strings.Cut(field, "="); found {
+					fields = append(fields, flag, value)
+					continue
+				}
+			}
+			fields = append(fields, field)
+		}
+		return fields
 	}
 	scanner := bufio.NewScanner(file)
 	var entries []*Entry
@@ -137,15 +297,17 @@ func parse(filename string) ([]*Entry, error) {
 			continue
 		}
 
-		s := strings.FieldsFunc(line, splitSpacesAndEqualSign)
+		s := splitFields(line)
 		for i := 0; i < len(s); i++ {
 			field := strings.TrimSpace(s[i])
 			switch field {
 			case "-a", "--traddr":
-				i++
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
 				value := strings.TrimSpace(s[i])
-				_, err = nvme.AdjustTraddr(value)
-				if err != nil {
+				// hostnames are resolved by the cache, only their syntax is checked here.
+				if isHostname(value) && !validHostname(value) {
 					return nil, &ParserError{
 						Msg:     "bad address",
 						Details: fmt.Sprintf("%s is not a valid hostname or IP address", s[i]),
@@ -154,7 +316,9 @@ func parse(filename string) ([]*Entry, error) {
 				}
 				e.Traddr = value
 			case "-t", "--transport":
-				i++
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
 				value := strings.TrimSpace(s[i])
 				if value != "tcp" {
 					return nil, &ParserError{
@@ -165,7 +329,9 @@ func parse(filename string) ([]*Entry, error) {
 				}
 				e.Transport = value
 			case "-s", "--trsvcid":
-				i++
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
 				value := strings.TrimSpace(s[i])
 				port, err := strconv.ParseInt(value, 10, 32)
 				if err != nil {
@@ -177,18 +343,26 @@ func parse(filename string) ([]*Entry, error) {
 				}
 				e.Trsvcid = int(port)
 			case "-q", "--hostnqn":
-				i++
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
 				e.Hostnqn = strings.TrimSpace(s[i])
 			case "-I", "--hostid":
-				i++
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
 				e.Hostid = strings.TrimSpace(s[i])
 			case "-n", "--subsysnqn":
-				i++
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
 				e.Subsysnqn = strings.TrimSpace(s[i])
 			case "-p", "--persistent":
 				e.Persistent = true
 			case "-l", "--ctrl-loss-tmo":
-				i++
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
 				value := strings.TrimSpace(s[i])
 				ctrlLossTMO, err := strconv.ParseInt(value, 10, 32)
 				if err != nil {
@@ -200,6 +374,139 @@ func parse(filename string) ([]*Entry, error) {
 				}
 				ctrlLossTMOInt := int(ctrlLossTMO)
 				e.CtrlLossTMO = &ctrlLossTMOInt
+			case "-i", "--nr-io-queues", "-k", "--keep-alive-tmo":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				value := strings.TrimSpace(s[i])
+				v, err := strconv.ParseInt(value, 10, 32)
+				if err != nil {
+					return nil, &ParserError{
+						Msg:     fmt.Sprintf("bad %s value", strings.TrimLeft(field, "-")),
+						Details: fmt.Sprintf("%s is not a valid int", s[i]),
+						Err:     err,
+					}
+				}
+				intValue := int(v)
+				if field == "-i" || field == "--nr-io-queues" {
+					e.MaxIOQueues = &intValue
+				} else {
+					e.Kato = &intValue
+				}
+			case "-S", "--dhchap-secret":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				e.DhChapSecret = Secret(strings.TrimSpace(s[i]))
+			case "-C", "--dhchap-ctrl-secret":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				e.DhChapCtrlSecret = Secret(strings.TrimSpace(s[i]))
+			case "--weight":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				value := strings.TrimSpace(s[i])
+				weight, err := strconv.ParseInt(value, 10, 32)
+				if err != nil {
+					return nil, &ParserError{
+						Msg:     "bad weight",
+						Details: fmt.Sprintf("%s is not a valid int", s[i]),
+						Err:     err,
+					}
+				}
+				e.Weight = int(weight)
+			case "--locality":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				e.Locality = strings.TrimSpace(s[i])
+			case "--allow-nqn", "--deny-nqn", "--allow-traddr", "--deny-traddr":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				value := strings.TrimSpace(s[i])
+				if e.IOFilter == nil {
+					e.IOFilter = &model.IOControllersFilter{}
+				}
+				switch field {
+				case "--allow-nqn":
+					e.IOFilter.AllowNQN = append(e.IOFilter.AllowNQN, value)
+				case "--deny-nqn":
+					e.IOFilter.DenyNQN = append(e.IOFilter.DenyNQN, value)
+				case "--allow-traddr":
+					e.IOFilter.AllowTraddr = append(e.IOFilter.AllowTraddr, value)
+				case "--deny-traddr":
+					e.IOFilter.DenyTraddr = append(e.IOFilter.DenyTraddr, value)
+				}
+			case "-W", "--nr-write-queues", "-P", "--nr-poll-queues", "-Q", "--queue-size",
+				"-c", "--reconnect-delay", "--fast_io_fail_tmo", "-T", "--tos":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				value := strings.TrimSpace(s[i])
+				v, err := strconv.ParseInt(value, 10, 32)
+				if err != nil {
+					return nil, &ParserError{
+						Msg:     fmt.Sprintf("bad %s value", strings.TrimLeft(field, "-")),
+						Details: fmt.Sprintf("%s is not a valid int", s[i]),
+						Err:     err,
+					}
+				}
+				intValue := int(v)
+				opts := e.fabricsOptions()
+				switch field {
+				case "-W", "--nr-write-queues":
+					opts.NrWriteQueues = intValue
+				case "-P", "--nr-poll-queues":
+					opts.NrPollQueues = intValue
+				case "-Q", "--queue-size":
+					opts.QueueSize = intValue
+				case "-c", "--reconnect-delay":
+					opts.ReconnectDelay = intValue
+				case "--fast_io_fail_tmo":
+					opts.FastIOFailTMO = &intValue
+				case "-T", "--tos":
+					opts.Tos = &intValue
+				}
+			case "--host-path":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				value := strings.TrimSpace(s[i])
+				hostPath, err := model.ParseHostPath(value)
+				if err != nil {
+					return nil, &ParserError{
+						Msg:     "bad host path",
+						Details: err.Error(),
+						Err:     err,
+					}
+				}
+				if e.HostPaths == nil {
+					e.HostPaths = &model.HostPaths{}
+				}
+				*e.HostPaths = append(*e.HostPaths, hostPath)
+			case "-f", "--host-iface":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				e.fabricsOptions().HostIface = strings.TrimSpace(s[i])
+			case "-g", "--hdr-digest", "--hdr_digest":
+				e.fabricsOptions().HdrDigest = true
+			case "-G", "--data-digest", "--data_digest":
+				e.fabricsOptions().DataDigest = true
+			case "-D", "--duplicate-connect", "--duplicate_connect":
+				e.fabricsOptions().DuplicateConnect = true
+			case "-d", "--disable-sqflow", "--disable_sqflow":
+				e.fabricsOptions().DisableSqflow = true
+			case "--tls":
+				e.TLS = true
+			case "--tls-key-file":
+				if i++; i >= len(s) {
+					return nil, missingValueError(field)
+				}
+				e.TLSKeyFile = strings.TrimSpace(s[i])
 			default:
 				return nil, &ParserError{
 					Msg:     "unknown flag",
@@ -242,10 +549,26 @@ type referrals struct {
 	CreationTime time.Time `json:"creation_time"`
 }
 
+// lastUpdate returns the latest modification time of the directory and the
+// files in it. a file edited in place does not update the directory itself.
 func lastUpdate(path string) (updateTime time.Time, err error) {
 	stat, err := os.Stat(path)
 	if err != nil {
 		return time.Time{}, err
 	}
-	return stat.ModTime(), nil
+	updateTime = stat.ModTime()
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(updateTime) {
+			updateTime = info.ModTime()
+		}
+	}
+	return updateTime, nil
 }
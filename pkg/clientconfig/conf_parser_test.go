@@ -15,10 +15,13 @@
 package clientconfig
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/lightbitslabs/discovery-client/model"
 	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
 	"github.com/stretchr/testify/require"
 )
@@ -87,6 +90,7 @@ func TestDiscoveryConfParser(t *testing.T) {
 		{name: "bad address", filename: "testdata/discovery_k8s_bad_address.conf", err: &ParserError{Msg: "bad address"}},
 		{name: "missing address", filename: "testdata/discovery_k8s_missing_address.conf", err: &ParserError{Msg: "bad address"}},
 		{name: "bad transport", filename: "testdata/discovery_k8s_bad_transport.conf", err: &ParserError{Msg: "bad transport"}},
+		{name: "missing value", filename: "testdata/discovery_k8s_missing_value.conf", err: &ParserError{Msg: "missing value"}},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -111,3 +115,90 @@ func TestDiscoveryConfParser(t *testing.T) {
 		})
 	}
 }
+
+func TestDiscoveryConfParserSelectionParams(t *testing.T) {
+	entries, err := parse("testdata/discovery_selection.conf")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	expected := map[string]struct {
+		weight   int
+		locality string
+	}{
+		"192.168.1.1": {3, "rack1"},
+		"192.168.1.2": {0, "rack2"},
+		"192.168.1.3": {0, ""},
+	}
+	for _, entry := range entries {
+		require.Equal(t, expected[entry.Traddr].weight, entry.Weight, "weight of %s", entry.Traddr)
+		require.Equal(t, expected[entry.Traddr].locality, entry.Locality, "locality of %s", entry.Traddr)
+	}
+}
+
+func TestDiscoveryConfParserHostnames(t *testing.T) {
+	// hostnames that don't resolve when the file is read are resolved later by the cache.
+	entries, err := parse("testdata/discovery_hostnames.conf")
+	require.NoError(t, err)
+	traddrs := []string{}
+	for _, entry := range entries {
+		traddrs = append(traddrs, entry.Traddr)
+	}
+	require.ElementsMatch(t, []string{"discovery.example.invalid", "discovery-1.rack-a.example.invalid."}, traddrs)
+
+	for _, host := range []string{"bad_host", "-host", "host-", "a..b", strings.Repeat("a", 64)} {
+		require.False(t, validHostname(host), host)
+	}
+}
+
+func TestDiscoveryConfParserIOFilter(t *testing.T) {
+	entries, err := parse("testdata/discovery_filter.conf")
+	require.NoError(t, err)
+	require.Len(t, entries, 2, "the entry with an invalid pattern should be skipped")
+	expected := map[string]*model.IOControllersFilter{
+		"192.168.1.1": {
+			AllowNQN:   []string{"*:tenant-a-*", "re:.*:tenant-b-[0-9]+"},
+			DenyTraddr: []string{"10.0.1.*"},
+		},
+		"192.168.1.2": {
+			DenyNQN:     []string{"*:scratch-*"},
+			AllowTraddr: []string{"10.0.0.*"},
+		},
+	}
+	for _, entry := range entries {
+		require.Equal(t, expected[entry.Traddr], entry.IOFilter, "filter of %s", entry.Traddr)
+	}
+}
+
+func TestDiscoveryConfParserConnectParams(t *testing.T) {
+	entries, err := parse("testdata/discovery_connect_params.conf")
+	require.NoError(t, err)
+	require.Len(t, entries, 7, "the entries with a controller secret and no host secret, an invalid queue size or a key file without TLS should be skipped")
+	intPtr := func(v int) *int { return &v }
+	expected := map[string]inheritedParams{
+		"192.168.1.1": {MaxIOQueues: intPtr(4), Kato: intPtr(15), DhChapSecret: "DHHC-1:00:c2VjcmV0MQ==:", DhChapCtrlSecret: "DHHC-1:00:Y3RybHNlY3JldA==:"},
+		"192.168.1.2": {MaxIOQueues: intPtr(2), Kato: intPtr(5), DhChapSecret: "DHHC-1:00:c2VjcmV0MQ==:"},
+		"192.168.1.4": {FabricsOptions: &model.FabricsOptions{
+			NrWriteQueues:    2,
+			NrPollQueues:     1,
+			QueueSize:        256,
+			ReconnectDelay:   5,
+			FastIOFailTMO:    intPtr(0),
+			Tos:              intPtr(0),
+			HdrDigest:        true,
+			DataDigest:       true,
+			DuplicateConnect: true,
+			DisableSqflow:    true,
+			HostIface:        "eth1",
+		}},
+		"192.168.1.6":  {HostPaths: &model.HostPaths{{Iface: "eth1"}, {Traddr: "10.0.1.5"}}},
+		"fe80::1%ens3": {HostPaths: &model.HostPaths{{Traddr: "fe80::5%ens3"}}},
+		"192.168.1.7":  {TLS: true},
+		"192.168.1.8":  {TLS: true, TLSKeyFile: "/etc/discovery-client/tls-keys.subsysnqn1"},
+	}
+	for _, entry := range entries {
+		require.Equal(t, expected[entry.Traddr], entry.inheritedParams(), "connect parameters of %s", entry.Traddr)
+		require.NotContains(t, fmt.Sprintf("%+v", entry), "c2VjcmV0MQ", "secrets should not be printed")
+		request := newConnection(context.Background(), entryKey(entry), entry).GetDiscoveryRequest(0)
+		require.Equal(t, entry.TLS, request.TLS, "TLS of the discovery connection of %s", entry.Traddr)
+		require.Equal(t, entry.TLSKeyFile, request.TLSKeyFile)
+	}
+}
@@ -73,6 +73,8 @@ func inc(ip net.IP) {
 	}
 }
 
+const testHostID = "46f5a7b4-3b3a-4f4c-9a3e-0f3b0c7f4d2a"
+
 func createSysClassNvmeFileTree(t *testing.T, subsysnqn, hostnqn, transport, cidr string, port int, controllers int) string {
 	dir, err := os.MkdirTemp("", "prefix")
 	require.NoError(t, err, "failed creating temp dir")
@@ -89,6 +91,7 @@ func createSysClassNvmeFileTree(t *testing.T, subsysnqn, hostnqn, transport, cid
 		if len(hostnqn) > 0 {
 			require.NoError(t, os.WriteFile(path.Join(nvmeCtrlPath, "hostnqn"), []byte(hostnqn), os.ModePerm), "failed")
 		}
+		require.NoError(t, os.WriteFile(path.Join(nvmeCtrlPath, "hostid"), []byte(testHostID), os.ModePerm), "failed")
 		if len(transport) > 0 {
 			require.NoError(t, os.WriteFile(path.Join(nvmeCtrlPath, "transport"), []byte(transport), os.ModePerm), "failed")
 		}
@@ -171,9 +174,9 @@ func TestDetectEntriesByIOControllers(t *testing.T) {
 			dir:    createSysClassNvmeFileTree(t, goodSubsys, hostnqn, "tcp", "192.168.11.0/24", 8009, 3),
 			dsPort: 8009,
 			expected: []*commonstructs.Entry{
-				{Transport: "tcp", Traddr: "192.168.11.1", Trsvcid: 8009, Hostnqn: hostnqn, Nqn: goodSubsys},
-				{Transport: "tcp", Traddr: "192.168.11.2", Trsvcid: 8009, Hostnqn: hostnqn, Nqn: goodSubsys},
-				{Transport: "tcp", Traddr: "192.168.11.3", Trsvcid: 8009, Hostnqn: hostnqn, Nqn: goodSubsys},
+				{Transport: "tcp", Traddr: "192.168.11.1", Trsvcid: 8009, Hostnqn: hostnqn, Nqn: goodSubsys, HostID: testHostID},
+				{Transport: "tcp", Traddr: "192.168.11.2", Trsvcid: 8009, Hostnqn: hostnqn, Nqn: goodSubsys, HostID: testHostID},
+				{Transport: "tcp", Traddr: "192.168.11.3", Trsvcid: 8009, Hostnqn: hostnqn, Nqn: goodSubsys, HostID: testHostID},
 			},
 		},
 		{
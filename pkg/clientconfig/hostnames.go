@@ -0,0 +1,167 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clientconfig
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+)
+
+// resolveTimeout bounds the resolution of a hostname.
+const resolveTimeout = 10 * time.Second
+
+// isHostname returns true if traddr is a hostname rather than an IP address.
+func isHostname(traddr string) bool {
+	addr, _ := nvme.SplitZone(traddr)
+	return net.ParseIP(addr) == nil
+}
+
+// validHostname returns true if host is a syntactically valid hostname (RFC 1123). the
+// hostnames of the entries are resolved by the cache, a hostname that doesn't resolve yet
+// doesn't make its file invalid.
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resolveFileHostnames resolves the hostnames of the entries of filename that were not
+// resolved yet. it is called without c.mu held, so that the lookups, bounded by
+// resolveTimeout, don't block the cache.
+func (c *cache) resolveFileHostnames(filename string) {
+	entries, err := parse(filename)
+	if err != nil {
+		// reported by fileAdded.
+		return
+	}
+	c.mu.Lock()
+	hosts := map[string]bool{}
+	for _, entry := range entries {
+		if _, ok := c.resolved[entry.Traddr]; !ok && isHostname(entry.Traddr) {
+			hosts[entry.Traddr] = true
+		}
+	}
+	c.mu.Unlock()
+	if len(hosts) == 0 {
+		return
+	}
+	resolved := map[string][]string{}
+	for host := range hosts {
+		resolved[host] = c.resolve(host)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for host, addrs := range resolved {
+		if _, ok := c.resolved[host]; !ok {
+			c.resolved[host] = addrs
+		}
+	}
+}
+
+// resolve returns the sorted A and AAAA addresses of host, none if it can't be resolved.
+func (c *cache) resolve(host string) []string {
+	ctx, cancel := context.WithTimeout(c.ctx, resolveTimeout)
+	defer cancel()
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		c.log.WithError(err).Warnf("failed to resolve %s", host)
+		return nil
+	}
+	sort.Strings(addrs)
+	c.log.Debugf("%s resolved to %v", host, addrs)
+	return addrs
+}
+
+// SetHostnameResolveInterval sets the interval between resolutions of the hostnames of the
+// entries. a non positive interval stops resolving them again.
+func (c *cache) SetHostnameResolveInterval(interval time.Duration) {
+	if interval <= 0 {
+		c.log.Infof("resolving the hostnames of the entries again is disabled")
+		c.resolveTicker.Stop()
+		return
+	}
+	c.log.Infof("resolving the hostnames of the entries every %s", interval)
+	c.resolveTicker.Reset(interval)
+}
+
+// resolveHostnames resolves the hostnames of the entries again, and adds or removes the
+// connections of the addresses that changed. a hostname that fails to resolve keeps its
+// previous addresses.
+func (c *cache) resolveHostnames() {
+	c.mu.Lock()
+	hostnames := map[string][]string{}
+	for _, entry := range c.cacheEntries {
+		if isHostname(entry.Traddr) {
+			hostnames[entry.Traddr] = c.resolved[entry.Traddr]
+		}
+	}
+	// forget the hostnames of the removed entries.
+	c.resolved = hostnames
+	c.mu.Unlock()
+
+	changed := map[string][]string{}
+	for host, previous := range hostnames {
+		addrs := c.resolve(host)
+		if len(addrs) == 0 && len(previous) > 0 {
+			continue
+		}
+		if !reflect.DeepEqual(addrs, previous) {
+			c.log.Infof("addresses of %s changed: %v => %v", host, previous, addrs)
+			changed[host] = addrs
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	pairsSet := map[ClientClusterPair]bool{}
+	for host, addrs := range changed {
+		c.resolved[host] = addrs
+	}
+	for _, entry := range c.cacheEntries {
+		if _, ok := changed[entry.Traddr]; ok {
+			pairsSet[ClientClusterPair{ClusterNqn: entry.Subsysnqn, HostNqn: entry.Hostnqn}] = true
+		}
+	}
+	pairs := []ClientClusterPair{}
+	for pair := range pairsSet {
+		if c.syncConnections(pair) {
+			pairs = append(pairs, pair)
+		}
+	}
+	c.mu.Unlock()
+	if len(pairs) > 0 {
+		c.notifyChange(pairs)
+	}
+}
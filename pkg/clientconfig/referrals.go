@@ -0,0 +1,158 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clientconfig
+
+import (
+	"fmt"
+)
+
+// ReferralOrigin is the discovery endpoint whose log page reported a referral.
+type ReferralOrigin struct {
+	// Subsysnqn of the connection group of the endpoint.
+	Subsysnqn string
+	Hostnqn   string `json:"-"`
+	Traddr    string
+	Trsvcid   int
+	// Depth is the number of referrals to other connection groups followed from the
+	// user entries to the referral.
+	Depth int `json:",omitempty"`
+}
+
+func (o *ReferralOrigin) pair() ClientClusterPair {
+	return ClientClusterPair{ClusterNqn: o.Subsysnqn, HostNqn: o.Hostnqn}
+}
+
+// ReferralOrigin returns the origin of the referrals reported by the endpoint of the connection.
+func (c *Connection) ReferralOrigin() ReferralOrigin {
+	return ReferralOrigin{Subsysnqn: c.Key.Nqn, Hostnqn: c.Hostnqn, Traddr: c.Key.Ip, Trsvcid: c.Key.port}
+}
+
+func entryPair(entry *Entry) ClientClusterPair {
+	return ClientClusterPair{ClusterNqn: entry.Subsysnqn, HostNqn: entry.Hostnqn}
+}
+
+// managerPair returns the connection group whose log pages add and remove entry: the
+// group that referred it, or its own group for user entries and the referrals between the
+// endpoints of a group.
+func managerPair(entry *Entry) ClientClusterPair {
+	if entry.Origin == nil {
+		return entryPair(entry)
+	}
+	return ClientClusterPair{ClusterNqn: entry.Origin.Subsysnqn, HostNqn: entry.Hostnqn}
+}
+
+// inheritedParamsEntry returns the entry of pair whose parameters the new referrals of pair
+// inherit: a user entry, or a referral of a group reached through referrals.
+func (c *cache) inheritedParamsEntry(pair ClientClusterPair) *Entry {
+	var referral *Entry
+	for _, entry := range c.entriesOfPair(pair) {
+		if entry.EntrySource == EntrySourceUser {
+			return entry
+		}
+		if referral == nil && entry.EntrySource == EntrySourceReferral && entry.Origin != nil && entry.Origin.Subsysnqn != pair.ClusterNqn {
+			referral = entry
+		}
+	}
+	return referral
+}
+
+// SetMaxReferralDepth sets the number of referrals to other connection groups followed
+// from the user entries. 0 doesn't follow referrals to other groups.
+func (c *cache) SetMaxReferralDepth(depth int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxReferralDepth = depth
+}
+
+// groupDepth returns the number of referrals to other groups followed to reach pair.
+func (c *cache) groupDepth(pair ClientClusterPair) int {
+	depth := -1
+	for _, entry := range c.entriesOfPair(pair) {
+		entryDepth := 0
+		if entry.Origin != nil {
+			entryDepth = entry.Origin.Depth
+		}
+		if depth == -1 || entryDepth < depth {
+			depth = entryDepth
+		}
+	}
+	if depth == -1 {
+		return 0
+	}
+	return depth
+}
+
+// ancestors returns the groups whose referrals were followed to reach pair.
+func (c *cache) ancestors(pair ClientClusterPair) map[ClientClusterPair]bool {
+	ancestors := map[ClientClusterPair]bool{}
+	pending := []ClientClusterPair{pair}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		for _, entry := range c.entriesOfPair(current) {
+			parent := managerPair(entry)
+			if parent == current || ancestors[parent] {
+				continue
+			}
+			ancestors[parent] = true
+			pending = append(pending, parent)
+		}
+	}
+	return ancestors
+}
+
+// followReferrals returns an error if the referrals of from to the group to must not be
+// followed: to is beyond the maximum depth, one of the groups from was referred by (a
+// loop), or a group that is configured by the user or referred by another group.
+func (c *cache) followReferrals(from, to ClientClusterPair, depth int) error {
+	if depth > c.maxReferralDepth {
+		return fmt.Errorf("referral depth %d exceeds the maximum of %d", depth, c.maxReferralDepth)
+	}
+	if c.ancestors(from)[to] {
+		return fmt.Errorf("referral loop: %s was followed to reach %s", to.ClusterNqn, from.ClusterNqn)
+	}
+	for _, entry := range c.entriesOfPair(to) {
+		if manager := managerPair(entry); manager != from && manager != to {
+			return fmt.Errorf("%s is reached through %s", to.ClusterNqn, manager.ClusterNqn)
+		}
+		if entry.Origin == nil {
+			return fmt.Errorf("%s is configured by the user", to.ClusterNqn)
+		}
+	}
+	return nil
+}
+
+// dropOrphanReferrals removes the entries referred by groups that no longer exist, and so
+// on down the referral chains. returns the groups that changed.
+func (c *cache) dropOrphanReferrals() map[ClientClusterPair]bool {
+	pairsSet := map[ClientClusterPair]bool{}
+	for dropped := true; dropped; {
+		dropped = false
+		for _, entry := range c.cacheEntries {
+			manager := managerPair(entry)
+			if manager == entryPair(entry) || len(c.entriesOfPair(manager)) > 0 {
+				continue
+			}
+			c.log.Infof("removing entry %+v referred by removed group %s", entry, manager.ClusterNqn)
+			if pair, err := c.deleteEntry(entry); err == nil {
+				pairsSet[pair] = true
+			}
+			dropped = true
+			// cacheEntries changed under the loop.
+			break
+		}
+	}
+	return pairsSet
+}
@@ -19,10 +19,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
 	"github.com/lightbitslabs/discovery-client/pkg/testutils"
 	"github.com/stretchr/testify/require"
 )
@@ -160,6 +163,8 @@ func TestCache(t *testing.T) {
 			}
 			// verify that exactly the expected entries are exist.
 			cacheImpl := cacheInt.(*cache)
+			cacheImpl.mu.Lock()
+			defer cacheImpl.mu.Unlock()
 			entriesEqual(t, tc.entries, cacheImpl.cacheEntries)
 		})
 	}
@@ -178,3 +183,378 @@ func entriesEqual(t *testing.T, expected, actual []*Entry) {
 		require.True(t, found, fmt.Sprintf("failed to find %+v in found entries: %s", expectedEntry, EntriesToString(actual)))
 	}
 }
+
+func TestCacheFileRemoved(t *testing.T) {
+	hostnqn := "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431"
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cacheInt := NewCache(ctx, userDir, internalDir, nil)
+	defer cacheInt.Stop()
+	cacheInt.Run(false)
+	cacheImpl := cacheInt.(*cache)
+
+	file1 := filepath.Join(userDir, "vol1.conf")
+	testutils.CreateFile(t, file1, `
+	-t tcp -a 192.168.1.1 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1
+	-t tcp -a 192.168.1.2 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1`)
+	<-cacheInt.Connections()
+	file2 := filepath.Join(userDir, "vol2.conf")
+	testutils.CreateFile(t, file2, `
+	-t tcp -a 192.168.1.2 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1`)
+	// the entry in vol2.conf is already cached, no notification expected.
+	time.Sleep(500 * time.Millisecond)
+
+	// a referral derived entry of the same cluster
+	refKey := ReferralKey{Transport: "tcp", Ip: "192.168.1.3", Port: 8009, DPSubNqn: "subsysnqn1", Hostnqn: hostnqn}
+	cacheImpl.mu.Lock()
+	_, err := cacheImpl.addEntry(getEntryFromReferral(refKey, &hostapi.NvmeDiscPageEntry{Traddr: refKey.Ip, TrsvcID: refKey.Port}))
+	require.NoError(t, err)
+	require.Len(t, cacheImpl.cacheEntries, 3)
+	cacheImpl.mu.Unlock()
+
+	testutils.DeleteFile(t, file1)
+	changed := <-cacheInt.Connections()
+	pair := ClientClusterPair{ClusterNqn: "subsysnqn1", HostNqn: hostnqn}
+	require.Len(t, changed[pair].ClusterConnectionsMap, 2, "entry shared with vol2.conf and referral should remain")
+	cacheImpl.mu.Lock()
+	entriesEqual(t, []*Entry{
+		{Traddr: "192.168.1.2", Trsvcid: 8009, Transport: "tcp", Hostnqn: hostnqn, Persistent: true, Subsysnqn: "subsysnqn1"},
+		{Traddr: "192.168.1.3", Trsvcid: 8009, Transport: "tcp", Hostnqn: hostnqn, Persistent: true, Subsysnqn: "subsysnqn1"},
+	}, cacheImpl.cacheEntries)
+	cacheImpl.mu.Unlock()
+
+	testutils.DeleteFile(t, file2)
+	changed = <-cacheInt.Connections()
+	clusterConnections, ok := changed[pair]
+	require.True(t, ok, "removed cluster should be notified")
+	require.Empty(t, clusterConnections.ClusterConnectionsMap)
+	cacheImpl.mu.Lock()
+	defer cacheImpl.mu.Unlock()
+	require.Empty(t, cacheImpl.cacheEntries, "referral entries of removed cluster should be removed")
+	_, ok = cacheImpl.connections[pair]
+	require.False(t, ok)
+}
+
+func TestCacheFileModified(t *testing.T) {
+	hostnqn := "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431"
+	hostid := "46f5a7b4-3b3a-4f4c-9a3e-0f3b0c7f4d2a"
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cacheInt := NewCache(ctx, userDir, internalDir, nil)
+	defer cacheInt.Stop()
+	cacheInt.Run(false)
+	cacheImpl := cacheInt.(*cache)
+
+	file1 := filepath.Join(userDir, "vol1.conf")
+	testutils.CreateFile(t, file1, `
+	-t tcp -a 192.168.1.1 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 -l 10
+	-t tcp -a 192.168.1.2 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 -l 10`)
+	<-cacheInt.Connections()
+	pair := ClientClusterPair{ClusterNqn: "subsysnqn1", HostNqn: hostnqn}
+
+	// edit the attributes of an existing entry in place
+	testutils.CreateFile(t, file1, `
+	-t tcp -a 192.168.1.1 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 -l 20 -I `+hostid+`
+	-t tcp -a 192.168.1.2 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 -l 10`)
+	time.Sleep(500 * time.Millisecond)
+	cacheImpl.mu.Lock()
+	require.Len(t, cacheImpl.cacheEntries, 2)
+	entry := cacheImpl.findEntry(&Entry{Traddr: "192.168.1.1", Trsvcid: 8009, Transport: "tcp", Hostnqn: hostnqn, Subsysnqn: "subsysnqn1"}, cacheImpl.cacheEntries)
+	require.NotNil(t, entry)
+	require.NotNil(t, entry.CtrlLossTMO)
+	require.Equal(t, 20, *entry.CtrlLossTMO)
+	require.Equal(t, hostid, entry.Hostid)
+	conn := cacheImpl.connections[pair].ClusterConnectionsMap[entryKey(entry)]
+	require.NotNil(t, conn)
+	require.Equal(t, 20, *conn.GetCtrlLossTMO())
+	require.Equal(t, hostid, conn.GetHostid())
+	cacheImpl.mu.Unlock()
+
+	// drop an entry from the file
+	testutils.CreateFile(t, file1, `
+	-t tcp -a 192.168.1.1 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 -l 20 -I `+hostid)
+	changed := <-cacheInt.Connections()
+	require.Len(t, changed[pair].ClusterConnectionsMap, 1)
+	cacheImpl.mu.Lock()
+	defer cacheImpl.mu.Unlock()
+	require.Len(t, cacheImpl.cacheEntries, 1)
+}
+
+func TestCacheReferralsInheritConnectParams(t *testing.T) {
+	hostnqn := "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431"
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cacheInt := NewCache(ctx, userDir, internalDir, nil)
+	defer cacheInt.Stop()
+	cacheInt.Run(false)
+	cacheImpl := cacheInt.(*cache)
+
+	file1 := filepath.Join(userDir, "vol1.conf")
+	testutils.CreateFile(t, file1, `
+	-t tcp -a 192.168.1.1 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 -l 30 -i 4 -k 15 --dhchap-secret=DHHC-1:00:c2VjcmV0MQ==:`)
+	<-cacheInt.Connections()
+	pair := ClientClusterPair{ClusterNqn: "subsysnqn1", HostNqn: hostnqn}
+
+	origin := ReferralOrigin{Subsysnqn: "subsysnqn1", Hostnqn: hostnqn, Traddr: "192.168.1.1", Trsvcid: 8009}
+	referrals := ReferralMap{}
+	for _, traddr := range []string{"192.168.1.1", "192.168.1.2"} {
+		referrals[ReferralKey{Transport: "tcp", Ip: traddr, Port: 8009, DPSubNqn: "subsysnqn1", Hostnqn: hostnqn}] =
+			&hostapi.NvmeDiscPageEntry{Traddr: traddr, TrsvcID: 8009, Subnqn: "subsysnqn1"}
+	}
+	require.NoError(t, cacheInt.HandleReferrals(origin, referrals))
+	<-cacheInt.Connections()
+
+	referralParams := func() IOConnectParams {
+		cacheImpl.mu.Lock()
+		defer cacheImpl.mu.Unlock()
+		entry := cacheImpl.findEntry(&Entry{Traddr: "192.168.1.2", Trsvcid: 8009, Transport: "tcp", Hostnqn: hostnqn, Subsysnqn: "subsysnqn1"}, cacheImpl.cacheEntries)
+		require.NotNil(t, entry)
+		require.Equal(t, EntrySourceReferral, entry.EntrySource)
+		conn := cacheImpl.connections[pair].ClusterConnectionsMap[entryKey(entry)]
+		require.NotNil(t, conn)
+		return conn.GetIOConnectParams()
+	}
+	params := referralParams()
+	require.Equal(t, 30, *params.CtrlLossTMO)
+	require.Equal(t, 4, *params.MaxIOQueues)
+	require.Equal(t, 15, *params.Kato)
+	require.Equal(t, "DHHC-1:00:c2VjcmV0MQ==:", params.DhChapSecret)
+
+	// referrals follow the changes of the user entry
+	testutils.CreateFile(t, file1, `
+	-t tcp -a 192.168.1.1 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 -l 30 -i 8 -k 15 --dhchap-secret=DHHC-1:00:c2VjcmV0MQ==:`)
+	require.Eventually(t, func() bool {
+		return *referralParams().MaxIOQueues == 8
+	}, 2*time.Second, 100*time.Millisecond)
+}
+
+func TestCacheSecretsNotStored(t *testing.T) {
+	hostnqn := "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431"
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	cacheInt := NewCache(ctx, userDir, internalDir, nil)
+	cacheInt.Run(false)
+
+	testutils.CreateFile(t, filepath.Join(userDir, "vol1.conf"), `
+	-t tcp -a 192.168.1.1 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 --dhchap-secret=DHHC-1:00:c2VjcmV0MQ==: --dhchap-ctrl-secret=DHHC-1:00:Y3RybHNlY3JldA==:`)
+	<-cacheInt.Connections()
+	origin := ReferralOrigin{Subsysnqn: "subsysnqn1", Hostnqn: hostnqn, Traddr: "192.168.1.1", Trsvcid: 8009}
+	referrals := ReferralMap{}
+	for _, traddr := range []string{"192.168.1.1", "192.168.1.2"} {
+		referrals[ReferralKey{Transport: "tcp", Ip: traddr, Port: 8009, DPSubNqn: "subsysnqn1", Hostnqn: hostnqn}] =
+			&hostapi.NvmeDiscPageEntry{Traddr: traddr, TrsvcID: 8009, Subnqn: "subsysnqn1"}
+	}
+	require.NoError(t, cacheInt.HandleReferrals(origin, referrals))
+	<-cacheInt.Connections()
+	cacheInt.Stop()
+	cancel()
+
+	content, err := os.ReadFile(filepath.Join(internalDir, InternalJson))
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "c2VjcmV0MQ==")
+	require.NotContains(t, string(content), "Y3RybHNlY3JldA==")
+
+	// a restart loads the entries of the internal json, with the secrets of the user file.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	cacheInt = NewCache(ctx, userDir, internalDir, nil)
+	defer cacheInt.Stop()
+	cacheInt.Run(true)
+	connections := <-cacheInt.Connections()
+	clusterConnections := connections[ClientClusterPair{ClusterNqn: "subsysnqn1", HostNqn: hostnqn}]
+	require.Len(t, clusterConnections.ClusterConnectionsMap, 2)
+	for _, conn := range clusterConnections.ClusterConnectionsMap {
+		params := conn.GetIOConnectParams()
+		require.Equal(t, "DHHC-1:00:c2VjcmV0MQ==:", params.DhChapSecret, conn.Key.Ip)
+		require.Equal(t, "DHHC-1:00:Y3RybHNlY3JldA==:", params.DhChapCtrlSecret, conn.Key.Ip)
+	}
+}
+
+func TestCacheReferralsToOtherGroups(t *testing.T) {
+	hostnqn := "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431"
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cacheInt := NewCache(ctx, userDir, internalDir, nil)
+	defer cacheInt.Stop()
+	cacheInt.Run(false)
+	cacheImpl := cacheInt.(*cache)
+
+	file1 := filepath.Join(userDir, "vol1.conf")
+	testutils.CreateFile(t, file1, `
+	-t tcp -a 192.168.1.1 -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1 -l 30`)
+	<-cacheInt.Connections()
+	pair1 := ClientClusterPair{ClusterNqn: "subsysnqn1", HostNqn: hostnqn}
+	pair2 := ClientClusterPair{ClusterNqn: "subsysnqn2", HostNqn: hostnqn}
+
+	referral := func(traddr, nqn string) (ReferralKey, *hostapi.NvmeDiscPageEntry) {
+		return ReferralKey{Transport: "tcp", Ip: traddr, Port: 8009, DPSubNqn: nqn, Hostnqn: hostnqn},
+			&hostapi.NvmeDiscPageEntry{Traddr: traddr, TrsvcID: 8009, Subnqn: nqn}
+	}
+	referrals := func(refs ...[2]string) ReferralMap {
+		referrals := ReferralMap{}
+		for _, ref := range refs {
+			key, entry := referral(ref[0], ref[1])
+			referrals[key] = entry
+		}
+		return referrals
+	}
+	entriesOfPair := func(pair ClientClusterPair) []*Entry {
+		cacheImpl.mu.Lock()
+		defer cacheImpl.mu.Unlock()
+		return cacheImpl.entriesOfPair(pair)
+	}
+
+	// the referral to another discovery subsystem creates a group of its own.
+	origin1 := ReferralOrigin{Subsysnqn: "subsysnqn1", Hostnqn: hostnqn, Traddr: "192.168.1.1", Trsvcid: 8009}
+	require.NoError(t, cacheInt.HandleReferrals(origin1, referrals(
+		[2]string{"192.168.1.1", "subsysnqn1"}, [2]string{"10.0.0.1", "subsysnqn2"})))
+	changed := <-cacheInt.Connections()
+	require.Len(t, changed[pair2].ClusterConnectionsMap, 1)
+	entries := entriesOfPair(pair2)
+	require.Len(t, entries, 1)
+	require.NotNil(t, entries[0].Origin)
+	require.Equal(t, "subsysnqn1", entries[0].Origin.Subsysnqn)
+	require.Equal(t, 1, entries[0].Origin.Depth)
+	require.Equal(t, 30, *entries[0].CtrlLossTMO)
+
+	// the referrals of the new group back to the group it was reached from, or beyond the
+	// maximum depth, are not followed.
+	cacheInt.SetMaxReferralDepth(1)
+	origin2 := ReferralOrigin{Subsysnqn: "subsysnqn2", Hostnqn: hostnqn, Traddr: "10.0.0.1", Trsvcid: 8009}
+	require.NoError(t, cacheInt.HandleReferrals(origin2, referrals(
+		[2]string{"10.0.0.1", "subsysnqn2"}, [2]string{"192.168.1.2", "subsysnqn1"}, [2]string{"10.0.1.1", "subsysnqn3"})))
+	require.Len(t, entriesOfPair(pair1), 1)
+	require.Len(t, entriesOfPair(pair2), 1)
+	require.Empty(t, entriesOfPair(ClientClusterPair{ClusterNqn: "subsysnqn3", HostNqn: hostnqn}))
+
+	// the group is removed once the group that referred it no longer does.
+	require.NoError(t, cacheInt.HandleReferrals(origin1, referrals([2]string{"192.168.1.1", "subsysnqn1"})))
+	changed = <-cacheInt.Connections()
+	require.Empty(t, changed[pair2].ClusterConnectionsMap)
+	require.Empty(t, entriesOfPair(pair2))
+	require.Len(t, entriesOfPair(pair1), 1)
+}
+
+func TestCacheHostnameResolution(t *testing.T) {
+	hostnqn := "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431"
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cacheInt := NewCache(ctx, userDir, internalDir, nil)
+	defer cacheInt.Stop()
+	cacheImpl := cacheInt.(*cache)
+	var mu sync.Mutex
+	addrs := []string{"192.168.1.2", "192.168.1.1"}
+	cacheImpl.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, addrs...), nil
+	}
+	cacheInt.Run(false)
+
+	file1 := filepath.Join(userDir, "vol1.conf")
+	testutils.CreateFile(t, file1, `
+	-t tcp -a localhost -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1`)
+	changed := <-cacheInt.Connections()
+	pair := ClientClusterPair{ClusterNqn: "subsysnqn1", HostNqn: hostnqn}
+	connectionAddresses := func(clusterConnections ClusterConnections) []string {
+		addresses := []string{}
+		for _, conn := range clusterConnections.ClusterConnectionsMap {
+			require.Equal(t, "localhost", conn.Hostname)
+			addresses = append(addresses, conn.Address())
+		}
+		sort.Strings(addresses)
+		return addresses
+	}
+	require.Equal(t, []string{"localhost (192.168.1.1)", "localhost (192.168.1.2)"}, connectionAddresses(changed[pair]))
+
+	// the referrals don't remove the hostname entry, and share its connections.
+	origin := ReferralOrigin{Subsysnqn: "subsysnqn1", Hostnqn: hostnqn, Traddr: "192.168.1.1", Trsvcid: 8009}
+	referrals := ReferralMap{}
+	for _, traddr := range []string{"192.168.1.2", "192.168.1.3"} {
+		referrals[ReferralKey{Transport: "tcp", Ip: traddr, Port: 8009, DPSubNqn: "subsysnqn1", Hostnqn: hostnqn}] =
+			&hostapi.NvmeDiscPageEntry{Traddr: traddr, TrsvcID: 8009, Subnqn: "subsysnqn1"}
+	}
+	require.NoError(t, cacheInt.HandleReferrals(origin, referrals))
+	changed = <-cacheInt.Connections()
+	require.Len(t, changed[pair].ClusterConnectionsMap, 3)
+
+	mu.Lock()
+	addrs = []string{"192.168.1.4"}
+	mu.Unlock()
+	go cacheImpl.resolveHostnames()
+	changed = <-cacheInt.Connections()
+	addresses := []string{}
+	for key := range changed[pair].ClusterConnectionsMap {
+		addresses = append(addresses, key.Ip)
+	}
+	sort.Strings(addresses)
+	require.Equal(t, []string{"192.168.1.2", "192.168.1.3", "192.168.1.4"}, addresses,
+		"192.168.1.1 is gone from the DNS records, 192.168.1.2 is still a referral")
+}
+
+func TestCacheHostnameResolvedLater(t *testing.T) {
+	hostnqn := "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431"
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cacheInt := NewCache(ctx, userDir, internalDir, nil)
+	defer cacheInt.Stop()
+	cacheImpl := cacheInt.(*cache)
+	var mu sync.Mutex
+	var addrs []string
+	cacheImpl.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return append([]string{}, addrs...), nil
+	}
+	cacheInt.Run(false)
+
+	// the entry of a hostname that doesn't resolve yet is kept, with no connection.
+	testutils.CreateFile(t, filepath.Join(userDir, "vol1.conf"), `
+	-t tcp -a discovery.example.com -s 8009 -q nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431 -n subsysnqn1`)
+	require.Eventually(t, func() bool {
+		cacheImpl.mu.Lock()
+		defer cacheImpl.mu.Unlock()
+		return len(cacheImpl.cacheEntries) == 1
+	}, 2*time.Second, 50*time.Millisecond)
+
+	mu.Lock()
+	addrs = []string{"192.168.1.1"}
+	mu.Unlock()
+	go cacheImpl.resolveHostnames()
+	changed := <-cacheInt.Connections()
+	clusterConnections := changed[ClientClusterPair{ClusterNqn: "subsysnqn1", HostNqn: hostnqn}]
+	require.Len(t, clusterConnections.ClusterConnectionsMap, 1)
+	for key := range clusterConnections.ClusterConnectionsMap {
+		require.Equal(t, "192.168.1.1", key.Ip)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dhchapkeys holds the DH-HMAC-CHAP secrets of the key files of a directory, one
+// file per cluster or per host, named after the subsysnqn of the cluster or the hostnqn.
+package dhchapkeys
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
+)
+
+// Secrets are the secrets of a key file: the host secret and the optional controller secret.
+type Secrets struct {
+	Secret     string
+	CtrlSecret string
+}
+
+// Store is the secrets of the key files of a directory, by file name.
+type Store struct {
+	dir     string
+	log     *logrus.Entry
+	mu      sync.RWMutex
+	secrets map[string]Secrets
+}
+
+// NewStore returns the store of the key files of dir. the files are read by Load.
+func NewStore(dir string) *Store {
+	return &Store{
+		dir:     dir,
+		log:     logrus.WithField("dhchap-key-dir", dir),
+		secrets: map[string]Secrets{},
+	}
+}
+
+// Lookup returns the secrets of hostnqn with the cluster clusterNqn: those of the file of
+// the cluster, otherwise those of the file of the host.
+func (s *Store) Lookup(hostnqn, clusterNqn string) (Secrets, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if secrets, ok := s.secrets[clusterNqn]; ok {
+		return secrets, true
+	}
+	secrets, ok := s.secrets[hostnqn]
+	return secrets, ok
+}
+
+// Load reads the key files again and returns the names of the files whose secrets changed,
+// were added or were removed. a file that can't be used is logged and keeps its previous
+// secrets, so a file that is being rewritten doesn't drop them.
+func (s *Store) Load() []string {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil && !os.IsNotExist(err) {
+		s.log.WithError(err).Errorf("failed to read DH-CHAP key dir")
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets := map[string]Secrets{}
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		// editors and tools that rewrite a file through a temporary one use hidden names.
+		if dirEntry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		fileSecrets, err := readKeyFile(filepath.Join(s.dir, name))
+		if err != nil {
+			s.log.WithError(err).Errorf("ignoring DH-CHAP key file %s", name)
+			if previous, ok := s.secrets[name]; ok {
+				secrets[name] = previous
+			}
+			continue
+		}
+		secrets[name] = fileSecrets
+	}
+	var changed []string
+	for name, fileSecrets := range secrets {
+		if previous, ok := s.secrets[name]; !ok || previous != fileSecrets {
+			changed = append(changed, name)
+		}
+	}
+	for name := range s.secrets {
+		if _, ok := secrets[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	s.secrets = secrets
+	return changed
+}
+
+// Watch loads the key files on every change of the directory, and sends the names of the
+// files whose secrets changed on the returned channel.
+func (s *Store) Watch(ctx context.Context) (<-chan []string, error) {
+	var fw clientconfig.FileWatcher
+	events, err := fw.Watch(ctx, s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []string)
+	go func() {
+		for {
+			select {
+			case event := <-events:
+				s.log.Debugf("DH-CHAP key file %s: %s", filepath.Base(event.Name), event.Op)
+				changed := s.Load()
+				if len(changed) == 0 {
+					continue
+				}
+				select {
+				case ch <- changed:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// readKeyFile returns the secrets of the key file at path: a single "<secret> [<ctrl secret>]"
+// line, empty lines and lines starting with # are ignored. the file must only be accessible
+// by the user of the service.
+func readKeyFile(path string) (Secrets, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Secrets{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return Secrets{}, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return Secrets{}, fmt.Errorf("key file is accessible by other users (mode %s)", info.Mode().Perm())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return Secrets{}, fmt.Errorf("key file is owned by uid %d", stat.Uid)
+	}
+
+	var fields []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields != nil {
+			return Secrets{}, fmt.Errorf("expected a single <secret> [<ctrl secret>] line")
+		}
+		fields = strings.Fields(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return Secrets{}, err
+	}
+	if len(fields) == 0 || len(fields) > 2 {
+		return Secrets{}, fmt.Errorf("expected a single <secret> [<ctrl secret>] line")
+	}
+	for _, field := range fields {
+		if _, err := nvmeauth.ParseSecret(field); err != nil {
+			return Secrets{}, err
+		}
+	}
+	secrets := Secrets{Secret: fields[0]}
+	if len(fields) == 2 {
+		secrets.CtrlSecret = fields[1]
+	}
+	return secrets, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhchapkeys
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
+)
+
+const (
+	hostnqn    = "nqn.2014-08.org.nvmexpress:uuid:host"
+	clusterNqn = "nqn.2016-01.com.lightbitslabs:uuid:cluster"
+)
+
+func secret(b byte) string {
+	return (&nvmeauth.Secret{Key: bytes.Repeat([]byte{b}, 32)}).String()
+}
+
+func writeKeyFile(t *testing.T, dir, name, content string, mode os.FileMode) {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), mode))
+	require.NoError(t, os.Chmod(path, mode))
+}
+
+func TestStoreLoad(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(dir)
+	require.Empty(t, store.Load())
+	_, ok := store.Lookup(hostnqn, clusterNqn)
+	require.False(t, ok)
+
+	writeKeyFile(t, dir, hostnqn, "# host secret\n"+secret(1)+"\n", 0600)
+	require.Equal(t, []string{hostnqn}, store.Load())
+	secrets, ok := store.Lookup(hostnqn, clusterNqn)
+	require.True(t, ok)
+	require.Equal(t, Secrets{Secret: secret(1)}, secrets)
+	require.Empty(t, store.Load(), "unchanged files are not reported")
+
+	// the file of the cluster takes precedence over the file of the host
+	writeKeyFile(t, dir, clusterNqn, secret(2)+" "+secret(3)+"\n", 0400)
+	require.Equal(t, []string{clusterNqn}, store.Load())
+	secrets, _ = store.Lookup(hostnqn, clusterNqn)
+	require.Equal(t, Secrets{Secret: secret(2), CtrlSecret: secret(3)}, secrets)
+	secrets, _ = store.Lookup(hostnqn, "nqn.2016-01.com.lightbitslabs:uuid:other")
+	require.Equal(t, Secrets{Secret: secret(1)}, secrets)
+
+	// an unusable file keeps its previous secrets
+	for _, content := range []string{"", "DHHC-1:00:c2VjcmV0MQ==:\n", secret(4) + "\n" + secret(5) + "\n"} {
+		writeKeyFile(t, dir, clusterNqn, content, 0600)
+		require.Empty(t, store.Load(), content)
+	}
+	writeKeyFile(t, dir, clusterNqn, secret(4)+"\n", 0644)
+	require.Empty(t, store.Load(), "files accessible by other users are ignored")
+	secrets, _ = store.Lookup(hostnqn, clusterNqn)
+	require.Equal(t, Secrets{Secret: secret(2), CtrlSecret: secret(3)}, secrets)
+
+	writeKeyFile(t, dir, ".tmp", secret(4)+"\n", 0600)
+	require.NoError(t, os.Remove(filepath.Join(dir, clusterNqn)))
+	require.Equal(t, []string{clusterNqn}, store.Load())
+	secrets, _ = store.Lookup(hostnqn, clusterNqn)
+	require.Equal(t, Secrets{Secret: secret(1)}, secrets)
+}
+
+func TestStoreWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	store := NewStore(dir)
+	store.Load()
+	ch, err := store.Watch(ctx)
+	require.NoError(t, err)
+
+	writeKeyFile(t, dir, hostnqn, secret(1)+"\n", 0600)
+	select {
+	case changed := <-ch:
+		require.Equal(t, []string{hostnqn}, changed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("key file change was not reported")
+	}
+	secrets, ok := store.Lookup(hostnqn, clusterNqn)
+	require.True(t, ok)
+	require.Equal(t, secret(1), secrets.Secret)
+}
@@ -36,6 +36,17 @@ type DiscoverRequest struct {
 	Kato      time.Duration //keep alive timeout. 0 value signifies request for non persistant connection
 	AENChan   chan AENStruct
 	Hostid    string
+	// HdrDigest and DataDigest enable the header and the data digests of the connection.
+	HdrDigest  bool
+	DataDigest bool
+	// TLS secures the connection with TLS 1.3. the userspace discovery takes the PSK of the host
+	// and the discovery subsystem from TLSKeyFile, the kernel from its keyring.
+	TLS        bool
+	TLSKeyFile string
+	// DhChapSecret and DhChapCtrlSecret authenticate the host and the discovery controller with
+	// DH-HMAC-CHAP, in the DHHC-1 format.
+	DhChapSecret     string
+	DhChapCtrlSecret string
 }
 
 // NvmeDiscPageEntry struct represent discovery log page that will be returned from discover method
@@ -46,6 +57,21 @@ type NvmeDiscPageEntry struct {
 	Subnqn  string             `json:"subnqn"`
 	Traddr  string             `json:"traddr"`
 	SubType nvme.SubsystemType `json:"subtype"`
+	// Eflags of the entry, see nvme.NVMF_DISC_EFLAGS_DUPRETINFO and its siblings.
+	Eflags uint16 `json:"eflags,omitempty"`
+	// Transport of the entry, empty if unknown.
+	Transport string `json:"trtype,omitempty"`
+}
+
+// LogPage is the discovery log page returned by a discover command.
+type LogPage struct {
+	// GenCtr is the generation counter of the log page. the discovery controller
+	// increments it every time the content of the log page changes.
+	GenCtr  uint64
+	Entries []*NvmeDiscPageEntry
+	// Identify is the Identify Controller data of the discovery controller the log page
+	// was read from, nil if it was not identified.
+	Identify *nvme.IdentifyController
 }
 
 type AENStruct struct {
@@ -56,7 +82,7 @@ type AENStruct struct {
 type ConnectionID string
 
 type HostAPI interface {
-	Discover(discoveryRequest *DiscoverRequest) ([]*NvmeDiscPageEntry, ConnectionID, error)
+	Discover(discoveryRequest *DiscoverRequest) (*LogPage, ConnectionID, error)
 	Disconnect(connectionID ConnectionID) error
 }
 
@@ -80,11 +106,29 @@ func (c *DiscoverRequest) ToOptions() string {
 	if len(c.Hostaddr) > 0 {
 		sb.WriteString(fmt.Sprintf(",host_traddr=%s", c.Hostaddr))
 	}
+	if iface := nvme.ZoneInterface(c.Traddr); iface != "" {
+		sb.WriteString(fmt.Sprintf(",host_iface=%s", iface))
+	}
 	if c.Kato > 0 {
 		sb.WriteString(fmt.Sprintf(",keep_alive_tmo=%d", c.Kato))
 	}
 	if len(c.Hostid) > 0 {
 		sb.WriteString(fmt.Sprintf(",hostid=%s", c.Hostid))
 	}
+	if c.HdrDigest {
+		sb.WriteString(",hdr_digest")
+	}
+	if c.DataDigest {
+		sb.WriteString(",data_digest")
+	}
+	if c.TLS {
+		sb.WriteString(",tls")
+	}
+	if c.DhChapSecret != "" {
+		sb.WriteString(fmt.Sprintf(",dhchap_secret=%s", c.DhChapSecret))
+		if c.DhChapCtrlSecret != "" {
+			sb.WriteString(fmt.Sprintf(",dhchap_ctrl_secret=%s", c.DhChapCtrlSecret))
+		}
+	}
 	return sb.String()
 }
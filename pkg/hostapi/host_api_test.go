@@ -25,9 +25,9 @@ func NewHostAPIMock() HostAPI {
 	return &hostAPIMock{}
 }
 
-var discoverMock func(discoveryRequest *DiscoverRequest) ([]*NvmeDiscPageEntry, ConnectionID, error)
+var discoverMock func(discoveryRequest *DiscoverRequest) (*LogPage, ConnectionID, error)
 
-func (h *hostAPIMock) Discover(discoveryRequest *DiscoverRequest) ([]*NvmeDiscPageEntry, ConnectionID, error) {
+func (h *hostAPIMock) Discover(discoveryRequest *DiscoverRequest) (*LogPage, ConnectionID, error) {
 	return discoverMock(discoveryRequest)
 }
 
@@ -43,12 +43,12 @@ func TestEmptyDiscovery(t *testing.T) {
 		Hostnqn:   "client_0",
 		Kato:      time.Duration(30 * time.Second),
 	}
-	discoverMock = func(discoveryRequest *DiscoverRequest) ([]*NvmeDiscPageEntry, ConnectionID, error) {
-		return nil, ConnectionID("1"), nil
+	discoverMock = func(discoveryRequest *DiscoverRequest) (*LogPage, ConnectionID, error) {
+		return &LogPage{}, ConnectionID("1"), nil
 	}
 	apiMock := NewHostAPIMock()
-	entries, _, _ := apiMock.Discover(request)
-	if entries != nil {
+	logPage, _, _ := apiMock.Discover(request)
+	if logPage.Entries != nil {
 		t.Error("Expected entries to be nil")
 	}
 }
@@ -0,0 +1,165 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hostroute picks the host source address (host_traddr) of the connections to
+// a target from the routing table of the host, restricted to a set of interfaces.
+package hostroute
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+)
+
+// Route is the host interface and source address the kernel routes a target through.
+type Route struct {
+	Iface string
+	Src   net.IP
+}
+
+// Interface is a host network interface and its addresses.
+type Interface struct {
+	Name  string
+	Addrs []*net.IPNet
+}
+
+// Selector picks the host source address of a target among the allowed interfaces.
+type Selector struct {
+	allowed []string
+	// lookup and interfaces query the host, replaced by tests.
+	lookup     func(dst *net.IPAddr) (Route, error)
+	interfaces func() ([]Interface, error)
+}
+
+// New returns a selector that only uses the interfaces whose name matches one of the
+// allowed glob patterns (see path.Match).
+func New(allowed []string) (*Selector, error) {
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("no allowed interfaces")
+	}
+	for _, pattern := range allowed {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q: %w", pattern, err)
+		}
+	}
+	return &Selector{allowed: allowed, lookup: lookupRoute, interfaces: hostInterfaces}, nil
+}
+
+func (s *Selector) isAllowed(iface string) bool {
+	for _, pattern := range s.allowed {
+		if matched, _ := path.Match(pattern, iface); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// HostTraddr returns the host source address to connect to traddr from. it is the source
+// address of the route to traddr if the route goes through an allowed interface, otherwise
+// the address of an allowed interface traddr is directly reachable from. a target that is
+// only reachable through other interfaces, e.g. a management network, is refused. the
+// zone of a zone scoped traddr, e.g. fe80::1%ens3, is the only interface it is reachable
+// through, and scopes the link-local address returned.
+func (s *Selector) HostTraddr(traddr string) (string, error) {
+	dst, err := net.ResolveIPAddr("ip", traddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", traddr, err)
+	}
+	route, err := s.lookup(dst)
+	if err != nil {
+		return "", fmt.Errorf("route lookup of %s failed: %w", traddr, err)
+	}
+	if s.isAllowed(route.Iface) {
+		return hostTraddr(route.Src, dst.Zone), nil
+	}
+	ifaces, err := s.interfaces()
+	if err != nil {
+		return "", fmt.Errorf("failed to list the host interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		if !s.isAllowed(iface.Name) || (dst.Zone != "" && !zoneOf(dst.Zone, iface.Name)) {
+			continue
+		}
+		for _, addr := range iface.Addrs {
+			if addr.Contains(dst.IP) {
+				return hostTraddr(addr.IP, dst.Zone), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s is only reachable through interface %s, which is not one of the allowed interfaces %v",
+		traddr, route.Iface, s.allowed)
+}
+
+// hostTraddr returns the host_traddr of src, scoped to zone if it is a link-local address.
+func hostTraddr(src net.IP, zone string) string {
+	if zone != "" && src.To4() == nil && src.IsLinkLocalUnicast() {
+		return src.String() + "%" + zone
+	}
+	return src.String()
+}
+
+// zoneOf returns true if zone, an interface name or index, is the interface name.
+func zoneOf(zone, name string) bool {
+	if zone == name {
+		return true
+	}
+	iface, err := net.InterfaceByName(name)
+	return err == nil && strconv.Itoa(iface.Index) == zone
+}
+
+// lookupRoute asks the kernel for the route to dst by connecting a UDP socket, which
+// sends nothing, and finds the interface of the source address it picked.
+func lookupRoute(dst *net.IPAddr) (Route, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst.IP, Port: 9, Zone: dst.Zone})
+	if err != nil {
+		return Route{}, err
+	}
+	src := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	ifaces, err := hostInterfaces()
+	if err != nil {
+		return Route{}, err
+	}
+	for _, iface := range ifaces {
+		for _, addr := range iface.Addrs {
+			if addr.IP.Equal(src) {
+				return Route{Iface: iface.Name, Src: src}, nil
+			}
+		}
+	}
+	return Route{}, fmt.Errorf("no interface has the source address %s", src)
+}
+
+func hostInterfaces() ([]Interface, error) {
+	netIfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []Interface
+	for _, netIface := range netIfaces {
+		addrs, err := netIface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		iface := Interface{Name: netIface.Name}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				iface.Addrs = append(iface.Addrs, ipNet)
+			}
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostroute
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostTraddr(t *testing.T) {
+	cidr := func(s string) *net.IPNet {
+		ip, ipNet, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		ipNet.IP = ip
+		return ipNet
+	}
+	ifaces := []Interface{
+		{Name: "eno1", Addrs: []*net.IPNet{cidr("172.16.0.10/24")}},
+		{Name: "ens1f0", Addrs: []*net.IPNet{cidr("10.0.1.5/24")}},
+		{Name: "ens1f1", Addrs: []*net.IPNet{cidr("10.0.2.5/24"), cidr("fd00:2::5/64")}},
+	}
+	// the storage networks are routed through ens1f0, everything else through the management nic.
+	lookup := func(dst *net.IPAddr) (Route, error) {
+		if dst.Zone != "" {
+			return Route{Iface: dst.Zone, Src: net.ParseIP("fe80::5")}, nil
+		}
+		if cidr("10.0.0.0/16").Contains(dst.IP) {
+			return Route{Iface: "ens1f0", Src: net.ParseIP("10.0.1.5")}, nil
+		}
+		return Route{Iface: "eno1", Src: net.ParseIP("172.16.0.10")}, nil
+	}
+	s, err := New([]string{"ens1f*"})
+	require.NoError(t, err)
+	s.lookup = lookup
+	s.interfaces = func() ([]Interface, error) { return ifaces, nil }
+
+	testCases := []struct {
+		traddr     string
+		hostTraddr string
+		err        bool
+	}{
+		{traddr: "10.0.3.7", hostTraddr: "10.0.1.5"},
+		// routed through the management nic, but on-link on an allowed interface.
+		{traddr: "fd00:2::7", hostTraddr: "fd00:2::5"},
+		{traddr: "192.168.5.7", err: true},
+		{traddr: "fe80::7%ens1f1", hostTraddr: "fe80::5%ens1f1"},
+		{traddr: "fe80::7%eno1", err: true},
+	}
+	for _, tc := range testCases {
+		hostTraddr, err := s.HostTraddr(tc.traddr)
+		if tc.err {
+			require.Error(t, err, tc.traddr)
+			continue
+		}
+		require.NoError(t, err, tc.traddr)
+		require.Equal(t, tc.hostTraddr, hostTraddr, tc.traddr)
+	}
+
+	_, err = New(nil)
+	require.Error(t, err)
+	_, err = New([]string{"ens["})
+	require.Error(t, err)
+}
+
+func TestLookupRouteLoopback(t *testing.T) {
+	route, err := lookupRoute(&net.IPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Skipf("no loopback route: %v", err)
+	}
+	require.True(t, route.Src.IsLoopback())
+	require.NotEmpty(t, route.Iface)
+}
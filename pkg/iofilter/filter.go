@@ -0,0 +1,133 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iofilter decides which IO controllers of a discovery log page the host connects to,
+// by allow and deny patterns on the subsystem NQN and the transport address.
+package iofilter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// RegexPrefix marks a pattern as a regular expression. other patterns are globs.
+const RegexPrefix = "re:"
+
+// pattern is a glob (see path.Match) or a regular expression matched against the whole value.
+type pattern struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+func parsePattern(raw string) (pattern, error) {
+	if strings.HasPrefix(raw, RegexPrefix) {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(raw, RegexPrefix) + ")$")
+		if err != nil {
+			return pattern{}, fmt.Errorf("invalid regular expression %q: %w", raw, err)
+		}
+		return pattern{raw: raw, re: re}, nil
+	}
+	if _, err := path.Match(raw, ""); err != nil {
+		return pattern{}, fmt.Errorf("invalid glob %q: %w", raw, err)
+	}
+	return pattern{raw: raw}, nil
+}
+
+func (p pattern) match(value string) bool {
+	if p.re != nil {
+		return p.re.MatchString(value)
+	}
+	matched, _ := path.Match(p.raw, value)
+	return matched
+}
+
+type patterns []pattern
+
+func parsePatterns(raw []string) (patterns, error) {
+	var res patterns
+	for _, r := range raw {
+		p, err := parsePattern(r)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// match returns the first pattern value matches, empty if none.
+func (ps patterns) match(value string) string {
+	for _, p := range ps {
+		if p.match(value) {
+			return p.raw
+		}
+	}
+	return ""
+}
+
+// Filter allows an IO controller if its subsystem NQN and transport address match one
+// of the allow patterns, or there are no allow patterns, and match none of the deny patterns.
+type Filter struct {
+	allowNQN    patterns
+	denyNQN     patterns
+	allowTraddr patterns
+	denyTraddr  patterns
+}
+
+// New returns a filter of the given patterns.
+func New(allowNQN, denyNQN, allowTraddr, denyTraddr []string) (*Filter, error) {
+	var f Filter
+	var err error
+	if f.allowNQN, err = parsePatterns(allowNQN); err != nil {
+		return nil, err
+	}
+	if f.denyNQN, err = parsePatterns(denyNQN); err != nil {
+		return nil, err
+	}
+	if f.allowTraddr, err = parsePatterns(allowTraddr); err != nil {
+		return nil, err
+	}
+	if f.denyTraddr, err = parsePatterns(denyTraddr); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Empty returns true if the filter allows every IO controller.
+func (f *Filter) Empty() bool {
+	return f == nil || len(f.allowNQN)+len(f.denyNQN)+len(f.allowTraddr)+len(f.denyTraddr) == 0
+}
+
+// Allowed returns true if the IO controller of subsystem nqn at traddr may be connected.
+// otherwise reason describes the pattern that filtered it out.
+func (f *Filter) Allowed(nqn, traddr string) (allowed bool, reason string) {
+	if f.Empty() {
+		return true, ""
+	}
+	if p := f.denyNQN.match(nqn); p != "" {
+		return false, fmt.Sprintf("subsystem nqn matches deny pattern %q", p)
+	}
+	if p := f.denyTraddr.match(traddr); p != "" {
+		return false, fmt.Sprintf("traddr matches deny pattern %q", p)
+	}
+	if len(f.allowNQN) > 0 && f.allowNQN.match(nqn) == "" {
+		return false, "subsystem nqn matches no allow pattern"
+	}
+	if len(f.allowTraddr) > 0 && f.allowTraddr.match(traddr) == "" {
+		return false, "traddr matches no allow pattern"
+	}
+	return true, ""
+}
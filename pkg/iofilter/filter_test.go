@@ -0,0 +1,66 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iofilter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	const (
+		tenantA = "nqn.2016-01.com.lightbitslabs:uuid:tenant-a-vol1"
+		tenantB = "nqn.2016-01.com.lightbitslabs:uuid:tenant-b-vol1"
+	)
+	testCases := []struct {
+		name        string
+		allowNQN    []string
+		denyNQN     []string
+		allowTraddr []string
+		denyTraddr  []string
+		nqn         string
+		traddr      string
+		allowed     bool
+	}{
+		{name: "empty filter", nqn: tenantA, traddr: "10.0.0.1", allowed: true},
+		{name: "allowed by glob", allowNQN: []string{"*:tenant-a-*"}, nqn: tenantA, traddr: "10.0.0.1", allowed: true},
+		{name: "not allowed by glob", allowNQN: []string{"*:tenant-a-*"}, nqn: tenantB, traddr: "10.0.0.1", allowed: false},
+		{name: "allowed by regex", allowNQN: []string{`re:.*tenant-(a|c)-vol\d+`}, nqn: tenantA, traddr: "10.0.0.1", allowed: true},
+		{name: "regex matches the whole nqn", allowNQN: []string{`re:tenant-a`}, nqn: tenantA, traddr: "10.0.0.1", allowed: false},
+		{name: "deny wins over allow", allowNQN: []string{"*"}, denyNQN: []string{"*vol1"}, nqn: tenantA, traddr: "10.0.0.1", allowed: false},
+		{name: "denied traddr", denyTraddr: []string{"10.0.1.*"}, nqn: tenantA, traddr: "10.0.1.7", allowed: false},
+		{name: "allowed traddr", allowTraddr: []string{"10.0.0.*", "10.0.2.*"}, nqn: tenantA, traddr: "10.0.2.7", allowed: true},
+		{name: "not allowed traddr", allowTraddr: []string{"10.0.0.*"}, nqn: tenantA, traddr: "10.0.2.7", allowed: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := New(tc.allowNQN, tc.denyNQN, tc.allowTraddr, tc.denyTraddr)
+			require.NoError(t, err)
+			allowed, reason := f.Allowed(tc.nqn, tc.traddr)
+			require.Equal(t, tc.allowed, allowed, reason)
+			if !allowed {
+				require.NotEmpty(t, reason)
+			}
+		})
+	}
+}
+
+func TestFilterInvalidPatterns(t *testing.T) {
+	_, err := New([]string{"re:("}, nil, nil, nil)
+	require.Error(t, err)
+	_, err = New(nil, nil, nil, []string{"10.0.0.["})
+	require.Error(t, err)
+}
@@ -31,6 +31,8 @@ import (
 
 var (
 	validLevels = []string{"debug", "info", "warn", "warning", "error", "fatal"}
+	// fileWriter is the log file writer of the current setup, closed when logging is set up again.
+	fileWriter *lumberjack.Logger
 )
 
 type Config struct {
@@ -98,6 +100,7 @@ func setupLoggingFile(cfg Config, wantedLevel logrus.Level) error {
 			MaxAge:    int(cfg.MaxAge),
 			LocalTime: false,
 		}
+		fileWriter = writer
 
 		writerMap := lfshook.WriterMap{}
 		for level := int(wantedLevel); level > int(logrus.PanicLevel); level-- {
@@ -112,6 +115,9 @@ func setupLoggingFile(cfg Config, wantedLevel logrus.Level) error {
 	return nil
 }
 
+// SetupLogging configures the standard logger according to cfg.
+// it may be called again to apply a new configuration, in which case the
+// hooks and log file of the previous configuration are released.
 func SetupLogging(cfg Config) error {
 	var err error
 	wantedLevel := logrus.InfoLevel
@@ -122,6 +128,11 @@ func SetupLogging(cfg Config) error {
 		}
 	}
 
+	logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	if fileWriter != nil {
+		fileWriter.Close()
+		fileWriter = nil
+	}
 	logrus.SetOutput(io.Discard)
 	disableTimeStamp := true
 	setupConsoleLogs(disableTimeStamp)
@@ -0,0 +1,234 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvme
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
+	"github.com/lunixbochs/struc"
+)
+
+//#include <linux/nvme.h>
+import "C"
+
+// the fabrics command types of the in-band authentication, missing in linux/nvme.h.
+const (
+	nvmeFabricsTypeAuthSend    = 0x05
+	nvmeFabricsTypeAuthReceive = 0x06
+)
+
+const (
+	// NVME_CONNECT_AUTHREQ_ATR - set in the result of a Connect command when the host is
+	// required to authenticate before the queue accepts other commands.
+	NVME_CONNECT_AUTHREQ_ATR uint32 = 1 << 17
+	// NVME_CONNECT_AUTHREQ_ASCR - set when the host is required to authenticate and to
+	// concatenate a secure channel.
+	NVME_CONNECT_AUTHREQ_ASCR uint32 = 1 << 18
+)
+
+// AuthCommand is the AUTH_Send and the AUTH_Receive commands. Length is the transfer length of
+// AUTH_Send and the allocation length of AUTH_Receive.
+type AuthCommand struct {
+	Opcode    uint8     `struc:"uint8"`
+	Resv1     uint8     `struc:"uint8"`
+	CommandID uint16    `struc:"uint16,little"`
+	FcType    uint8     `struc:"uint8"`
+	Rsvd2     [19]uint8 `struc:"[19]uint8"`
+	Dptr      DataPtr
+	Rsvd3     uint8     `struc:"uint8"`
+	Spsp0     uint8     `struc:"uint8"`
+	Spsp1     uint8     `struc:"uint8"`
+	Secp      uint8     `struc:"uint8"`
+	Length    uint32    `struc:"uint32,little"`
+	Rsvd4     [16]uint8 `struc:"[16]uint8"`
+}
+
+func newAuthCommand(cmdID uint16, fcType uint8, length uint32) AuthCommand {
+	return AuthCommand{
+		Opcode:    C.nvme_fabrics_command,
+		Resv1:     uint8(0x40),
+		CommandID: cmdID,
+		FcType:    fcType,
+		Spsp0:     nvmeauth.SPSP0,
+		Spsp1:     nvmeauth.SPSP1,
+		Secp:      nvmeauth.SecurityProtocol,
+		Length:    length,
+	}
+}
+
+// valid returns the status of a command of another security protocol.
+func (cmd *AuthCommand) valid() uint16 {
+	if cmd.Secp != nvmeauth.SecurityProtocol || cmd.Spsp0 != nvmeauth.SPSP0 || cmd.Spsp1 != nvmeauth.SPSP1 || cmd.Length == 0 {
+		return C.NVME_SC_INVALID_FIELD | C.NVME_SC_DNR
+	}
+	return C.NVME_SC_SUCCESS
+}
+
+func (cmd *AuthCommand) String() string {
+	return fmt.Sprintf("id: %#04x. opcode: %s(%#04x). fcType: %#02x, length: %d",
+		cmd.CommandID, OpcodeName(cmd.Opcode), cmd.Opcode, cmd.FcType, cmd.Length)
+}
+
+// NvmefAuthSendRequest sends a message of the authentication transaction in-capsule.
+type NvmefAuthSendRequest struct {
+	AbstractRequest
+	Cmd AuthCommand
+}
+
+func NewAuthSendRequest(cmdID uint16, msg []byte) *NvmefAuthSendRequest {
+	request := &NvmefAuthSendRequest{
+		AbstractRequest: AbstractRequest{
+			CmdID:      cmdID,
+			DataLength: uint32(len(msg)),
+		},
+		Cmd: newAuthCommand(cmdID, nvmeFabricsTypeAuthSend, uint32(len(msg))),
+	}
+	request.sgl = NewScatterList(len(msg), 1024)
+	NewScatterListWriter(request.sgl).Write(msg)
+	request.dptr().SetSgInline(request.DataLength)
+	return request
+}
+
+func (request *NvmefAuthSendRequest) String() string {
+	status := "not completed"
+	if request.Completion() != nil {
+		status = fmt.Sprintf("%#02x", request.Completion().Status>>1)
+	}
+	return fmt.Sprintf("%s, %s. status: %q", reflect.TypeOf(request).String(), request.Cmd.String(), status)
+}
+
+func (request *NvmefAuthSendRequest) PackCmd(buffer *bufio.Writer) error {
+	return struc.Pack(buffer, &request.Cmd)
+}
+
+func (request *NvmefAuthSendRequest) dptr() *DataPtr {
+	return &request.Cmd.Dptr
+}
+
+func (request *NvmefAuthSendRequest) isWrite() bool {
+	return true
+}
+
+func (request *NvmefAuthSendRequest) execute() {
+	status := request.Cmd.valid()
+	if status == C.NVME_SC_SUCCESS && request.queue.auth == nil {
+		request.queue.log.Errorf("cmd id: %#04x, AUTH_Send from a host that doesn't authenticate", request.Cmd.CommandID)
+		status = C.NVME_SC_INVALID_FIELD | C.NVME_SC_DNR
+	}
+	if status == C.NVME_SC_SUCCESS {
+		var msg bytes.Buffer
+		if _, err := io.Copy(&msg, NewScatterListReader(request.sgl)); err != nil {
+			status = C.NVME_SC_INTERNAL
+		} else if err := request.queue.auth.Send(msg.Bytes()); err != nil {
+			// the failure is returned by the next AUTH_Receive
+			request.queue.log.WithError(err).Warnf("authentication of the host failed")
+		} else if request.queue.auth.Authenticated() {
+			request.queue.log.Infof("host authenticated")
+		}
+	}
+	request.queue.completeRequest(request, NewCompletion(request.CommandID(), request.queue.sq.qID, status))
+}
+
+// NvmefAuthReceiveRequest receives a message of the authentication transaction, of up to the
+// allocation length.
+type NvmefAuthReceiveRequest struct {
+	AbstractRequest
+	Cmd AuthCommand
+}
+
+func NewAuthReceiveRequest(cmdID uint16, length uint32) *NvmefAuthReceiveRequest {
+	request := &NvmefAuthReceiveRequest{
+		AbstractRequest: AbstractRequest{
+			CmdID: cmdID,
+		},
+		Cmd: newAuthCommand(cmdID, nvmeFabricsTypeAuthReceive, length),
+	}
+	request.dptr().SetSgHostData(length)
+	return request
+}
+
+func (request *NvmefAuthReceiveRequest) String() string {
+	status := "not completed"
+	if request.Completion() != nil {
+		status = fmt.Sprintf("%#02x", request.Completion().Status>>1)
+	}
+	return fmt.Sprintf("%s, %s. status: %q", reflect.TypeOf(request).String(), request.Cmd.String(), status)
+}
+
+func (request *NvmefAuthReceiveRequest) PackCmd(buffer *bufio.Writer) error {
+	return struc.Pack(buffer, &request.Cmd)
+}
+
+func (request *NvmefAuthReceiveRequest) dptr() *DataPtr {
+	return &request.Cmd.Dptr
+}
+
+func (request *NvmefAuthReceiveRequest) isWrite() bool {
+	return false
+}
+
+func (request *NvmefAuthReceiveRequest) execute() {
+	status := request.Cmd.valid()
+	if status == C.NVME_SC_SUCCESS && request.queue.auth == nil {
+		request.queue.log.Errorf("cmd id: %#04x, AUTH_Receive from a host that doesn't authenticate", request.Cmd.CommandID)
+		status = C.NVME_SC_INVALID_FIELD | C.NVME_SC_DNR
+	}
+	if status == C.NVME_SC_SUCCESS {
+		msg, err := request.queue.auth.Receive()
+		if err != nil {
+			request.queue.log.WithError(err).Errorf("cmd id: %#04x, unexpected AUTH_Receive", request.Cmd.CommandID)
+			status = C.NVME_SC_INVALID_FIELD | C.NVME_SC_DNR
+		} else if len(msg) > int(request.Cmd.Length) {
+			request.queue.log.Errorf("cmd id: %#04x, authentication message of %d bytes exceeds the allocation length %d",
+				request.Cmd.CommandID, len(msg), request.Cmd.Length)
+			status = C.NVME_SC_INVALID_FIELD | C.NVME_SC_DNR
+		} else {
+			// the message is followed by zeroes up to the allocation length
+			NewScatterListWriter(request.sgl).Write(msg)
+		}
+	}
+	request.queue.completeRequest(request, NewCompletion(request.CommandID(), request.queue.sq.qID, status))
+}
+
+func (queue *nvmeQueue) nvmetParseAuthCommand(fctype uint8, pdu []byte) (Request, error) {
+	var cmd AuthCommand
+	if err := struc.Unpack(bytes.NewReader(pdu), &cmd); err != nil {
+		return nil, err
+	}
+	abstractRequest := AbstractRequest{
+		queue:      queue,
+		CmdID:      cmd.CommandID,
+		DataLength: cmd.Length,
+	}
+	if fctype == nvmeFabricsTypeAuthSend {
+		request := &NvmefAuthSendRequest{AbstractRequest: abstractRequest, Cmd: cmd}
+		request.Req = request
+		return request, nil
+	}
+	request := &NvmefAuthReceiveRequest{AbstractRequest: abstractRequest, Cmd: cmd}
+	request.Req = request
+	return request, nil
+}
+
+// authRequired returns true if the host of the queue has yet to authenticate, and is limited to
+// the authentication commands.
+func (queue *nvmeQueue) authRequired() bool {
+	return queue.auth != nil && !queue.auth.Authenticated()
+}
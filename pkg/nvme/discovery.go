@@ -45,6 +45,23 @@ const (
 	// Discovery controllers and whose controllers may have attached
 	// namespaces.
 	NVME_NQN_DISC SubsystemType = C.NVME_NQN_DISC
+	// NVME_NQN_CURR - The entry describes a port of the discovery subsystem that returned
+	// the log page (TP8013). missing from linux/nvme.h of this tree.
+	NVME_NQN_CURR SubsystemType = 3
+)
+
+// Entry flags (EFLAGS) of a discovery log page entry (TP8013, TP8014). targets that
+// don't report NVME_NQN_CURR entries leave them cleared.
+const (
+	// NVMF_DISC_EFLAGS_DUPRETINFO - connecting to the discovery controller of the entry
+	// returns the same information as the one that returned the log page.
+	NVMF_DISC_EFLAGS_DUPRETINFO uint16 = 1 << 0
+	// NVMF_DISC_EFLAGS_EPCSD - the discovery controller of the entry supports explicit
+	// persistent connections.
+	NVMF_DISC_EFLAGS_EPCSD uint16 = 1 << 1
+	// NVMF_DISC_EFLAGS_NCC - the port of the entry has no connectivity to a centralized
+	// discovery controller.
+	NVMF_DISC_EFLAGS_NCC uint16 = 1 << 2
 )
 
 // DiscoverySubsystem ...
@@ -227,7 +244,8 @@ type NvmefDiscRspPageEntry struct {
 	PortID  uint16                     `struc:"uint16,little"`
 	CntlID  uint16                     `struc:"uint16,little"`
 	Asqsz   uint16                     `struc:"uint16,little"`
-	Resv8   [22]uint8                  `struc:"[22]uint8"`
+	Eflags  uint16                     `struc:"uint16,little"`
+	Resv12  [20]uint8                  `struc:"[20]uint8"`
 	TrsvcID [C.NVMF_TRSVCID_SIZE]uint8 `struc:"[32]uint8"`
 	Resv64  [192]uint8                 `struc:"[192]uint8"`
 	Subnqn  string                     `struc:"[256]uint8"`
@@ -338,6 +356,8 @@ func (request *NvmeIdentifyDiscoveryRequest) execute() {
 	id.Ver = uint32(nvmeVS(1, 3, 0))
 	id.Lpa = (1 << 2)
 	id.Oaes = nvmeAENCfgOptional
+	id.CntrlType = NVME_CTRL_CNTRLTYPE_DISC
+	id.DcType = NVME_CTRL_DCTYPE_DDC
 
 	id.Maxcmd = nvmetMaxCmd
 
@@ -232,6 +232,8 @@ func (queue *nvmeQueue) nvmetParseFabricsCommand(opcode uint8, pdu []byte) (Requ
 			CmdID: request.Cmd.CommandID,
 		}
 		return request, nil
+	case nvmeFabricsTypeAuthSend, nvmeFabricsTypeAuthReceive:
+		return queue.nvmetParseAuthCommand(fctype, pdu)
 	default:
 		queue.log.Errorf("received unknown capsule type 0x%x\n", fctype)
 		_, _ = queue.nvmetParseCommonCmd(pdu)
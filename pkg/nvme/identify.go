@@ -0,0 +1,120 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvme
+
+import (
+	"strings"
+	"time"
+)
+
+// Controller types (CNTRLTYPE) of the Identify Controller data structure. 0 is not reported.
+const (
+	NVME_CTRL_CNTRLTYPE_IO    uint8 = 1
+	NVME_CTRL_CNTRLTYPE_DISC  uint8 = 2
+	NVME_CTRL_CNTRLTYPE_ADMIN uint8 = 3
+)
+
+// Discovery controller types (DCTYPE) of the Identify Controller data structure (TP8010).
+// 0 is not reported.
+const (
+	// NVME_CTRL_DCTYPE_DDC - a direct discovery controller, of a storage subsystem.
+	NVME_CTRL_DCTYPE_DDC uint8 = 1
+	// NVME_CTRL_DCTYPE_CDC - a centralized discovery controller, of a fabric.
+	NVME_CTRL_DCTYPE_CDC uint8 = 2
+)
+
+// NVME_CTRL_OAES_DLPCN is set in OAES if the controller sends discovery log page change notices.
+const NVME_CTRL_OAES_DLPCN uint32 = 1 << 31
+
+// keepAliveUnit is the unit of KAS.
+const keepAliveUnit = 100 * time.Millisecond
+
+// IdentifyController is the decoded Identify Controller data structure of a controller.
+type IdentifyController struct {
+	VID    uint16 `json:"vid"`
+	SSVID  uint16 `json:"ssvid"`
+	Sn     string `json:"sn"`
+	Mn     string `json:"mn"`
+	Fr     string `json:"fr"`
+	CntlID uint16 `json:"cntlid"`
+	Subnqn string `json:"subnqn"`
+	// CntrlType is one of NVME_CTRL_CNTRLTYPE_IO and its siblings.
+	CntrlType uint8 `json:"cntrltype"`
+	// DcType is one of NVME_CTRL_DCTYPE_DDC and its siblings.
+	DcType uint8 `json:"dctype"`
+	// Mdts is the maximum data transfer size, a power of two of the minimum memory page
+	// size. 0 has no limit.
+	Mdts uint8 `json:"mdts"`
+	// Kas is the keep alive granularity, in units of 100 milliseconds.
+	Kas  uint16 `json:"kas"`
+	Sgls uint32 `json:"sgls"`
+	Oaes uint32 `json:"oaes"`
+}
+
+func trimIdentifyString(s string) string {
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// Decode returns the decoded fields of id.
+func (id *IDCtrl) Decode() *IdentifyController {
+	return &IdentifyController{
+		VID:       id.VID,
+		SSVID:     id.SSVID,
+		Sn:        trimIdentifyString(string(id.Sn[:])),
+		Mn:        trimIdentifyString(string(id.Mn[:])),
+		Fr:        trimIdentifyString(id.Fr),
+		CntlID:    id.CntlID,
+		Subnqn:    trimIdentifyString(string(id.SubNqn[:])),
+		CntrlType: id.CntrlType,
+		DcType:    id.DcType,
+		Mdts:      id.Mdts,
+		Kas:       id.Kas,
+		Sgls:      id.Sgls,
+		Oaes:      id.Oaes,
+	}
+}
+
+// IsDiscovery returns true if the controller is a discovery controller. controllers that
+// don't report their type are told by the well-known discovery subsystem nqn.
+func (c *IdentifyController) IsDiscovery() bool {
+	if c.CntrlType != 0 {
+		return c.CntrlType == NVME_CTRL_CNTRLTYPE_DISC
+	}
+	return c.Subnqn == DiscoverySubsysName
+}
+
+// MaxTransferSize returns the largest data transfer the controller accepts in bytes, given
+// the minimum memory page size of the controller. 0 has no limit.
+func (c *IdentifyController) MaxTransferSize(pageSize uint32) uint32 {
+	if c.Mdts == 0 || c.Mdts >= 32 {
+		return 0
+	}
+	return pageSize << c.Mdts
+}
+
+// KeepAliveTimeout returns kato rounded up to the keep alive granularity of the controller.
+func (c *IdentifyController) KeepAliveTimeout(kato time.Duration) time.Duration {
+	granularity := time.Duration(c.Kas) * keepAliveUnit
+	if granularity == 0 || kato%granularity == 0 {
+		return kato
+	}
+	return (kato/granularity + 1) * granularity
+}
+
+// DiscoveryLogChangeNotices returns true if the controller sends an AEN when its discovery
+// log page changes.
+func (c *IdentifyController) DiscoveryLogChangeNotices() bool {
+	return c.Oaes&NVME_CTRL_OAES_DLPCN != 0
+}
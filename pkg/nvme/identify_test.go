@@ -0,0 +1,77 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvme
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/lunixbochs/struc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentifyController(t *testing.T) {
+	size, err := struc.Sizeof(&IDCtrl{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4096, size)
+
+	// the fields decoded at their offsets in the Identify Controller data structure.
+	data := make([]byte, 4096)
+	binary.LittleEndian.PutUint16(data[0:], 0x1d78)
+	copy(data[4:24], "SN0001              ")
+	copy(data[24:64], "Lightbits discovery                     ")
+	copy(data[64:72], "3.4.1   ")
+	data[77] = 3
+	binary.LittleEndian.PutUint16(data[78:], 7)
+	binary.LittleEndian.PutUint32(data[92:], NVME_CTRL_OAES_DLPCN)
+	data[111] = NVME_CTRL_CNTRLTYPE_DISC
+	data[252] = NVME_CTRL_DCTYPE_DDC
+	binary.LittleEndian.PutUint16(data[320:], 10)
+	binary.LittleEndian.PutUint32(data[536:], 1<<20|1)
+	copy(data[768:], "nqn.2014-08.org.nvmexpress.discovery:uuid:1")
+
+	id := &IDCtrl{}
+	assert.NoError(t, struc.Unpack(bytes.NewReader(data), id))
+	identify := id.Decode()
+	assert.Equal(t, &IdentifyController{
+		VID:       0x1d78,
+		Sn:        "SN0001",
+		Mn:        "Lightbits discovery",
+		Fr:        "3.4.1",
+		CntlID:    7,
+		Subnqn:    "nqn.2014-08.org.nvmexpress.discovery:uuid:1",
+		CntrlType: NVME_CTRL_CNTRLTYPE_DISC,
+		DcType:    NVME_CTRL_DCTYPE_DDC,
+		Mdts:      3,
+		Kas:       10,
+		Sgls:      1<<20 | 1,
+		Oaes:      NVME_CTRL_OAES_DLPCN,
+	}, identify)
+
+	assert.True(t, identify.IsDiscovery())
+	assert.True(t, identify.DiscoveryLogChangeNotices())
+	assert.Equal(t, uint32(32768), identify.MaxTransferSize(4096))
+	assert.Equal(t, 30*time.Second, identify.KeepAliveTimeout(30*time.Second))
+	assert.Equal(t, 2*time.Second, identify.KeepAliveTimeout(1500*time.Millisecond), "rounded up to the granularity of 1s")
+
+	legacy := &IdentifyController{Subnqn: DiscoverySubsysName}
+	assert.True(t, legacy.IsDiscovery(), "controllers that don't report their type are told by their nqn")
+	assert.False(t, legacy.DiscoveryLogChangeNotices())
+	assert.Equal(t, uint32(0), legacy.MaxTransferSize(4096))
+	assert.Equal(t, 1500*time.Millisecond, legacy.KeepAliveTimeout(1500*time.Millisecond))
+	assert.False(t, (&IdentifyController{CntrlType: NVME_CTRL_CNTRLTYPE_IO, Subnqn: DiscoverySubsysName}).IsDiscovery())
+}
@@ -102,7 +102,16 @@ type IDCtrl struct {
 	Rtd3e     uint32     `struc:"uint32,little"`
 	Oaes      uint32     `struc:"uint32,little"`
 	CtrAtt    uint32     `struc:"uint32,little"`
-	Rsvd100   [156]uint8 `struc:"[156]uint8"`
+	Rrls      uint16     `struc:"uint16,little"`
+	Rsvd102   [9]uint8   `struc:"[9]uint8"`
+	CntrlType uint8      `struc:"uint8"`
+	Fguid     [16]uint8  `struc:"[16]uint8"`
+	Crdt      [3]uint16  `struc:"[3]uint16,little"`
+	Rsvd134   [118]uint8 `struc:"[118]uint8"`
+	DcType    uint8      `struc:"uint8"`
+	Nvmsr     uint8      `struc:"uint8"`
+	Vwci      uint8      `struc:"uint8"`
+	Mec       uint8      `struc:"uint8"`
 	Oacs      uint16     `struc:"uint16,little"`
 	ACL       uint8      `struc:"uint8"`
 	Arel      uint8      `struc:"uint8"`
@@ -376,7 +385,11 @@ func (request *AdminConnectRequest) execute() {
 		return
 	}
 	completion := NewCompletion(request.CommandID(), request.queue.sq.qID, C.NVME_SC_SUCCESS)
-	completion.Result.setU16Result(ctrl.ControllerID())
+	result := uint32(ctrl.ControllerID())
+	if request.queue.auth != nil {
+		result |= NVME_CONNECT_AUTHREQ_ATR
+	}
+	completion.Result.setU32Result(result)
 	request.queue.completeRequest(request, completion)
 }
 
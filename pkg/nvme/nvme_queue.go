@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
 	"github.com/lunixbochs/struc"
 	"github.com/sirupsen/logrus"
 )
@@ -53,6 +54,10 @@ type nvmeQueue struct {
 	keepAliveWatchStopCh chan interface{}
 	serviceID            string
 	controllerID         uint16
+	// authConfig configures the authentication of the hosts, nil if they don't authenticate.
+	authConfig *nvmeauth.Config
+	// auth authenticates the host of the queue, nil if it doesn't authenticate.
+	auth *nvmeauth.Controller
 }
 
 func (queue *nvmeQueue) nvmetParseConnectCmd(pdu []byte) (Request, error) {
@@ -120,6 +125,12 @@ func (queue *nvmeQueue) nvmetRequestInit(transport nvmetTransport, pdu []byte) (
 	var err error
 	if queue.sq.ctrl == nil {
 		request, err = queue.nvmetParseConnectCmd(pdu)
+	} else if queue.authRequired() && (opcode != C.nvme_fabrics_command ||
+		(pdu[4] != nvmeFabricsTypeAuthSend && pdu[4] != nvmeFabricsTypeAuthReceive)) {
+		err = &ParserError{
+			status: C.NVME_SC_AUTH_REQUIRED | C.NVME_SC_DNR,
+			msg:    "command on a queue of a host yet to authenticate",
+		}
 	} else if opcode == C.nvme_fabrics_command {
 		request, err = queue.nvmetParseFabricsCommand(opcode, pdu)
 	} else {
@@ -178,6 +189,12 @@ func (queue *nvmeQueue) createNvmeController(request *AdminConnectRequest, conne
 		queue.sq.sqhd = 0xffff
 	}
 
+	if queue.authConfig != nil {
+		if keys := queue.authConfig.GetHostKeys(connectData.HostNqn); keys != nil {
+			queue.auth = nvmeauth.NewController(connectData.HostNqn, connectData.SubsysNqn, keys)
+		}
+	}
+
 	queue.discoverySubsystem.RegisterController(ctrl)
 	queue.keepAliveWatchStopCh = queue.watchKeepAliveExpired()
 
@@ -0,0 +1,247 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeauth
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"math/big"
+)
+
+// Config configures the authentication of the hosts by the controllers.
+type Config struct {
+	// GetHostKeys returns the keys of hostNqn, nil if the host isn't required to authenticate.
+	GetHostKeys func(hostNqn string) *HostKeys
+}
+
+// HostKeys are the keys a host authenticates with.
+type HostKeys struct {
+	Secret *Secret
+	// CtrlSecret authenticates the controller to the host, if requested by the host.
+	CtrlSecret *Secret
+	// Hashes and DHGroups restrict those of the transactions to the ones listed, any if empty.
+	// the first one offered by the host is selected.
+	Hashes   []Hash
+	DHGroups []DHGroup
+}
+
+type controllerState int
+
+const (
+	// waiting for AUTH_Negotiate, which is accepted in any state to (re)start a transaction.
+	stateNegotiate controllerState = iota
+	// returning DH-HMAC-CHAP_Challenge
+	stateChallenge
+	// waiting for DH-HMAC-CHAP_Reply
+	stateReply
+	// returning DH-HMAC-CHAP_Success1
+	stateSuccess1
+	// waiting for DH-HMAC-CHAP_Success2
+	stateSuccess2
+	// returning AUTH_Failure1
+	stateFailure1
+	stateDone
+)
+
+// Controller is the controller side of the DH-HMAC-CHAP transactions of a host, the messages of
+// the AUTH_Send commands passed to Send and the ones of the AUTH_Receive commands returned by Receive.
+type Controller struct {
+	hostNqn       string
+	subsysNqn     string
+	keys          *HostKeys
+	state         controllerState
+	failure       error
+	authenticated bool
+	transactionID uint16
+	hash          Hash
+	dhGroup       DHGroup
+	private       *big.Int
+	dhValue       []byte
+	challenge     []byte
+	seqNum        uint32
+	// response of the controller to the challenge of the host, nil if not authenticated.
+	response []byte
+}
+
+// NewController returns the controller of subsysNqn authenticating hostNqn with keys.
+func NewController(hostNqn, subsysNqn string, keys *HostKeys) *Controller {
+	return &Controller{hostNqn: hostNqn, subsysNqn: subsysNqn, keys: keys}
+}
+
+// Authenticated returns true once a transaction authenticated the host.
+func (c *Controller) Authenticated() bool {
+	return c.authenticated
+}
+
+// Send handles the message of an AUTH_Send command. an unexpected or invalid message fails the
+// transaction, the failure is returned to the host by the next AUTH_Receive command.
+func (c *Controller) Send(msg []byte) error {
+	msgType, msgID, tid, err := parseHeader(msg)
+	if err == nil {
+		switch {
+		case msgType == authTypeCommon && msgID == msgNegotiate:
+			err = c.negotiate(msg)
+		case msgType == authTypeCommon && msgID == msgFailure2:
+			c.state = stateNegotiate
+			c.authenticated = false
+			return peerFailure(msg)
+		case c.state == stateReply:
+			err = c.reply(msg)
+		case c.state == stateSuccess2:
+			if err = expectMessage(msg, msgSuccess2, c.transactionID, headerLen); err == nil {
+				c.state = stateDone
+				c.authenticated = true
+			}
+		default:
+			err = failure(FailureIncorrectMessage, "unexpected authentication message %#x/%#x of transaction %d", msgType, msgID, tid)
+		}
+	}
+	if err != nil {
+		c.state = stateFailure1
+		c.failure = err
+		c.authenticated = false
+	}
+	return err
+}
+
+// Receive returns the message of an AUTH_Receive command.
+func (c *Controller) Receive() ([]byte, error) {
+	switch c.state {
+	case stateChallenge:
+		c.state = stateReply
+		msg := &challengeMessage{
+			transactionID: c.transactionID,
+			hash:          c.hash,
+			dhGroup:       c.dhGroup,
+			seqNum:        c.seqNum,
+			challenge:     c.challenge,
+			dhValue:       c.dhValue,
+		}
+		return msg.marshal(), nil
+	case stateSuccess1:
+		if c.response != nil {
+			c.state = stateSuccess2
+		} else {
+			c.state = stateDone
+			c.authenticated = true
+		}
+		msg := &success1Message{transactionID: c.transactionID, hashLen: c.hash.Size(), response: c.response}
+		return msg.marshal(), nil
+	case stateFailure1:
+		c.state = stateNegotiate
+		return marshalFailure(msgFailure1, c.transactionID, c.failure), nil
+	default:
+		return nil, fmt.Errorf("no authentication message to return to host %s", c.hostNqn)
+	}
+}
+
+func (c *Controller) negotiate(msg []byte) error {
+	negotiate, err := parseNegotiateMessage(msg)
+	if err != nil {
+		return err
+	}
+	c.transactionID = negotiate.transactionID
+	c.response = nil
+	var ok bool
+	if c.hash, ok = c.selectHash(negotiate.hashes); !ok {
+		return failure(FailureHashUnusable, "no usable hash in %v", negotiate.hashes)
+	}
+	if c.dhGroup, ok = c.selectDHGroup(negotiate.dhGroups); !ok {
+		return failure(FailureDHGroupUnusable, "no usable group in %v", negotiate.dhGroups)
+	}
+	if c.dhGroup != DHGroupNull {
+		c.private, c.dhValue, err = c.dhGroup.generateKey()
+		if err != nil {
+			return failure(FailureFailed, "%v", err)
+		}
+	} else {
+		c.private, c.dhValue = nil, nil
+	}
+	c.challenge, c.seqNum, err = randomChallenge(c.hash)
+	if err != nil {
+		return failure(FailureFailed, "%v", err)
+	}
+	c.state = stateChallenge
+	return nil
+}
+
+func (c *Controller) reply(msg []byte) error {
+	reply, err := parseReplyMessage(msg, c.transactionID)
+	if err != nil {
+		return err
+	}
+	if len(reply.response) != c.hash.Size() {
+		return failure(FailureIncorrectPayload, "response of %d bytes, expected %d for %s", len(reply.response), c.hash.Size(), c.hash)
+	}
+	var sessionKey []byte
+	if c.dhGroup != DHGroupNull {
+		sessionKey, err = c.dhGroup.sharedSecret(c.private, reply.dhValue)
+		if err != nil {
+			return failure(FailureIncorrectPayload, "%v", err)
+		}
+	} else if len(reply.dhValue) != 0 {
+		return failure(FailureIncorrectPayload, "DH value of %d bytes with the null group", len(reply.dhValue))
+	}
+	expected := hostResponse(c.hash, c.keys.Secret, augmentedChallenge(c.hash, sessionKey, c.challenge),
+		c.seqNum, c.transactionID, c.hostNqn, c.subsysNqn)
+	if !hmac.Equal(reply.response, expected) {
+		return failure(FailureFailed, "host %s failed to authenticate", c.hostNqn)
+	}
+	if reply.challenge != nil {
+		if c.keys.CtrlSecret == nil {
+			return failure(FailureFailed, "host %s requested to authenticate the controller, which has no secret", c.hostNqn)
+		}
+		c.response = controllerResponse(c.hash, c.keys.CtrlSecret, augmentedChallenge(c.hash, sessionKey, reply.challenge),
+			reply.seqNum, c.transactionID, c.hostNqn, c.subsysNqn)
+	}
+	c.state = stateSuccess1
+	return nil
+}
+
+// selectHash returns the first hash of offered that is supported and allowed by the keys.
+func (c *Controller) selectHash(offered []Hash) (Hash, bool) {
+	for _, h := range offered {
+		if !h.valid() {
+			continue
+		}
+		if len(c.keys.Hashes) == 0 {
+			return h, true
+		}
+		for _, allowed := range c.keys.Hashes {
+			if h == allowed {
+				return h, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// selectDHGroup returns the first group of offered that is supported and allowed by the keys.
+func (c *Controller) selectDHGroup(offered []DHGroup) (DHGroup, bool) {
+	for _, g := range offered {
+		if !g.valid() {
+			continue
+		}
+		if len(c.keys.DHGroups) == 0 {
+			return g, true
+		}
+		for _, allowed := range c.keys.DHGroups {
+			if g == allowed {
+				return g, true
+			}
+		}
+	}
+	return 0, false
+}
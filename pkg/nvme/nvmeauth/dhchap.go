@@ -0,0 +1,225 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// Hash is the hash function of the HMAC of DH-HMAC-CHAP, by its identifier.
+type Hash uint8
+
+const (
+	HashSHA256 Hash = 0x01
+	HashSHA384 Hash = 0x02
+	HashSHA512 Hash = 0x03
+)
+
+// Hashes are the hash functions supported, in the order the host offers them.
+var Hashes = []Hash{HashSHA256, HashSHA384, HashSHA512}
+
+func (h Hash) String() string {
+	switch h {
+	case HashSHA256:
+		return "sha256"
+	case HashSHA384:
+		return "sha384"
+	case HashSHA512:
+		return "sha512"
+	default:
+		return fmt.Sprintf("unknown hash %#x", uint8(h))
+	}
+}
+
+func (h Hash) valid() bool {
+	return h >= HashSHA256 && h <= HashSHA512
+}
+
+func (h Hash) newHash() func() hash.Hash {
+	switch h {
+	case HashSHA384:
+		return sha512.New384
+	case HashSHA512:
+		return sha512.New
+	default:
+		return sha256.New
+	}
+}
+
+// Size returns the length of the digests of h, the length of the challenges and the responses.
+func (h Hash) Size() int {
+	return h.newHash()().Size()
+}
+
+func (h Hash) sum(data []byte) []byte {
+	digest := h.newHash()()
+	digest.Write(data)
+	return digest.Sum(nil)
+}
+
+// DHGroup is the Diffie-Hellman group of DH-HMAC-CHAP, by its identifier.
+type DHGroup uint8
+
+const (
+	// DHGroupNull doesn't exchange Diffie-Hellman values, the challenges are used as is.
+	DHGroupNull      DHGroup = 0x00
+	DHGroupFFDHE2048 DHGroup = 0x01
+	DHGroupFFDHE3072 DHGroup = 0x02
+	DHGroupFFDHE4096 DHGroup = 0x03
+	DHGroupFFDHE6144 DHGroup = 0x04
+	DHGroupFFDHE8192 DHGroup = 0x05
+)
+
+// DHGroups are the Diffie-Hellman groups supported, in the order the host offers them.
+var DHGroups = []DHGroup{DHGroupNull, DHGroupFFDHE2048, DHGroupFFDHE3072, DHGroupFFDHE4096, DHGroupFFDHE6144, DHGroupFFDHE8192}
+
+// privateKeyLen is the length of the private exponents, above twice the security strength of
+// the largest group (RFC 7919, section 5.2).
+const privateKeyLen = 64
+
+var ffdhePrimes = map[DHGroup]*big.Int{
+	DHGroupFFDHE2048: mustParsePrime(ffdhe2048Prime),
+	DHGroupFFDHE3072: mustParsePrime(ffdhe3072Prime),
+	DHGroupFFDHE4096: mustParsePrime(ffdhe4096Prime),
+	DHGroupFFDHE6144: mustParsePrime(ffdhe6144Prime),
+	DHGroupFFDHE8192: mustParsePrime(ffdhe8192Prime),
+}
+
+func mustParsePrime(s string) *big.Int {
+	p, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid prime " + s)
+	}
+	return p
+}
+
+func (g DHGroup) String() string {
+	switch g {
+	case DHGroupNull:
+		return "null"
+	case DHGroupFFDHE2048:
+		return "ffdhe2048"
+	case DHGroupFFDHE3072:
+		return "ffdhe3072"
+	case DHGroupFFDHE4096:
+		return "ffdhe4096"
+	case DHGroupFFDHE6144:
+		return "ffdhe6144"
+	case DHGroupFFDHE8192:
+		return "ffdhe8192"
+	default:
+		return fmt.Sprintf("unknown group %#x", uint8(g))
+	}
+}
+
+func (g DHGroup) valid() bool {
+	return g <= DHGroupFFDHE8192
+}
+
+// valueLen returns the length of the public values of g, 0 for the null group.
+func (g DHGroup) valueLen() int {
+	if g == DHGroupNull {
+		return 0
+	}
+	return (ffdhePrimes[g].BitLen() + 7) / 8
+}
+
+// generateKey returns a private exponent of g and its public value.
+func (g DHGroup) generateKey() (*big.Int, []byte, error) {
+	buf := make([]byte, privateKeyLen)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(big.NewInt(2), private, ffdhePrimes[g])
+	return private, public.FillBytes(make([]byte, g.valueLen())), nil
+}
+
+// sharedSecret returns the session key of private and the public value of the peer.
+func (g DHGroup) sharedSecret(private *big.Int, peerPublic []byte) ([]byte, error) {
+	p := ffdhePrimes[g]
+	if len(peerPublic) != g.valueLen() {
+		return nil, fmt.Errorf("invalid %s public value length %d", g, len(peerPublic))
+	}
+	y := new(big.Int).SetBytes(peerPublic)
+	// 1 < y < p-1, refusing the values of the small subgroup.
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(p, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("invalid %s public value", g)
+	}
+	secret := new(big.Int).Exp(y, private, p)
+	return secret.FillBytes(make([]byte, g.valueLen())), nil
+}
+
+// augmentedChallenge returns the challenge augmented with the session key of the Diffie-Hellman
+// exchange: HMAC(H(sessionKey), challenge), the challenge as is without a session key.
+func augmentedChallenge(h Hash, sessionKey []byte, challenge []byte) []byte {
+	if sessionKey == nil {
+		return challenge
+	}
+	mac := hmac.New(h.newHash(), h.sum(sessionKey))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// response returns the response to challenge of the party of role, "HostHost" or "Controller",
+// with its transformed key: HMAC(key, challenge || seqNum || transactionID || SC_C || role ||
+// nqn || 00h || peerNqn).
+func response(h Hash, key []byte, challenge []byte, seqNum uint32, transactionID uint16, role string, nqn string, peerNqn string) []byte {
+	mac := hmac.New(h.newHash(), key)
+	mac.Write(challenge)
+	mac.Write(binary.LittleEndian.AppendUint32(nil, seqNum))
+	mac.Write(binary.LittleEndian.AppendUint16(nil, transactionID))
+	// no secure channel concatenation
+	mac.Write([]byte{0})
+	mac.Write([]byte(role))
+	mac.Write([]byte(nqn))
+	mac.Write([]byte{0})
+	mac.Write([]byte(peerNqn))
+	return mac.Sum(nil)
+}
+
+// hostResponse returns the response of the host hostNqn to the challenge of the controller.
+func hostResponse(h Hash, secret *Secret, challenge []byte, seqNum uint32, transactionID uint16, hostNqn, subsysNqn string) []byte {
+	return response(h, secret.transform(hostNqn), challenge, seqNum, transactionID, "HostHost", hostNqn, subsysNqn)
+}
+
+// controllerResponse returns the response of the controller of subsysNqn to the challenge of the host.
+func controllerResponse(h Hash, ctrlSecret *Secret, challenge []byte, seqNum uint32, transactionID uint16, hostNqn, subsysNqn string) []byte {
+	return response(h, ctrlSecret.transform(subsysNqn), challenge, seqNum, transactionID, "Controller", subsysNqn, hostNqn)
+}
+
+// randomChallenge returns a random challenge of h and a non zero sequence number.
+func randomChallenge(h Hash) ([]byte, uint32, error) {
+	challenge := make([]byte, h.Size())
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, 0, err
+	}
+	var buf [4]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, 0, err
+		}
+		if seqNum := binary.LittleEndian.Uint32(buf[:]); seqNum != 0 {
+			return challenge, seqNum, nil
+		}
+	}
+}
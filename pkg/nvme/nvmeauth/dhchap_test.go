@@ -0,0 +1,191 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testHostNqn   = "nqn.2014-08.org.nvmexpress:uuid:host"
+	testSubsysNqn = "nqn.2014-08.org.nvmexpress.discovery"
+)
+
+// authenticate runs a transaction of host with controller, returning the error of the host.
+func authenticate(host *Host, controller *Controller) error {
+	if err := controller.Send(host.Negotiate()); err != nil {
+		return err
+	}
+	challenge, err := controller.Receive()
+	if err != nil {
+		return err
+	}
+	reply, err := host.Reply(challenge)
+	if err != nil {
+		controller.Send(host.Failure2(err))
+		return err
+	}
+	controller.Send(reply)
+	success1, err := controller.Receive()
+	if err != nil {
+		return err
+	}
+	success2, err := host.Success2(success1)
+	if err != nil {
+		var authErr *Error
+		if errors.As(err, &authErr) {
+			controller.Send(host.Failure2(err))
+		}
+		return err
+	}
+	if success2 != nil {
+		return controller.Send(success2)
+	}
+	return nil
+}
+
+func TestAuthentication(t *testing.T) {
+	secret := &Secret{Hash: HashSHA256, Key: bytes.Repeat([]byte{1}, 32)}
+	ctrlSecret := &Secret{Key: bytes.Repeat([]byte{2}, 48)}
+
+	for _, hash := range Hashes {
+		for _, dhGroup := range []DHGroup{DHGroupNull, DHGroupFFDHE2048, DHGroupFFDHE4096} {
+			for _, bidirectional := range []bool{false, true} {
+				keys := &HostKeys{Secret: secret, CtrlSecret: ctrlSecret, Hashes: []Hash{hash}, DHGroups: []DHGroup{dhGroup}}
+				controller := NewController(testHostNqn, testSubsysNqn, keys)
+				hostCtrlSecret := ctrlSecret
+				if !bidirectional {
+					hostCtrlSecret = nil
+				}
+				host := NewHost(testHostNqn, testSubsysNqn, secret, hostCtrlSecret, 7)
+				assert.NoError(t, authenticate(host, controller), "%s %s", hash, dhGroup)
+				assert.True(t, controller.Authenticated())
+				assert.Equal(t, hash, controller.hash)
+				assert.Equal(t, dhGroup, controller.dhGroup)
+			}
+		}
+	}
+}
+
+func TestAuthenticationFailure(t *testing.T) {
+	secret := &Secret{Key: bytes.Repeat([]byte{1}, 32)}
+	otherSecret := &Secret{Key: bytes.Repeat([]byte{3}, 32)}
+	ctrlSecret := &Secret{Key: bytes.Repeat([]byte{2}, 32)}
+
+	for name, tc := range map[string]struct {
+		keys       *HostKeys
+		secret     *Secret
+		ctrlSecret *Secret
+	}{
+		"wrong host secret": {
+			keys:   &HostKeys{Secret: otherSecret},
+			secret: secret,
+		},
+		"wrong controller secret": {
+			keys:       &HostKeys{Secret: secret, CtrlSecret: otherSecret},
+			secret:     secret,
+			ctrlSecret: ctrlSecret,
+		},
+		"no controller secret": {
+			keys:       &HostKeys{Secret: secret},
+			secret:     secret,
+			ctrlSecret: ctrlSecret,
+		},
+		"unusable hash": {
+			keys:   &HostKeys{Secret: secret, Hashes: []Hash{0x10}},
+			secret: secret,
+		},
+		"unusable group": {
+			keys:   &HostKeys{Secret: secret, DHGroups: []DHGroup{0x10}},
+			secret: secret,
+		},
+	} {
+		controller := NewController(testHostNqn, testSubsysNqn, tc.keys)
+		host := NewHost(testHostNqn, testSubsysNqn, tc.secret, tc.ctrlSecret, 1)
+		assert.Error(t, authenticate(host, controller), name)
+		assert.False(t, controller.Authenticated(), name)
+	}
+}
+
+func TestControllerUnexpectedMessage(t *testing.T) {
+	secret := &Secret{Key: bytes.Repeat([]byte{1}, 32)}
+	controller := NewController(testHostNqn, testSubsysNqn, &HostKeys{Secret: secret})
+	_, err := controller.Receive()
+	assert.Error(t, err)
+
+	// a success before the negotiation fails the transaction, and is reported by AUTH_Failure1
+	assert.Error(t, controller.Send(marshalSuccess2(1)))
+	failure1, err := controller.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{authTypeCommon, msgFailure1, 0, 0, 0, 0, failureReasonFailed, FailureIncorrectMessage}, failure1)
+
+	// a new transaction succeeds
+	host := NewHost(testHostNqn, testSubsysNqn, secret, nil, 2)
+	assert.NoError(t, authenticate(host, controller))
+	assert.True(t, controller.Authenticated())
+}
+
+func TestHostResponse(t *testing.T) {
+	secret := &Secret{Key: bytes.Repeat([]byte{1}, 32)}
+	challenge := bytes.Repeat([]byte{2}, 32)
+
+	mac := hmac.New(sha256.New, secret.Key)
+	mac.Write(challenge)
+	mac.Write([]byte{0x04, 0x03, 0x02, 0x01, 0x06, 0x05, 0x00})
+	mac.Write([]byte("HostHost" + testHostNqn + "\x00" + testSubsysNqn))
+	assert.Equal(t, mac.Sum(nil), hostResponse(HashSHA256, secret, challenge, 0x01020304, 0x0506, testHostNqn, testSubsysNqn))
+
+	mac = hmac.New(sha256.New, secret.Key)
+	mac.Write(challenge)
+	mac.Write([]byte{0x04, 0x03, 0x02, 0x01, 0x06, 0x05, 0x00})
+	mac.Write([]byte("Controller" + testSubsysNqn + "\x00" + testHostNqn))
+	assert.Equal(t, mac.Sum(nil), controllerResponse(HashSHA256, secret, challenge, 0x01020304, 0x0506, testHostNqn, testSubsysNqn))
+}
+
+func TestFFDHEPrimes(t *testing.T) {
+	for group, bits := range map[DHGroup]int{
+		DHGroupFFDHE2048: 2048,
+		DHGroupFFDHE3072: 3072,
+		DHGroupFFDHE4096: 4096,
+		DHGroupFFDHE6144: 6144,
+		DHGroupFFDHE8192: 8192,
+	} {
+		p := ffdhePrimes[group]
+		assert.Equal(t, bits, p.BitLen(), group.String())
+		assert.Equal(t, bits/8, group.valueLen())
+		// safe primes: q = (p-1)/2 is prime
+		q := new(big.Int).Rsh(p, 1)
+		if bits <= 3072 {
+			assert.True(t, p.ProbablyPrime(1), group.String())
+			assert.True(t, q.ProbablyPrime(1), group.String())
+		}
+	}
+
+	private, public, err := DHGroupFFDHE2048.generateKey()
+	assert.NoError(t, err)
+	_, err = DHGroupFFDHE2048.sharedSecret(private, public[1:])
+	assert.Error(t, err)
+	one := make([]byte, len(public))
+	one[len(one)-1] = 1
+	_, err = DHGroupFFDHE2048.sharedSecret(private, one)
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeauth
+
+import (
+	"crypto/hmac"
+)
+
+// Host is the host side of a DH-HMAC-CHAP transaction. it authenticates the host to the
+// controller with its secret, and the controller to the host with the controller secret if set:
+//
+//	AUTH_Send(Negotiate()), AUTH_Receive -> Reply(), AUTH_Send(reply),
+//	AUTH_Receive -> Success2(), AUTH_Send(success2) if not nil.
+//
+// the messages of a failed step that returns an *Error are followed by AUTH_Send(Failure2(err)).
+type Host struct {
+	hostNqn       string
+	subsysNqn     string
+	secret        *Secret
+	ctrlSecret    *Secret
+	transactionID uint16
+	hash          Hash
+	sessionKey    []byte
+	// challenge and seqNum of the controller, if authenticated.
+	challenge []byte
+	seqNum    uint32
+}
+
+// NewHost returns the host hostNqn authenticating to the controller of subsysNqn, in the
+// transaction transactionID. ctrlSecret is nil if the controller isn't authenticated.
+func NewHost(hostNqn, subsysNqn string, secret, ctrlSecret *Secret, transactionID uint16) *Host {
+	return &Host{
+		hostNqn:       hostNqn,
+		subsysNqn:     subsysNqn,
+		secret:        secret,
+		ctrlSecret:    ctrlSecret,
+		transactionID: transactionID,
+	}
+}
+
+// Negotiate returns the AUTH_Negotiate message, offering the hashes and the groups supported.
+func (h *Host) Negotiate() []byte {
+	msg := &negotiateMessage{transactionID: h.transactionID, hashes: Hashes, dhGroups: DHGroups}
+	return msg.marshal()
+}
+
+// Reply returns the DH-HMAC-CHAP_Reply message to the DH-HMAC-CHAP_Challenge message of the controller.
+func (h *Host) Reply(msg []byte) ([]byte, error) {
+	challenge, err := parseChallengeMessage(msg, h.transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if !challenge.hash.valid() {
+		return nil, failure(FailureHashUnusable, "controller selected %s", challenge.hash)
+	}
+	if !challenge.dhGroup.valid() {
+		return nil, failure(FailureDHGroupUnusable, "controller selected %s", challenge.dhGroup)
+	}
+	h.hash = challenge.hash
+	if len(challenge.challenge) != h.hash.Size() {
+		return nil, failure(FailureIncorrectPayload, "challenge of %d bytes, expected %d for %s", len(challenge.challenge), h.hash.Size(), h.hash)
+	}
+
+	reply := &replyMessage{transactionID: h.transactionID}
+	if challenge.dhGroup != DHGroupNull {
+		private, public, err := challenge.dhGroup.generateKey()
+		if err != nil {
+			return nil, err
+		}
+		h.sessionKey, err = challenge.dhGroup.sharedSecret(private, challenge.dhValue)
+		if err != nil {
+			return nil, failure(FailureIncorrectPayload, "%v", err)
+		}
+		reply.dhValue = public
+	} else if len(challenge.dhValue) != 0 {
+		return nil, failure(FailureIncorrectPayload, "DH value of %d bytes with the null group", len(challenge.dhValue))
+	}
+	reply.response = hostResponse(h.hash, h.secret, augmentedChallenge(h.hash, h.sessionKey, challenge.challenge),
+		challenge.seqNum, h.transactionID, h.hostNqn, h.subsysNqn)
+	if h.ctrlSecret != nil {
+		h.challenge, h.seqNum, err = randomChallenge(h.hash)
+		if err != nil {
+			return nil, err
+		}
+		reply.challenge = h.challenge
+		reply.seqNum = h.seqNum
+	}
+	return reply.marshal(), nil
+}
+
+// Success2 verifies the DH-HMAC-CHAP_Success1 message of the controller, and returns the
+// DH-HMAC-CHAP_Success2 message that ends the transaction, nil if the controller isn't authenticated.
+func (h *Host) Success2(msg []byte) ([]byte, error) {
+	success1, err := parseSuccess1Message(msg, h.transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if success1.hashLen != h.hash.Size() {
+		return nil, failure(FailureIncorrectPayload, "success of %d bytes hash, expected %d for %s", success1.hashLen, h.hash.Size(), h.hash)
+	}
+	if h.ctrlSecret == nil {
+		return nil, nil
+	}
+	if success1.response == nil {
+		return nil, failure(FailureFailed, "controller didn't respond to the challenge of the host")
+	}
+	expected := controllerResponse(h.hash, h.ctrlSecret, augmentedChallenge(h.hash, h.sessionKey, h.challenge),
+		h.seqNum, h.transactionID, h.hostNqn, h.subsysNqn)
+	if !hmac.Equal(success1.response, expected) {
+		return nil, failure(FailureFailed, "controller of %s failed to authenticate", h.subsysNqn)
+	}
+	return marshalSuccess2(h.transactionID), nil
+}
+
+// Failure2 returns the AUTH_Failure2 message that aborts the transaction after err.
+func (h *Host) Failure2(err error) []byte {
+	return marshalFailure(msgFailure2, h.transactionID, err)
+}
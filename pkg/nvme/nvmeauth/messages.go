@@ -0,0 +1,310 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeauth
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The security protocol of the AUTH_Send and AUTH_Receive commands: SECP, SPSP0 and SPSP1.
+const (
+	SecurityProtocol = 0xe9
+	SPSP0            = 0x01
+	SPSP1            = 0x01
+)
+
+// The types (auth_type) and identifiers (auth_id) of the messages.
+const (
+	authTypeCommon = 0x00
+	authTypeDHChap = 0x01
+
+	msgNegotiate = 0x00
+	msgChallenge = 0x01
+	msgReply     = 0x02
+	msgSuccess1  = 0x03
+	msgSuccess2  = 0x04
+	msgFailure2  = 0xf0
+	msgFailure1  = 0x91
+)
+
+const (
+	// authIDDHChap identifies DH-HMAC-CHAP in the protocol descriptors of AUTH_Negotiate.
+	authIDDHChap = 0x01
+	// headerLen is the length of the fields common to the messages: auth_type, auth_id and t_id.
+	headerLen     = 6
+	descriptorLen = 64
+	// maxIDs is the number of the hash and of the group identifiers of a protocol descriptor.
+	maxIDs = 30
+	// failureReasonFailed is the reason code of the failures, explained by their reason code explanation.
+	failureReasonFailed = 0x01
+)
+
+// The reason code explanations of the failures.
+const (
+	FailureFailed           = 0x01
+	FailureNotUsable        = 0x02
+	FailureConcatMismatch   = 0x03
+	FailureHashUnusable     = 0x04
+	FailureDHGroupUnusable  = 0x05
+	FailureIncorrectPayload = 0x06
+	FailureIncorrectMessage = 0x07
+)
+
+// Error is a failed authentication, with the reason code explanation the peer is notified with.
+type Error struct {
+	Reason uint8
+	msg    string
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+func failure(reason uint8, format string, args ...interface{}) *Error {
+	return &Error{Reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+func appendHeader(b []byte, authType, authID uint8, transactionID uint16) []byte {
+	b = append(b, authType, authID, 0, 0)
+	return binary.LittleEndian.AppendUint16(b, transactionID)
+}
+
+// parseHeader returns the type, the identifier and the transaction of the message b.
+func parseHeader(b []byte) (uint8, uint8, uint16, error) {
+	if len(b) < headerLen {
+		return 0, 0, 0, failure(FailureIncorrectPayload, "authentication message of %d bytes is too short", len(b))
+	}
+	return b[0], b[1], binary.LittleEndian.Uint16(b[4:]), nil
+}
+
+// expectMessage checks that b is the message authID of the transaction transactionID. a failure
+// message of the peer is returned as an error.
+func expectMessage(b []byte, authID uint8, transactionID uint16, minLen int) error {
+	msgType, msgID, tid, err := parseHeader(b)
+	if err != nil {
+		return err
+	}
+	if msgType == authTypeCommon && (msgID == msgFailure1 || msgID == msgFailure2) {
+		return peerFailure(b)
+	}
+	expectedType := uint8(authTypeDHChap)
+	if authID == msgNegotiate {
+		expectedType = authTypeCommon
+	}
+	if msgType != expectedType || msgID != authID {
+		return failure(FailureIncorrectMessage, "unexpected authentication message %#x/%#x, expected %#x/%#x", msgType, msgID, expectedType, authID)
+	}
+	if tid != transactionID {
+		return failure(FailureIncorrectPayload, "authentication message of transaction %d, expected %d", tid, transactionID)
+	}
+	if len(b) < minLen {
+		return failure(FailureIncorrectPayload, "authentication message %#x of %d bytes is too short", authID, len(b))
+	}
+	return nil
+}
+
+// peerFailure returns the error of the failure message b of the peer.
+func peerFailure(b []byte) error {
+	reason := uint8(0)
+	if len(b) >= headerLen+2 {
+		reason = b[headerLen+1]
+	}
+	return fmt.Errorf("authentication failed by the peer, reason %#x", reason)
+}
+
+type negotiateMessage struct {
+	transactionID uint16
+	hashes        []Hash
+	dhGroups      []DHGroup
+}
+
+func (m *negotiateMessage) marshal() []byte {
+	b := appendHeader(nil, authTypeCommon, msgNegotiate, m.transactionID)
+	// no secure channel concatenation, a single DH-HMAC-CHAP descriptor
+	b = append(b, 0, 1)
+	descriptor := make([]byte, descriptorLen)
+	descriptor[0] = authIDDHChap
+	descriptor[2] = uint8(len(m.hashes))
+	descriptor[3] = uint8(len(m.dhGroups))
+	for i, h := range m.hashes {
+		descriptor[4+i] = uint8(h)
+	}
+	for i, g := range m.dhGroups {
+		descriptor[4+maxIDs+i] = uint8(g)
+	}
+	return append(b, descriptor...)
+}
+
+func parseNegotiateMessage(b []byte) (*negotiateMessage, error) {
+	_, _, tid, err := parseHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectMessage(b, msgNegotiate, tid, headerLen+2); err != nil {
+		return nil, err
+	}
+	m := &negotiateMessage{transactionID: tid}
+	if b[headerLen] != 0 {
+		return nil, failure(FailureConcatMismatch, "secure channel concatenation %#x is not supported", b[headerLen])
+	}
+	napd := int(b[headerLen+1])
+	if len(b) < headerLen+2+napd*descriptorLen {
+		return nil, failure(FailureIncorrectPayload, "AUTH_Negotiate of %d bytes is too short for %d descriptors", len(b), napd)
+	}
+	for i := 0; i < napd; i++ {
+		descriptor := b[headerLen+2+i*descriptorLen:][:descriptorLen]
+		if descriptor[0] != authIDDHChap {
+			continue
+		}
+		halen, dhlen := int(descriptor[2]), int(descriptor[3])
+		if halen > maxIDs || dhlen > maxIDs {
+			return nil, failure(FailureIncorrectPayload, "invalid DH-HMAC-CHAP descriptor, %d hashes and %d groups", halen, dhlen)
+		}
+		for _, id := range descriptor[4:][:halen] {
+			m.hashes = append(m.hashes, Hash(id))
+		}
+		for _, id := range descriptor[4+maxIDs:][:dhlen] {
+			m.dhGroups = append(m.dhGroups, DHGroup(id))
+		}
+		return m, nil
+	}
+	return nil, failure(FailureNotUsable, "AUTH_Negotiate doesn't offer DH-HMAC-CHAP")
+}
+
+type challengeMessage struct {
+	transactionID uint16
+	hash          Hash
+	dhGroup       DHGroup
+	seqNum        uint32
+	challenge     []byte
+	dhValue       []byte
+}
+
+func (m *challengeMessage) marshal() []byte {
+	b := appendHeader(nil, authTypeDHChap, msgChallenge, m.transactionID)
+	b = append(b, uint8(len(m.challenge)), 0, uint8(m.hash), uint8(m.dhGroup))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.dhValue)))
+	b = binary.LittleEndian.AppendUint32(b, m.seqNum)
+	b = append(b, m.challenge...)
+	return append(b, m.dhValue...)
+}
+
+func parseChallengeMessage(b []byte, transactionID uint16) (*challengeMessage, error) {
+	if err := expectMessage(b, msgChallenge, transactionID, 16); err != nil {
+		return nil, err
+	}
+	hl, dhvlen := int(b[6]), int(binary.LittleEndian.Uint16(b[10:]))
+	if len(b) < 16+hl+dhvlen {
+		return nil, failure(FailureIncorrectPayload, "DH-HMAC-CHAP_Challenge of %d bytes is too short", len(b))
+	}
+	return &challengeMessage{
+		transactionID: transactionID,
+		hash:          Hash(b[8]),
+		dhGroup:       DHGroup(b[9]),
+		seqNum:        binary.LittleEndian.Uint32(b[12:]),
+		challenge:     b[16:][:hl],
+		dhValue:       b[16+hl:][:dhvlen],
+	}, nil
+}
+
+type replyMessage struct {
+	transactionID uint16
+	response      []byte
+	// challenge of the controller by the host, nil if the controller isn't authenticated.
+	challenge []byte
+	seqNum    uint32
+	dhValue   []byte
+}
+
+func (m *replyMessage) marshal() []byte {
+	b := appendHeader(nil, authTypeDHChap, msgReply, m.transactionID)
+	cvalid := uint8(0)
+	challenge := make([]byte, len(m.response))
+	if m.challenge != nil {
+		cvalid = 1
+		challenge = m.challenge
+	}
+	b = append(b, uint8(len(m.response)), 0, cvalid, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.dhValue)))
+	b = binary.LittleEndian.AppendUint32(b, m.seqNum)
+	b = append(b, m.response...)
+	b = append(b, challenge...)
+	return append(b, m.dhValue...)
+}
+
+func parseReplyMessage(b []byte, transactionID uint16) (*replyMessage, error) {
+	if err := expectMessage(b, msgReply, transactionID, 16); err != nil {
+		return nil, err
+	}
+	hl, dhvlen := int(b[6]), int(binary.LittleEndian.Uint16(b[10:]))
+	if len(b) < 16+2*hl+dhvlen {
+		return nil, failure(FailureIncorrectPayload, "DH-HMAC-CHAP_Reply of %d bytes is too short", len(b))
+	}
+	m := &replyMessage{
+		transactionID: transactionID,
+		response:      b[16:][:hl],
+		seqNum:        binary.LittleEndian.Uint32(b[12:]),
+		dhValue:       b[16+2*hl:][:dhvlen],
+	}
+	if b[8]&1 != 0 {
+		m.challenge = b[16+hl:][:hl]
+	}
+	return m, nil
+}
+
+type success1Message struct {
+	transactionID uint16
+	hashLen       int
+	// response of the controller, nil if the controller isn't authenticated.
+	response []byte
+}
+
+func (m *success1Message) marshal() []byte {
+	b := appendHeader(nil, authTypeDHChap, msgSuccess1, m.transactionID)
+	rvalid := uint8(0)
+	if m.response != nil {
+		rvalid = 1
+	}
+	b = append(b, uint8(m.hashLen), 0, rvalid, 0, 0, 0, 0, 0, 0, 0)
+	return append(b, m.response...)
+}
+
+func parseSuccess1Message(b []byte, transactionID uint16) (*success1Message, error) {
+	if err := expectMessage(b, msgSuccess1, transactionID, 16); err != nil {
+		return nil, err
+	}
+	m := &success1Message{transactionID: transactionID, hashLen: int(b[6])}
+	if b[8]&1 != 0 {
+		if len(b) < 16+m.hashLen {
+			return nil, failure(FailureIncorrectPayload, "DH-HMAC-CHAP_Success1 of %d bytes is too short", len(b))
+		}
+		m.response = b[16:][:m.hashLen]
+	}
+	return m, nil
+}
+
+func marshalSuccess2(transactionID uint16) []byte {
+	return append(appendHeader(nil, authTypeDHChap, msgSuccess2, transactionID), make([]byte, 10)...)
+}
+
+// marshalFailure returns the failure message authID, AUTH_Failure1 or AUTH_Failure2, of err.
+func marshalFailure(authID uint8, transactionID uint16, err error) []byte {
+	reason := uint8(FailureFailed)
+	if authErr, ok := err.(*Error); ok {
+		reason = authErr.Reason
+	}
+	return append(appendHeader(nil, authTypeCommon, authID, transactionID), failureReasonFailed, reason)
+}
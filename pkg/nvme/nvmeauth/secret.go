@@ -0,0 +1,87 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nvmeauth implements the in-band authentication of NVMe over Fabrics: the DH-HMAC-CHAP
+// protocol of the host and of the controller, with the secrets in the DHHC-1 format the kernel
+// and nvme-cli use.
+package nvmeauth
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+const secretPrefix = "DHHC-1"
+
+// Secret is a DH-HMAC-CHAP secret in the DHHC-1 format, "DHHC-1:<hh>:<base64 of the key and its
+// CRC-32>:".
+type Secret struct {
+	// Hash the key is transformed with before use, 0 to use the key as is.
+	Hash Hash
+	Key  []byte
+}
+
+// ParseSecret parses a secret in the DHHC-1 format.
+func ParseSecret(s string) (*Secret, error) {
+	fields := strings.Split(strings.TrimSpace(s), ":")
+	if len(fields) != 4 || fields[0] != secretPrefix || fields[3] != "" {
+		return nil, fmt.Errorf("invalid DH-HMAC-CHAP secret, expected %s:<hh>:<key>:", secretPrefix)
+	}
+	var secret Secret
+	switch fields[1] {
+	case "00":
+	case "01":
+		secret.Hash = HashSHA256
+	case "02":
+		secret.Hash = HashSHA384
+	case "03":
+		secret.Hash = HashSHA512
+	default:
+		return nil, fmt.Errorf("invalid DH-HMAC-CHAP secret hash %q", fields[1])
+	}
+	decoded, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid DH-HMAC-CHAP secret: %w", err)
+	}
+	if len(decoded) != 32+4 && len(decoded) != 48+4 && len(decoded) != 64+4 {
+		return nil, fmt.Errorf("invalid DH-HMAC-CHAP secret length %d", len(decoded)-4)
+	}
+	secret.Key = decoded[:len(decoded)-4]
+	if crc := binary.LittleEndian.Uint32(decoded[len(secret.Key):]); crc != crc32.ChecksumIEEE(secret.Key) {
+		return nil, fmt.Errorf("invalid DH-HMAC-CHAP secret, bad CRC-32")
+	}
+	return &secret, nil
+}
+
+// String returns the secret in the DHHC-1 format.
+func (s *Secret) String() string {
+	key := binary.LittleEndian.AppendUint32(append([]byte{}, s.Key...), crc32.ChecksumIEEE(s.Key))
+	return fmt.Sprintf("%s:%02d:%s:", secretPrefix, s.Hash, base64.StdEncoding.EncodeToString(key))
+}
+
+// transform returns the key of the responses of nqn: HMAC(key, nqn || "NVMe-over-Fabrics") with
+// the hash of the secret, the key as is if the secret has none.
+func (s *Secret) transform(nqn string) []byte {
+	if s.Hash == 0 {
+		return s.Key
+	}
+	mac := hmac.New(s.Hash.newHash(), s.Key)
+	mac.Write([]byte(nqn))
+	mac.Write([]byte("NVMe-over-Fabrics"))
+	return mac.Sum(nil)
+}
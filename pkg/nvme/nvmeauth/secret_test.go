@@ -0,0 +1,60 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecret(t *testing.T) {
+	for _, secret := range []*Secret{
+		{Key: bytes.Repeat([]byte{1}, 32)},
+		{Hash: HashSHA256, Key: bytes.Repeat([]byte{2}, 32)},
+		{Hash: HashSHA384, Key: bytes.Repeat([]byte{3}, 48)},
+		{Hash: HashSHA512, Key: bytes.Repeat([]byte{4}, 64)},
+	} {
+		parsed, err := ParseSecret(secret.String())
+		assert.NoError(t, err)
+		assert.Equal(t, secret, parsed)
+	}
+
+	valid := (&Secret{Key: bytes.Repeat([]byte{1}, 32)}).String()
+	for _, s := range []string{
+		"",
+		"DHHC-1:00:c2VjcmV0MQ==:",
+		"DHHC-2" + valid[6:],
+		"DHHC-1:04" + valid[9:],
+		valid[:len(valid)-1],
+		valid[:12] + "A" + valid[13:],
+	} {
+		_, err := ParseSecret(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestSecretTransform(t *testing.T) {
+	secret := &Secret{Key: bytes.Repeat([]byte{1}, 32)}
+	assert.Equal(t, secret.Key, secret.transform("nqn.host"))
+
+	secret.Hash = HashSHA384
+	mac := hmac.New(sha512.New384, secret.Key)
+	mac.Write([]byte("nqn.hostNVMe-over-Fabrics"))
+	assert.Equal(t, mac.Sum(nil), secret.transform("nqn.host"))
+}
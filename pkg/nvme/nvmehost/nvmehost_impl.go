@@ -16,6 +16,7 @@ package nvmehost
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
 	"github.com/sirupsen/logrus"
@@ -35,6 +36,8 @@ type connInfo struct {
 }
 
 type hostApiImp struct {
+	// mu protects ConnTbl and i. discovery requests of different clusters run concurrently.
+	mu                       sync.Mutex
 	ConnTbl                  map[hostapi.ConnectionID]*connInfo
 	log                      *logrus.Entry
 	i                        int
@@ -53,23 +56,26 @@ func NewHostApi(logPagePaginationEnabled bool, nvmeHostIDPath string) hostapi.Ho
 	}
 }
 
-func (h *hostApiImp) Discover(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+func (h *hostApiImp) Discover(discoveryRequest *hostapi.DiscoverRequest) (*hostapi.LogPage, hostapi.ConnectionID, error) {
 	// convert discovery request type
 	req := createDiscoveryRequest(discoveryRequest)
 	client := NewClient(h.logPagePaginationEnabled, h.nvmeHostIDPath) // creates aenCh
 
-	response, err := client.Discover(req)
+	response, genCtr, err := client.Discover(req)
 	if err != nil {
 		return nil, hostapi.ConnectionID("0"), err
 	}
+	logPage := &hostapi.LogPage{GenCtr: genCtr, Entries: createDiscoveryEntries(response), Identify: client.Identify()}
 	if discoveryRequest.Kato == 0 {
 		client.Stop()
-		return createDiscoveryEntries(response), hostapi.ConnectionID("0"), err
+		return logPage, hostapi.ConnectionID("0"), err
 	}
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	// if err on discover - kill, return connection_id
 	connection_id, found := h.findClient(discoveryRequest)
-	h.Disconnect(connection_id)
+	h.disconnect(connection_id)
 
 	if err != nil {
 		h.log.Debugf("Failed discovery (kato=%v) was in db? %v", discoveryRequest.Kato, found)
@@ -84,22 +90,18 @@ func (h *hostApiImp) Discover(discoveryRequest *hostapi.DiscoverRequest) ([]*hos
 		h.i++
 	}
 
-	h.ConnTbl[connection_id] = &connInfo{
+	info := &connInfo{
 		request: discoveryRequest,
 		client:  client,
 	}
+	h.ConnTbl[connection_id] = info
 
-	go h.handleChannel(connection_id)
+	go h.handleChannel(connection_id, info)
 
-	return createDiscoveryEntries(response), connection_id, nil
+	return logPage, connection_id, nil
 }
 
-func (h *hostApiImp) handleChannel(connection_id hostapi.ConnectionID) {
-
-	info, ok := h.ConnTbl[connection_id]
-	if !ok {
-		panic("started loop for non exist cid")
-	}
+func (h *hostApiImp) handleChannel(connection_id hostapi.ConnectionID, info *connInfo) {
 	h.log.Debugf("Start CHandler [cid=%v]", connection_id)
 	for {
 		select {
@@ -127,6 +129,13 @@ func (h *hostApiImp) handleChannel(connection_id hostapi.ConnectionID) {
 }
 
 func (h *hostApiImp) Disconnect(connectionID hostapi.ConnectionID) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.disconnect(connectionID)
+}
+
+// disconnect must be called with h.mu held.
+func (h *hostApiImp) disconnect(connectionID hostapi.ConnectionID) error {
 	info, ok := h.ConnTbl[connectionID]
 	if !ok {
 		err := fmt.Errorf("connection with id %v not found", connectionID)
@@ -153,7 +162,13 @@ func (h *hostApiImp) findClient(r *hostapi.DiscoverRequest) (hostapi.ConnectionI
 			s.Traddr == r.Traddr &&
 			s.Trsvcid == r.Trsvcid &&
 			s.Hostnqn == r.Hostnqn &&
-			s.Hostaddr == r.Hostaddr {
+			s.Hostaddr == r.Hostaddr &&
+			s.HdrDigest == r.HdrDigest &&
+			s.DataDigest == r.DataDigest &&
+			s.TLS == r.TLS &&
+			s.TLSKeyFile == r.TLSKeyFile &&
+			s.DhChapSecret == r.DhChapSecret &&
+			s.DhChapCtrlSecret == r.DhChapCtrlSecret {
 
 			if s.Kato != r.Kato {
 				// same request but different kato field [interval]
@@ -175,12 +190,18 @@ func (h *hostApiImp) findClient(r *hostapi.DiscoverRequest) (hostapi.ConnectionI
 func createDiscoveryRequest(discoveryRequest *hostapi.DiscoverRequest) *DiscoverRequest {
 	// convert discover requests
 	return &DiscoverRequest{
-		Transport: discoveryRequest.Transport,
-		Traddr:    discoveryRequest.Traddr,
-		Trsvcid:   discoveryRequest.Trsvcid,
-		Hostnqn:   discoveryRequest.Hostnqn,
-		Hostaddr:  discoveryRequest.Hostaddr,
-		Kato:      discoveryRequest.Kato,
+		Transport:        discoveryRequest.Transport,
+		Traddr:           discoveryRequest.Traddr,
+		Trsvcid:          discoveryRequest.Trsvcid,
+		Hostnqn:          discoveryRequest.Hostnqn,
+		Hostaddr:         discoveryRequest.Hostaddr,
+		Kato:             discoveryRequest.Kato,
+		HdrDigest:        discoveryRequest.HdrDigest,
+		DataDigest:       discoveryRequest.DataDigest,
+		TLS:              discoveryRequest.TLS,
+		TLSKeyFile:       discoveryRequest.TLSKeyFile,
+		DhChapSecret:     discoveryRequest.DhChapSecret,
+		DhChapCtrlSecret: discoveryRequest.DhChapCtrlSecret,
 	}
 }
 
@@ -192,12 +213,14 @@ func createDiscoveryEntries(entries []*NvmeDiscPageEntry) []*hostapi.NvmeDiscPag
 	}
 	for _, entry := range entries {
 		res := &hostapi.NvmeDiscPageEntry{
-			PortID:  entry.PortID,
-			CntlID:  entry.CntlID,
-			SubType: entry.SubType,
-			TrsvcID: entry.TrsvcID,
-			Subnqn:  entry.Subnqn,
-			Traddr:  entry.Traddr,
+			PortID:    entry.PortID,
+			CntlID:    entry.CntlID,
+			SubType:   entry.SubType,
+			Eflags:    entry.Eflags,
+			TrsvcID:   entry.TrsvcID,
+			Subnqn:    entry.Subnqn,
+			Traddr:    entry.Traddr,
+			Transport: entry.Transport,
 		}
 		response = append(response, res)
 	}
@@ -27,6 +27,8 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmetls"
 )
 
 //#cgo CFLAGS: -I../
@@ -45,6 +47,9 @@ type NvmeDiscPageEntry struct {
 	Subnqn  string
 	Traddr  string
 	SubType nvme.SubsystemType
+	Eflags  uint16
+	// Transport of the entry, empty if unknown.
+	Transport string
 }
 
 type DiscoverRequest struct {
@@ -54,12 +59,27 @@ type DiscoverRequest struct {
 	Hostnqn   string
 	Hostaddr  string
 	Kato      time.Duration
+	// HdrDigest and DataDigest enable the header and the data digests of the queue.
+	HdrDigest  bool
+	DataDigest bool
+	// TLS secures the queue with TLS 1.3, with the PSK of the host and the discovery subsystem
+	// in TLSKeyFile.
+	TLS        bool
+	TLSKeyFile string
+	// DhChapSecret authenticates the host to a discovery controller that requires it, and
+	// DhChapCtrlSecret the discovery controller to the host, in the DHHC-1 format.
+	DhChapSecret     string
+	DhChapCtrlSecret string
 }
 
 // TCPClient tcp based client API
 type TCPClient interface {
 	Stop() error
-	Discover(discoverRequest *DiscoverRequest) ([]*NvmeDiscPageEntry, error)
+	// Discover returns the discovery log page entries and the generation counter of the log page.
+	Discover(discoverRequest *DiscoverRequest) ([]*NvmeDiscPageEntry, uint64, error)
+	// Identify returns the Identify Controller data of the discovery controller, nil
+	// before Discover identified it.
+	Identify() *nvme.IdentifyController
 	AENChan() <-chan interface{}
 	KAChan() chan interface{}
 }
@@ -77,6 +97,7 @@ type tcpClient struct {
 	cancel                   context.CancelFunc
 	logPagePaginationEnabled bool
 	nvmeHostIDPath           string
+	identify                 *nvme.IdentifyController
 }
 
 // NewClient creates NVMeTCP client
@@ -113,6 +134,10 @@ func (client *tcpClient) AENChan() <-chan interface{} {
 	return client.aenCh
 }
 
+func (client *tcpClient) Identify() *nvme.IdentifyController {
+	return client.identify
+}
+
 // NVMe connect timeout before KATO starts.
 func (client *tcpClient) startStopTimer(timeout time.Duration) (cancel func()) {
 	ctx, cancelFunc := context.WithCancel(context.Background())
@@ -131,12 +156,12 @@ func (client *tcpClient) startStopTimer(timeout time.Duration) (cancel func()) {
 }
 
 // Run starts accepting tcp connections on NVMe server
-func (client *tcpClient) Discover(discoverRequest *DiscoverRequest) ([]*NvmeDiscPageEntry, error) {
+func (client *tcpClient) Discover(discoverRequest *DiscoverRequest) ([]*NvmeDiscPageEntry, uint64, error) {
 	client.log.Debugf("enter discover")
 	client.remoteAddress = discoverRequest.Traddr
 	hostID, err := nvme.GetOrCreateHostID(client.log.Logger, client.nvmeHostIDPath)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if !isValidUUID(hostID) {
 		panic(fmt.Sprintf("invalid host id: %q", hostID))
@@ -147,20 +172,50 @@ func (client *tcpClient) Discover(discoverRequest *DiscoverRequest) ([]*NvmeDisc
 
 	addr := net.JoinHostPort(client.remoteAddress, strconv.Itoa(discoverRequest.Trsvcid))
 	dialer := net.Dialer{Timeout: client.keepAlivePeriod}
+	if discoverRequest.Hostaddr != "" {
+		hostaddr, zone := nvme.SplitZone(discoverRequest.Hostaddr)
+		hostIP := net.ParseIP(hostaddr)
+		if hostIP == nil {
+			return nil, 0, fmt.Errorf("invalid host address %q", discoverRequest.Hostaddr)
+		}
+		if zone == "" && hostIP.IsLinkLocalUnicast() {
+			// a link-local source is bound to the interface of the target zone.
+			_, zone = nvme.SplitZone(discoverRequest.Traddr)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: hostIP, Zone: zone}
+	}
 	conn, err := dialer.Dial("tcp", addr)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	// conversion
 	tcpConn, ok := conn.(*net.TCPConn)
 	if !ok {
-		return nil, fmt.Errorf("type assert failed: %w", err)
+		return nil, 0, fmt.Errorf("type assert failed: %w", err)
 	}
 	client.tcpConn = tcpConn
+	var tlsConn *nvmetls.Conn
+	if discoverRequest.TLS {
+		psk, err := loadPSK(discoverRequest.TLSKeyFile, discoverRequest.Hostnqn)
+		if err != nil {
+			return nil, 0, err
+		}
+		tlsConn = nvmetls.Client(conn, &nvmetls.Config{PSK: psk})
+		conn = tlsConn
+	}
 	client.tcpQ = newNvmeTCPQueue(1, conn)
 	cancel := client.startStopTimer(10*time.Second)
 	defer cancel()
 
+	if tlsConn != nil {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, 0, fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+		}
+	}
+	if err := client.tcpQ.initConnection(discoverRequest.HdrDigest, discoverRequest.DataDigest); err != nil {
+		return nil, 0, err
+	}
+
 	// now the code become async and we need to use the sq completion queue.
 	client.wg.Add(1)
 	go func() {
@@ -179,31 +234,43 @@ func (client *tcpClient) Discover(discoverRequest *DiscoverRequest) ([]*NvmeDisc
 		}
 	}()
 
-	if err := client.tcpQ.sendNvmeInitConnection(); err != nil {
-		return nil, err
-	}
-
-	if err := client.tcpQ.sendConnectRequest(client.ctx, discoverRequest.Hostnqn, hostID); err != nil {
+	connectResult, err := client.tcpQ.sendConnectRequest(client.ctx, discoverRequest.Hostnqn, hostID)
+	if err != nil {
 		//client.log.WithError(err).Errorf("NVMe connect failed")
-		return nil, err
+		return nil, 0, err
+	}
+	// the host authenticates when required, and to authenticate the controller.
+	if connectResult&(nvme.NVME_CONNECT_AUTHREQ_ATR|nvme.NVME_CONNECT_AUTHREQ_ASCR) != 0 || discoverRequest.DhChapCtrlSecret != "" {
+		if err := client.authenticate(discoverRequest, connectResult); err != nil {
+			return nil, 0, fmt.Errorf("authentication with %s failed: %w", addr, err)
+		}
 	}
 
 	err = client.tcpQ.setProperties(client.ctx, false)
 	if err != nil {
 		//client.log.WithError(err).Errorf("NVMe set feature failed")
-		return nil, err
+		return nil, 0, err
 	}
-	if err := client.tcpQ.sendIdentifyRequest(client.ctx); err != nil {
-		return nil, err
+	identify, err := client.tcpQ.sendIdentifyRequest(client.ctx)
+	if err != nil {
+		return nil, 0, err
 	}
-
-	if err := client.tcpQ.sendAsyncEventSetFeature(client.ctx); err != nil {
-		return nil, err
+	client.identify = identify
+	client.log.Debugf("identified discovery controller %d of %q: %s %s %s, mdts %d, kas %d, oaes %#x",
+		identify.CntlID, identify.Subnqn, identify.Mn, identify.Sn, identify.Fr, identify.Mdts, identify.Kas, identify.Oaes)
+
+	aen := identify.DiscoveryLogChangeNotices()
+	if aen {
+		if err := client.tcpQ.sendAsyncEventSetFeature(client.ctx); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		client.log.Debugf("discovery controller doesn't send discovery log page change notices")
 	}
 
-	entries, err := client.tcpQ.getLogPageEntries(client.ctx, client.logPagePaginationEnabled)
+	entries, genCtr, err := client.tcpQ.getLogPageEntries(client.ctx, client.logPagePaginationEnabled)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	response := []*NvmeDiscPageEntry{}
 	for _, entry := range entries {
@@ -214,24 +281,61 @@ func (client *tcpClient) Discover(discoverRequest *DiscoverRequest) ([]*NvmeDisc
 		}
 
 		res := &NvmeDiscPageEntry{
-			PortID:  entry.PortID,
-			CntlID:  entry.CntlID,
-			SubType: entry.SubType,
-			TrsvcID: uint16(targetServiceID),
-			Subnqn:  strings.TrimRight(string(entry.Subnqn[:]), "\x00"),
-			Traddr:  strings.TrimRight(string(entry.Traddr[:]), "\x00"),
+			PortID:    entry.PortID,
+			CntlID:    entry.CntlID,
+			SubType:   entry.SubType,
+			Eflags:    entry.Eflags,
+			TrsvcID:   uint16(targetServiceID),
+			Subnqn:    strings.TrimRight(string(entry.Subnqn[:]), "\x00"),
+			Traddr:    strings.TrimRight(string(entry.Traddr[:]), "\x00"),
+			Transport: nvme.TransportName(entry.TrType),
 		}
 		response = append(response, res)
 	}
 
 	if discoverRequest.Kato > 0 {
 		client.log.Debugf("started routines")
-		client.pollAEN()
-		go client.tcpQ.keepAlive(client.ctx, discoverRequest.Kato)
+		if aen {
+			client.pollAEN()
+		}
+		go client.tcpQ.keepAlive(client.ctx, identify.KeepAliveTimeout(discoverRequest.Kato))
 	}
 
 	cancel()
-	return response, nil
+	return response, genCtr, nil
+}
+
+// loadPSK returns the TLS PSK of hostnqn and the discovery subsystem, from the key file.
+func loadPSK(keyFile string, hostnqn string) (*nvmetls.PSK, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("TLS requires a key file")
+	}
+	keys, err := nvmetls.LoadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return keys.PSK(hostnqn, nvme.DiscoverySubsysName)
+}
+
+// authenticate runs the DH-HMAC-CHAP authentication of the queue, with the secrets of discoverRequest.
+func (client *tcpClient) authenticate(discoverRequest *DiscoverRequest, connectResult uint32) error {
+	if connectResult&nvme.NVME_CONNECT_AUTHREQ_ASCR != 0 {
+		return fmt.Errorf("secure channel concatenation is not supported")
+	}
+	if discoverRequest.DhChapSecret == "" {
+		return fmt.Errorf("the discovery controller requires authentication, no DH-HMAC-CHAP secret")
+	}
+	secret, err := nvmeauth.ParseSecret(discoverRequest.DhChapSecret)
+	if err != nil {
+		return err
+	}
+	var ctrlSecret *nvmeauth.Secret
+	if discoverRequest.DhChapCtrlSecret != "" {
+		if ctrlSecret, err = nvmeauth.ParseSecret(discoverRequest.DhChapCtrlSecret); err != nil {
+			return err
+		}
+	}
+	return client.tcpQ.authenticate(client.ctx, discoverRequest.Hostnqn, secret, ctrlSecret)
 }
 
 func (client *tcpClient) pollAEN() error {
@@ -15,8 +15,17 @@
 package nvmehost
 
 import (
-	"github.com/google/uuid"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmetls"
 )
 
 func TestRemoveDash(t *testing.T) {
@@ -35,3 +44,195 @@ func TestRemoveDash(t *testing.T) {
 		t.Errorf("fails validate content of uuid wrapped with new lines")
 	}
 }
+
+type testDiscoverySubsystem struct {
+	entries []*nvme.NvmefDiscRspPageEntry
+	// genCtrChanges is the number of log page reads that change the generation counter.
+	genCtrChanges int
+	genCtr        uint64
+}
+
+func (s *testDiscoverySubsystem) RegisterController(controller nvme.Controller) {}
+
+func (s *testDiscoverySubsystem) DeregisterController(controller nvme.Controller) {}
+
+func (s *testDiscoverySubsystem) FillDiscoveryLogPage(offset uint64, maxEntries uint32, hostNqn string) ([]*nvme.NvmefDiscRspPageEntry, uint32, uint64) {
+	first := int(offset / 1024)
+	if first > len(s.entries) {
+		first = len(s.entries)
+	}
+	last := first + int(maxEntries)
+	if last > len(s.entries) {
+		last = len(s.entries)
+	}
+	genCtr := s.genCtr + 1
+	if s.genCtrChanges > 0 {
+		s.genCtrChanges--
+		s.genCtr++
+	}
+	return s.entries[first:last], uint32(len(s.entries)), genCtr
+}
+
+func writeKeyFile(t *testing.T, hostnqn string, key byte) string {
+	psk := &nvmetls.ConfiguredPSK{Hash: nvmetls.PSKHashSHA256, Key: bytes.Repeat([]byte{key}, 32)}
+	path := filepath.Join(t.TempDir(), "tls-keys")
+	content := hostnqn + " " + nvme.DiscoverySubsysName + " " + psk.String() + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDiscoverTLS(t *testing.T) {
+	hostnqn := "nqn.2014-08.org.nvmexpress:uuid:" + uuid.New().String()
+	hostIDPath := filepath.Join(t.TempDir(), "hostid")
+	targetKeyFile, err := nvmetls.LoadKeyFile(writeKeyFile(t, hostnqn, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	subsystem := &testDiscoverySubsystem{entries: []*nvme.NvmefDiscRspPageEntry{
+		{TrType: 3, SubType: nvme.NVME_NQN_NVME, Subnqn: "nqn.2016-01.com.lightbitslabs:uuid:subsys", Traddr: "10.0.0.1"},
+	}}
+	go nvme.ServeTCP(listener, subsystem, "test", &nvmetls.Config{GetPSK: targetKeyFile.LookupIdentity}, nil)
+
+	request := &DiscoverRequest{
+		Transport:  "tcp",
+		Traddr:     "127.0.0.1",
+		Trsvcid:    listener.Addr().(*net.TCPAddr).Port,
+		Hostnqn:    hostnqn,
+		TLS:        true,
+		TLSKeyFile: writeKeyFile(t, hostnqn, 1),
+	}
+	client := NewClient(false, hostIDPath)
+	entries, _, err := client.Discover(request)
+	client.Stop()
+	if err != nil {
+		t.Fatalf("discover over TLS failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Subnqn != subsystem.entries[0].Subnqn {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	request.TLSKeyFile = writeKeyFile(t, hostnqn, 2)
+	client = NewClient(false, hostIDPath)
+	_, _, err = client.Discover(request)
+	client.Stop()
+	if err == nil {
+		t.Errorf("discover with the wrong PSK succeeded")
+	}
+}
+
+func TestDiscoverDHChap(t *testing.T) {
+	hostnqn := "nqn.2014-08.org.nvmexpress:uuid:" + uuid.New().String()
+	hostIDPath := filepath.Join(t.TempDir(), "hostid")
+	secret := &nvmeauth.Secret{Hash: nvmeauth.HashSHA256, Key: bytes.Repeat([]byte{1}, 32)}
+	ctrlSecret := &nvmeauth.Secret{Key: bytes.Repeat([]byte{2}, 48)}
+	otherSecret := &nvmeauth.Secret{Key: bytes.Repeat([]byte{3}, 32)}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	subsystem := &testDiscoverySubsystem{entries: []*nvme.NvmefDiscRspPageEntry{
+		{TrType: 3, SubType: nvme.NVME_NQN_NVME, Subnqn: "nqn.2016-01.com.lightbitslabs:uuid:subsys", Traddr: "10.0.0.1"},
+	}}
+	authConfig := &nvmeauth.Config{GetHostKeys: func(hostNqn string) *nvmeauth.HostKeys {
+		if hostNqn != hostnqn {
+			return nil
+		}
+		return &nvmeauth.HostKeys{
+			Secret:     secret,
+			CtrlSecret: ctrlSecret,
+			Hashes:     []nvmeauth.Hash{nvmeauth.HashSHA384},
+			DHGroups:   []nvmeauth.DHGroup{nvmeauth.DHGroupFFDHE3072},
+		}
+	}}
+	go nvme.ServeTCP(listener, subsystem, "test", nil, authConfig)
+
+	for _, tc := range []struct {
+		name         string
+		hostnqn      string
+		secret       string
+		ctrlSecret   string
+		expectedFail bool
+	}{
+		{name: "host", hostnqn: hostnqn, secret: secret.String()},
+		{name: "bidirectional", hostnqn: hostnqn, secret: secret.String(), ctrlSecret: ctrlSecret.String()},
+		{name: "no secret", hostnqn: hostnqn, expectedFail: true},
+		{name: "wrong secret", hostnqn: hostnqn, secret: otherSecret.String(), expectedFail: true},
+		{name: "wrong controller secret", hostnqn: hostnqn, secret: secret.String(), ctrlSecret: otherSecret.String(), expectedFail: true},
+		{name: "controller of a host that doesn't authenticate", hostnqn: hostnqn + "-other", secret: secret.String(), ctrlSecret: ctrlSecret.String(), expectedFail: true},
+		{name: "host that doesn't authenticate", hostnqn: hostnqn + "-other"},
+	} {
+		request := &DiscoverRequest{
+			Transport:        "tcp",
+			Traddr:           "127.0.0.1",
+			Trsvcid:          listener.Addr().(*net.TCPAddr).Port,
+			Hostnqn:          tc.hostnqn,
+			DhChapSecret:     tc.secret,
+			DhChapCtrlSecret: tc.ctrlSecret,
+		}
+		client := NewClient(false, hostIDPath)
+		entries, _, err := client.Discover(request)
+		client.Stop()
+		if tc.expectedFail {
+			if err == nil {
+				t.Errorf("%s: discover succeeded", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: discover failed: %v", tc.name, err)
+		} else if len(entries) != 1 {
+			t.Errorf("%s: unexpected entries %+v", tc.name, entries)
+		}
+	}
+}
+
+func TestDiscoverGenCtrChanges(t *testing.T) {
+	hostnqn := "nqn.2014-08.org.nvmexpress:uuid:" + uuid.New().String()
+	hostIDPath := filepath.Join(t.TempDir(), "hostid")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	subsystem := &testDiscoverySubsystem{entries: []*nvme.NvmefDiscRspPageEntry{
+		{TrType: 3, SubType: nvme.NVME_NQN_NVME, Subnqn: "nqn.2016-01.com.lightbitslabs:uuid:subsys", Traddr: "10.0.0.1"},
+	}}
+	go nvme.ServeTCP(listener, subsystem, "test", nil, nil)
+
+	request := &DiscoverRequest{
+		Transport: "tcp",
+		Traddr:    "127.0.0.1",
+		Trsvcid:   listener.Addr().(*net.TCPAddr).Port,
+		Hostnqn:   hostnqn,
+	}
+	// every log page read is a header, the entries and the header again.
+	subsystem.genCtrChanges = 3 * 3
+	client := NewClient(false, hostIDPath)
+	entries, genCtr, err := client.Discover(request)
+	client.Stop()
+	if err != nil {
+		t.Fatalf("discover while the generation counter changes failed: %v", err)
+	}
+	if len(entries) != 1 || genCtr != 10 {
+		t.Errorf("unexpected entries %+v of generation %d", entries, genCtr)
+	}
+
+	subsystem.genCtrChanges = 3 * (maxLogPageRetries + 1)
+	client = NewClient(false, hostIDPath)
+	_, _, err = client.Discover(request)
+	client.Stop()
+	if err == nil {
+		t.Errorf("discover succeeded while the generation counter kept changing")
+	}
+}
@@ -18,16 +18,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
-	"reflect"
-	"strings"
 	"time"
 
 	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
 	"github.com/lunixbochs/struc"
 	"github.com/sirupsen/logrus"
 )
@@ -39,6 +40,14 @@ import "C"
 const (
 	// important not to put too small
 	waitForReplyTimeout = 5000000000 // 5 seconds
+	// authReceiveLength is the allocation length of the AUTH_Receive commands, enough for the
+	// DH value of the largest group.
+	authReceiveLength = 4096
+	// authTransactionID identifies the single authentication transaction of a queue.
+	authTransactionID = 1
+	// maxLogPageRetries is the number of times the log page is read again when its generation
+	// counter changed while it was read, as nvme-cli does.
+	maxLogPageRetries = 10
 )
 
 type nvmetTransport interface {
@@ -57,6 +66,12 @@ type tcpQueue struct {
 	commandID             uint16
 	completedRequestsChan chan nvme.Request
 	completedAENRequestCh chan nvme.Request
+	// pageSize is the minimum memory page size of the controller (CAP.MPSMIN).
+	pageSize uint32
+	// identify is the Identify Controller data of the controller, nil until identified.
+	identify *nvme.IdentifyController
+	// pduFormat is the format of the PDUs negotiated with the controller.
+	pduFormat nvme.TCPPduFormat
 }
 
 func newNvmeTCPQueue(id uint16, tcpConn net.Conn) *tcpQueue {
@@ -71,6 +86,7 @@ func newNvmeTCPQueue(id uint16, tcpConn net.Conn) *tcpQueue {
 		completedRequestsChan: make(chan nvme.Request),
 		completedAENRequestCh: make(chan nvme.Request),
 		commandID:             0x01,
+		pageSize:              4096,
 	}
 	// queue.nvmeQueue.log = queue.log
 	// metrics.Metrics.TCPQueues.WithLabelValues(serviceID, queue.tcpConn.LocalAddr().String(), queue.tcpConn.RemoteAddr().String()).Inc()
@@ -83,8 +99,43 @@ func (queue *tcpQueue) destroy() {
 	// metrics.Metrics.TCPQueues.DeleteLabelValues(queue.serviceID, queue.tcpConn.LocalAddr().String(), queue.tcpConn.RemoteAddr().String())
 }
 
+// initConnection negotiates the format of the PDUs of the queue, requesting the given digests.
+// it must complete before the PDUs of the queue are received by recvPdu.
+func (queue *tcpQueue) initConnection(hdrDigest, dataDigest bool) error {
+	digest := nvme.TCPDigestOptions(hdrDigest, dataDigest)
+	if err := queue.sendNvmeInitConnection(digest); err != nil {
+		return err
+	}
+
+	hdr, err := queue.recvTCPHeader()
+	if err != nil {
+		return err
+	}
+	if hdr.Type != C.nvme_tcp_icresp {
+		return fmt.Errorf("queue %d: unexpected pdu type %v", queue.id, hdr.Type)
+	}
+	// ICResp never carries digests
+	pdu, _, err := nvme.TCPPduFormat{}.ReadPdu(queue.tcpReader, hdr)
+	if err != nil {
+		return err
+	}
+	icresp, err := queue.recvNvmeInitConnResponse(bytes.NewReader(pdu))
+	if err != nil {
+		return err
+	}
+	if icresp.Digest != digest {
+		return fmt.Errorf("queue %d: controller enabled digests %#x, requested %#x", queue.id, icresp.Digest, digest)
+	}
+
+	queue.pduFormat, err = nvme.NewTCPPduFormat(icresp.Digest, icresp.Cpda)
+	if err != nil {
+		return fmt.Errorf("queue %d: unsupported cpda returned %d: %w", queue.id, icresp.Cpda, err)
+	}
+	return nil
+}
+
 // https://github.com/torvalds/linux/blob/1ee08de1e234d95b5b4f866878b72fceb5372904/drivers/nvme/host/tcp.c
-func (queue *tcpQueue) sendNvmeInitConnection() error {
+func (queue *tcpQueue) sendNvmeInitConnection(digest uint8) error {
 	hdr := &nvme.TCPHeaderType{
 		Hlen:  C.sizeof_struct_nvme_tcp_icreq_pdu,
 		Plen:  C.sizeof_struct_nvme_tcp_icreq_pdu,
@@ -100,7 +151,7 @@ func (queue *tcpQueue) sendNvmeInitConnection() error {
 	icReq := &nvme.TCPIcReqPduType{
 		Pfv:    C.NVME_TCP_PFV_1_0,
 		Hpda:   0, /* no alignment constraint */
-		Digest: 0,
+		Digest: digest,
 		Maxr2t: 0,
 	}
 	if err := struc.Pack(queue.tcpWriter, icReq); err != nil {
@@ -122,14 +173,11 @@ func (queue *tcpQueue) recvNvmeInitConnResponse(pduReader *bytes.Reader) (*nvme.
 	if icresp.Pfv != C.NVME_TCP_PFV_1_0 {
 		return nil, fmt.Errorf("queue %d: bad pfv returned %d", queue.id, icresp.Pfv)
 	}
-
-	if icresp.Cpda != 0 {
-		return nil, fmt.Errorf("queue %d: unsupported cpda returned %d", queue.id, icresp.Cpda)
-	}
 	return icresp, nil
 }
 
-func (queue *tcpQueue) sendConnectRequest(ctx context.Context, hostnqn string, hostID string) error {
+// sendConnectRequest connects the queue, and returns the result of the Connect command.
+func (queue *tcpQueue) sendConnectRequest(ctx context.Context, hostnqn string, hostID string) (uint32, error) {
 	theNewHostID, _ := hex.DecodeString(hostID)
 	connectData := &nvme.ConnectData{
 		HostID:    string(theNewHostID),
@@ -139,48 +187,101 @@ func (queue *tcpQueue) sendConnectRequest(ctx context.Context, hostnqn string, h
 	}
 
 	request := nvme.NewAdminConnectRequest(queue.nextCmdID(), 0*time.Millisecond, connectData)
+	if err := queue.sendRequest(request); err != nil {
+		return 0, err
+	}
+
+	completedRequest, err := queue.waitForResponse(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if completedRequest == nil || completedRequest.Completion() == nil {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint32(completedRequest.Completion().Result.Result[:]), nil
+}
 
-	if err := struc.Pack(queue.tcpWriter, createTCPHeader(true)); err != nil {
+// authenticate authenticates the host to the controller with DH-HMAC-CHAP, and the controller to
+// the host if ctrlSecret is set.
+func (queue *tcpQueue) authenticate(ctx context.Context, hostnqn string, secret, ctrlSecret *nvmeauth.Secret) error {
+	host := nvmeauth.NewHost(hostnqn, nvme.DiscoverySubsysName, secret, ctrlSecret, authTransactionID)
+	if err := queue.sendAuthSendRequest(ctx, host.Negotiate()); err != nil {
 		return err
 	}
-	if err := request.PackCmd(queue.tcpWriter); err != nil {
+	challenge, err := queue.sendAuthReceiveRequest(ctx)
+	if err != nil {
+		return err
+	}
+	reply, err := host.Reply(challenge)
+	if err != nil {
+		return queue.abortAuthentication(ctx, host, err)
+	}
+	if err := queue.sendAuthSendRequest(ctx, reply); err != nil {
 		return err
 	}
-	// copy sgl to tcpWriter
-	if _, err := io.Copy(queue.tcpWriter, nvme.NewScatterListReader(request.GetData())); err != nil {
+	success1, err := queue.sendAuthReceiveRequest(ctx)
+	if err != nil {
 		return err
 	}
+	success2, err := host.Success2(success1)
+	if err != nil {
+		return queue.abortAuthentication(ctx, host, err)
+	}
+	if success2 != nil {
+		return queue.sendAuthSendRequest(ctx, success2)
+	}
+	return nil
+}
 
-	queue.outstandingRequests[request.CommandID()] = request
+// abortAuthentication notifies the controller of the failure err of the host, unless the failure
+// was reported by the controller.
+func (queue *tcpQueue) abortAuthentication(ctx context.Context, host *nvmeauth.Host, err error) error {
+	var authErr *nvmeauth.Error
+	if errors.As(err, &authErr) {
+		if sendErr := queue.sendAuthSendRequest(ctx, host.Failure2(err)); sendErr != nil {
+			queue.log.WithError(sendErr).Debugf("failed to send AUTH_Failure2")
+		}
+	}
+	return err
+}
 
-	if err := queue.tcpWriter.Flush(); err != nil {
+func (queue *tcpQueue) sendAuthSendRequest(ctx context.Context, msg []byte) error {
+	request := nvme.NewAuthSendRequest(queue.nextCmdID(), msg)
+	if err := queue.sendRequest(request); err != nil {
 		return err
 	}
-
-	if _, err := queue.waitForResponse(ctx); err != nil {
+	completedRequest, err := queue.waitForResponse(ctx)
+	if err != nil {
 		return err
 	}
-
+	if status := completedRequest.Completion().Status >> 1; status != C.NVME_SC_SUCCESS {
+		return fmt.Errorf("queue %d: AUTH_Send failed, status %#x", queue.id, status)
+	}
 	return nil
 }
 
-func createTCPHeader(isConnect bool) *nvme.TCPHeaderType {
-	var dataLenBytes int
-	flags := uint8(0)
-	cmdLenBytes := uint8(C.sizeof_struct_nvme_tcp_cmd_pdu)
-	if isConnect {
-		dataLenBytes = C.sizeof_struct_nvmf_connect_data
-	} else {
-		dataLenBytes = 0
+// sendAuthReceiveRequest returns the message of the controller.
+func (queue *tcpQueue) sendAuthReceiveRequest(ctx context.Context) ([]byte, error) {
+	request := nvme.NewAuthReceiveRequest(queue.nextCmdID(), authReceiveLength)
+	if err := queue.sendRequest(request); err != nil {
+		return nil, err
 	}
-
-	header := &nvme.TCPHeaderType{
-		Type:  C.nvme_tcp_cmd,
-		Flags: flags,
-		Hlen:  cmdLenBytes,
-		Plen:  int(cmdLenBytes) + dataLenBytes,
+	completedRequest, err := queue.waitForResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status := completedRequest.Completion().Status >> 1; status != C.NVME_SC_SUCCESS {
+		return nil, fmt.Errorf("queue %d: AUTH_Receive failed, status %#x", queue.id, status)
+	}
+	data := completedRequest.GetData()
+	if data == nil {
+		return nil, fmt.Errorf("queue %d: got AUTH_Receive response with nil data", queue.id)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, nvme.NewScatterListReader(data)); err != nil {
+		return nil, err
 	}
-	return header
+	return buf.Bytes(), nil
 }
 
 func (queue *tcpQueue) sendSetPropertyRequest(ctx context.Context, registerOffset uint32, val uint64) error {
@@ -201,16 +302,21 @@ func (queue *tcpQueue) nextCmdID() uint16 {
 	return cmdID
 }
 
-func (queue *tcpQueue) sendGetPropertyRequest(ctx context.Context, registerOffset uint32) error {
+// sendGetPropertyRequest returns the value of the property at registerOffset.
+func (queue *tcpQueue) sendGetPropertyRequest(ctx context.Context, registerOffset uint32) (uint64, error) {
 	cmdID := queue.nextCmdID()
 	request := nvme.NewPropertyGetRequest(cmdID, registerOffset)
 	if err := queue.sendRequest(request); err != nil {
-		return err
+		return 0, err
 	}
-	if _, err := queue.waitForResponse(ctx); err != nil {
-		return err
+	completedRequest, err := queue.waitForResponse(ctx)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	if completedRequest == nil || completedRequest.Completion() == nil {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint64(completedRequest.Completion().Result.Result[:]), nil
 }
 
 func (queue *tcpQueue) setControllerConfiguration(ctx context.Context, controllerConfigValue uint64) error {
@@ -219,8 +325,7 @@ func (queue *tcpQueue) setControllerConfiguration(ctx context.Context, controlle
 		return err
 	}
 
-	err = queue.sendGetPropertyRequest(ctx, C.NVME_REG_CSTS)
-	if err != nil {
+	if _, err = queue.sendGetPropertyRequest(ctx, C.NVME_REG_CSTS); err != nil {
 		return err
 	}
 	return nil
@@ -243,22 +348,25 @@ func (queue *tcpQueue) setProperties(ctx context.Context, persistent bool) error
 	+ the host reads the Discovery Log Page. Refer to section 5.3
 	*/
 
-	if err := queue.sendGetPropertyRequest(ctx, C.NVME_REG_CAP); err != nil {
+	capabilities, err := queue.sendGetPropertyRequest(ctx, C.NVME_REG_CAP)
+	if err != nil {
 		return err
 	}
+	// CAP.MPSMIN, bits 51:48, is the minimum memory page size: 2 ^ (12 + MPSMIN).
+	queue.pageSize = uint32(1) << (12 + (capabilities>>48)&0xf)
 
 	if err := queue.setControllerConfiguration(ctx, 0x460001); err != nil {
 		return err
 	}
 
-	if err := queue.sendGetPropertyRequest(ctx, C.NVME_REG_VS); err != nil {
+	if _, err := queue.sendGetPropertyRequest(ctx, C.NVME_REG_VS); err != nil {
 		return err
 	}
 	// YOGEV: add this version check that we don on the
 	// if 1 == cqe.Result.Result[2] && 3 == cqe.Result.Result[1] && 0 == cqe.Result.Result[0] {
 	// 	queue.log.Infof("same version, major minor")
 	// }
-	if err := queue.sendGetPropertyRequest(ctx, C.NVME_REG_CAP); err != nil {
+	if _, err := queue.sendGetPropertyRequest(ctx, C.NVME_REG_CAP); err != nil {
 		return err
 	}
 	return nil
@@ -283,17 +391,17 @@ func (queue *tcpQueue) recvTCPDataPdu(pduReader *bytes.Reader) (*nvme.TCPDataPDU
 	return c2hData, nil
 }
 
-func (queue *tcpQueue) recvIdentifyDataPdu(pduReader *bytes.Reader) error {
+func (queue *tcpQueue) recvIdentifyDataPdu(pduReader *bytes.Reader) (*nvme.IdentifyController, error) {
 	id := &nvme.IDCtrl{}
 	if err := struc.Unpack(pduReader, id); err != nil {
-		return err
+		return nil, err
 	}
-	subNqn := strings.TrimRight(string(id.SubNqn[:]), "\x00")
-
-	if subNqn != C.NVME_DISC_SUBSYS_NAME {
-		return fmt.Errorf("subNqn must equal %q", C.NVME_DISC_SUBSYS_NAME)
+	identify := id.Decode()
+	if !identify.IsDiscovery() {
+		return nil, fmt.Errorf("controller %d of %q is not a discovery controller, cntrltype %d",
+			identify.CntlID, identify.Subnqn, identify.CntrlType)
 	}
-	return nil
+	return identify, nil
 }
 
 func (queue *tcpQueue) parseDiscRspHeader(pduReader *bytes.Reader) (uint64, uint64, error) {
@@ -375,17 +483,26 @@ func (queue *tcpQueue) sendKeepAlive(ctx context.Context) error {
 }
 
 func (queue *tcpQueue) sendRequest(request nvme.Request) error {
-	var header *nvme.TCPHeaderType
-	requestType := reflect.TypeOf(request).String()
-	if requestType == "*nvme.AdminConnectRequest" {
-		header = createTCPHeader(true)
-	} else {
-		header = createTCPHeader(false)
+	header := &nvme.TCPHeaderType{
+		Type: C.nvme_tcp_cmd,
 	}
-	if err := struc.Pack(queue.tcpWriter, header); err != nil {
+	var cmd bytes.Buffer
+	cmdWriter := bufio.NewWriter(&cmd)
+	if err := request.PackCmd(cmdWriter); err != nil {
 		return err
 	}
-	if err := request.PackCmd(queue.tcpWriter); err != nil {
+	if err := cmdWriter.Flush(); err != nil {
+		return err
+	}
+	// the connect data and the messages of AUTH_Send are the only in-capsule data sent
+	var data bytes.Buffer
+	switch request.(type) {
+	case *nvme.AdminConnectRequest, *nvme.NvmefAuthSendRequest:
+		if _, err := io.Copy(&data, nvme.NewScatterListReader(request.GetData())); err != nil {
+			return err
+		}
+	}
+	if err := queue.pduFormat.WritePdu(queue.tcpWriter, header, cmd.Bytes(), data.Bytes()); err != nil {
 		return err
 	}
 	queue.outstandingRequests[request.CommandID()] = request
@@ -395,40 +512,51 @@ func (queue *tcpQueue) sendRequest(request nvme.Request) error {
 	return nil
 }
 
-func (queue *tcpQueue) sendIdentifyRequest(ctx context.Context) error {
+// sendIdentifyRequest returns the Identify Controller data of the controller, and keeps
+// it for the requests that follow.
+func (queue *tcpQueue) sendIdentifyRequest(ctx context.Context) (*nvme.IdentifyController, error) {
 	request := nvme.NewIdentifyRequest(queue.nextCmdID()) //C.nvme_admin_identify
 	if err := queue.sendRequest(request); err != nil {
-		return err
+		return nil, err
 	}
 	completedRequest, err := queue.waitForResponse(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// did we get back a valid response?
 	if completedRequest == nil {
-		return fmt.Errorf("queue %d [%v]: got nil identify response",
+		return nil, fmt.Errorf("queue %d [%v]: got nil identify response",
 			queue.id, queue.tcpConn.RemoteAddr())
 	}
 
 	data := completedRequest.GetData()
 	if data == nil {
-		return fmt.Errorf("queue %d [%v]: got identify response with nil data",
+		return nil, fmt.Errorf("queue %d [%v]: got identify response with nil data",
 			queue.id, queue.tcpConn.RemoteAddr())
 	}
 
 	// copy sgl to buffer
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, nvme.NewScatterListReader(data)); err != nil {
-		return err
+		return nil, err
 	}
 	pduReader := bytes.NewReader(buf.Bytes())
 
-	if err := queue.recvIdentifyDataPdu(pduReader); err != nil {
-		return err
+	identify, err := queue.recvIdentifyDataPdu(pduReader)
+	if err != nil {
+		return nil, err
 	}
+	queue.identify = identify
+	return identify, nil
+}
 
-	return nil
+// maxTransferSize returns the largest data transfer the controller accepts, 0 if unlimited.
+func (queue *tcpQueue) maxTransferSize() uint32 {
+	if queue.identify == nil {
+		return 0
+	}
+	return queue.identify.MaxTransferSize(queue.pageSize)
 }
 
 func pduSize(pduType uint8) int {
@@ -442,7 +570,6 @@ func pduSize(pduType uint8) int {
 	default:
 		panic("BUG!!")
 	}
-	return 0
 }
 
 func pduValid(pduType uint8) bool {
@@ -469,51 +596,78 @@ func (queue *tcpQueue) recvTCPHeader() (*nvme.TCPHeaderType, error) {
 	return hdr, nil
 }
 
-func (queue *tcpQueue) getLogPageEntries(ctx context.Context, logPagePaginationEnabled bool) ([]*nvme.NvmefDiscRspPageEntry, error) {
+// getLogPageEntries returns the entries of the discovery log page and its generation counter.
+// the log page is read again while its generation counter changes during the read.
+func (queue *tcpQueue) getLogPageEntries(ctx context.Context, logPagePaginationEnabled bool) ([]*nvme.NvmefDiscRspPageEntry, uint64, error) {
+	for retries := 0; ; retries++ {
+		entries, genCtr, newGenCtr, err := queue.readLogPageEntries(ctx, logPagePaginationEnabled)
+		if err != nil {
+			return nil, 0, err
+		}
+		if genCtr == newGenCtr {
+			return entries, genCtr, nil
+		}
+		if retries == maxLogPageRetries {
+			return nil, 0, fmt.Errorf("genCtr changed during GetLogPage %d times. issue another discover request", retries+1)
+		}
+		queue.log.Debugf("genCtr changed from %d to %d during GetLogPage, reading the log page again", genCtr, newGenCtr)
+	}
+}
+
+// readLogPageEntries returns the entries of the discovery log page, its generation counter
+// before the entries were read and its generation counter once they were read.
+func (queue *tcpQueue) readLogPageEntries(ctx context.Context, logPagePaginationEnabled bool) ([]*nvme.NvmefDiscRspPageEntry, uint64, uint64, error) {
 	numRec, genCtr, _, err := queue.sendDiscLogPageRequest(ctx, 1024, 0, 0xffffffff, 0)
 	if err != nil {
-		return nil, err
+		return nil, 0, 0, err
 	}
 	var res []*nvme.NvmefDiscRspPageEntry
 	offset := uint64(0)
+	eSize, _ := struc.Sizeof(&nvme.NvmefDiscRspPageEntry{})
+	entrySize := uint32(eSize)
+	hSize, _ := struc.Sizeof(&nvme.DiscRspPageHdr{})
+	headerSize := uint32(hSize)
+	requestSize := headerSize + uint32(numRec)*entrySize
+	// the pages of 4096 bytes are within any maximum data transfer size, which is at least
+	// twice the minimum memory page size.
+	if maxTransfer := queue.maxTransferSize(); maxTransfer > 0 && !logPagePaginationEnabled && requestSize > maxTransfer {
+		queue.log.Debugf("log page of %d bytes exceeds the maximum data transfer size %d, retrieving it with pagination", requestSize, maxTransfer)
+		logPagePaginationEnabled = true
+	}
 	if logPagePaginationEnabled {
 		// retrieving with pagination
 		for uint64(len(res)) < numRec {
 			queue.log.Debug("loop --", uint64(len(res)), numRec)
 			_, _, entries, err := queue.sendDiscLogPageRequest(ctx, 4096, offset, 0x00000000, numRec)
 			if err != nil {
-				return nil, err
+				return nil, 0, 0, err
 			}
 			res = append(res, entries...)
 			offset = uint64(len(res) * 1024)
 		}
 	} else {
 		// retrieving log page entries without pagination
-		eSize, _ := struc.Sizeof(&nvme.NvmefDiscRspPageEntry{})
-		entrySize := uint32(eSize)
-		hSize, _ := struc.Sizeof(&nvme.DiscRspPageHdr{})
-		headerSize := uint32(hSize)
-		requestSize := headerSize + uint32(numRec)*entrySize
 		_, _, res, err = queue.sendDiscLogPageRequest(ctx, requestSize, 0, 0x00000000, numRec)
 		if err != nil {
-			return nil, err
+			return nil, 0, 0, err
 		}
 	}
 
 	if uint64(len(res)) != numRec {
+		// entries were added or removed while the log page was read, it is read again.
+		if _, newGenCtr, _, err := queue.sendDiscLogPageRequest(ctx, 1024, 0, 0x00000000, 0); err == nil && newGenCtr != genCtr {
+			return nil, genCtr, newGenCtr, nil
+		}
 		err = fmt.Errorf("number of obtained entries differs from numRec")
 		queue.log.WithError(err).Errorf("Expected %d entries, received %d entries", numRec, len(res))
-		return nil, err
+		return nil, 0, 0, err
 	}
 
 	_, newGenCtr, _, err := queue.sendDiscLogPageRequest(ctx, 1024, 0, 0x00000000, 0)
 	if err != nil {
-		return nil, err
-	}
-	if genCtr != newGenCtr {
-		return nil, fmt.Errorf("genCtr changed during GetLogPage. issue another discover request")
+		return nil, 0, 0, err
 	}
-	return res, nil
+	return res, genCtr, newGenCtr, nil
 }
 
 func (queue *tcpQueue) waitForResponse(ctx context.Context) (nvme.Request, error) {
@@ -525,7 +679,6 @@ func (queue *tcpQueue) waitForResponse(ctx context.Context) (nvme.Request, error
 	case completedRequest := <-queue.completedRequestsChan:
 		return completedRequest, nil
 	}
-	return nil, fmt.Errorf("aborted")
 }
 
 func (queue *tcpQueue) sendDiscLogPageRequest(ctx context.Context, size uint32, offset uint64, nsid uint32, num uint64) (uint64, uint64, []*nvme.NvmefDiscRspPageEntry, error) {
@@ -588,23 +741,16 @@ func (queue *tcpQueue) handleRecv() error {
 		return err
 	}
 
-	// no digest support for now
-	hdgst := 0
-	rcvLeft := int(hdr.Plen) - C.sizeof_struct_nvme_tcp_hdr + hdgst
-	pdu := make([]byte, rcvLeft)
-
-	_, err = io.ReadFull(queue.tcpReader, pdu)
+	pdu, data, err := queue.pduFormat.ReadPdu(queue.tcpReader, hdr)
 	if err != nil {
 		return err
 	}
 
-	completedRequest, err := queue.parseResponse(hdr.Type, pdu)
+	completedRequest, err := queue.parseResponse(hdr.Type, pdu, data)
 	if err != nil {
 		return err
 	}
-	// this case cover response from init-connection request. it is not
-	// the same as all other nvme-requests - we didn't push it to the
-	// pending requests queue hence we don't mark it as completed.
+	// this case cover responses of requests that are not outstanding.
 	if completedRequest == nil {
 		return nil
 	}
@@ -640,18 +786,15 @@ func (queue *tcpQueue) recvPdu(ctx context.Context) <-chan error {
 	return errChan
 }
 
-func (queue *tcpQueue) parseResponse(pduType uint8, pdu []byte) (nvme.Request, error) {
+// parseResponse returns the request completed by the PDU of pduType, of the PDU specific
+// header pdu and of data.
+func (queue *tcpQueue) parseResponse(pduType uint8, pdu []byte, data []byte) (nvme.Request, error) {
 	var commandID uint16
 	pduReader := bytes.NewReader(pdu)
 	switch pduType {
 	case C.nvme_tcp_icresp:
-		_, err := queue.recvNvmeInitConnResponse(pduReader)
-		if err != nil {
-			return nil, err
-		}
-		// current code does not handle this response as an outstanding requests.
-		// it will not try to match such request from queue.outstandingRequests
-		return nil, nil
+		// the connection was initialized by initConnection
+		return nil, fmt.Errorf("queue %d: unexpected icresp", queue.id)
 	case C.nvme_tcp_rsp:
 		cqe, err := queue.recvCqe(pduReader)
 		// we might got error status but still got the cqe so we proceed with the parsing
@@ -681,16 +824,19 @@ func (queue *tcpQueue) parseResponse(pduType uint8, pdu []byte) (nvme.Request, e
 			return nil, err
 		}
 
+		if len(data) != int(c2hData.DataLength) {
+			return nil, fmt.Errorf("queue %d: got %d bytes of data, expected %d", queue.id, len(data), c2hData.DataLength)
+		}
+
 		chunkSize := int(math.Min(1024.0, float64(c2hData.DataLength)))
 		request.SetData(nvme.NewScatterList(int(c2hData.DataLength), chunkSize))
 		sglWriter := nvme.NewScatterListWriter(request.GetData())
 
-		if _, err := io.Copy(sglWriter, pduReader); err != nil {
+		if _, err := io.Copy(sglWriter, bytes.NewReader(data)); err != nil {
 			return nil, err
 		}
 		return request, nil
 	default:
 		panic("BUG!!")
 	}
-	return nil, nil
 }
@@ -0,0 +1,446 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmetls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeHandshake        = 22
+	recordTypeApplicationData  = 23
+
+	recordHeaderLen = 5
+	maxPlaintext    = 16384
+	maxCiphertext   = maxPlaintext + 256
+	// maxEmptyRecords is the number of empty records in a row accepted.
+	maxEmptyRecords = 16
+	aeadNonceLen    = 12
+
+	handshakeHeaderLen = 4
+	maxHandshake       = 65536
+
+	changeCipherSpecPayload = 1
+	keyUpdateNotRequested   = 0
+	keyUpdateRequested      = 1
+
+	// closeNotifyTimeout bounds the write of the close notify alert.
+	closeNotifyTimeout = time.Second
+)
+
+// Alerts, and their levels.
+const (
+	alertLevelWarning = 1
+	alertLevelFatal   = 2
+
+	alertCloseNotify        = 0
+	alertUnexpectedMessage  = 10
+	alertBadRecordMAC       = 20
+	alertRecordOverflow     = 22
+	alertHandshakeFailure   = 40
+	alertIllegalParameter   = 47
+	alertDecodeError        = 50
+	alertDecryptError       = 51
+	alertProtocolVersion    = 70
+	alertMissingExtension   = 109
+	alertUnknownPSKIdentity = 115
+)
+
+// Config of a TLS connection.
+type Config struct {
+	// PSK of the client.
+	PSK *PSK
+	// GetPSK returns the PSK of an identity offered to the server, nil if unknown.
+	GetPSK func(identity string) *PSK
+	// AllowPSKKE lets the client offer psk_ke, a key exchange with the PSK only and no forward
+	// secrecy, next to psk_dhe_ke. without it the server must send a key share.
+	AllowPSKKE bool
+}
+
+// alertError is a local error, sent to the peer as an alert.
+type alertError struct {
+	alert uint8
+	msg   string
+}
+
+func (e *alertError) Error() string {
+	return "nvmetls: " + e.msg
+}
+
+func newAlertError(alert uint8, format string, args ...interface{}) error {
+	return &alertError{alert: alert, msg: fmt.Sprintf(format, args...)}
+}
+
+// halfConn is the protection of one direction of a connection, none before the keys are set.
+type halfConn struct {
+	suite  *cipherSuite
+	secret []byte
+	aead   cipher.AEAD
+	iv     []byte
+	seq    uint64
+}
+
+func (hc *halfConn) setSecret(suite *cipherSuite, secret []byte) error {
+	block, err := aes.NewCipher(suite.expandLabel(secret, "key", nil, suite.keyLen))
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	hc.suite = suite
+	hc.secret = secret
+	hc.aead = aead
+	hc.iv = suite.expandLabel(secret, "iv", nil, aeadNonceLen)
+	hc.seq = 0
+	return nil
+}
+
+// update moves to the next traffic secret, on a key update.
+func (hc *halfConn) update() error {
+	return hc.setSecret(hc.suite, hc.suite.expandLabel(hc.secret, "traffic upd", nil, hc.suite.hashLen()))
+}
+
+func (hc *halfConn) nonce() []byte {
+	nonce := append([]byte{}, hc.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(hc.seq >> (8 * i))
+	}
+	return nonce
+}
+
+// Conn is a TLS 1.3 connection secured with a pre-shared key.
+type Conn struct {
+	conn     net.Conn
+	config   *Config
+	isClient bool
+
+	handshakeMu   sync.Mutex
+	handshakeErr  error
+	handshakeDone atomic.Bool
+
+	// readMu protects in, input and hsBuf.
+	readMu sync.Mutex
+	in     halfConn
+	// input is the application data received and not read yet.
+	input []byte
+	// hsBuf is the handshake data received and not handled yet.
+	hsBuf []byte
+
+	// writeMu protects out.
+	writeMu sync.Mutex
+	out     halfConn
+}
+
+// Client returns the client side of a TLS connection over conn.
+func Client(conn net.Conn, config *Config) *Conn {
+	return &Conn{conn: conn, config: config, isClient: true}
+}
+
+// Server returns the server side of a TLS connection over conn.
+func Server(conn net.Conn, config *Config) *Conn {
+	return &Conn{conn: conn, config: config}
+}
+
+// Handshake runs the handshake of the connection if it didn't run yet. it runs on the first
+// Read or Write otherwise.
+func (c *Conn) Handshake() error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.handshakeDone.Load() || c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+
+	c.readMu.Lock()
+	c.writeMu.Lock()
+	var err error
+	if c.isClient {
+		err = c.clientHandshake()
+	} else {
+		err = c.serverHandshake()
+	}
+	var alertErr *alertError
+	if errors.As(err, &alertErr) {
+		c.writeRecord(recordTypeAlert, []byte{alertLevelFatal, alertErr.alert})
+	}
+	c.writeMu.Unlock()
+	c.readMu.Unlock()
+
+	if err != nil {
+		c.handshakeErr = err
+		return err
+	}
+	c.handshakeDone.Store(true)
+	return nil
+}
+
+// readRecord returns the type and the content of the next record, decrypted if the keys are set.
+func (c *Conn) readRecord() (uint8, []byte, error) {
+	for empty := 0; ; {
+		header := make([]byte, recordHeaderLen)
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			return 0, nil, err
+		}
+		recordType := header[0]
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if header[1] != 3 {
+			return 0, nil, newAlertError(alertProtocolVersion, "bad record version %#x", header[1:3])
+		}
+		if length > maxCiphertext {
+			return 0, nil, newAlertError(alertRecordOverflow, "record of %d bytes", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return 0, nil, err
+		}
+
+		// the change cipher spec of middlebox compatibility mode is ignored.
+		if recordType == recordTypeChangeCipherSpec {
+			if length != 1 || payload[0] != changeCipherSpecPayload || c.handshakeDone.Load() {
+				return 0, nil, newAlertError(alertUnexpectedMessage, "unexpected change cipher spec")
+			}
+			continue
+		}
+		if c.in.aead == nil {
+			return recordType, payload, nil
+		}
+		if recordType != recordTypeApplicationData {
+			return 0, nil, newAlertError(alertUnexpectedMessage, "unprotected record of type %d", recordType)
+		}
+		plaintext, err := c.in.aead.Open(payload[:0], c.in.nonce(), payload, header)
+		if err != nil {
+			return 0, nil, newAlertError(alertBadRecordMAC, "failed to decrypt record")
+		}
+		c.in.seq++
+		i := len(plaintext) - 1
+		for i >= 0 && plaintext[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return 0, nil, newAlertError(alertUnexpectedMessage, "record without a content type")
+		}
+		if i == 0 && plaintext[i] == recordTypeApplicationData {
+			// empty application data records are legal, but too many of them are not
+			if empty++; empty > maxEmptyRecords {
+				return 0, nil, newAlertError(alertUnexpectedMessage, "too many empty records")
+			}
+			continue
+		}
+		return plaintext[i], plaintext[:i], nil
+	}
+}
+
+// writeRecord writes data in records of recordType, encrypted if the keys are set.
+func (c *Conn) writeRecord(recordType uint8, data []byte) error {
+	for first := true; first || len(data) > 0; first = false {
+		n := len(data)
+		if n > maxPlaintext {
+			n = maxPlaintext
+		}
+		fragment := data[:n]
+		data = data[n:]
+
+		var record []byte
+		if c.out.aead == nil {
+			record = append([]byte{recordType, 3, 3}, 0, 0)
+			binary.BigEndian.PutUint16(record[3:], uint16(len(fragment)))
+			record = append(record, fragment...)
+		} else {
+			inner := append(append([]byte{}, fragment...), recordType)
+			record = make([]byte, recordHeaderLen, recordHeaderLen+len(inner)+c.out.aead.Overhead())
+			record[0], record[1], record[2] = recordTypeApplicationData, 3, 3
+			binary.BigEndian.PutUint16(record[3:], uint16(len(inner)+c.out.aead.Overhead()))
+			record = c.out.aead.Seal(record, c.out.nonce(), inner, record[:recordHeaderLen])
+			c.out.seq++
+		}
+		if _, err := c.conn.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHandshake returns the next handshake message, header included.
+func (c *Conn) readHandshake() ([]byte, error) {
+	for {
+		if len(c.hsBuf) >= handshakeHeaderLen {
+			n := handshakeLen(c.hsBuf)
+			if n > maxHandshake {
+				return nil, newAlertError(alertUnexpectedMessage, "handshake message of %d bytes", n)
+			}
+			if len(c.hsBuf) >= n {
+				msg := append([]byte{}, c.hsBuf[:n]...)
+				c.hsBuf = c.hsBuf[n:]
+				return msg, nil
+			}
+		}
+		recordType, data, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		switch recordType {
+		case recordTypeHandshake:
+			c.hsBuf = append(c.hsBuf, data...)
+		case recordTypeAlert:
+			return nil, alertReceived(data)
+		default:
+			return nil, newAlertError(alertUnexpectedMessage, "unexpected record of type %d", recordType)
+		}
+	}
+}
+
+// handshakeLen returns the length of the handshake message at the start of b, header included.
+func handshakeLen(b []byte) int {
+	return handshakeHeaderLen + (int(b[1])<<16 | int(b[2])<<8 | int(b[3]))
+}
+
+func alertReceived(data []byte) error {
+	if len(data) == 2 && data[1] == alertCloseNotify {
+		return io.EOF
+	}
+	if len(data) != 2 {
+		return newAlertError(alertDecodeError, "bad alert")
+	}
+	return fmt.Errorf("nvmetls: received alert %d", data[1])
+}
+
+// handlePostHandshake handles the handshake messages received after the handshake.
+func (c *Conn) handlePostHandshake(data []byte) error {
+	c.hsBuf = append(c.hsBuf, data...)
+	for len(c.hsBuf) >= handshakeHeaderLen {
+		n := handshakeLen(c.hsBuf)
+		if len(c.hsBuf) < n {
+			return nil
+		}
+		msg := c.hsBuf[:n]
+		c.hsBuf = c.hsBuf[n:]
+		switch msg[0] {
+		case typeNewSessionTicket:
+			// resumption is not supported, the tickets are dropped.
+		case typeKeyUpdate:
+			if n != handshakeHeaderLen+1 || msg[4] > keyUpdateRequested {
+				return newAlertError(alertDecodeError, "bad key update")
+			}
+			if len(c.hsBuf) > 0 {
+				return newAlertError(alertUnexpectedMessage, "key update not at the end of a record")
+			}
+			if err := c.in.update(); err != nil {
+				return err
+			}
+			if msg[4] == keyUpdateRequested {
+				if err := c.sendKeyUpdate(); err != nil {
+					return err
+				}
+			}
+		default:
+			return newAlertError(alertUnexpectedMessage, "unexpected handshake message of type %d", msg[0])
+		}
+	}
+	return nil
+}
+
+func (c *Conn) sendKeyUpdate() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.writeRecord(recordTypeHandshake, handshakeMessage(typeKeyUpdate, []byte{keyUpdateNotRequested})); err != nil {
+		return err
+	}
+	return c.out.update()
+}
+
+// Read reads application data from the connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.input) == 0 {
+		recordType, data, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		switch recordType {
+		case recordTypeApplicationData:
+			c.input = data
+		case recordTypeHandshake:
+			if err := c.handlePostHandshake(data); err != nil {
+				return 0, err
+			}
+		case recordTypeAlert:
+			return 0, alertReceived(data)
+		default:
+			return 0, newAlertError(alertUnexpectedMessage, "unexpected record of type %d", recordType)
+		}
+	}
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+// Write writes application data to the connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.writeRecord(recordTypeApplicationData, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close notify alert, if the connection isn't busy writing, and closes the connection.
+func (c *Conn) Close() error {
+	if c.handshakeDone.Load() && c.writeMu.TryLock() {
+		c.conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+		c.writeRecord(recordTypeAlert, []byte{alertLevelWarning, alertCloseNotify})
+		c.writeMu.Unlock()
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,166 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmetls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestConns(clientPSK, serverPSK *PSK) (*Conn, *Conn) {
+	clientConn, serverConn := net.Pipe()
+	client := Client(clientConn, &Config{PSK: clientPSK})
+	server := Server(serverConn, &Config{GetPSK: func(identity string) *PSK {
+		if identity == serverPSK.Identity {
+			return serverPSK
+		}
+		return nil
+	}})
+	return client, server
+}
+
+func handshake(client, server *Conn) (error, error) {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Handshake()
+	}()
+	clientErr := client.Handshake()
+	if clientErr != nil {
+		client.Close()
+	}
+	return clientErr, <-serverErr
+}
+
+func TestHandshake(t *testing.T) {
+	for _, configured := range []*ConfiguredPSK{
+		{Hash: PSKHashSHA256, Key: bytes.Repeat([]byte{1}, 32)},
+		{Hash: PSKHashSHA384, Key: bytes.Repeat([]byte{2}, 48)},
+	} {
+		psk := configured.TLSPSK("host", "subsys")
+		client, server := newTestConns(psk, psk)
+		clientErr, serverErr := handshake(client, server)
+		assert.NoError(t, clientErr)
+		assert.NoError(t, serverErr)
+
+		// larger than a record, both ways
+		data := make([]byte, 3*maxPlaintext+1)
+		rand.Read(data)
+		go func() {
+			server.Write(data)
+			echo := make([]byte, len(data))
+			io.ReadFull(server, echo)
+			server.Write(echo)
+		}()
+		received := make([]byte, len(data))
+		_, err := io.ReadFull(client, received)
+		assert.NoError(t, err)
+		assert.Equal(t, data, received)
+		go client.Write(data)
+		_, err = io.ReadFull(client, received)
+		assert.NoError(t, err)
+		assert.Equal(t, data, received)
+
+		// the key of the client changes, the server follows
+		go func() {
+			client.sendKeyUpdate()
+			client.Write([]byte("after key update"))
+		}()
+		received = make([]byte, len("after key update"))
+		_, err = io.ReadFull(server, received)
+		assert.NoError(t, err)
+		assert.Equal(t, "after key update", string(received))
+
+		go client.Close()
+		_, err = server.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	}
+}
+
+func TestHandshakeFailure(t *testing.T) {
+	psk := (&ConfiguredPSK{Hash: PSKHashSHA256, Key: bytes.Repeat([]byte{1}, 32)}).TLSPSK("host", "subsys")
+	wrongKey := *psk
+	wrongKey.Key = bytes.Repeat([]byte{2}, 32)
+	unknownIdentity := *psk
+	unknownIdentity.Identity = "NVMe0R01 host other"
+	otherSuite := (&ConfiguredPSK{Hash: PSKHashSHA384, Key: bytes.Repeat([]byte{1}, 48)}).TLSPSK("host", "subsys")
+
+	for _, clientPSK := range []*PSK{&wrongKey, &unknownIdentity, otherSuite} {
+		client, server := newTestConns(clientPSK, psk)
+		clientErr, serverErr := handshake(client, server)
+		assert.Error(t, clientErr)
+		assert.Error(t, serverErr)
+		_, err := client.Write([]byte("data"))
+		assert.Equal(t, clientErr, err)
+	}
+}
+
+func TestHandshakeServerHello(t *testing.T) {
+	psk := (&ConfiguredPSK{Hash: PSKHashSHA256, Key: bytes.Repeat([]byte{1}, 32)}).TLSPSK("host", "subsys")
+	testCases := []struct {
+		name       string
+		allowPSKKE bool
+		sessionID  []byte
+		pskModes   []byte
+		alert      uint8
+	}{
+		{name: "no key share", pskModes: []byte{pskModeDHEKE}, alert: alertMissingExtension},
+		{name: "session id echo", allowPSKKE: true, sessionID: []byte{1, 2, 3}, pskModes: []byte{pskModeDHEKE, pskModeKE}, alert: alertIllegalParameter},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			client := Client(clientConn, &Config{PSK: psk, AllowPSKKE: tc.allowPSKKE})
+			server := Server(serverConn, &Config{})
+			hellos := make(chan *clientHello, 1)
+			go func() {
+				defer server.Close()
+				msg, err := server.readHandshakeOfType(typeClientHello)
+				if err != nil {
+					close(hellos)
+					return
+				}
+				hello, _ := parseClientHello(msg)
+				hellos <- hello
+				// a server hello with psk_ke and the session id of the test case.
+				var extensions []byte
+				extensions = appendExtension(extensions, extensionSupportedVersions, appendU16(nil, versionTLS13))
+				extensions = appendExtension(extensions, extensionPreSharedKey, appendU16(nil, 0))
+				body := appendU16(nil, versionTLS12)
+				body = append(body, make([]byte, 32)...)
+				body = appendVec8(body, tc.sessionID)
+				body = appendU16(body, psk.CipherSuite)
+				body = append(body, 0)
+				body = appendVec16(body, extensions)
+				server.writeRecord(recordTypeHandshake, handshakeMessage(typeServerHello, body))
+				// the alert of the client.
+				server.readHandshake()
+			}()
+			err := client.Handshake()
+			var alertErr *alertError
+			if assert.ErrorAs(t, err, &alertErr) {
+				assert.Equal(t, tc.alert, alertErr.alert, err.Error())
+			}
+			hello := <-hellos
+			if assert.NotNil(t, hello) {
+				assert.Equal(t, tc.pskModes, hello.pskModes)
+			}
+		})
+	}
+}
@@ -0,0 +1,563 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmetls
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"hash"
+)
+
+const (
+	typeClientHello         = 1
+	typeServerHello         = 2
+	typeNewSessionTicket    = 4
+	typeEncryptedExtensions = 8
+	typeFinished            = 20
+	typeKeyUpdate           = 24
+
+	extensionSupportedGroups     = 10
+	extensionSignatureAlgorithms = 13
+	extensionPreSharedKey        = 41
+	extensionSupportedVersions   = 43
+	extensionPSKKeyExchangeModes = 45
+	extensionKeyShare            = 51
+
+	versionTLS12 uint16 = 0x0303
+	versionTLS13 uint16 = 0x0304
+
+	pskModeKE    = 0
+	pskModeDHEKE = 1
+
+	groupX25519    uint16 = 0x001d
+	groupSecp256r1 uint16 = 0x0017
+	groupSecp384r1 uint16 = 0x0018
+)
+
+var curves = map[uint16]ecdh.Curve{
+	groupX25519:    ecdh.X25519(),
+	groupSecp256r1: ecdh.P256(),
+	groupSecp384r1: ecdh.P384(),
+}
+
+// clientKeyShares are the groups of the key shares of the client. a server that supports none of
+// them fails the handshake unless Config.AllowPSKKE, hello retry requests are not supported.
+var clientKeyShares = []uint16{groupX25519, groupSecp256r1}
+
+// signatureAlgorithms are never used with PSKs, they are sent for servers that require the extension.
+var signatureAlgorithms = []byte{0x08, 0x04, 0x04, 0x03}
+
+// helloRetryRequestRandom is the random of a ServerHello that is a HelloRetryRequest.
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+func appendU16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendVec8(b []byte, v []byte) []byte {
+	return append(append(b, byte(len(v))), v...)
+}
+
+func appendVec16(b []byte, v []byte) []byte {
+	return append(appendU16(b, uint16(len(v))), v...)
+}
+
+func appendExtension(b []byte, extension uint16, data []byte) []byte {
+	return appendVec16(appendU16(b, extension), data)
+}
+
+func handshakeMessage(msgType uint8, body []byte) []byte {
+	msg := []byte{msgType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+// parser reads the fields of a message. reading past its end marks it as failed and returns zeros.
+type parser struct {
+	b      []byte
+	failed bool
+}
+
+func (p *parser) bytes(n int) []byte {
+	if p.failed || len(p.b) < n {
+		p.failed = true
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *parser) u8() uint8 {
+	if v := p.bytes(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (p *parser) u16() uint16 {
+	if v := p.bytes(2); v != nil {
+		return uint16(v[0])<<8 | uint16(v[1])
+	}
+	return 0
+}
+
+func (p *parser) vec8() []byte {
+	return p.bytes(int(p.u8()))
+}
+
+func (p *parser) vec16() []byte {
+	return p.bytes(int(p.u16()))
+}
+
+func (p *parser) empty() bool {
+	return len(p.b) == 0
+}
+
+// keySchedule is the state of the handshake shared by the client and the server.
+type keySchedule struct {
+	suite      *cipherSuite
+	transcript hash.Hash
+	early      []byte
+	handshake  []byte
+	// traffic secrets of the handshake.
+	clientHandshake []byte
+	serverHandshake []byte
+}
+
+func newKeySchedule(suite *cipherSuite, psk []byte) *keySchedule {
+	return &keySchedule{
+		suite:      suite,
+		transcript: suite.newHash(),
+		early:      suite.extract(nil, psk),
+	}
+}
+
+// binder returns the binder of an external PSK, of the ClientHello truncated before the binders.
+func (ks *keySchedule) binder(truncatedHello []byte) []byte {
+	binderKey := ks.suite.deriveSecret(ks.early, "ext binder", ks.suite.sum(nil))
+	return ks.suite.finishedMAC(binderKey, ks.suite.sum(truncatedHello))
+}
+
+// setSharedSecret derives the handshake traffic secrets, once the transcript includes the
+// ServerHello. sharedSecret is nil with psk_ke.
+func (ks *keySchedule) setSharedSecret(sharedSecret []byte) {
+	if sharedSecret == nil {
+		sharedSecret = make([]byte, ks.suite.hashLen())
+	}
+	ks.handshake = ks.suite.extract(ks.suite.deriveSecret(ks.early, "derived", ks.suite.sum(nil)), sharedSecret)
+	transcriptHash := ks.transcript.Sum(nil)
+	ks.clientHandshake = ks.suite.deriveSecret(ks.handshake, "c hs traffic", transcriptHash)
+	ks.serverHandshake = ks.suite.deriveSecret(ks.handshake, "s hs traffic", transcriptHash)
+}
+
+// applicationSecrets returns the client and the server application traffic secrets, once the
+// transcript includes the server Finished.
+func (ks *keySchedule) applicationSecrets() ([]byte, []byte) {
+	master := ks.suite.extract(ks.suite.deriveSecret(ks.handshake, "derived", ks.suite.sum(nil)), make([]byte, ks.suite.hashLen()))
+	transcriptHash := ks.transcript.Sum(nil)
+	return ks.suite.deriveSecret(master, "c ap traffic", transcriptHash),
+		ks.suite.deriveSecret(master, "s ap traffic", transcriptHash)
+}
+
+// finished returns the Finished message of the traffic secret, of the current transcript.
+func (ks *keySchedule) finished(trafficSecret []byte) []byte {
+	return handshakeMessage(typeFinished, ks.suite.finishedMAC(trafficSecret, ks.transcript.Sum(nil)))
+}
+
+// readHandshakeOfType reads the next handshake message, which must be of msgType.
+func (c *Conn) readHandshakeOfType(msgType uint8) ([]byte, error) {
+	msg, err := c.readHandshake()
+	if err != nil {
+		return nil, err
+	}
+	if msg[0] != msgType {
+		return nil, newAlertError(alertUnexpectedMessage, "got handshake message of type %d, expected %d", msg[0], msgType)
+	}
+	return msg, nil
+}
+
+// setInSecret moves the reads to secret, at the end of a record.
+func (c *Conn) setInSecret(suite *cipherSuite, secret []byte) error {
+	if len(c.hsBuf) > 0 {
+		return newAlertError(alertUnexpectedMessage, "key change not at the end of a record")
+	}
+	return c.in.setSecret(suite, secret)
+}
+
+// verifyFinished reads the Finished message of the peer and verifies it against the current transcript.
+func (c *Conn) verifyFinished(ks *keySchedule, trafficSecret []byte) error {
+	expected := ks.finished(trafficSecret)
+	msg, err := c.readHandshakeOfType(typeFinished)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(msg, expected) {
+		return newAlertError(alertDecryptError, "bad finished")
+	}
+	ks.transcript.Write(msg)
+	return nil
+}
+
+func (c *Conn) clientHandshake() error {
+	psk := c.config.PSK
+	if psk == nil {
+		return newAlertError(alertHandshakeFailure, "no PSK")
+	}
+	suite := cipherSuiteByID(psk.CipherSuite)
+	if suite == nil {
+		return newAlertError(alertHandshakeFailure, "unsupported cipher suite %#04x", psk.CipherSuite)
+	}
+	ks := newKeySchedule(suite, psk.Key)
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	keys := make(map[uint16]*ecdh.PrivateKey)
+	var groups, keyShares []byte
+	for _, group := range clientKeyShares {
+		key, err := curves[group].GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		keys[group] = key
+		groups = appendU16(groups, group)
+		keyShares = appendU16(keyShares, group)
+		keyShares = appendVec16(keyShares, key.PublicKey().Bytes())
+	}
+
+	var extensions []byte
+	extensions = appendExtension(extensions, extensionSupportedVersions, appendVec8(nil, appendU16(nil, versionTLS13)))
+	extensions = appendExtension(extensions, extensionSupportedGroups, appendVec16(nil, groups))
+	extensions = appendExtension(extensions, extensionSignatureAlgorithms, appendVec16(nil, signatureAlgorithms))
+	extensions = appendExtension(extensions, extensionKeyShare, appendVec16(nil, keyShares))
+	// psk_ke has no forward secrecy, it is only offered when allowed.
+	pskModes := []byte{pskModeDHEKE}
+	if c.config.AllowPSKKE {
+		pskModes = append(pskModes, pskModeKE)
+	}
+	extensions = appendExtension(extensions, extensionPSKKeyExchangeModes, appendVec8(nil, pskModes))
+	// the pre shared key extension is the last one, its binder is filled in once the hello is built.
+	identity := append(appendVec16(nil, []byte(psk.Identity)), 0, 0, 0, 0)
+	binders := appendVec8(nil, make([]byte, suite.hashLen()))
+	extensions = appendExtension(extensions, extensionPreSharedKey, append(appendVec16(nil, identity), appendVec16(nil, binders)...))
+
+	body := appendU16(nil, versionTLS12)
+	body = append(body, random...)
+	body = appendVec8(body, nil)
+	body = appendVec16(body, appendU16(nil, suite.id))
+	body = appendVec8(body, []byte{0})
+	body = appendVec16(body, extensions)
+	hello := handshakeMessage(typeClientHello, body)
+	truncated := len(hello) - len(binders) - 2
+	copy(hello[len(hello)-suite.hashLen():], ks.binder(hello[:truncated]))
+	ks.transcript.Write(hello)
+	if err := c.writeRecord(recordTypeHandshake, hello); err != nil {
+		return err
+	}
+
+	msg, err := c.readHandshakeOfType(typeServerHello)
+	if err != nil {
+		return err
+	}
+	p := parser{b: msg[handshakeHeaderLen:]}
+	p.u16()
+	if bytes.Equal(p.bytes(32), helloRetryRequestRandom) {
+		return newAlertError(alertHandshakeFailure, "hello retry requests are not supported")
+	}
+	sessionIDEcho := p.vec8()
+	suiteID := p.u16()
+	compression := p.u8()
+	extensionsParser := parser{b: p.vec16()}
+	if p.failed || !p.empty() {
+		return newAlertError(alertDecodeError, "bad server hello")
+	}
+	// the client sends an empty session id, the server must echo it.
+	if len(sessionIDEcho) != 0 {
+		return newAlertError(alertIllegalParameter, "server echoed a session id that wasn't sent")
+	}
+	if suiteID != suite.id || compression != 0 {
+		return newAlertError(alertIllegalParameter, "server selected cipher suite %#04x, compression %d", suiteID, compression)
+	}
+	var version uint16
+	var sharedSecret []byte
+	pskSelected := false
+	for !extensionsParser.empty() && !extensionsParser.failed {
+		extension := extensionsParser.u16()
+		data := parser{b: extensionsParser.vec16()}
+		switch extension {
+		case extensionSupportedVersions:
+			version = data.u16()
+		case extensionPreSharedKey:
+			if data.u16() != 0 {
+				return newAlertError(alertIllegalParameter, "server selected an unknown PSK")
+			}
+			pskSelected = true
+		case extensionKeyShare:
+			group := data.u16()
+			key, ok := keys[group]
+			if !ok {
+				return newAlertError(alertIllegalParameter, "server selected group %#04x", group)
+			}
+			peerKey, err := curves[group].NewPublicKey(data.vec16())
+			if err != nil {
+				return newAlertError(alertIllegalParameter, "bad key share: %v", err)
+			}
+			if sharedSecret, err = key.ECDH(peerKey); err != nil {
+				return newAlertError(alertIllegalParameter, "bad key share: %v", err)
+			}
+		}
+		if data.failed || !data.empty() {
+			return newAlertError(alertDecodeError, "bad server hello extension %d", extension)
+		}
+	}
+	if extensionsParser.failed {
+		return newAlertError(alertDecodeError, "bad server hello extensions")
+	}
+	if version != versionTLS13 {
+		return newAlertError(alertProtocolVersion, "server selected version %#04x", version)
+	}
+	if !pskSelected {
+		return newAlertError(alertHandshakeFailure, "server didn't accept the PSK")
+	}
+	if sharedSecret == nil && !c.config.AllowPSKKE {
+		return newAlertError(alertMissingExtension, "server didn't send a key share")
+	}
+	ks.transcript.Write(msg)
+	ks.setSharedSecret(sharedSecret)
+	if err := c.setInSecret(suite, ks.serverHandshake); err != nil {
+		return err
+	}
+
+	msg, err = c.readHandshakeOfType(typeEncryptedExtensions)
+	if err != nil {
+		return err
+	}
+	ks.transcript.Write(msg)
+	if err := c.verifyFinished(ks, ks.serverHandshake); err != nil {
+		return err
+	}
+	clientSecret, serverSecret := ks.applicationSecrets()
+	if err := c.setInSecret(suite, serverSecret); err != nil {
+		return err
+	}
+
+	if err := c.out.setSecret(suite, ks.clientHandshake); err != nil {
+		return err
+	}
+	if err := c.writeRecord(recordTypeHandshake, ks.finished(ks.clientHandshake)); err != nil {
+		return err
+	}
+	return c.out.setSecret(suite, clientSecret)
+}
+
+// clientHello is the content of a ClientHello the server handles.
+type clientHello struct {
+	sessionID    []byte
+	cipherSuites []uint16
+	tls13        bool
+	keyShares    map[uint16][]byte
+	pskModes     []byte
+	identities   []string
+	binders      [][]byte
+	// truncatedLen is the length of the hello before the binders.
+	truncatedLen int
+}
+
+func parseClientHello(msg []byte) (*clientHello, error) {
+	hello := &clientHello{keyShares: make(map[uint16][]byte)}
+	p := parser{b: msg[handshakeHeaderLen:]}
+	p.u16()
+	p.bytes(32)
+	hello.sessionID = p.vec8()
+	suites := parser{b: p.vec16()}
+	for !suites.empty() && !suites.failed {
+		hello.cipherSuites = append(hello.cipherSuites, suites.u16())
+	}
+	p.vec8()
+	extensionsParser := parser{b: p.vec16()}
+	if p.failed || suites.failed || !p.empty() {
+		return nil, newAlertError(alertDecodeError, "bad client hello")
+	}
+	for !extensionsParser.empty() && !extensionsParser.failed {
+		extension := extensionsParser.u16()
+		data := parser{b: extensionsParser.vec16()}
+		switch extension {
+		case extensionSupportedVersions:
+			versions := parser{b: data.vec8()}
+			for !versions.empty() && !versions.failed {
+				hello.tls13 = hello.tls13 || versions.u16() == versionTLS13
+			}
+		case extensionKeyShare:
+			shares := parser{b: data.vec16()}
+			for !shares.empty() && !shares.failed {
+				group := shares.u16()
+				hello.keyShares[group] = shares.vec16()
+			}
+			data.failed = data.failed || shares.failed
+		case extensionPSKKeyExchangeModes:
+			hello.pskModes = data.vec8()
+		case extensionPreSharedKey:
+			if !extensionsParser.empty() {
+				return nil, newAlertError(alertIllegalParameter, "pre shared key is not the last extension")
+			}
+			identities := parser{b: data.vec16()}
+			for !identities.empty() && !identities.failed {
+				hello.identities = append(hello.identities, string(identities.vec16()))
+				identities.bytes(4)
+			}
+			hello.truncatedLen = len(msg) - len(data.b)
+			binders := parser{b: data.vec16()}
+			for !binders.empty() && !binders.failed {
+				hello.binders = append(hello.binders, binders.vec8())
+			}
+			data.failed = data.failed || identities.failed || binders.failed || len(hello.binders) != len(hello.identities)
+		default:
+			data.b = nil
+		}
+		if data.failed || !data.empty() {
+			return nil, newAlertError(alertDecodeError, "bad client hello extension %d", extension)
+		}
+	}
+	if extensionsParser.failed {
+		return nil, newAlertError(alertDecodeError, "bad client hello extensions")
+	}
+	return hello, nil
+}
+
+func (c *Conn) serverHandshake() error {
+	msg, err := c.readHandshakeOfType(typeClientHello)
+	if err != nil {
+		return err
+	}
+	hello, err := parseClientHello(msg)
+	if err != nil {
+		return err
+	}
+	if !hello.tls13 {
+		return newAlertError(alertProtocolVersion, "client doesn't support TLS 1.3")
+	}
+	if len(hello.identities) == 0 {
+		return newAlertError(alertHandshakeFailure, "client didn't offer a PSK")
+	}
+	selected := -1
+	var psk *PSK
+	for i, identity := range hello.identities {
+		if psk = c.config.GetPSK(identity); psk != nil {
+			selected = i
+			break
+		}
+	}
+	if psk == nil {
+		return newAlertError(alertUnknownPSKIdentity, "unknown PSK identities %q", hello.identities)
+	}
+	suite := cipherSuiteByID(psk.CipherSuite)
+	offered := false
+	for _, id := range hello.cipherSuites {
+		offered = offered || (suite != nil && id == suite.id)
+	}
+	if !offered {
+		return newAlertError(alertHandshakeFailure, "client didn't offer cipher suite %#04x of the PSK", psk.CipherSuite)
+	}
+	ks := newKeySchedule(suite, psk.Key)
+	if !hmac.Equal(hello.binders[selected], ks.binder(msg[:hello.truncatedLen])) {
+		return newAlertError(alertDecryptError, "bad PSK binder")
+	}
+
+	// psk_dhe_ke if the client sent a key share the server supports, psk_ke otherwise.
+	var keyShare, sharedSecret []byte
+	if bytes.IndexByte(hello.pskModes, pskModeDHEKE) >= 0 {
+		for _, group := range []uint16{groupX25519, groupSecp256r1, groupSecp384r1} {
+			clientKey, ok := hello.keyShares[group]
+			if !ok {
+				continue
+			}
+			peerKey, err := curves[group].NewPublicKey(clientKey)
+			if err != nil {
+				return newAlertError(alertIllegalParameter, "bad key share: %v", err)
+			}
+			key, err := curves[group].GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+			if sharedSecret, err = key.ECDH(peerKey); err != nil {
+				return newAlertError(alertIllegalParameter, "bad key share: %v", err)
+			}
+			keyShare = appendVec16(appendU16(nil, group), key.PublicKey().Bytes())
+			break
+		}
+	}
+	if keyShare == nil && bytes.IndexByte(hello.pskModes, pskModeKE) < 0 {
+		return newAlertError(alertHandshakeFailure, "no supported PSK key exchange mode")
+	}
+	ks.transcript.Write(msg)
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	var extensions []byte
+	extensions = appendExtension(extensions, extensionSupportedVersions, appendU16(nil, versionTLS13))
+	if keyShare != nil {
+		extensions = appendExtension(extensions, extensionKeyShare, keyShare)
+	}
+	extensions = appendExtension(extensions, extensionPreSharedKey, appendU16(nil, uint16(selected)))
+	body := appendU16(nil, versionTLS12)
+	body = append(body, random...)
+	body = appendVec8(body, hello.sessionID)
+	body = appendU16(body, suite.id)
+	body = append(body, 0)
+	body = appendVec16(body, extensions)
+	serverHello := handshakeMessage(typeServerHello, body)
+	ks.transcript.Write(serverHello)
+	if err := c.writeRecord(recordTypeHandshake, serverHello); err != nil {
+		return err
+	}
+	// middlebox compatibility mode, for the clients that sent a session id.
+	if len(hello.sessionID) > 0 {
+		if err := c.writeRecord(recordTypeChangeCipherSpec, []byte{changeCipherSpecPayload}); err != nil {
+			return err
+		}
+	}
+
+	ks.setSharedSecret(sharedSecret)
+	if err := c.out.setSecret(suite, ks.serverHandshake); err != nil {
+		return err
+	}
+	encryptedExtensions := handshakeMessage(typeEncryptedExtensions, appendVec16(nil, nil))
+	ks.transcript.Write(encryptedExtensions)
+	finished := ks.finished(ks.serverHandshake)
+	ks.transcript.Write(finished)
+	if err := c.writeRecord(recordTypeHandshake, append(encryptedExtensions, finished...)); err != nil {
+		return err
+	}
+	clientSecret, serverSecret := ks.applicationSecrets()
+	if err := c.out.setSecret(suite, serverSecret); err != nil {
+		return err
+	}
+
+	if err := c.setInSecret(suite, ks.clientHandshake); err != nil {
+		return err
+	}
+	if err := c.verifyFinished(ks, ks.clientHandshake); err != nil {
+		return err
+	}
+	return c.setInSecret(suite, clientSecret)
+}
@@ -0,0 +1,110 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmetls
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+)
+
+// The TLS 1.3 cipher suites of NVMe/TCP.
+const (
+	TLS_AES_128_GCM_SHA256 uint16 = 0x1301
+	TLS_AES_256_GCM_SHA384 uint16 = 0x1302
+)
+
+type cipherSuite struct {
+	id      uint16
+	newHash func() hash.Hash
+	keyLen  int
+}
+
+var cipherSuites = []*cipherSuite{
+	{id: TLS_AES_128_GCM_SHA256, newHash: sha256.New, keyLen: 16},
+	{id: TLS_AES_256_GCM_SHA384, newHash: sha512.New384, keyLen: 32},
+}
+
+func cipherSuiteByID(id uint16) *cipherSuite {
+	for _, suite := range cipherSuites {
+		if suite.id == id {
+			return suite
+		}
+	}
+	return nil
+}
+
+func (s *cipherSuite) hashLen() int {
+	return s.newHash().Size()
+}
+
+// sum returns the hash of data.
+func (s *cipherSuite) sum(data []byte) []byte {
+	h := s.newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// extract is HKDF-Extract of RFC 5869. a nil salt is a string of zeros.
+func (s *cipherSuite) extract(salt, ikm []byte) []byte {
+	return hkdfExtract(s.newHash, salt, ikm)
+}
+
+// expandLabel is HKDF-Expand-Label of RFC 8446.
+func (s *cipherSuite) expandLabel(secret []byte, label string, context []byte, length int) []byte {
+	return hkdfExpandLabel(s.newHash, secret, label, context, length)
+}
+
+// deriveSecret is Derive-Secret of RFC 8446, given the hash of the transcript.
+func (s *cipherSuite) deriveSecret(secret []byte, label string, transcriptHash []byte) []byte {
+	return s.expandLabel(secret, label, transcriptHash, s.hashLen())
+}
+
+// finishedMAC returns the verify data of a Finished message, or a PSK binder, of the base key.
+func (s *cipherSuite) finishedMAC(baseKey, transcriptHash []byte) []byte {
+	mac := hmac.New(s.newHash, s.expandLabel(baseKey, "finished", nil, s.hashLen()))
+	mac.Write(transcriptHash)
+	return mac.Sum(nil)
+}
+
+func hkdfExtract(newHash func() hash.Hash, salt, ikm []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, newHash().Size())
+	}
+	mac := hmac.New(newHash, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(newHash func() hash.Hash, prk, info []byte, length int) []byte {
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(newHash, prk)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, context []byte, length int) []byte {
+	info := appendU16(nil, uint16(length))
+	info = appendVec8(info, []byte("tls13 "+label))
+	info = appendVec8(info, context)
+	return hkdfExpand(newHash, secret, info, length)
+}
@@ -0,0 +1,189 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nvmetls implements the secure channels of NVMe/TCP: TLS 1.3 with pre-shared keys. it
+// covers the PSK interchange format, the retained and TLS PSKs derived from configured PSKs, and a
+// TLS 1.3 client and server restricted to external PSKs. crypto/tls only resumes sessions with
+// PSKs, it has no external PSKs, and the handshake upcall of the kernel (tlshd) serves the sockets
+// of the kernel NVMe/TCP host, not the sockets of the discovery connections of this service.
+package nvmetls
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"strings"
+)
+
+const (
+	pskPrefix = "NVMeTLSkey-1"
+	// identityVersion is the version of the PSK identities, the TLS PSK being the retained PSK.
+	identityVersion = 0
+)
+
+// The hash functions a retained PSK is derived with ("hh" of the PSK interchange format).
+const (
+	// PSKHashNone uses the configured PSK as the retained PSK.
+	PSKHashNone   = 0
+	PSKHashSHA256 = 1
+	PSKHashSHA384 = 2
+)
+
+// ConfiguredPSK is a PSK in the PSK interchange format, "NVMeTLSkey-1:<hh>:<base64 of the key and
+// its CRC-32>:".
+type ConfiguredPSK struct {
+	// Hash of the retained PSK, PSKHashNone or one of its siblings.
+	Hash int
+	Key  []byte
+}
+
+// PSK is a pre-shared key of a TLS connection.
+type PSK struct {
+	Identity string
+	Key      []byte
+	// CipherSuite of the connection, the one of the hash of the key.
+	CipherSuite uint16
+}
+
+// ParseConfiguredPSK parses a PSK in the PSK interchange format.
+func ParseConfiguredPSK(s string) (*ConfiguredPSK, error) {
+	fields := strings.Split(strings.TrimSpace(s), ":")
+	if len(fields) != 4 || fields[0] != pskPrefix || fields[3] != "" {
+		return nil, fmt.Errorf("invalid PSK, expected %s:<hh>:<key>:", pskPrefix)
+	}
+	var psk ConfiguredPSK
+	switch fields[1] {
+	case "00":
+		psk.Hash = PSKHashNone
+	case "01":
+		psk.Hash = PSKHashSHA256
+	case "02":
+		psk.Hash = PSKHashSHA384
+	default:
+		return nil, fmt.Errorf("invalid PSK hash %q", fields[1])
+	}
+	decoded, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PSK: %w", err)
+	}
+	if len(decoded) != 32+4 && len(decoded) != 48+4 {
+		return nil, fmt.Errorf("invalid PSK length %d", len(decoded)-4)
+	}
+	psk.Key = decoded[:len(decoded)-4]
+	if crc := binary.LittleEndian.Uint32(decoded[len(psk.Key):]); crc != crc32.ChecksumIEEE(psk.Key) {
+		return nil, fmt.Errorf("invalid PSK, bad CRC-32")
+	}
+	if psk.Hash != PSKHashNone && len(psk.Key) != psk.newHash()().Size() {
+		return nil, fmt.Errorf("invalid PSK length %d for hash %s", len(psk.Key), fields[1])
+	}
+	return &psk, nil
+}
+
+// String returns the PSK in the PSK interchange format.
+func (k *ConfiguredPSK) String() string {
+	key := binary.LittleEndian.AppendUint32(append([]byte{}, k.Key...), crc32.ChecksumIEEE(k.Key))
+	return fmt.Sprintf("%s:%02d:%s:", pskPrefix, k.Hash, base64.StdEncoding.EncodeToString(key))
+}
+
+// newHash returns the hash of the key, by its length if the configured PSK is used as is.
+func (k *ConfiguredPSK) newHash() func() hash.Hash {
+	if k.Hash == PSKHashSHA384 || (k.Hash == PSKHashNone && len(k.Key) == 48) {
+		return sha512.New384
+	}
+	return sha256.New
+}
+
+// TLSPSK returns the PSK of the TLS connections of hostnqn to subnqn: the identity "NVMe0R<hh>
+// <hostnqn> <subnqn>" and the retained PSK, derived from the configured PSK with HKDF-Expand-Label
+// and the label "HostNQN".
+func (k *ConfiguredPSK) TLSPSK(hostnqn, subnqn string) *PSK {
+	newHash := k.newHash()
+	retained := k.Key
+	if k.Hash != PSKHashNone {
+		retained = hkdfExpandLabel(newHash, hkdfExtract(newHash, nil, k.Key), "HostNQN", []byte(hostnqn), len(k.Key))
+	}
+	psk := &PSK{Key: retained, CipherSuite: TLS_AES_128_GCM_SHA256}
+	hh := PSKHashSHA256
+	if newHash().Size() == 48 {
+		psk.CipherSuite = TLS_AES_256_GCM_SHA384
+		hh = PSKHashSHA384
+	}
+	psk.Identity = fmt.Sprintf("NVMe%dR%02d %s %s", identityVersion, hh, hostnqn, subnqn)
+	return psk
+}
+
+// KeyFile is a file of configured PSKs, one "<hostnqn> <subnqn> <configured PSK>" per line.
+// empty lines and lines starting with # are ignored.
+type KeyFile struct {
+	keys map[[2]string]*ConfiguredPSK
+}
+
+// LoadKeyFile reads the key file at path.
+func LoadKeyFile(path string) (*KeyFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keyFile := &KeyFile{keys: make(map[[2]string]*ConfiguredPSK)}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected <hostnqn> <subnqn> <psk>", path, lineNumber)
+		}
+		psk, err := ParseConfiguredPSK(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		keyFile.keys[[2]string{fields[0], fields[1]}] = psk
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keyFile, nil
+}
+
+// PSK returns the PSK of the TLS connections of hostnqn to subnqn.
+func (f *KeyFile) PSK(hostnqn, subnqn string) (*PSK, error) {
+	configured, ok := f.keys[[2]string{hostnqn, subnqn}]
+	if !ok {
+		return nil, fmt.Errorf("no PSK of host %q and subsystem %q", hostnqn, subnqn)
+	}
+	return configured.TLSPSK(hostnqn, subnqn), nil
+}
+
+// LookupIdentity returns the PSK of identity, nil if not found. it is the GetPSK of servers.
+func (f *KeyFile) LookupIdentity(identity string) *PSK {
+	fields := strings.Fields(identity)
+	if len(fields) != 3 {
+		return nil
+	}
+	psk, err := f.PSK(fields[1], fields[2])
+	if err != nil || psk.Identity != identity {
+		return nil
+	}
+	return psk
+}
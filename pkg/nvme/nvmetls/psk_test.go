@@ -0,0 +1,108 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmetls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869 test case 1
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	prk := hkdfExtract(sha256.New, salt, ikm)
+	assert.Equal(t, "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5", hex.EncodeToString(prk))
+	assert.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		hex.EncodeToString(hkdfExpand(sha256.New, prk, info, 42)))
+}
+
+func TestParseConfiguredPSK(t *testing.T) {
+	for _, hash := range []int{PSKHashNone, PSKHashSHA256, PSKHashSHA384} {
+		key := bytes.Repeat([]byte{byte(hash) + 1}, 32)
+		if hash == PSKHashSHA384 {
+			key = bytes.Repeat([]byte{3}, 48)
+		}
+		psk := &ConfiguredPSK{Hash: hash, Key: key}
+		parsed, err := ParseConfiguredPSK(psk.String())
+		assert.NoError(t, err)
+		assert.Equal(t, psk, parsed)
+	}
+
+	valid := (&ConfiguredPSK{Hash: PSKHashSHA256, Key: make([]byte, 32)}).String()
+	for _, s := range []string{
+		"",
+		valid[:len(valid)-1],
+		"NVMeTLSkey-2" + valid[len(pskPrefix):],
+		valid[:len(pskPrefix)+1] + "03" + valid[len(pskPrefix)+3:],
+		// a SHA-384 PSK of 32 bytes
+		valid[:len(pskPrefix)+1] + "02" + valid[len(pskPrefix)+3:],
+		// bad CRC-32
+		valid[:len(valid)-3] + "A=:",
+	} {
+		_, err := ParseConfiguredPSK(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestTLSPSK(t *testing.T) {
+	hostnqn := "nqn.2014-08.org.nvmexpress:uuid:host"
+	subnqn := "nqn.2014-08.org.nvmexpress.discovery"
+
+	psk := (&ConfiguredPSK{Hash: PSKHashNone, Key: make([]byte, 32)}).TLSPSK(hostnqn, subnqn)
+	assert.Equal(t, "NVMe0R01 "+hostnqn+" "+subnqn, psk.Identity)
+	assert.Equal(t, make([]byte, 32), psk.Key)
+	assert.Equal(t, TLS_AES_128_GCM_SHA256, psk.CipherSuite)
+
+	psk = (&ConfiguredPSK{Hash: PSKHashSHA384, Key: make([]byte, 48)}).TLSPSK(hostnqn, subnqn)
+	assert.Equal(t, "NVMe0R02 "+hostnqn+" "+subnqn, psk.Identity)
+	assert.Len(t, psk.Key, 48)
+	assert.NotEqual(t, make([]byte, 48), psk.Key)
+	assert.Equal(t, TLS_AES_256_GCM_SHA384, psk.CipherSuite)
+
+	// the retained PSK is bound to the host
+	other := (&ConfiguredPSK{Hash: PSKHashSHA384, Key: make([]byte, 48)}).TLSPSK(hostnqn+"2", subnqn)
+	assert.NotEqual(t, psk.Key, other.Key)
+}
+
+func TestKeyFile(t *testing.T) {
+	configured := &ConfiguredPSK{Hash: PSKHashSHA256, Key: bytes.Repeat([]byte{7}, 32)}
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# hostnqn subnqn psk\n\nhost1 subsys1 " + configured.String() + "\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	keyFile, err := LoadKeyFile(path)
+	assert.NoError(t, err)
+	psk, err := keyFile.PSK("host1", "subsys1")
+	assert.NoError(t, err)
+	assert.Equal(t, configured.TLSPSK("host1", "subsys1"), psk)
+	_, err = keyFile.PSK("host2", "subsys1")
+	assert.Error(t, err)
+
+	assert.Equal(t, psk, keyFile.LookupIdentity(psk.Identity))
+	assert.Nil(t, keyFile.LookupIdentity("NVMe0R02 host1 subsys1"))
+	assert.Nil(t, keyFile.LookupIdentity("host1"))
+
+	assert.NoError(t, os.WriteFile(path, []byte("host1 subsys1\n"), 0600))
+	_, err = LoadKeyFile(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,192 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvme
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/lunixbochs/struc"
+)
+
+//#include <linux/nvme-tcp.h>
+import "C"
+
+const (
+	tcpHdrSize    = C.sizeof_struct_nvme_tcp_hdr
+	tcpDigestSize = C.NVME_TCP_DIGEST_LENGTH
+	// tcpMaxPda is the largest HPDA and CPDA, in dwords 0's based.
+	tcpMaxPda = 31
+	// tcpMaxPduSize is the largest PDU read from a peer, a discovery log page of 16K records.
+	// the PDU is allocated at once, its length must not be taken from the wire as is.
+	tcpMaxPduSize = 16 << 20
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// TCPDigest returns the CRC32C of b, the header and data digests of NVMe/TCP PDUs.
+func TCPDigest(b []byte) uint32 {
+	return crc32.Checksum(b, crc32cTable)
+}
+
+// TCPDigestOptions returns the digest field of ICReq and ICResp enabling the given digests.
+func TCPDigestOptions(headerDigest, dataDigest bool) uint8 {
+	var digest uint8
+	if headerDigest {
+		digest |= C.NVME_TCP_HDR_DIGEST_ENABLE
+	}
+	if dataDigest {
+		digest |= C.NVME_TCP_DATA_DIGEST_ENABLE
+	}
+	return digest
+}
+
+// TCPPduFormat is the format of the PDUs of an NVMe/TCP queue, as negotiated by ICReq and ICResp.
+// ICReq and ICResp themselves never carry digests.
+type TCPPduFormat struct {
+	HeaderDigest bool
+	DataDigest   bool
+	// DataAlignment is the alignment of the data of the PDUs sent, in bytes from the start of
+	// the PDU, as required by the peer. 0 has no alignment constraint.
+	DataAlignment int
+}
+
+// NewTCPPduFormat returns the format of the PDUs of a queue given digest, the digest field of
+// ICResp, and pda, the HPDA or CPDA of the peer.
+func NewTCPPduFormat(digest uint8, pda uint8) (TCPPduFormat, error) {
+	if pda > tcpMaxPda {
+		return TCPPduFormat{}, fmt.Errorf("pda %d out of range", pda)
+	}
+	format := TCPPduFormat{
+		HeaderDigest: digest&C.NVME_TCP_HDR_DIGEST_ENABLE != 0,
+		DataDigest:   digest&C.NVME_TCP_DATA_DIGEST_ENABLE != 0,
+	}
+	if pda > 0 {
+		format.DataAlignment = (int(pda) + 1) * 4
+	}
+	return format, nil
+}
+
+func appendDigest(b []byte, digested []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, TCPDigest(digested))
+}
+
+// WritePdu writes a PDU made of hdr, the PDU specific header and data to w. the lengths, the
+// data offset and the digest flags of hdr are set by the format.
+func (f TCPPduFormat) WritePdu(w io.Writer, hdr *TCPHeaderType, header []byte, data []byte) error {
+	hdr.Hlen = uint8(tcpHdrSize + len(header))
+	hdr.Flags &^= C.NVME_TCP_F_HDGST | C.NVME_TCP_F_DDGST
+	hdr.Pdo = 0
+	length := int(hdr.Hlen)
+	if f.HeaderDigest {
+		hdr.Flags |= C.NVME_TCP_F_HDGST
+		length += tcpDigestSize
+	}
+	padding := 0
+	if len(data) > 0 {
+		if f.DataAlignment > 0 && length%f.DataAlignment != 0 {
+			padding = f.DataAlignment - length%f.DataAlignment
+		}
+		hdr.Pdo = uint8(length + padding)
+		length += padding + len(data)
+		if f.DataDigest {
+			hdr.Flags |= C.NVME_TCP_F_DDGST
+			length += tcpDigestSize
+		}
+	}
+	hdr.Plen = length
+
+	var buf bytes.Buffer
+	if err := struc.Pack(&buf, hdr); err != nil {
+		return err
+	}
+	pdu := append(buf.Bytes(), header...)
+	if f.HeaderDigest {
+		pdu = appendDigest(pdu, pdu)
+	}
+	if len(data) > 0 {
+		pdu = append(pdu, make([]byte, padding)...)
+		pdu = append(pdu, data...)
+		if f.DataDigest {
+			pdu = appendDigest(pdu, data)
+		}
+	}
+	_, err := w.Write(pdu)
+	return err
+}
+
+// ReadPdu reads the rest of the PDU of hdr from r and verifies its digests. it returns the PDU
+// specific header and the data of the PDU, nil if it has none.
+func (f TCPPduFormat) ReadPdu(r io.Reader, hdr *TCPHeaderType) ([]byte, []byte, error) {
+	hdgst := hdr.Flags&C.NVME_TCP_F_HDGST != 0
+	ddgst := hdr.Flags&C.NVME_TCP_F_DDGST != 0
+	if hdgst != f.HeaderDigest {
+		return nil, nil, fmt.Errorf("pdu type %d: header digest %t, negotiated %t", hdr.Type, hdgst, f.HeaderDigest)
+	}
+	hdrLen := int(hdr.Hlen)
+	if hdrLen < tcpHdrSize {
+		return nil, nil, fmt.Errorf("pdu type %d: bad hlen %d", hdr.Type, hdr.Hlen)
+	}
+	if hdgst {
+		hdrLen += tcpDigestSize
+	}
+	if hdr.Plen < hdrLen || hdr.Plen > tcpMaxPduSize {
+		return nil, nil, fmt.Errorf("pdu type %d: bad hlen %d or plen %d", hdr.Type, hdr.Hlen, hdr.Plen)
+	}
+
+	var buf bytes.Buffer
+	if err := struc.Pack(&buf, hdr); err != nil {
+		return nil, nil, err
+	}
+	pdu := make([]byte, hdr.Plen)
+	copy(pdu, buf.Bytes())
+	if _, err := io.ReadFull(r, pdu[tcpHdrSize:]); err != nil {
+		return nil, nil, err
+	}
+
+	header := pdu[tcpHdrSize:hdr.Hlen]
+	if hdgst {
+		expected := binary.LittleEndian.Uint32(pdu[hdr.Hlen:hdrLen])
+		if digest := TCPDigest(pdu[:hdr.Hlen]); digest != expected {
+			return nil, nil, fmt.Errorf("pdu type %d: header digest error, got %#08x, expected %#08x", hdr.Type, digest, expected)
+		}
+	}
+	if hdr.Plen == hdrLen {
+		return header, nil, nil
+	}
+
+	if ddgst != f.DataDigest {
+		return nil, nil, fmt.Errorf("pdu type %d: data digest %t, negotiated %t", hdr.Type, ddgst, f.DataDigest)
+	}
+	end := hdr.Plen
+	if ddgst {
+		end -= tcpDigestSize
+	}
+	pdo := int(hdr.Pdo)
+	if pdo < hdrLen || pdo > end {
+		return nil, nil, fmt.Errorf("pdu type %d: bad pdo %d, hlen %d, plen %d", hdr.Type, hdr.Pdo, hdr.Hlen, hdr.Plen)
+	}
+	data := pdu[pdo:end]
+	if ddgst {
+		expected := binary.LittleEndian.Uint32(pdu[end:])
+		if digest := TCPDigest(data); digest != expected {
+			return nil, nil, fmt.Errorf("pdu type %d: data digest error, got %#08x, expected %#08x", hdr.Type, digest, expected)
+		}
+	}
+	return header, data, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvme
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lunixbochs/struc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPDigest(t *testing.T) {
+	// the check value of CRC32C
+	assert.Equal(t, uint32(0xe3069283), TCPDigest([]byte("123456789")))
+
+	format, err := NewTCPPduFormat(TCPDigestOptions(true, false), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, TCPPduFormat{HeaderDigest: true}, format)
+	format, err = NewTCPPduFormat(TCPDigestOptions(false, true), 7)
+	assert.NoError(t, err)
+	assert.Equal(t, TCPPduFormat{DataDigest: true, DataAlignment: 32}, format)
+	_, err = NewTCPPduFormat(0, 32)
+	assert.Error(t, err)
+}
+
+func TestTCPPduFormat(t *testing.T) {
+	header := bytes.Repeat([]byte{0xa5}, 16)
+	data := []byte("discovery log page")
+	tests := []struct {
+		name   string
+		format TCPPduFormat
+		pdo    uint8
+		plen   int
+	}{
+		{name: "no digests", format: TCPPduFormat{}, pdo: 24, plen: 24 + 18},
+		{name: "header digest", format: TCPPduFormat{HeaderDigest: true}, pdo: 28, plen: 28 + 18},
+		{name: "data digest", format: TCPPduFormat{DataDigest: true}, pdo: 24, plen: 24 + 18 + 4},
+		{name: "both digests aligned", format: TCPPduFormat{HeaderDigest: true, DataDigest: true, DataAlignment: 32}, pdo: 32, plen: 32 + 18 + 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			hdr := &TCPHeaderType{Type: 7, Flags: 0x04}
+			assert.NoError(t, tt.format.WritePdu(&buf, hdr, header, data))
+			assert.Equal(t, uint8(24), hdr.Hlen)
+			assert.Equal(t, tt.pdo, hdr.Pdo)
+			assert.Equal(t, tt.plen, hdr.Plen)
+			assert.Equal(t, tt.plen, buf.Len())
+
+			pdu := buf.Bytes()
+			received := &TCPHeaderType{}
+			reader := bytes.NewReader(pdu)
+			assert.NoError(t, struc.Unpack(reader, received))
+			assert.Equal(t, hdr, received)
+			gotHeader, gotData, err := tt.format.ReadPdu(reader, received)
+			assert.NoError(t, err)
+			assert.Equal(t, header, gotHeader)
+			assert.Equal(t, data, gotData)
+
+			// a corrupted header or data is detected only by its digest.
+			for _, offset := range []int{10, tt.plen - 6} {
+				corrupted := append([]byte{}, pdu...)
+				corrupted[offset] ^= 0xff
+				reader := bytes.NewReader(corrupted)
+				assert.NoError(t, struc.Unpack(reader, received))
+				_, _, err := tt.format.ReadPdu(reader, received)
+				digested := tt.format.HeaderDigest
+				if offset != 10 {
+					digested = tt.format.DataDigest
+				}
+				assert.Equal(t, digested, err != nil, "offset %d", offset)
+			}
+		})
+	}
+
+	// the digests must be the negotiated ones.
+	var buf bytes.Buffer
+	hdr := &TCPHeaderType{Type: 5}
+	assert.NoError(t, TCPPduFormat{}.WritePdu(&buf, hdr, header, nil))
+	assert.Equal(t, 24, hdr.Plen)
+	assert.Equal(t, uint8(0), hdr.Pdo)
+	reader := bytes.NewReader(buf.Bytes())
+	assert.NoError(t, struc.Unpack(reader, hdr))
+	_, _, err := TCPPduFormat{HeaderDigest: true}.ReadPdu(reader, hdr)
+	assert.Error(t, err)
+}
+
+func TestTCPPduBadLengths(t *testing.T) {
+	tests := []struct {
+		name   string
+		format TCPPduFormat
+		hdr    TCPHeaderType
+	}{
+		// the header digest must not make up for an hlen shorter than the common header.
+		{name: "header digest short hlen", format: TCPPduFormat{HeaderDigest: true}, hdr: TCPHeaderType{Type: 5, Flags: 0x01, Hlen: 4, Plen: 8}},
+		{name: "short hlen", format: TCPPduFormat{}, hdr: TCPHeaderType{Type: 5, Hlen: 4, Plen: 8}},
+		{name: "plen shorter than hlen", format: TCPPduFormat{}, hdr: TCPHeaderType{Type: 5, Hlen: 24, Plen: 16}},
+		{name: "huge plen", format: TCPPduFormat{}, hdr: TCPHeaderType{Type: 7, Hlen: 24, Pdo: 24, Plen: 0xffffffff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := tt.hdr
+			// the peer sends the PDU its header announces, the lengths must be rejected before reading it.
+			reader := bytes.NewReader(make([]byte, 64))
+			_, _, err := tt.format.ReadPdu(reader, &hdr)
+			assert.Error(t, err)
+			assert.Equal(t, 64, reader.Len())
+		})
+	}
+}
@@ -16,12 +16,15 @@ package nvme
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
 
 	"github.com/lightbitslabs/discovery-client/pkg/metrics"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmetls"
 	"github.com/lunixbochs/struc"
 	"github.com/sirupsen/logrus"
 )
@@ -29,6 +32,10 @@ import (
 //#include <linux/nvme-tcp.h>
 import "C"
 
+// tcpMaxPduOverhead is the largest size of a PDU without its data: the header, the digests and
+// the padding of the data.
+const tcpMaxPduOverhead = 256
+
 type nvmetTransport interface {
 	queueResponse(Request)
 }
@@ -41,6 +48,8 @@ type tcpQueue struct {
 	completedNvmeRequests chan Request
 	log                   *logrus.Entry
 	doneCh                chan interface{}
+	// pduFormat is the format of the PDUs negotiated with the host.
+	pduFormat TCPPduFormat
 }
 
 func newNvmeTCPQueue(discoverySubsystem DiscoverySubsystem, id uint16, tcpConn net.Conn, serviceID string, controllerID uint16) *tcpQueue {
@@ -85,7 +94,6 @@ func pduSize(pduType uint8) int {
 	default:
 		panic("BUG!!")
 	}
-	return 0
 }
 
 func pduValid(pduType uint8) bool {
@@ -139,9 +147,13 @@ func (queue *tcpQueue) nvmeConnect() error {
 		return fmt.Errorf("queue %d: bad pfv %d", queue.id, icReq.Pfv)
 	}
 
-	if icReq.Hpda != 0 {
-		return fmt.Errorf("queue %d: unsupported hpda %d", queue.id, icReq.Hpda)
+	// the digests requested by the host are enabled, and the data sent is aligned to its hpda.
+	digest := icReq.Digest & TCPDigestOptions(true, true)
+	pduFormat, err := NewTCPPduFormat(digest, icReq.Hpda)
+	if err != nil {
+		return fmt.Errorf("queue %d: unsupported hpda %d: %w", queue.id, icReq.Hpda, err)
 	}
+	queue.pduFormat = pduFormat
 
 	connectRespTCPHeader := &TCPHeaderType{
 		Type: C.nvme_tcp_icresp,
@@ -150,6 +162,7 @@ func (queue *tcpQueue) nvmeConnect() error {
 	}
 	connectResp := &TCPIcrespPdu{
 		Pfv:     C.NVME_TCP_PFV_1_0,
+		Digest:  digest,
 		Maxdata: 0x10000,
 	}
 
@@ -169,37 +182,24 @@ func (queue *tcpQueue) nvmeConnect() error {
 }
 
 func (queue *tcpQueue) sendCqe(cqe *Completion) error {
-
 	hdr := &TCPHeaderType{
-		Hlen: C.sizeof_struct_nvme_tcp_rsp_pdu,
-		Plen: C.sizeof_struct_nvme_tcp_rsp_pdu,
 		Type: C.nvme_tcp_rsp,
 	}
 
-	// TODO: digest is not supported yet
-	if err := struc.Pack(queue.tcpWriter, hdr); err != nil {
-		queue.log.WithError(err).Infof("failed to serialize cqe header")
+	var pdu bytes.Buffer
+	if err := struc.Pack(&pdu, cqe); err != nil {
+		queue.log.WithError(err).Infof("failed to serialize cqe")
 		return err
 	}
 
-	return struc.Pack(queue.tcpWriter, cqe)
+	return queue.pduFormat.WritePdu(queue.tcpWriter, hdr, pdu.Bytes(), nil)
 }
 
 func (queue *tcpQueue) sendDataPdu(nvmeRequest Request) error {
 	hdr := &TCPHeaderType{
-		Hlen: C.sizeof_struct_nvme_tcp_rsp_pdu,
-		Plen: C.sizeof_struct_nvme_tcp_rsp_pdu,
-		Type: C.nvme_tcp_rsp,
-	}
-	hdr.Type = C.nvme_tcp_c2h_data
-	hdr.Flags = C.NVME_TCP_F_DATA_LAST
-	hdr.Hlen = C.sizeof_struct_nvme_tcp_data_pdu
-	if nvmeRequest.dataLen() > 0 {
-		hdr.Pdo = C.sizeof_struct_nvme_tcp_data_pdu
-	} else {
-		hdr.Pdo = 0
+		Type:  C.nvme_tcp_c2h_data,
+		Flags: C.NVME_TCP_F_DATA_LAST,
 	}
-	hdr.Plen = int(C.sizeof_struct_nvme_tcp_data_pdu + nvmeRequest.dataLen())
 
 	pdu := &TCPDataPDU{
 		CommandID:  nvmeRequest.CommandID(),
@@ -207,27 +207,20 @@ func (queue *tcpQueue) sendDataPdu(nvmeRequest Request) error {
 		DataOffset: 0,
 	}
 
-	// Digest is not supported yet
-
-	// send tcp header
-	if err := struc.Pack(queue.tcpWriter, hdr); err != nil {
-		queue.log.WithError(err).Infof("failed to serialize data pdu")
-		return err
-	}
-
-	// send pdu
-	if err := struc.Pack(queue.tcpWriter, pdu); err != nil {
+	var header bytes.Buffer
+	if err := struc.Pack(&header, pdu); err != nil {
 		queue.log.WithError(err).Infof("failed to serialize data pdu")
 		return err
 	}
 
-	// Now send the data
-	if _, err := io.Copy(queue.tcpWriter, NewScatterListReader(nvmeRequest.GetData())); err != nil {
-		queue.log.WithError(err).Infof("failed to copy sgl to tcpWriter")
+	// copy the sgl, the data is digested as a whole
+	var data bytes.Buffer
+	if _, err := io.Copy(&data, NewScatterListReader(nvmeRequest.GetData())); err != nil {
+		queue.log.WithError(err).Infof("failed to copy sgl to data pdu")
 		return err
 	}
 
-	return nil
+	return queue.pduFormat.WritePdu(queue.tcpWriter, hdr, header.Bytes(), data.Bytes())
 }
 
 func needsDataOut(request Request) bool {
@@ -308,12 +301,13 @@ func (queue *tcpQueue) handleReceivePdu() <-chan error {
 				return
 			}
 
-			// no digest support for now
-			hdgst := 0
-			rcvLeft := int(hdr.Hlen) - C.sizeof_struct_nvme_tcp_hdr + hdgst
-			pdu := make([]byte, rcvLeft)
-
-			_, err = io.ReadFull(queue.tcpReader, pdu)
+			if hdr.Plen > tcpMaxPduOverhead+int(queue.nvmeQueue.inlineSize()) {
+				err := fmt.Errorf("pdu type %v bad plen %v", hdr.Type, hdr.Plen)
+				queue.log.WithError(err).Errorf("failed to read pdu")
+				errChan <- err
+				return
+			}
+			pdu, inlineData, err := queue.pduFormat.ReadPdu(queue.tcpReader, hdr)
 			if err != nil {
 				queue.log.WithError(err).Infof("failed to read pdu")
 				errChan <- err
@@ -333,6 +327,10 @@ func (queue *tcpQueue) handleReceivePdu() <-chan error {
 					// and we do NOT want to close the queue.
 					continue
 				}
+				if stt&^C.NVME_SC_DNR == C.NVME_SC_AUTH_REQUIRED {
+					// the host may still authenticate
+					continue
+				}
 				errChan <- err
 				return
 			}
@@ -354,8 +352,12 @@ func (queue *tcpQueue) handleReceivePdu() <-chan error {
 					return
 				}
 
+				if len(inlineData) != int(tcpRequest.GetPDULength()) {
+					errChan <- fmt.Errorf("got %d bytes of inline data, expected %d", len(inlineData), tcpRequest.GetPDULength())
+					return
+				}
 				sglWriter := NewScatterListWriter(tcpRequest.NvmeRequest().GetData())
-				_, err := io.CopyN(sglWriter, queue.tcpReader, int64(tcpRequest.GetPDULength()))
+				_, err := io.Copy(sglWriter, bytes.NewReader(inlineData))
 				if err != nil {
 					queue.log.WithError(err).Errorf("failed to copy sgl data to tcp queue")
 					errChan <- err
@@ -408,3 +410,26 @@ func (queue *tcpQueue) ioWork() {
 		queue.log.Info("goroutines closed - ioWork closed")
 	}()
 }
+
+// ServeTCP serves the NVMe/TCP connections accepted by listener as admin queues of the discovery
+// subsystem, each with its own controller. the connections are secured with TLS 1.3 if tlsConfig
+// is set, and the hosts authenticate with DH-HMAC-CHAP if authConfig is set. it returns the error
+// of Accept, when listener is closed.
+func ServeTCP(listener net.Listener, discoverySubsystem DiscoverySubsystem, serviceID string, tlsConfig *nvmetls.Config, authConfig *nvmeauth.Config) error {
+	for controllerID := uint16(1); ; controllerID++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if tlsConfig != nil {
+			conn = nvmetls.Server(conn, tlsConfig)
+		}
+		queue := newNvmeTCPQueue(discoverySubsystem, 0, conn, serviceID, controllerID)
+		queue.authConfig = authConfig
+		queue.ioWork()
+		go func() {
+			<-queue.doneChan()
+			queue.destroy()
+		}()
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
@@ -42,7 +43,27 @@ func maxUint32(x, y uint32) uint32 {
 	return y
 }
 
+// TransportName returns the name of the transport type of a discovery log page entry,
+// as in the transport connect option, or "" if unknown.
+func TransportName(trtype uint8) string {
+	switch trtype {
+	case 1:
+		return "rdma"
+	case 2:
+		return "fc"
+	case 3:
+		return "tcp"
+	case 254:
+		return "loop"
+	}
+	return ""
+}
+
 func AdjustTraddr(traddr string) (string, error) {
+	if _, zone := SplitZone(traddr); zone != "" {
+		// traddr is a zone scoped ipv6, e.g. fe80::1%ens3 - do nothing
+		return traddr, nil
+	}
 	if net.ParseIP(traddr).To4() != nil {
 		// traddr is ipv4 - do nothing
 		return traddr, nil
@@ -59,6 +80,45 @@ func AdjustTraddr(traddr string) (string, error) {
 	return "", err
 }
 
+// SplitZone splits a zone scoped IPv6 address, e.g. fe80::1%ens3, into the address and
+// its zone, an interface name or index. other addresses are returned with no zone.
+func SplitZone(traddr string) (string, string) {
+	if i := strings.LastIndexByte(traddr, '%'); i > 0 {
+		if ip := net.ParseIP(traddr[:i]); ip != nil && ip.To4() == nil && i < len(traddr)-1 {
+			return traddr[:i], traddr[i+1:]
+		}
+	}
+	return traddr, ""
+}
+
+// ScopeTraddr returns traddr scoped to zone if it is an IPv6 link-local address with no zone,
+// which is only reachable through a given interface. other addresses are returned as is.
+func ScopeTraddr(traddr, zone string) string {
+	if zone == "" {
+		return traddr
+	}
+	if addr, z := SplitZone(traddr); z == "" {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			return addr + "%" + zone
+		}
+	}
+	return traddr
+}
+
+// ZoneInterface returns the name of the interface traddr is scoped to, the zone of a zone
+// scoped IPv6 address given as an interface name or index, or "" if it has none.
+func ZoneInterface(traddr string) string {
+	_, zone := SplitZone(traddr)
+	if index, err := strconv.Atoi(zone); err == nil {
+		iface, err := net.InterfaceByIndex(index)
+		if err != nil {
+			return ""
+		}
+		return iface.Name
+	}
+	return zone
+}
+
 func GetOrCreateHostID(log *logrus.Logger, nvmeHostIDPath string) (string, error) {
 	// if host-id file doesn't exist generate it, and save it to the file.
 	// if it does exist, read it from the file, and return it
@@ -0,0 +1,46 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvme
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZoneScopedTraddr(t *testing.T) {
+	for _, traddr := range []string{"10.0.0.1", "fd00::1", "fe80::1%ens3", "fe80::1%2"} {
+		adjusted, err := AdjustTraddr(traddr)
+		assert.NoError(t, err, traddr)
+		assert.Equal(t, traddr, adjusted)
+	}
+	_, err := AdjustTraddr("fe80::1%")
+	assert.Error(t, err)
+
+	addr, zone := SplitZone("fe80::1%ens3")
+	assert.Equal(t, "fe80::1", addr)
+	assert.Equal(t, "ens3", zone)
+	addr, zone = SplitZone("10.0.0.1%ens3")
+	assert.Equal(t, "10.0.0.1%ens3", addr, "ipv4 addresses have no zone")
+	assert.Equal(t, "", zone)
+
+	assert.Equal(t, "fe80::1%ens3", ScopeTraddr("fe80::1", "ens3"))
+	assert.Equal(t, "fe80::1%eth0", ScopeTraddr("fe80::1%eth0", "ens3"), "the zone of traddr wins")
+	assert.Equal(t, "fd00::1", ScopeTraddr("fd00::1", "ens3"), "only link-local addresses are scoped")
+	assert.Equal(t, "fe80::1", ScopeTraddr("fe80::1", ""))
+
+	assert.Equal(t, "ens3", ZoneInterface("fe80::1%ens3"))
+	assert.Equal(t, "", ZoneInterface("fe80::1"))
+}
@@ -0,0 +1,118 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lightbitslabs/discovery-client/model"
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+)
+
+type ConnectStatus string
+
+const (
+	// ConnectStatusConnected - a new IO controller was created.
+	ConnectStatusConnected ConnectStatus = "connected"
+	// ConnectStatusAlreadyConnected - the IO controller already exists on the host.
+	ConnectStatusAlreadyConnected ConnectStatus = "already-connected"
+	// ConnectStatusFailed - connecting the IO controller failed, including the retries.
+	ConnectStatusFailed ConnectStatus = "failed"
+)
+
+// ConnectResult is the outcome of connecting the IO controller of a log page entry.
+type ConnectResult struct {
+	Entry   *hostapi.NvmeDiscPageEntry
+	Request *ConnectRequest
+	Status  ConnectStatus
+	// Ctrl is the created controller, set if Status is ConnectStatusConnected.
+	Ctrl *CtrlIdentifier
+	// Attempts made to connect, including the retries.
+	Attempts int
+	Duration time.Duration
+	Err      error
+}
+
+// ConnectedControllers returns the controllers created by results.
+func ConnectedControllers(results []*ConnectResult) []*CtrlIdentifier {
+	var ctrls []*CtrlIdentifier
+	for _, result := range results {
+		if result.Status == ConnectStatusConnected {
+			ctrls = append(ctrls, result.Ctrl)
+		}
+	}
+	return ctrls
+}
+
+// connectLimits bound the IO controllers connected in parallel. the per cluster limit
+// applies to a single ConnectAllNVMEDevices call, the global one to all of them.
+var connectLimits = struct {
+	sync.Mutex
+	perCluster int
+	global     chan struct{}
+}{
+	perCluster: model.DefaultConnectsPerCluster,
+	global:     make(chan struct{}, model.DefaultConnectsGlobal),
+}
+
+// SetConnectConcurrency sets the number of IO controllers connected in parallel for a
+// single log page and by all log pages together. non positive values keep the limit.
+// connects that are already running are not affected.
+func SetConnectConcurrency(perCluster, global int) {
+	connectLimits.Lock()
+	defer connectLimits.Unlock()
+	if perCluster > 0 {
+		connectLimits.perCluster = perCluster
+	}
+	if global > 0 && global != cap(connectLimits.global) {
+		connectLimits.global = make(chan struct{}, global)
+	}
+}
+
+func getConnectLimits() (int, chan struct{}) {
+	connectLimits.Lock()
+	defer connectLimits.Unlock()
+	return connectLimits.perCluster, connectLimits.global
+}
+
+// connectParallel runs connect for every request, at most perCluster of them at a time,
+// each holding a slot of global while it runs. the results are in the order of requests.
+func connectParallel(
+	entries []*hostapi.NvmeDiscPageEntry,
+	requests []*ConnectRequest,
+	perCluster int,
+	global chan struct{},
+	connect func(entry *hostapi.NvmeDiscPageEntry, request *ConnectRequest) *ConnectResult,
+) []*ConnectResult {
+	results := make([]*ConnectResult, len(requests))
+	slots := make(chan struct{}, perCluster)
+	var wg sync.WaitGroup
+	for i := range requests {
+		slots <- struct{}{}
+		global <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				<-global
+				<-slots
+			}()
+			results[i] = connect(entries[i], requests[i])
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,88 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeclient
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+)
+
+func TestConnectParallel(t *testing.T) {
+	testCases := []struct {
+		name        string
+		perCluster  int
+		global      int
+		clusters    int
+		expectedMax int32
+	}{
+		{name: "per cluster limit", perCluster: 3, global: 100, clusters: 1, expectedMax: 3},
+		{name: "global limit", perCluster: 3, global: 4, clusters: 3, expectedMax: 4},
+		{name: "sequential", perCluster: 1, global: 100, clusters: 1, expectedMax: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var running, maxRunning atomic.Int32
+			connect := func(entry *hostapi.NvmeDiscPageEntry, request *ConnectRequest) *ConnectResult {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				if entry.Traddr == "10.0.0.3" {
+					return &ConnectResult{Entry: entry, Request: request, Status: ConnectStatusFailed, Err: fmt.Errorf("connect failed")}
+				}
+				return &ConnectResult{Entry: entry, Request: request, Status: ConnectStatusConnected, Ctrl: &CtrlIdentifier{}}
+			}
+			entries := []*hostapi.NvmeDiscPageEntry{}
+			requests := []*ConnectRequest{}
+			for i := 0; i < 10; i++ {
+				traddr := fmt.Sprintf("10.0.0.%d", i)
+				entries = append(entries, &hostapi.NvmeDiscPageEntry{Traddr: traddr})
+				requests = append(requests, &ConnectRequest{Traddr: traddr})
+			}
+			global := make(chan struct{}, tc.global)
+			clusterResults := make([][]*ConnectResult, tc.clusters)
+			var wg sync.WaitGroup
+			for c := 0; c < tc.clusters; c++ {
+				wg.Add(1)
+				go func(c int) {
+					defer wg.Done()
+					clusterResults[c] = connectParallel(entries, requests, tc.perCluster, global, connect)
+				}(c)
+			}
+			wg.Wait()
+			for _, results := range clusterResults {
+				require.Len(t, results, len(entries))
+				for i, result := range results {
+					require.Equal(t, entries[i], result.Entry, "results should be in the order of the entries")
+				}
+				require.Equal(t, ConnectStatusFailed, results[3].Status)
+				require.Len(t, ConnectedControllers(results), len(entries)-1)
+			}
+			require.Equal(t, tc.expectedMax, maxRunning.Load())
+		})
+	}
+}
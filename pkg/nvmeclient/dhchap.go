@@ -0,0 +1,99 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeclient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/lightbitslabs/discovery-client/metrics"
+)
+
+// DhChapRotation is the outcome of replacing the DH-CHAP secrets of an IO controller.
+type DhChapRotation string
+
+const (
+	// DhChapRotated - the new secrets were set, the kernel re-authenticates the controller with them.
+	DhChapRotated DhChapRotation = "rotated"
+	// DhChapUnchanged - the controller already uses the secrets.
+	DhChapUnchanged DhChapRotation = "unchanged"
+	// DhChapNotAuthenticated - the controller was connected without a secret, and uses the
+	// secrets only once reconnected.
+	DhChapNotAuthenticated DhChapRotation = "not-authenticated"
+	// DhChapRotationFailed - the kernel rejected the secrets, or doesn't support their rotation.
+	DhChapRotationFailed DhChapRotation = "failed"
+)
+
+// the value of the secret attributes of a controller connected without the secret.
+const dhChapNoSecret = "none"
+
+// RotateDhChapSecrets sets the DH-CHAP secrets of the controller of devicePath (`/dev/nvme0`)
+// through its dhchap_secret and dhchap_ctrl_secret attributes, which makes the kernel
+// re-authenticate it. an empty ctrlSecret leaves the controller secret as is.
+func RotateDhChapSecrets(devicePath, secret, ctrlSecret string) (DhChapRotation, error) {
+	return rotateDhChapSecrets(path.Join(SysNvme, path.Base(devicePath)), secret, ctrlSecret)
+}
+
+func rotateDhChapSecrets(ctrlPath, secret, ctrlSecret string) (DhChapRotation, error) {
+	type attribute struct {
+		name  string
+		value string
+	}
+	var changed []attribute
+	var names []string
+	for _, attr := range []attribute{{"dhchap_secret", secret}, {"dhchap_ctrl_secret", ctrlSecret}} {
+		if attr.value == "" {
+			continue
+		}
+		current, err := os.ReadFile(path.Join(ctrlPath, attr.name))
+		if errors.Is(err, os.ErrNotExist) {
+			return DhChapRotationFailed, fmt.Errorf("%s is not supported by the kernel", attr.name)
+		}
+		if err != nil {
+			return DhChapRotationFailed, err
+		}
+		switch strings.TrimSpace(string(current)) {
+		case attr.value:
+			continue
+		case dhChapNoSecret:
+			if attr.name == "dhchap_secret" {
+				return DhChapNotAuthenticated, nil
+			}
+			return DhChapRotationFailed, fmt.Errorf("controller was connected without a controller secret, reconnect it to authenticate the controller")
+		}
+		changed = append(changed, attr)
+		names = append(names, attr.name)
+	}
+	if len(changed) == 0 {
+		return DhChapUnchanged, nil
+	}
+	if IsDryRun() {
+		logrus.Infof("dry-run: would set %s of IO controller %s", strings.Join(names, ", "), path.Base(ctrlPath))
+		metrics.Metrics.DryRunActions.WithLabelValues("rotate-dhchap").Inc()
+		return DhChapRotated, nil
+	}
+	for _, attr := range changed {
+		// every write starts a re-authentication, the last one uses both secrets.
+		if err := os.WriteFile(path.Join(ctrlPath, attr.name), []byte(attr.value), 0600); err != nil {
+			return DhChapRotationFailed, fmt.Errorf("failed to set %s: %w", attr.name, err)
+		}
+	}
+	return DhChapRotated, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeclient
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateDhChapSecrets(t *testing.T) {
+	const (
+		oldSecret = "DHHC-1:00:b2xkIHNlY3JldA==:"
+		newSecret = "DHHC-1:00:bmV3IHNlY3JldA==:"
+		ctrlKey   = "DHHC-1:00:Y3RybCBzZWNyZXQ=:"
+	)
+	ctrlPath := t.TempDir()
+	setAttr := func(name, value string) {
+		require.NoError(t, os.WriteFile(path.Join(ctrlPath, name), []byte(value+"\n"), 0600))
+	}
+	attr := func(name string) string {
+		value, err := os.ReadFile(path.Join(ctrlPath, name))
+		require.NoError(t, err)
+		return string(value)
+	}
+
+	_, err := rotateDhChapSecrets(ctrlPath, newSecret, "")
+	require.Error(t, err, "kernels without in-band authentication have no dhchap_secret attribute")
+
+	setAttr("dhchap_secret", dhChapNoSecret)
+	setAttr("dhchap_ctrl_secret", dhChapNoSecret)
+	rotation, err := rotateDhChapSecrets(ctrlPath, newSecret, "")
+	require.NoError(t, err)
+	require.Equal(t, DhChapNotAuthenticated, rotation)
+
+	setAttr("dhchap_secret", oldSecret)
+	rotation, err = rotateDhChapSecrets(ctrlPath, oldSecret, "")
+	require.NoError(t, err)
+	require.Equal(t, DhChapUnchanged, rotation)
+
+	rotation, err = rotateDhChapSecrets(ctrlPath, newSecret, ctrlKey)
+	require.Error(t, err, "the controller secret can't be set on a controller connected without one")
+	require.Equal(t, DhChapRotationFailed, rotation)
+	require.Equal(t, oldSecret+"\n", attr("dhchap_secret"))
+
+	SetDryRun(true)
+	rotation, err = rotateDhChapSecrets(ctrlPath, newSecret, "")
+	SetDryRun(false)
+	require.NoError(t, err)
+	require.Equal(t, DhChapRotated, rotation)
+	require.Equal(t, oldSecret+"\n", attr("dhchap_secret"))
+
+	rotation, err = rotateDhChapSecrets(ctrlPath, newSecret, "")
+	require.NoError(t, err)
+	require.Equal(t, DhChapRotated, rotation)
+	require.Equal(t, newSecret, attr("dhchap_secret"))
+	require.Equal(t, dhChapNoSecret+"\n", attr("dhchap_ctrl_secret"))
+}
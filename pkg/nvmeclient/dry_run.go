@@ -0,0 +1,72 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeclient
+
+import (
+	"path"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/lightbitslabs/discovery-client/metrics"
+)
+
+// dryRun replaces the IO controllers connects and disconnects with log messages,
+// leaving the kernel untouched.
+var dryRun atomic.Bool
+
+// SetDryRun enables or disables the dry-run mode.
+func SetDryRun(enabled bool) {
+	dryRun.Store(enabled)
+}
+
+// IsDryRun returns true if the dry-run mode is enabled.
+func IsDryRun() bool {
+	return dryRun.Load()
+}
+
+// dryRunConnect reports the connect that request would do. a controller that already
+// exists on the host is reported as connected, as the kernel would.
+func dryRunConnect(request *ConnectRequest) (*CtrlIdentifier, error) {
+	if ctrls, err := ListNvmeControllersInfo(); err == nil {
+		for _, ctrl := range ctrls {
+			if ctrl == nil || ctrl.Transport != request.Transport || ctrl.Traddr != request.Traddr ||
+				ctrl.Trsvcid != request.Trsvcid || ctrl.Subsysnqn != request.Subsysnqn {
+				continue
+			}
+			if ctrl.Hostnqn != "" && ctrl.Hostnqn != request.Hostnqn {
+				continue
+			}
+			if (request.HostIface != "" && ctrl.HostIface != request.HostIface) ||
+				(request.Hostaddr != "" && ctrl.HostTraddr != request.Hostaddr) {
+				continue
+			}
+			return nil, &NvmeClientError{
+				Status: CONN_ALREADY_CONNECTED,
+				Msg:    "controller already connected",
+			}
+		}
+	}
+	logrus.Infof("dry-run: would connect IO controller: '%s'", request)
+	metrics.Metrics.DryRunActions.WithLabelValues("connect").Inc()
+	return &CtrlIdentifier{Instance: -1}, nil
+}
+
+// dryRunRemove reports the removal of the controller of the delete_controller sysPath.
+func dryRunRemove(sysPath string) error {
+	logrus.Infof("dry-run: would disconnect IO controller %s", path.Base(path.Dir(sysPath)))
+	metrics.Metrics.DryRunActions.WithLabelValues("disconnect").Inc()
+	return nil
+}
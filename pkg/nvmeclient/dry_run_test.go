@@ -0,0 +1,94 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nvmeclient
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lightbitslabs/discovery-client/model"
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+)
+
+func TestDryRun(t *testing.T) {
+	SetDryRun(true)
+	defer SetDryRun(false)
+
+	entries := []*hostapi.NvmeDiscPageEntry{
+		{Traddr: "192.0.2.1", TrsvcID: 4420, Subnqn: "subsysnqn1", SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.0.2.2", TrsvcID: 8009, Subnqn: "subsysnqn1", SubType: nvme.NVME_NQN_DISC},
+	}
+	results := ConnectAllNVMEDevices(entries, &ConnectParams{
+		Hostnqn:     "hostnqn1",
+		Hostid:      "46f5a7b4-3b3a-4f4c-9a3e-0f3b0c7f4d2a",
+		Transport:   "tcp",
+		CtrlLossTMO: -1,
+	})
+	require.Len(t, results, 1, "only IO controllers should be connected")
+	require.Equal(t, ConnectStatusConnected, results[0].Status)
+	require.Equal(t, -1, results[0].Ctrl.Instance)
+
+	// the controller does not exist, writing its delete_controller would fail.
+	require.NoError(t, RemoveCtrl(1000))
+}
+
+func TestDryRunHostPaths(t *testing.T) {
+	SetDryRun(true)
+	defer SetDryRun(false)
+
+	entries := []*hostapi.NvmeDiscPageEntry{
+		{Traddr: "192.0.2.1", TrsvcID: 4420, Subnqn: "subsysnqn1", SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.0.2.2", TrsvcID: 4420, Subnqn: "subsysnqn1", SubType: nvme.NVME_NQN_NVME},
+	}
+	results := ConnectAllNVMEDevices(entries, &ConnectParams{
+		Hostnqn:     "hostnqn1",
+		Transport:   "tcp",
+		CtrlLossTMO: -1,
+		HostPaths:   model.HostPaths{{Iface: "eth1"}, {Traddr: "10.0.0.5"}},
+	})
+	require.Len(t, results, 4, "every IO controller should be connected through every host path")
+	options := map[string]int{}
+	for _, result := range results {
+		require.Equal(t, ConnectStatusConnected, result.Status)
+		options[result.Request.ToOptions()]++
+	}
+	require.Len(t, options, 4)
+	require.Contains(t, results[0].Request.ToOptions(), ",host_iface=eth1")
+	require.Contains(t, results[1].Request.ToOptions(), ",host_traddr=10.0.0.5")
+}
+
+func TestDryRunLinkLocal(t *testing.T) {
+	SetDryRun(true)
+	defer SetDryRun(false)
+
+	entries := []*hostapi.NvmeDiscPageEntry{
+		{Traddr: "fe80::1", TrsvcID: 4420, Subnqn: "subsysnqn1", SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "fd00::1", TrsvcID: 4420, Subnqn: "subsysnqn1", SubType: nvme.NVME_NQN_NVME},
+	}
+	results := ConnectAllNVMEDevices(entries, &ConnectParams{
+		Hostnqn:     "hostnqn1",
+		Transport:   "tcp",
+		CtrlLossTMO: -1,
+		Zone:        "ens3",
+	})
+	require.Len(t, results, 2)
+	require.Equal(t, ConnectStatusConnected, results[0].Status)
+	require.Contains(t, results[0].Request.ToOptions(), ",traddr=fe80::1%ens3,")
+	require.Contains(t, results[0].Request.ToOptions(), ",host_iface=ens3")
+	require.Contains(t, results[1].Request.ToOptions(), ",traddr=fd00::1,")
+	require.NotContains(t, results[1].Request.ToOptions(), "host_iface")
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/lightbitslabs/discovery-client/metrics"
 	"github.com/lightbitslabs/discovery-client/model"
 	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/hostroute"
 	"github.com/lightbitslabs/discovery-client/pkg/ioctl"
 	"github.com/lightbitslabs/discovery-client/pkg/nvme"
 	"github.com/lightbitslabs/discovery-client/pkg/regexutil"
@@ -92,7 +93,9 @@ type NvmeControllerInfo struct {
 	Trsvcid    int
 	Transport  string
 	Subsysnqn  string
+	Hostnqn    string
 	HostTraddr string
+	HostIface  string
 	// Device path of the controller - /dev/nvme<Instance>
 	Device string
 }
@@ -117,6 +120,7 @@ type ConnectRequest struct {
 	Kato                   int
 	DhChapSecret           string
 	DhChapControllerSecret string
+	model.FabricsOptions
 }
 
 // ToOptions returns a comma delimited key=value string
@@ -152,6 +156,8 @@ func (c *ConnectRequest) ToOptions() string {
 		sb.WriteString(fmt.Sprintf(",keep_alive_tmo=%d", c.Kato))
 	}
 
+	sb.WriteString(c.FabricsOptions.Options())
+
 	if c.DhChapSecret != "" {
 		sb.WriteString(fmt.Sprintf(",dhchap_secret=%s", c.DhChapSecret))
 	}
@@ -194,6 +200,8 @@ func (c *ConnectRequest) String() string {
 		sb.WriteString(fmt.Sprintf(",keep_alive_tmo=%d", c.Kato))
 	}
 
+	sb.WriteString(c.FabricsOptions.Options())
+
 	if c.DhChapSecret != "" {
 		sb.WriteString(fmt.Sprintf(",dhchap_secret=%s", "redacted"))
 	}
@@ -244,6 +252,11 @@ func getNvmeControllerInfo(ctrlName string) (*NvmeControllerInfo, error) {
 	}
 	info.Transport = strings.TrimSpace(string(transport))
 
+	// hostnqn attribute is not exposed by old kernels.
+	if hostnqn, err := os.ReadFile(path.Join(ctrlPath, "hostnqn")); err == nil {
+		info.Hostnqn = strings.TrimSpace(string(hostnqn))
+	}
+
 	address, err := os.ReadFile(path.Join(ctrlPath, "address"))
 	if err != nil {
 		return nil, err
@@ -262,6 +275,8 @@ func getNvmeControllerInfo(ctrlName string) (*NvmeControllerInfo, error) {
 			info.Trsvcid = int(port)
 		case "host_traddr":
 			info.HostTraddr = value
+		case "host_iface":
+			info.HostIface = value
 		}
 	}
 	info.Device = fmt.Sprintf("/dev/%s", ctrlName)
@@ -269,6 +284,14 @@ func getNvmeControllerInfo(ctrlName string) (*NvmeControllerInfo, error) {
 	return info, nil
 }
 
+// OnHostPath returns true if the controller was connected through hostPath.
+func (info *NvmeControllerInfo) OnHostPath(hostPath model.HostPath) bool {
+	if hostPath.Iface != "" {
+		return info.HostIface == hostPath.Iface
+	}
+	return info.HostTraddr == hostPath.Traddr
+}
+
 func ListNvmeControllersInfo() (map[string]*NvmeControllerInfo, error) {
 	ctrlNames, err := listNvmeControllers()
 	if err != nil {
@@ -301,6 +324,9 @@ func CheckCtrlRemovePathExists(devicePath string) (bool, error) {
 }
 
 func removeCtrlByPath(sysPath string) error {
+	if IsDryRun() {
+		return dryRunRemove(sysPath)
+	}
 	f, err := os.OpenFile(sysPath, os.O_WRONLY, 0755)
 	if err != nil {
 		logrus.WithError(err).Errorf("failed to open file")
@@ -332,6 +358,32 @@ func RemoveCtrlByDevice(devicePath string) error {
 	return removeCtrlByPath(deleteControllerPath)
 }
 
+// DisconnectSubsystemControllers removes all the IO controllers connected to
+// subsysnqn (with or without the auxiliary suffix) on behalf of hostnqn. controllers
+// without a hostnqn, which old kernels don't expose, are considered connected by hostnqn.
+// returns the device paths of the removed controllers.
+func DisconnectSubsystemControllers(subsysnqn, hostnqn string) ([]string, error) {
+	controllers, err := ListNvmeControllersInfo()
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, info := range controllers {
+		if info == nil || (info.Hostnqn != "" && info.Hostnqn != hostnqn) {
+			continue
+		}
+		if info.Subsysnqn != subsysnqn && info.Subsysnqn != fmt.Sprintf("%s.%s", subsysnqn, AuxSuffix) {
+			continue
+		}
+		if err := RemoveCtrlByDevice(info.Device); err != nil {
+			logrus.WithError(err).Errorf("failed to disconnect %s", info.Device)
+			continue
+		}
+		removed = append(removed, info.Device)
+	}
+	return removed, nil
+}
+
 func addCtrl(options string) (*CtrlIdentifier, error) {
 	f, err := os.OpenFile(PathNvmeFabrics, os.O_RDWR, 0755)
 	if err != nil {
@@ -412,7 +464,8 @@ type nvmefDiscRspPageEntry struct {
 	PortID  uint16                     `struc:"uint16,little"`
 	CntlID  uint16                     `struc:"uint16,little"`
 	Asqsz   uint16                     `struc:"uint16,little"`
-	Resv8   [22]uint8                  `struc:"[22]uint8"`
+	Eflags  uint16                     `struc:"uint16,little"`
+	Resv12  [20]uint8                  `struc:"[20]uint8"`
 	TrsvcID [C.NVMF_TRSVCID_SIZE]uint8 `struc:"[32]uint8"`
 	Resv64  [192]uint8                 `struc:"[192]uint8"`
 	Subnqn  string                     `struc:"[256]uint8"`
@@ -456,6 +509,10 @@ func readDiscoveryResponseHeader(f *os.File) (*nvmefDiscRspPageHdr, error) {
 	return discoveryResponseHdr, nil
 }
 
+// maxDiscoveryRetries is the number of times the discovery log page is read again when its
+// generation counter changed while it was read, as nvme-cli does.
+const maxDiscoveryRetries = 10
+
 func nvmfDiscoveryGetLogPage(ctrlInfo *CtrlIdentifier) ([]*nvmefDiscRspPageEntry, error) {
 	f, err := os.OpenFile(ctrlInfo.Device, os.O_RDWR, 0755)
 	if err != nil {
@@ -469,32 +526,63 @@ func nvmfDiscoveryGetLogPage(ctrlInfo *CtrlIdentifier) ([]*nvmefDiscRspPageEntry
 		}
 	}()
 
+	for retries := 0; ; retries++ {
+		res, discoveryResponseHdr, currentDiscoveryResponseHdr, err := readDiscoveryLogPage(f)
+		if err != nil {
+			return nil, err
+		}
+		if discoveryResponseHdr.GenCtr != currentDiscoveryResponseHdr.GenCtr {
+			if retries < maxDiscoveryRetries {
+				logrus.Debugf("discovery log page generation changed from %d to %d while it was read, reading it again",
+					discoveryResponseHdr.GenCtr, currentDiscoveryResponseHdr.GenCtr)
+				continue
+			}
+			return nil, &NvmeClientError{
+				Status: DISC_RETRY_EXHAUSTED,
+				Msg:    "exhausted all retries",
+				Err:    fmt.Errorf("generation counter changed in each of %d reads of the log page", retries+1)}
+		}
+
+		if discoveryResponseHdr.NumRec != currentDiscoveryResponseHdr.NumRec {
+			return nil, &NvmeClientError{
+				Status: DISC_NOT_EQUAL,
+				Msg:    fmt.Sprintf("got different record count: %d != %d", discoveryResponseHdr.NumRec, currentDiscoveryResponseHdr.NumRec),
+				Err:    fmt.Errorf("exhausted all retries")}
+		}
+
+		return res, nil
+	}
+}
+
+// readDiscoveryLogPage reads the discovery log page of f once, and returns its entries, its
+// header and its header once the entries were read.
+func readDiscoveryLogPage(f *os.File) ([]*nvmefDiscRspPageEntry, *nvmefDiscRspPageHdr, *nvmefDiscRspPageHdr, error) {
 	discoveryResponseHdr, err := readDiscoveryResponseHeader(f)
 	if err != nil {
-		return nil, &NvmeClientError{Status: DISC_GET_LOG, Msg: "get discovery log failed", Err: err}
+		return nil, nil, nil, &NvmeClientError{Status: DISC_GET_LOG, Msg: "get discovery log failed", Err: err}
 	}
 
 	if discoveryResponseHdr.NumRec == 0 {
-		return nil, &NvmeClientError{Status: DISC_NO_LOG, Msg: "no log entries", Err: nil}
+		return nil, nil, nil, &NvmeClientError{Status: DISC_NO_LOG, Msg: "no log entries", Err: nil}
 	}
 
 	logSize := discoveryHeaderSize + nvmefDiscRspPageEntrySize*discoveryResponseHdr.NumRec
 	log := make([]byte, logSize)
 	if err := nvmeDiscoveryLog(f, log); err != nil {
-		return nil, &NvmeClientError{Status: DISC_GET_LOG, Msg: "get discovery log failed", Err: err}
+		return nil, nil, nil, &NvmeClientError{Status: DISC_GET_LOG, Msg: "get discovery log failed", Err: err}
 	}
 	var res []*nvmefDiscRspPageEntry
 	reader := bytes.NewReader(log)
 
 	if err := struc.Unpack(reader, &discoveryResponseHdr); err != nil {
-		return nil, &NvmeClientError{Status: DISC_GET_LOG, Msg: "unpack discovery response header failed", Err: err}
+		return nil, nil, nil, &NvmeClientError{Status: DISC_GET_LOG, Msg: "unpack discovery response header failed", Err: err}
 	}
 
 	for i := uint64(0); i < discoveryResponseHdr.NumRec; i++ {
 		entry := &nvmefDiscRspPageEntry{}
 		if err := struc.Unpack(reader, entry); err != nil {
 			logrus.WithError(err).Errorf("unpack discovery response page entry failed")
-			return nil, err
+			return nil, nil, nil, err
 		}
 		res = append(res, entry)
 	}
@@ -505,27 +593,11 @@ func nvmfDiscoveryGetLogPage(ctrlInfo *CtrlIdentifier) ([]*nvmefDiscRspPageEntry
 	 * to fetch the header again to have the most up-to-date
 	 * value for the generation counter
 	 */
-	generationCounter := discoveryResponseHdr.GenCtr
-	numRecords := discoveryResponseHdr.NumRec
 	currentDiscoveryResponseHdr, err := readDiscoveryResponseHeader(f)
 	if err != nil {
-		return nil, &NvmeClientError{Status: DISC_GET_LOG, Msg: "get discovery log failed", Err: err}
-	}
-
-	// notice that now we implement no retries so if this is not equal we fail on the first try.
-	// maybe later we will implement this part
-	if generationCounter != currentDiscoveryResponseHdr.GenCtr {
-		return nil, &NvmeClientError{Status: DISC_RETRY_EXHAUSTED, Msg: "exhausted all retries", Err: fmt.Errorf("exhausted all retries")}
-	}
-
-	if numRecords != currentDiscoveryResponseHdr.NumRec {
-		return nil, &NvmeClientError{
-			Status: DISC_NOT_EQUAL,
-			Msg:    fmt.Sprintf("got different record count: %d != %d", numRecords, currentDiscoveryResponseHdr.NumRec),
-			Err:    fmt.Errorf("exhausted all retries")}
+		return nil, nil, nil, &NvmeClientError{Status: DISC_GET_LOG, Msg: "get discovery log failed", Err: err}
 	}
-
-	return res, nil
+	return res, discoveryResponseHdr, currentDiscoveryResponseHdr, nil
 }
 
 func Connect(request *ConnectRequest) (*CtrlIdentifier, error) {
@@ -538,6 +610,11 @@ func Connect(request *ConnectRequest) (*CtrlIdentifier, error) {
 		}
 	}
 	request.Traddr = traddr
+	// the kernel takes the zone of a link-local traddr as its scope, bind the connection to
+	// the interface of the zone as well.
+	if request.HostIface == "" {
+		request.HostIface = nvme.ZoneInterface(traddr)
+	}
 	if request.Hostid == "" {
 		request.Hostid, err = nvme.GetOrCreateHostID(logrus.New(), model.DefaultHostIDPath)
 		if err != nil {
@@ -553,6 +630,10 @@ func Connect(request *ConnectRequest) (*CtrlIdentifier, error) {
 		request.Subsysnqn = fmt.Sprintf("%s.%s", request.Subsysnqn, AuxSuffix)
 	}
 
+	if IsDryRun() {
+		return dryRunConnect(request)
+	}
+
 	logrus.Debugf("calling nvme connect with options: '%s'", request);
 	ctrlID, err := addCtrl(request.ToOptions())
 	if err != nil {
@@ -577,24 +658,36 @@ func Connect(request *ConnectRequest) (*CtrlIdentifier, error) {
 
 func ConnectAll(discoveryRequest *hostapi.DiscoverRequest,
 	maxIOQueues int, kato int,
-	ctrlLossTMO *int) ([]*CtrlIdentifier, error) {
+	ctrlLossTMO *int, fabricsOptions model.FabricsOptions) ([]*CtrlIdentifier, error) {
 	logPageEntries, err := Discover(discoveryRequest)
 	if err != nil {
 		return nil, err
 	}
-	ctrls := ConnectAllNVMEDevices(logPageEntries, discoveryRequest.Hostnqn,
-		discoveryRequest.Hostid,
-		discoveryRequest.Transport, maxIOQueues, kato, ctrlLossTMO, nil)
-	return ctrls, nil
+	params := &ConnectParams{
+		Hostnqn:        discoveryRequest.Hostnqn,
+		Hostid:         discoveryRequest.Hostid,
+		Transport:      discoveryRequest.Transport,
+		CtrlLossTMO:    -1,
+		MaxIOQueues:    maxIOQueues,
+		Kato:           kato,
+		FabricsOptions: fabricsOptions,
+	}
+	if ctrlLossTMO != nil {
+		params.CtrlLossTMO = *ctrlLossTMO
+	}
+	results := ConnectAllNVMEDevices(logPageEntries, params)
+	return ConnectedControllers(results), nil
 }
 
-func connectNVMEDevicesWithRetry(request *ConnectRequest) (*CtrlIdentifier, error) {
+func connectNVMEDevicesWithRetry(request *ConnectRequest) (*CtrlIdentifier, int, error) {
 	var err error
 	var ctrlID *CtrlIdentifier
+	attempts := 0
 
 	logrus.Debug("try to reconnect nvme-devices")
 
 	retry.Do(func() error {
+		attempts++
 		ctrlID, err = Connect(request)
 		if err == nil {
 			return nil
@@ -603,83 +696,169 @@ func connectNVMEDevicesWithRetry(request *ConnectRequest) (*CtrlIdentifier, erro
 		return err
 	}, retry.DelayType(retry.BackOffDelay), retry.Attempts(5), retry.Delay(time.Millisecond*10))
 
-	return ctrlID, err
+	return ctrlID, attempts, err
 }
 
-func ConnectAllNVMEDevices(logPageEntries []*hostapi.NvmeDiscPageEntry,
-	hostnqn string,
-	hostid string,
-	transport string,
-	maxIOQueues int, kato int,
-	ctrlLossTMO *int,
-	cfg *model.AppConfig,
-) []*CtrlIdentifier {
-	var ctrls []*CtrlIdentifier
+// ConnectParams are the parameters of the IO controllers connected from a log page.
+type ConnectParams struct {
+	Hostnqn   string
+	Hostid    string
+	Transport string
+	// CtrlLossTMO in seconds, -1 for no limit.
+	CtrlLossTMO            int
+	MaxIOQueues            int
+	Kato                   int
+	DhChapSecret           string
+	DhChapControllerSecret string
+	model.FabricsOptions
+	// HostPaths every IO controller is connected through, one controller per path.
+	// with no paths the kernel picks the route.
+	HostPaths model.HostPaths
+	// HostTraddrSelector picks the host_traddr of the IO controllers with no host path, if set.
+	HostTraddrSelector *hostroute.Selector
+	// Zone of the IPv6 link-local IO controller addresses that have none, the zone of the
+	// discovery controller that reported them.
+	Zone string
+}
+
+// requests returns the requests that connect the IO controller of logPageEntry, one per host path.
+func (p *ConnectParams) requests(logPageEntry *hostapi.NvmeDiscPageEntry) []*ConnectRequest {
+	if len(p.HostPaths) == 0 {
+		return []*ConnectRequest{p.request(logPageEntry)}
+	}
+	var requests []*ConnectRequest
+	for _, hostPath := range p.HostPaths {
+		request := p.request(logPageEntry)
+		if hostPath.Iface != "" {
+			request.HostIface = hostPath.Iface
+		} else {
+			request.Hostaddr = hostPath.Traddr
+		}
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// request returns the request that connects the IO controller of logPageEntry.
+func (p *ConnectParams) request(logPageEntry *hostapi.NvmeDiscPageEntry) *ConnectRequest {
+	return &ConnectRequest{
+		Traddr:                 nvme.ScopeTraddr(logPageEntry.Traddr, p.Zone),
+		Trsvcid:                int(logPageEntry.TrsvcID),
+		Subsysnqn:              logPageEntry.Subnqn,
+		Hostnqn:                p.Hostnqn,
+		Hostid:                 p.Hostid,
+		Transport:              p.Transport,
+		CtrlLossTMO:            p.CtrlLossTMO,
+		MaxIOQueues:            p.MaxIOQueues,
+		Kato:                   p.Kato,
+		DhChapSecret:           p.DhChapSecret,
+		DhChapControllerSecret: p.DhChapControllerSecret,
+		FabricsOptions:         p.FabricsOptions,
+	}
+}
+
+// ConnectAllNVMEDevices connects the IO controllers of logPageEntries in parallel, bounded by
+// the limits set with SetConnectConcurrency, and returns a result for every IO controller entry.
+func ConnectAllNVMEDevices(logPageEntries []*hostapi.NvmeDiscPageEntry, params *ConnectParams) []*ConnectResult {
+	var entries []*hostapi.NvmeDiscPageEntry
+	var requests []*ConnectRequest
 	for _, logPageEntry := range logPageEntries {
 		// skip the non IO subsystems.
 		if logPageEntry.SubType != nvme.NVME_NQN_NVME {
 			continue
 		}
-
-		ctrlLossTMOValue := -1
-		if ctrlLossTMO != nil {
-			ctrlLossTMOValue = *ctrlLossTMO
-		} else if cfg != nil {
-			ctrlLossTMOValue = cfg.CtrlLossTMO
+		for _, request := range params.requests(logPageEntry) {
+			entries = append(entries, logPageEntry)
+			requests = append(requests, request)
 		}
+	}
+	if len(requests) == 0 {
+		return nil
+	}
 
-		request := &ConnectRequest{
-			Traddr:      logPageEntry.Traddr,
-			Trsvcid:     int(logPageEntry.TrsvcID),
-			Subsysnqn:   logPageEntry.Subnqn,
-			Hostnqn:     hostnqn,
-			Hostid:      hostid,
-			Transport:   transport,
-			CtrlLossTMO: ctrlLossTMOValue,
-			MaxIOQueues: maxIOQueues,
-			Kato:        kato,
+	start := time.Now()
+	perCluster, global := getConnectLimits()
+	connect := connectEntry
+	if params.HostTraddrSelector != nil {
+		connect = func(entry *hostapi.NvmeDiscPageEntry, request *ConnectRequest) *ConnectResult {
+			return selectHostTraddrAndConnect(params.HostTraddrSelector, entry, request)
 		}
+	}
+	results := connectParallel(entries, requests, perCluster, global, connect)
+	counts := map[ConnectStatus]int{}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	log := logrus.Debugf
+	if counts[ConnectStatusConnected] > 0 || counts[ConnectStatusFailed] > 0 {
+		log = logrus.Infof
+	}
+	log("connecting %d IO controllers took %s: %d connected, %d already connected, %d failed",
+		len(results), time.Since(start), counts[ConnectStatusConnected], counts[ConnectStatusAlreadyConnected], counts[ConnectStatusFailed])
+	return results
+}
 
-		if cfg != nil {
-			request.DhChapSecret = cfg.DhChapSecret
-			request.DhChapControllerSecret = cfg.DhChapCtrlSecret
+// selectHostTraddrAndConnect connects the IO controller of entry from the host_traddr picked
+// by selector, unless request already sets the host address or interface.
+func selectHostTraddrAndConnect(selector *hostroute.Selector, entry *hostapi.NvmeDiscPageEntry, request *ConnectRequest) *ConnectResult {
+	if request.Hostaddr == "" && request.HostIface == "" {
+		hostTraddr, err := selector.HostTraddr(request.Traddr)
+		if err != nil {
+			logrus.WithError(err).Warnf("not connecting IO controller %s:%d of subsystem %s", request.Traddr, request.Trsvcid, request.Subsysnqn)
+			return &ConnectResult{Entry: entry, Request: request, Status: ConnectStatusFailed, Err: err}
 		}
+		request.Hostaddr = hostTraddr
+	}
+	return connectEntry(entry, request)
+}
 
-		ctrlID, err := Connect(request)
+// connectEntry connects the IO controller of entry, retrying a failed connect.
+func connectEntry(entry *hostapi.NvmeDiscPageEntry, request *ConnectRequest) *ConnectResult {
+	result := &ConnectResult{Entry: entry, Request: request, Attempts: 1}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+	ctrlID, err := Connect(request)
+	if err != nil {
+		// we might get 2 problems here, either we already connected, and we don't care about this error
+		// or the connection has failed because io ctrl on the published target not accessible for some reason.
+		// either way we don't have anything to do with this information and we continue.
+		var perr *NvmeClientError
+		if !errors.As(err, &perr) {
+			logrus.WithError(err).Errorf("failed to connect to: %s", request.Traddr)
+			result.Status = ConnectStatusFailed
+			result.Err = err
+			return result
+		}
+		if perr.Status == CONN_ALREADY_CONNECTED {
+			logrus.Debugf("connection to %s is already established", request.Traddr)
+			result.Status = ConnectStatusAlreadyConnected
+			return result
+		}
+		var attempts int
+		ctrlID, attempts, err = connectNVMEDevicesWithRetry(request)
+		result.Attempts += attempts
 		if err != nil {
-			// we might get 2 problems here, either we already connected, and we don't care about this error
-			// or the connection has failed because io ctrl on the published target not accessible for some reason.
-			// either way we don't have anything to do with this information and we continue.
-			var perr *NvmeClientError
-			if errors.As(err, &perr) {
-				if perr.Status == CONN_ALREADY_CONNECTED {
-					logrus.Debugf("connection to %s is already established", request.Traddr)
-					continue
-				} else {
-					ctrlID, err = connectNVMEDevicesWithRetry(request)
-					if errors.As(err, &perr) {
-						// This warn will occur every 5 sec in case the node is down.
-						// discovery service will still report this controller to connect to but we will fail to connect.
-						// we can't deduce that if the DS is down on that node we will fail to connect cause there might be a network partition
-						// on the discovery-service or the DS is down on that node but the IO controller is still accessible.
-						if strings.Contains(perr.Error(), "open /dev/nvme-fabrics: no such file or directory") {
-							logrus.WithError(perr).Warn("failed to connect IO controller. You may need to load nvme-tcp kernel module")
-						} else {
-							logrus.WithError(perr).Warn("failed to connect IO controller. This may be a transient error or due to a node being down." +
-								"Continuing to attempt connection until the discovery-service stops providing the down node's address..")
-						}
-						continue
-					}
-				}
+			// This warn will occur every 5 sec in case the node is down.
+			// discovery service will still report this controller to connect to but we will fail to connect.
+			// we can't deduce that if the DS is down on that node we will fail to connect cause there might be a network partition
+			// on the discovery-service or the DS is down on that node but the IO controller is still accessible.
+			if strings.Contains(err.Error(), "open /dev/nvme-fabrics: no such file or directory") {
+				logrus.WithError(err).Warn("failed to connect IO controller. You may need to load nvme-tcp kernel module")
 			} else {
-				logrus.WithError(err).Errorf("failed to connect to: %s", request.Traddr)
-				continue
+				logrus.WithError(err).Warn("failed to connect IO controller. This may be a transient error or due to a node being down." +
+					"Continuing to attempt connection until the discovery-service stops providing the down node's address..")
 			}
+			result.Status = ConnectStatusFailed
+			result.Err = err
+			return result
 		}
-		logrus.Debugf("Successfully connected to: %s", request.Traddr)
-		ctrls = append(ctrls, ctrlID)
 	}
-	return ctrls
+	logrus.Debugf("Successfully connected to: %s", request.Traddr)
+	result.Status = ConnectStatusConnected
+	result.Ctrl = ctrlID
+	return result
 }
 
 func Discover(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, error) {
@@ -742,12 +921,14 @@ func Discover(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPag
 			continue
 		}
 		respEntry := &hostapi.NvmeDiscPageEntry{
-			SubType: entry.SubType,
-			PortID:  entry.PortID,
-			CntlID:  entry.CntlID,
-			TrsvcID: uint16(port),
-			Subnqn:  strings.TrimRight(entry.Subnqn, "\x00"),
-			Traddr:  strings.TrimRight(entry.Traddr, "\x00"),
+			SubType:   entry.SubType,
+			PortID:    entry.PortID,
+			CntlID:    entry.CntlID,
+			Eflags:    entry.Eflags,
+			TrsvcID:   uint16(port),
+			Subnqn:    strings.TrimRight(entry.Subnqn, "\x00"),
+			Traddr:    strings.TrimRight(entry.Traddr, "\x00"),
+			Transport: nvme.TransportName(entry.TrType),
 		}
 		res = append(res, respEntry)
 	}
@@ -0,0 +1,61 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/lightbitslabs/discovery-client/model"
+)
+
+// backoff tracks the consecutive failed connects to a cluster.
+type backoff struct {
+	failures int
+	// random returns a number in [0, 1). replaced by tests.
+	random func() float64
+}
+
+func newBackoff() *backoff {
+	return &backoff{random: rand.Float64}
+}
+
+// failed records a failed connect and returns the delay before the next one.
+// ok is false once cfg.MaxAttempts consecutive connects failed.
+func (b *backoff) failed(cfg model.BackoffConfig) (delay time.Duration, ok bool) {
+	b.failures++
+	if cfg.MaxAttempts > 0 && b.failures >= cfg.MaxAttempts {
+		return 0, false
+	}
+	return b.delay(cfg), true
+}
+
+// delay before the next connect given the number of failures so far.
+func (b *backoff) delay(cfg model.BackoffConfig) time.Duration {
+	multiplier := math.Max(cfg.Multiplier, 1)
+	delay := float64(cfg.InitialDelay) * math.Pow(multiplier, float64(b.failures-1))
+	delay = math.Min(delay, float64(cfg.MaxDelay))
+	if cfg.Jitter {
+		// never retry right away, at least half of the initial delay passes.
+		floor := math.Min(float64(cfg.InitialDelay)/2, delay)
+		delay = floor + b.random()*(delay-floor)
+	}
+	return time.Duration(delay)
+}
+
+func (b *backoff) reset() {
+	b.failures = 0
+}
@@ -0,0 +1,352 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/lightbitslabs/discovery-client/metrics"
+	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
+)
+
+type clusterState string
+
+const (
+	// clusterStateIdle - no connection to the cluster and no connect attempt scheduled.
+	clusterStateIdle clusterState = "idle"
+	// clusterStateConnecting - looking for a discovery controller of the cluster that responds.
+	clusterStateConnecting clusterState = "connecting"
+	// clusterStateConnected - a persistent discovery connection to the cluster is established.
+	clusterStateConnected clusterState = "connected"
+	// clusterStateBackingOff - the last connect attempt failed, waiting before the next one.
+	clusterStateBackingOff clusterState = "backing-off"
+	// clusterStateAlert - the connect attempts to the cluster ran out, it is no longer retried until
+	// its configuration changes or the service configuration is reloaded.
+	clusterStateAlert clusterState = "alert"
+)
+
+var clusterStates = []clusterState{clusterStateIdle, clusterStateConnecting, clusterStateConnected, clusterStateBackingOff, clusterStateAlert}
+
+// workerEvents are the events pending for a worker. events of the same kind are
+// coalesced, so notifying a worker never blocks.
+type workerEvents struct {
+	// connect to the cluster unless already connected.
+	connect bool
+	// persistent discovery connections that failed.
+	lost map[*clientconfig.Connection]bool
+	// connections an AEN was received on, fetch the log page through them.
+	aens map[*clientconfig.Connection]bool
+	// verify that the IO controllers of the last log page are connected.
+	reconcile bool
+	// connect again if the worker is in alert state, with a new retry budget.
+	resume bool
+	// the configuration of the cluster changed, apply the next log page even if its generation
+	// was already processed.
+	reapply bool
+	// the DH-CHAP key file of the cluster or of its host changed, rotate the secrets of the IO controllers.
+	rotateDhChap bool
+}
+
+func (events *workerEvents) addLost(conn *clientconfig.Connection) {
+	if events.lost == nil {
+		events.lost = map[*clientconfig.Connection]bool{}
+	}
+	events.lost[conn] = true
+}
+
+func (events *workerEvents) addAEN(conn *clientconfig.Connection) {
+	if events.aens == nil {
+		events.aens = map[*clientconfig.Connection]bool{}
+	}
+	events.aens[conn] = true
+}
+
+// clusterWorker drives the connection to a single client-cluster pair.
+// all fields but the pending events are accessed only by the worker goroutine.
+type clusterWorker struct {
+	s      *service
+	pair   clientconfig.ClientClusterPair
+	ctx    context.Context
+	cancel context.CancelFunc
+	log    *logrus.Entry
+
+	state clusterState
+	// activeConns are the persistent discovery connections to the cluster.
+	// the first one is the active connection of the cluster.
+	activeConns []*clientconfig.Connection
+	lastLogPage *discoveryLogPage
+	// generation of the last log page processed, valid if hasGeneration.
+	generation    uint64
+	hasGeneration bool
+	backoff       *backoff
+	retryTimer    *time.Timer
+	// subsystemPaths are the path counts of the subsystems of the last log page, as last reported.
+	subsystemPaths map[string]pathCount
+
+	mu      sync.Mutex
+	pending workerEvents
+	kick    chan struct{}
+}
+
+func newClusterWorker(s *service, pair clientconfig.ClientClusterPair) *clusterWorker {
+	w := &clusterWorker{
+		s:    s,
+		pair: pair,
+		log: s.log.WithField("subsys-nqn", pair.ClusterNqn).
+			WithField("hostnqn", pair.HostNqn),
+		kick:    make(chan struct{}, 1),
+		backoff: newBackoff(),
+	}
+	w.ctx, w.cancel = context.WithCancel(s.ctx)
+	w.setState(clusterStateIdle)
+	return w
+}
+
+// notify adds events to the pending events of the worker and wakes it up.
+func (w *clusterWorker) notify(update func(events *workerEvents)) {
+	w.mu.Lock()
+	update(&w.pending)
+	w.mu.Unlock()
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (w *clusterWorker) takeEvents() workerEvents {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	events := w.pending
+	w.pending = workerEvents{}
+	return events
+}
+
+// stop the worker. it does not wait for the worker to return.
+func (w *clusterWorker) stop() {
+	w.cancel()
+}
+
+func (w *clusterWorker) run() {
+	defer w.s.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			w.log.Errorf("cluster worker crashed: %v\n%s", r, debug.Stack())
+			w.stopRetryTimer()
+			select {
+			case w.s.crashedCh <- w:
+			case <-w.s.ctx.Done():
+			}
+		}
+	}()
+	defer func() {
+		for _, state := range clusterStates {
+			metrics.Metrics.ClusterState.DeleteLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, string(state))
+		}
+		metrics.Metrics.ClusterConnectFailures.DeleteLabelValues(w.pair.ClusterNqn, w.pair.HostNqn)
+		metrics.Metrics.ClusterBackoffSeconds.DeleteLabelValues(w.pair.ClusterNqn, w.pair.HostNqn)
+		metrics.Metrics.ClusterDiscoveryConnections.DeleteLabelValues(w.pair.ClusterNqn, w.pair.HostNqn)
+		metrics.Metrics.AENDuplicates.DeleteLabelValues(w.pair.ClusterNqn, w.pair.HostNqn)
+		metrics.Metrics.IOControllersFiltered.DeleteLabelValues(w.pair.ClusterNqn, w.pair.HostNqn)
+		metrics.Metrics.StaleLogPages.DeletePartialMatch(prometheus.Labels{"nqn": w.pair.ClusterNqn, "hostnqn": w.pair.HostNqn})
+		w.deleteSubsystemPaths()
+	}()
+	for {
+		select {
+		case <-w.ctx.Done():
+			w.stopRetryTimer()
+			w.log.Debugf("cluster worker stopped")
+			return
+		case <-w.kick:
+			w.handleEvents(w.takeEvents())
+		case <-w.retryCh():
+			w.retryTimer = nil
+			w.connect()
+		}
+	}
+}
+
+func (w *clusterWorker) handleEvents(events workerEvents) {
+	if events.reapply {
+		w.hasGeneration = false
+	}
+	if events.rotateDhChap {
+		w.rotateDhChapSecrets()
+	}
+	if w.state == clusterStateAlert && (events.connect || events.resume) {
+		w.log.Infof("cluster %s (hostnqn %s) leaves alert state, retrying to connect", w.pair.ClusterNqn, w.pair.HostNqn)
+		w.resetBackoff()
+		w.connect()
+		return
+	}
+	if events.connect {
+		// a new connect request cancels a scheduled reconnect, the connections
+		// of the cluster changed and may be reachable now.
+		w.connect()
+		return
+	}
+	if w.state != clusterStateConnected {
+		return
+	}
+	if len(events.lost) > 0 {
+		for conn := range events.lost {
+			w.dropConnection(conn, "keep alive failed")
+		}
+		if len(w.activeConns) == 0 {
+			w.log.Infof("lost all persistent discovery connections to cluster %s, reconnecting", w.pair.ClusterNqn)
+			w.connect()
+			return
+		}
+		w.addRedundantConnections()
+	}
+	for _, conn := range w.connections() {
+		if events.aens[conn] && w.isActive(conn) {
+			w.handleAEN(conn)
+		}
+	}
+	if events.reconcile && w.state == clusterStateConnected {
+		if len(w.activeConns) > 1 {
+			w.verifyGenerations()
+		} else if len(w.activeConns) == 1 && w.lastLogPage != nil && !w.lastLogPage.notifiesChanges() {
+			// no AEN tells us the log page changed, poll it.
+			w.handleAEN(w.activeConns[0])
+		}
+		w.addRedundantConnections()
+		w.reconcileIOControllers()
+	}
+}
+
+func (w *clusterWorker) setState(state clusterState) {
+	if w.state == state {
+		return
+	}
+	if w.state != "" {
+		w.log.Infof("cluster state: %s ===> %s", w.state, state)
+	}
+	w.state = state
+	for _, s := range clusterStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		metrics.Metrics.ClusterState.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, string(s)).Set(value)
+	}
+}
+
+func (w *clusterWorker) retryCh() <-chan time.Time {
+	if w.retryTimer == nil {
+		return nil
+	}
+	return w.retryTimer.C
+}
+
+func (w *clusterWorker) stopRetryTimer() {
+	if w.retryTimer != nil {
+		w.retryTimer.Stop()
+		w.retryTimer = nil
+	}
+}
+
+func (w *clusterWorker) resetBackoff() {
+	w.backoff.reset()
+	metrics.Metrics.ClusterConnectFailures.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn).Set(0)
+}
+
+// connectFailed schedules the next connect according to the backoff settings,
+// or moves to alert state once the connect attempts ran out.
+func (w *clusterWorker) connectFailed(err error) {
+	cfg := w.s.getSettings().backoff
+	delay, ok := w.backoff.failed(cfg)
+	metrics.Metrics.ClusterConnectFailures.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn).Set(float64(w.backoff.failures))
+	if !ok {
+		w.log.Errorf("%s. failed to connect to cluster %s (hostnqn %s) %d times in a row, giving up until its configuration changes or the service configuration is reloaded",
+			err, w.pair.ClusterNqn, w.pair.HostNqn, w.backoff.failures)
+		w.setState(clusterStateAlert)
+		return
+	}
+	w.log.Infof("%s. attempt %d failed, schedule reconnect in %s", err, w.backoff.failures, delay)
+	w.retryTimer = time.NewTimer(delay)
+	metrics.Metrics.ClusterBackoffSeconds.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn).Set(delay.Seconds())
+	w.setState(clusterStateBackingOff)
+}
+
+// connect tries to establish a persistent discovery connection to the cluster.
+// the DC support multiple clusters at the same time, and this method will
+// try to connect to single DS service in the cluster of the worker.
+func (w *clusterWorker) connect() {
+	w.stopRetryTimer()
+	metrics.Metrics.ClusterBackoffSeconds.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn).Set(0)
+	for _, conn := range w.connections() {
+		w.dropConnection(conn, "reconnecting to the cluster")
+	}
+	// the IO controllers may have been removed by the kernel while the cluster was unreachable
+	// (ctrl_loss_tmo), apply the first log page after the reconnect even if its generation
+	// was already processed.
+	w.hasGeneration = false
+	connections := w.s.clusterConnectionsList(w.pair)
+	if len(connections) == 0 {
+		w.log.Errorf("cannot connect to cluster with subsysNQN %s from client with hostnqn %s. no connections found",
+			w.pair.ClusterNqn, w.pair.HostNqn)
+		w.setState(clusterStateIdle)
+		return
+	}
+	w.setState(clusterStateConnecting)
+	w.log.Infof("trying to connect to cluster %s as hostnqn %s", w.pair.ClusterNqn, w.pair.HostNqn)
+	conn, err := w.s.getLiveConnection(connections, w.pair.ClusterNqn)
+	if err != nil {
+		w.connectFailed(err)
+		return
+	}
+	w.resetBackoff()
+	w.s.endpoints.connected(w.pair, conn)
+	w.addConnection(conn)
+	w.setState(clusterStateConnected)
+	w.log.Debugf("running discovery on new live %s", conn)
+	w.handleAEN(conn)
+	if len(w.activeConns) > 0 {
+		w.addRedundantConnections()
+	}
+}
+
+// handleAEN fetches the log page through conn and processes it unless its generation
+// was already processed.
+func (w *clusterWorker) handleAEN(conn *clientconfig.Connection) {
+	w.log.Debugf("received notification on %s", conn)
+	logPage, err := w.s.getLogPageEntries(conn, time.Duration(0))
+	if err != nil {
+		// failed issuing get-log-page command, the discovery server is probably
+		// down. continue with another connection to the cluster.
+		w.log.WithError(err).Errorf("error in receiving log page entries through %s", conn)
+		w.dropConnection(conn, "failed to get the log page")
+		if len(w.activeConns) == 0 {
+			w.log.Infof("no persistent discovery connection left to cluster %s. Start reconnect process", w.pair.ClusterNqn)
+			w.notify(func(events *workerEvents) {
+				events.connect = true
+			})
+			return
+		}
+		next := w.activeConns[0]
+		w.notify(func(events *workerEvents) {
+			events.addAEN(next)
+		})
+		return
+	}
+	w.processLogPage(logPage)
+}
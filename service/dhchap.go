@@ -0,0 +1,126 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/lightbitslabs/discovery-client/metrics"
+	"github.com/lightbitslabs/discovery-client/model"
+	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/nvmeclient"
+)
+
+// dhChapSecrets returns the DH-CHAP secrets of the discovery connection conn and of the IO
+// controllers discovered through it: those of its entry, otherwise those of the key file of
+// its cluster or of its host, otherwise those of the service configuration.
+func (s *service) dhChapSecrets(conn *clientconfig.Connection, cfg *model.AppConfig) (string, string) {
+	if entryParams := conn.GetIOConnectParams(); entryParams.DhChapSecret != "" {
+		// the controller secret belongs to the host secret, don't mix the entry and the other secrets.
+		return entryParams.DhChapSecret, entryParams.DhChapCtrlSecret
+	}
+	if s.dhChapKeys != nil {
+		if secrets, ok := s.dhChapKeys.Lookup(conn.Hostnqn, conn.Key.Nqn); ok {
+			return secrets.Secret, secrets.CtrlSecret
+		}
+	}
+	return cfg.DhChapSecret, cfg.DhChapCtrlSecret
+}
+
+// dhChapKeysChanged notifies the workers of the clusters and the hosts whose key files changed
+// to rotate the secrets of their IO controllers.
+func (s *service) dhChapKeysChanged(changed []string) {
+	s.log.Infof("DH-CHAP key files changed: %v", changed)
+	names := map[string]bool{}
+	for _, name := range changed {
+		names[name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for pair, w := range s.workers {
+		if names[pair.ClusterNqn] || names[pair.HostNqn] {
+			w.notify(func(events *workerEvents) {
+				events.rotateDhChap = true
+			})
+		}
+	}
+}
+
+// rotateDhChapSecrets sets the current DH-CHAP secrets of the cluster on the IO controllers of
+// its last log page, which the kernel re-authenticates with them. the persistent discovery
+// connections use them from their next connect.
+func (w *clusterWorker) rotateDhChapSecrets() {
+	logPage := w.lastLogPage
+	if logPage == nil {
+		return
+	}
+	params := w.s.ioConnectParams(logPage)
+	if params.DhChapSecret == "" {
+		w.log.Warnf("no DH-CHAP secret left for cluster %s (hostnqn %s), IO controllers keep their secrets until reconnected",
+			w.pair.ClusterNqn, w.pair.HostNqn)
+		return
+	}
+	ctrls, err := nvmeclient.ListNvmeControllersInfo()
+	if err != nil {
+		w.log.WithError(err).Errorf("DH-CHAP rotation: failed to list nvme controllers")
+		return
+	}
+	for _, ctrl := range logPageControllers(logPage.nvmeEntries, logPage.request.Hostnqn, logPage.request.Transport, ctrls) {
+		rotation, err := nvmeclient.RotateDhChapSecrets(ctrl.Device, params.DhChapSecret, params.DhChapControllerSecret)
+		metrics.Metrics.DhChapRotations.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, string(rotation)).Inc()
+		log := w.log.WithField("device", ctrl.Device).
+			WithField("ctrl-subsys-nqn", ctrl.Subsysnqn).
+			WithField("traddr", ctrl.Traddr)
+		switch rotation {
+		case nvmeclient.DhChapRotated:
+			log.Infof("DH-CHAP secrets of IO controller %s rotated, the kernel re-authenticates it", ctrl.Device)
+		case nvmeclient.DhChapUnchanged:
+			log.Debugf("IO controller %s already uses the DH-CHAP secrets", ctrl.Device)
+		case nvmeclient.DhChapNotAuthenticated:
+			log.Warnf("IO controller %s was connected without a DH-CHAP secret, reconnect it to authenticate", ctrl.Device)
+		default:
+			log.WithError(err).Errorf("failed to rotate the DH-CHAP secrets of IO controller %s", ctrl.Device)
+		}
+	}
+}
+
+// logPageControllers returns the controllers of ctrls connected by hostnqn over transport to
+// the IO controllers of logPageEntries.
+func logPageControllers(
+	logPageEntries []*hostapi.NvmeDiscPageEntry,
+	hostnqn string,
+	transport string,
+	ctrls map[string]*nvmeclient.NvmeControllerInfo,
+) []*nvmeclient.NvmeControllerInfo {
+	controllers := hostControllers(hostnqn, transport, ctrls)
+	var result []*nvmeclient.NvmeControllerInfo
+	seen := map[string]bool{}
+	for _, entry := range logPageEntries {
+		keys := []string{ioControllerKey(entry.Traddr, int(entry.TrsvcID), entry.Subnqn)}
+		if nvmeclient.AuxSuffix != "" {
+			keys = append(keys, ioControllerKey(entry.Traddr, int(entry.TrsvcID), fmt.Sprintf("%s.%s", entry.Subnqn, nvmeclient.AuxSuffix)))
+		}
+		for _, key := range keys {
+			for _, ctrl := range controllers[key] {
+				if !seen[ctrl.Device] {
+					seen[ctrl.Device] = true
+					result = append(result, ctrl)
+				}
+			}
+		}
+	}
+	return result
+}
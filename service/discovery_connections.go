@@ -0,0 +1,308 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lightbitslabs/discovery-client/metrics"
+	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+	"github.com/lightbitslabs/discovery-client/pkg/nvmeclient"
+)
+
+// a worker keeps up to settings.discoveryConnections persistent discovery connections
+// to its cluster, so an AEN is not missed while the discovery server of one of them
+// is down. the discovery servers of a cluster share the generation counter of the
+// log page: an AEN is sent on each of the connections, and the log page of a
+// generation that was already processed is skipped. a connection that returns a
+// log page older than another connection is considered stale and is replaced.
+
+// connections returns a copy of the persistent discovery connections of the worker.
+func (w *clusterWorker) connections() []*clientconfig.Connection {
+	return append([]*clientconfig.Connection{}, w.activeConns...)
+}
+
+func (w *clusterWorker) isActive(conn *clientconfig.Connection) bool {
+	for _, active := range w.activeConns {
+		if active == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// addConnection adds an established persistent discovery connection to the worker.
+func (w *clusterWorker) addConnection(conn *clientconfig.Connection) {
+	w.activeConns = append(w.activeConns, conn)
+	if len(w.activeConns) == 1 {
+		w.s.setActiveConnection(w.pair, conn)
+	}
+	w.s.multiplexNewConnection(conn)
+	metrics.Metrics.ClusterDiscoveryConnections.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn).Set(float64(len(w.activeConns)))
+}
+
+// dropConnection closes a persistent discovery connection of the worker.
+func (w *clusterWorker) dropConnection(conn *clientconfig.Connection, reason string) {
+	for i, active := range w.activeConns {
+		if active != conn {
+			continue
+		}
+		w.log.Infof("closing persistent discovery %s: %s", conn, reason)
+		w.activeConns = append(w.activeConns[:i], w.activeConns[i+1:]...)
+		w.s.disconnect(conn)
+		conn.SetState(false)
+		if i == 0 {
+			var primary *clientconfig.Connection
+			if len(w.activeConns) > 0 {
+				primary = w.activeConns[0]
+			}
+			w.s.setActiveConnection(w.pair, primary)
+		}
+		metrics.Metrics.ClusterDiscoveryConnections.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn).Set(float64(len(w.activeConns)))
+		return
+	}
+}
+
+// addRedundantConnections opens persistent discovery connections to other discovery
+// servers of the cluster until the worker has settings.discoveryConnections of them.
+// connections that are no longer wanted, e.g. after a configuration reload, are closed.
+func (w *clusterWorker) addRedundantConnections() {
+	want := w.s.getSettings().discoveryConnections
+	if want < 1 {
+		want = 1
+	}
+	for len(w.activeConns) > want {
+		w.dropConnection(w.activeConns[len(w.activeConns)-1], fmt.Sprintf("only %d connections are configured", want))
+	}
+	if len(w.activeConns) == want {
+		return
+	}
+	for _, conn := range w.s.clusterConnectionsList(w.pair) {
+		if len(w.activeConns) >= want || w.ctx.Err() != nil {
+			return
+		}
+		if w.isActive(conn) {
+			continue
+		}
+		if w.lastLogPage != nil && !w.lastLogPage.supportsPersistentConnection(conn) {
+			w.log.Debugf("discovery server %s doesn't support persistent connections, not opening a redundant connection", conn.Address())
+			continue
+		}
+		logPage, err := w.s.getLogPageEntries(conn, kato)
+		if err != nil {
+			w.log.WithError(err).Debugf("failed to open a redundant discovery connection through %s", conn)
+			continue
+		}
+		if w.hasGeneration && logPage.genCtr < w.generation {
+			w.log.Warnf("discovery server %s serves a stale log page: generation %d, processed generation %d",
+				conn.Address(), logPage.genCtr, w.generation)
+			metrics.Metrics.StaleLogPages.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, conn.Key.Ip).Inc()
+			w.s.disconnect(conn)
+			conn.SetState(false)
+			continue
+		}
+		w.log.Infof("opened redundant persistent discovery %s", conn)
+		w.addConnection(conn)
+	}
+	if len(w.activeConns) < want {
+		w.log.Warnf("%d of %d persistent discovery connections to cluster %s are established",
+			len(w.activeConns), want, w.pair.ClusterNqn)
+	}
+}
+
+// processLogPage applies logPage unless its generation was already processed.
+// a log page older than the last one processed means that either the discovery
+// server is stale or the generation counter of the cluster was reset, which is
+// told apart by comparing the log pages of all connections.
+func (w *clusterWorker) processLogPage(logPage *discoveryLogPage) {
+	if w.hasGeneration {
+		switch {
+		case logPage.genCtr == w.generation:
+			w.log.Debugf("log page generation %d through %s was already processed, skipping", logPage.genCtr, logPage.conn)
+			metrics.Metrics.AENDuplicates.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn).Inc()
+			return
+		case logPage.genCtr < w.generation:
+			w.log.Warnf("log page generation %d through %s is older than the processed generation %d, comparing the log pages of all connections",
+				logPage.genCtr, logPage.conn, w.generation)
+			w.verifyGenerations()
+			return
+		}
+	}
+	w.applyLogPage(logPage)
+}
+
+// verifyGenerations fetches the log page through every persistent discovery
+// connection, replaces the connections that serve a stale log page and applies
+// the newest log page if it was not processed yet.
+func (w *clusterWorker) verifyGenerations() {
+	logPages := []*discoveryLogPage{}
+	var newest *discoveryLogPage
+	for _, conn := range w.connections() {
+		logPage, err := w.s.getLogPageEntries(conn, 0)
+		if err != nil {
+			w.log.WithError(err).Errorf("error in receiving log page entries through %s", conn)
+			w.dropConnection(conn, "failed to get the log page")
+			continue
+		}
+		logPages = append(logPages, logPage)
+		if newest == nil || logPage.genCtr > newest.genCtr {
+			newest = logPage
+		}
+	}
+	if newest == nil {
+		w.notify(func(events *workerEvents) {
+			events.connect = true
+		})
+		return
+	}
+	for _, logPage := range logPages {
+		if logPage.genCtr < newest.genCtr {
+			w.log.Warnf("discovery server %s serves a stale log page: generation %d, generation %d through %s",
+				logPage.conn.Address(), logPage.genCtr, newest.genCtr, newest.conn.Address())
+			metrics.Metrics.StaleLogPages.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, logPage.conn.Key.Ip).Inc()
+			w.dropConnection(logPage.conn, "stale log page")
+		} else if !sameIOControllers(logPage.nvmeEntries, newest.nvmeEntries) {
+			w.log.Warnf("log pages of generation %d through %s and %s list different IO controllers",
+				newest.genCtr, logPage.conn.Address(), newest.conn.Address())
+		}
+	}
+	if !w.hasGeneration || newest.genCtr != w.generation {
+		// we missed an AEN, or the generation counter of the cluster went back.
+		w.log.Infof("applying log page generation %d through %s", newest.genCtr, newest.conn)
+		w.applyLogPage(newest)
+	}
+	w.addRedundantConnections()
+}
+
+// applyLogPage connects to all IO controllers of logPage and updates the cache with its referrals.
+func (w *clusterWorker) applyLogPage(logPage *discoveryLogPage) {
+	conn := logPage.conn
+	entries := w.filterIOControllers(logPage, true)
+	params := w.s.ioConnectParams(logPage)
+	nvmeclient.ConnectAllNVMEDevices(entries, params)
+	w.reportSubsystemPaths(entries, logPage, params.HostPaths, nil)
+	w.lastLogPage = logPage
+	w.generation = logPage.genCtr
+	w.hasGeneration = true
+	if w.ctx.Err() != nil {
+		// the cluster was removed while we were connecting, don't bring its referrals back.
+		return
+	}
+	if !logPage.supportsPersistentConnection(conn) {
+		w.log.Warnf("discovery server %s doesn't support persistent connections, changes of the log page may not be notified", conn.Address())
+	}
+	refMap := clientconfig.ReferralMap{}
+	// link-local referrals are reachable through the interface of the connection that reported them.
+	_, zone := nvme.SplitZone(conn.Key.Ip)
+	for _, referral := range logPage.referrals {
+		if referral.Eflags&nvme.NVMF_DISC_EFLAGS_NCC != 0 {
+			w.log.Debugf("discovery endpoint %s:%d has no connectivity to a centralized discovery controller", referral.Traddr, referral.TrsvcID)
+		}
+		transport := referral.Transport
+		if transport == "" {
+			transport = logPage.request.Transport
+		}
+		refKey := clientconfig.ReferralKey{
+			Transport: transport,
+			Ip:        nvme.ScopeTraddr(referral.Traddr, zone),
+			Port:      referral.TrsvcID,
+			DPSubNqn:  referralGroup(conn, referral),
+			Hostnqn:   conn.Hostnqn}
+		refMap[refKey] = referral
+	}
+	w.s.cache.HandleReferrals(conn.ReferralOrigin(), refMap)
+}
+
+// referralGroup returns the cluster nqn of the connection group of a referral reported
+// through conn. a referral that returns the same information as conn (DUPRETINFO), or to
+// another endpoint of the discovery subsystem of conn, the well-known discovery nqn or the
+// nqn of the cluster on the port of conn, belongs to the group of conn. a referral to another
+// discovery subsystem nqn or port has a group of its own.
+func referralGroup(conn *clientconfig.Connection, referral *hostapi.NvmeDiscPageEntry) string {
+	if referral.Eflags&nvme.NVMF_DISC_EFLAGS_DUPRETINFO != 0 {
+		return conn.Key.Nqn
+	}
+	port := int(referral.TrsvcID)
+	// the group of a referral to another port is named after both.
+	clusterNqn := strings.TrimSuffix(conn.Key.Nqn, fmt.Sprintf("@%d", conn.Key.Port()))
+	nqn := referral.Subnqn
+	if nqn == "" || nqn == hostapi.DiscoverySubsysName || referral.SubType == nvme.NVME_NQN_CURR {
+		// the current discovery subsystem entries may carry its unique discovery nqn.
+		nqn = clusterNqn
+	}
+	switch {
+	case port != conn.Key.Port():
+		return fmt.Sprintf("%s@%d", nqn, port)
+	case nqn == clusterNqn:
+		return conn.Key.Nqn
+	default:
+		return nqn
+	}
+}
+
+// ioConnectParams returns the parameters of the IO controllers of logPage: the parameters
+// of the entry logPage was fetched through, the service configuration for those not set.
+func (s *service) ioConnectParams(logPage *discoveryLogPage) *nvmeclient.ConnectParams {
+	settings := s.getSettings()
+	params := &nvmeclient.ConnectParams{
+		Hostnqn:        logPage.request.Hostnqn,
+		Hostid:         logPage.conn.GetHostid(),
+		Transport:      logPage.request.Transport,
+		CtrlLossTMO:    settings.cfg.CtrlLossTMO,
+		MaxIOQueues:    settings.maxIOQueues,
+		Kato:           settings.kato,
+		FabricsOptions: settings.cfg.FabricsOptions,
+	}
+	params.DhChapSecret, params.DhChapControllerSecret = s.dhChapSecrets(logPage.conn, &settings.cfg)
+	entryParams := logPage.conn.GetIOConnectParams()
+	if entryParams.CtrlLossTMO != nil {
+		params.CtrlLossTMO = *entryParams.CtrlLossTMO
+	}
+	if entryParams.MaxIOQueues != nil {
+		params.MaxIOQueues = *entryParams.MaxIOQueues
+	}
+	if entryParams.Kato != nil {
+		params.Kato = *entryParams.Kato
+	}
+	if entryParams.FabricsOptions != nil {
+		params.FabricsOptions = params.FabricsOptions.Override(*entryParams.FabricsOptions)
+	}
+	params.HostPaths = entryParams.HostPaths
+	params.HostTraddrSelector = settings.hostTraddrSelector
+	_, params.Zone = nvme.SplitZone(logPage.request.Traddr)
+	return params
+}
+
+// sameIOControllers returns true if both log pages list the same IO controllers.
+func sameIOControllers(a, b []*hostapi.NvmeDiscPageEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	controllers := map[string]int{}
+	for _, entry := range a {
+		controllers[ioControllerKey(entry.Traddr, int(entry.TrsvcID), entry.Subnqn)]++
+	}
+	for _, entry := range b {
+		key := ioControllerKey(entry.Traddr, int(entry.TrsvcID), entry.Subnqn)
+		if controllers[key] == 0 {
+			return false
+		}
+		controllers[key]--
+	}
+	return true
+}
@@ -0,0 +1,268 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightbitslabs/discovery-client/model"
+	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
+)
+
+// endpointSelector orders the discovery endpoints of a cluster for a connect attempt.
+type endpointSelector interface {
+	order(pair clientconfig.ClientClusterPair, connections []*clientconfig.Connection) []*clientconfig.Connection
+}
+
+func newEndpointSelector(policy model.EndpointSelectionPolicy, stats *endpointStats) endpointSelector {
+	switch policy {
+	case model.EndpointSelectionSticky:
+		return &stickySelector{stats: stats}
+	case model.EndpointSelectionLatency:
+		return &latencySelector{stats: stats}
+	default:
+		return &randomSelector{stats: stats}
+	}
+}
+
+// randomSelector balances the clients of a cluster between its endpoints.
+type randomSelector struct {
+	stats *endpointStats
+}
+
+func (sel *randomSelector) order(_ clientconfig.ClientClusterPair, connections []*clientconfig.Connection) []*clientconfig.Connection {
+	return weightedShuffle(connections, sel.stats.random)
+}
+
+// stickySelector tries the endpoint that worked last first, the rest in random order.
+type stickySelector struct {
+	stats *endpointStats
+}
+
+func (sel *stickySelector) order(pair clientconfig.ClientClusterPair, connections []*clientconfig.Connection) []*clientconfig.Connection {
+	ordered := weightedShuffle(connections, sel.stats.random)
+	lastGood := sel.stats.lastGoodConnection(pair)
+	for i, conn := range ordered {
+		if conn == lastGood {
+			copy(ordered[1:i+1], ordered[:i])
+			ordered[0] = conn
+			break
+		}
+	}
+	return ordered
+}
+
+// latencySelector tries the endpoints from the fastest to respond to the latest probe.
+// endpoints that were not probed yet come next, and endpoints that failed the probe last.
+type latencySelector struct {
+	stats *endpointStats
+}
+
+func (sel *latencySelector) order(_ clientconfig.ClientClusterPair, connections []*clientconfig.Connection) []*clientconfig.Connection {
+	ordered := weightedShuffle(connections, sel.stats.random)
+	probes := make([]probeResult, len(ordered))
+	for i, conn := range ordered {
+		probes[i] = sel.stats.probeResult(conn)
+	}
+	sort.Stable(byLatency{ordered, probes})
+	return ordered
+}
+
+type byLatency struct {
+	connections []*clientconfig.Connection
+	probes      []probeResult
+}
+
+func (b byLatency) Len() int { return len(b.connections) }
+
+func (b byLatency) Swap(i, j int) {
+	b.connections[i], b.connections[j] = b.connections[j], b.connections[i]
+	b.probes[i], b.probes[j] = b.probes[j], b.probes[i]
+}
+
+func (b byLatency) Less(i, j int) bool {
+	if b.probes[i].rank() != b.probes[j].rank() {
+		return b.probes[i].rank() < b.probes[j].rank()
+	}
+	return b.probes[i].latency < b.probes[j].latency
+}
+
+// weightedShuffle returns a random permutation of connections, where endpoints of
+// higher weight are more likely to come first.
+func weightedShuffle(connections []*clientconfig.Connection, random func() float64) []*clientconfig.Connection {
+	ordered := make([]*clientconfig.Connection, len(connections))
+	copy(ordered, connections)
+	// Efraimidis-Spirakis: sorting by u^(1/w) is a weighted random sampling without replacement.
+	keys := make(map[*clientconfig.Connection]float64, len(ordered))
+	for _, conn := range ordered {
+		keys[conn] = math.Pow(random(), 1/float64(conn.GetWeight()))
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return keys[ordered[i]] > keys[ordered[j]]
+	})
+	return ordered
+}
+
+// preferLocality moves the endpoints with the locality of the host to the front,
+// keeping the order within the local and the remote endpoints.
+func preferLocality(connections []*clientconfig.Connection, locality string) []*clientconfig.Connection {
+	if locality == "" {
+		return connections
+	}
+	sort.SliceStable(connections, func(i, j int) bool {
+		return connections[i].GetLocality() == locality && connections[j].GetLocality() != locality
+	})
+	return connections
+}
+
+type probeResult struct {
+	probed  bool
+	latency time.Duration
+	err     error
+}
+
+// rank of the probe result: succeeded probes first, then endpoints that were not
+// probed, then failed probes.
+func (p probeResult) rank() int {
+	switch {
+	case !p.probed:
+		return 1
+	case p.err != nil:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// endpointStats keeps what we learned about the discovery endpoints for the selection policies.
+type endpointStats struct {
+	mu       sync.Mutex
+	lastGood map[clientconfig.ClientClusterPair]*clientconfig.Connection
+	probes   map[*clientconfig.Connection]probeResult
+	// random returns a number in [0, 1). replaced by tests.
+	random func() float64
+	// probing is set while a probe round is running.
+	probing atomic.Bool
+}
+
+func newEndpointStats() *endpointStats {
+	return &endpointStats{
+		lastGood: make(map[clientconfig.ClientClusterPair]*clientconfig.Connection),
+		probes:   make(map[*clientconfig.Connection]probeResult),
+		random:   rand.Float64,
+	}
+}
+
+func (st *endpointStats) connected(pair clientconfig.ClientClusterPair, conn *clientconfig.Connection) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastGood[pair] = conn
+}
+
+func (st *endpointStats) lastGoodConnection(pair clientconfig.ClientClusterPair) *clientconfig.Connection {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.lastGood[pair]
+}
+
+func (st *endpointStats) probed(conn *clientconfig.Connection, latency time.Duration, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.probes[conn] = probeResult{probed: true, latency: latency, err: err}
+}
+
+func (st *endpointStats) probeResult(conn *clientconfig.Connection) probeResult {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.probes[conn]
+}
+
+// forgetConnection drops what we know about a connection that was removed.
+func (st *endpointStats) forgetConnection(pair clientconfig.ClientClusterPair, conn *clientconfig.Connection) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.probes, conn)
+	if st.lastGood[pair] == conn {
+		delete(st.lastGood, pair)
+	}
+}
+
+// setProbeInterval (re)starts the latency probes of the endpoints. probes run only
+// with the latency policy, a non positive interval stops them.
+func (s *service) setProbeInterval(policy model.EndpointSelectionPolicy, interval time.Duration) {
+	if s.probeTicker != nil {
+		s.probeTicker.Stop()
+		s.probeTicker = nil
+	}
+	if policy != model.EndpointSelectionLatency || interval <= 0 {
+		return
+	}
+	s.log.Infof("probing the latency of discovery endpoints every %s", interval)
+	s.probeTicker = time.NewTicker(interval)
+}
+
+// probeCh returns the channel of the probe ticker, nil if probes are disabled.
+func (s *service) probeCh() <-chan time.Time {
+	if s.probeTicker == nil {
+		return nil
+	}
+	return s.probeTicker.C
+}
+
+// probeEndpoints measures the time it takes every discovery endpoint to answer a
+// discover command over a non persistent connection. a probe round is skipped if
+// the previous one did not finish yet.
+func (s *service) probeEndpoints() {
+	if !s.endpoints.probing.CompareAndSwap(false, true) {
+		s.log.Debugf("previous latency probes are still running, skipping")
+		return
+	}
+	s.mu.Lock()
+	connections := []*clientconfig.Connection{}
+	for _, clusterConnections := range s.connections {
+		for _, conn := range clusterConnections.ClusterConnectionsMap {
+			connections = append(connections, conn)
+		}
+	}
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.endpoints.probing.Store(false)
+		for _, conn := range connections {
+			if s.ctx.Err() != nil {
+				return
+			}
+			start := time.Now()
+			request, err := s.discoveryRequest(conn, 0)
+			if err == nil {
+				_, _, err = s.Discover(request)
+			}
+			latency := time.Since(start)
+			if err != nil {
+				s.log.WithError(err).Debugf("latency probe of %s failed", conn)
+			} else {
+				s.log.Debugf("latency probe of %s took %s", conn, latency)
+			}
+			s.endpoints.probed(conn, latency, err)
+		}
+	}()
+}
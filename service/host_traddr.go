@@ -0,0 +1,67 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/lightbitslabs/discovery-client/model"
+	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/hostroute"
+)
+
+// compileHostTraddrSelector returns the host traddr selector of cfg, nil if disabled. the
+// selection was verified when the configuration was loaded.
+func compileHostTraddrSelector(cfg *model.AppConfig) *hostroute.Selector {
+	selector, err := cfg.HostTraddrSelection.Compile()
+	if err != nil {
+		logrus.WithError(err).Errorf("invalid host traddr selection, ignored")
+		return nil
+	}
+	if selector != nil {
+		logrus.Infof("picking the host traddr of the connections through interfaces %v", cfg.HostTraddrSelection.Interfaces)
+	}
+	return selector
+}
+
+// discoveryRequest returns the request that connects to the discovery controller of conn,
+// from the host traddr picked by the host traddr selection if enabled.
+func (s *service) discoveryRequest(conn *clientconfig.Connection, kato time.Duration) (*hostapi.DiscoverRequest, error) {
+	settings := s.getSettings()
+	request := conn.GetDiscoveryRequest(kato)
+	// the digests of the IO controllers are required by the fabric on the discovery controllers as well.
+	fabricsOptions := settings.cfg.FabricsOptions
+	if entryOptions := conn.GetIOConnectParams().FabricsOptions; entryOptions != nil {
+		fabricsOptions = fabricsOptions.Override(*entryOptions)
+	}
+	request.HdrDigest = fabricsOptions.HdrDigest
+	request.DataDigest = fabricsOptions.DataDigest
+	if request.TLS && request.TLSKeyFile == "" {
+		request.TLSKeyFile = settings.cfg.TLSKeyFile
+	}
+	// the discovery controllers authenticate the host with the secrets of its IO controllers.
+	request.DhChapSecret, request.DhChapCtrlSecret = s.dhChapSecrets(conn, &settings.cfg)
+	if selector := settings.hostTraddrSelector; selector != nil {
+		hostTraddr, err := selector.HostTraddr(request.Traddr)
+		if err != nil {
+			return nil, err
+		}
+		request.Hostaddr = hostTraddr
+	}
+	return request, nil
+}
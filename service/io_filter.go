@@ -0,0 +1,73 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/lightbitslabs/discovery-client/metrics"
+	"github.com/lightbitslabs/discovery-client/model"
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/iofilter"
+)
+
+// filterIOControllers returns the IO controllers of logPage the host may connect to: those
+// allowed by both the global filter and the filter of the entry logPage was fetched through.
+// if report is set the filtered IO controllers are logged and counted.
+func (w *clusterWorker) filterIOControllers(logPage *discoveryLogPage, report bool) []*hostapi.NvmeDiscPageEntry {
+	filters := []*iofilter.Filter{w.s.getSettings().ioFilter}
+	if entryFilter, err := logPage.conn.GetIOFilter().Compile(); err == nil {
+		filters = append(filters, entryFilter)
+	} else {
+		w.log.WithError(err).Errorf("invalid IO controllers filter of %s, ignored", logPage.conn)
+	}
+
+	allowed := []*hostapi.NvmeDiscPageEntry{}
+	filtered := 0
+	for _, entry := range logPage.nvmeEntries {
+		ok, reason := true, ""
+		for _, filter := range filters {
+			if ok, reason = filter.Allowed(entry.Subnqn, entry.Traddr); !ok {
+				break
+			}
+		}
+		if ok {
+			allowed = append(allowed, entry)
+			continue
+		}
+		filtered++
+		if report {
+			w.log.Infof("not connecting IO controller %s:%d of subsystem %s: %s", entry.Traddr, entry.TrsvcID, entry.Subnqn, reason)
+		}
+	}
+	if report {
+		metrics.Metrics.IOControllersFiltered.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn).Set(float64(filtered))
+	}
+	return allowed
+}
+
+// compileIOFilter returns the global IO controllers filter of cfg. the filter was verified
+// when the configuration was loaded.
+func compileIOFilter(cfg *model.AppConfig) *iofilter.Filter {
+	filter, err := cfg.IOControllersFilter.Compile()
+	if err != nil {
+		logrus.WithError(err).Errorf("invalid IO controllers filter, ignored")
+		return nil
+	}
+	if !filter.Empty() {
+		logrus.Infof("IO controllers filter: %+v", cfg.IOControllersFilter)
+	}
+	return filter
+}
@@ -0,0 +1,100 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/lightbitslabs/discovery-client/metrics"
+	"github.com/lightbitslabs/discovery-client/model"
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+	"github.com/lightbitslabs/discovery-client/pkg/nvmeclient"
+)
+
+// pathCount is the number of paths of a subsystem connected on the host, out of
+// those it should have.
+type pathCount struct {
+	connected int
+	expected  int
+}
+
+// countSubsystemPaths returns the path count of every subsystem of logPageEntries.
+func countSubsystemPaths(
+	logPageEntries []*hostapi.NvmeDiscPageEntry,
+	hostnqn string,
+	transport string,
+	hostPaths model.HostPaths,
+	ctrls map[string]*nvmeclient.NvmeControllerInfo,
+) map[string]pathCount {
+	controllers := hostControllers(hostnqn, transport, ctrls)
+	counts := map[string]pathCount{}
+	for _, entry := range logPageEntries {
+		if entry.SubType != nvme.NVME_NQN_NVME {
+			continue
+		}
+		connected, expected := connectedPaths(entry, hostPaths, controllers)
+		count := counts[entry.Subnqn]
+		count.connected += connected
+		count.expected += expected
+		counts[entry.Subnqn] = count
+	}
+	return counts
+}
+
+// reportSubsystemPaths exposes the paths of the subsystems of logPageEntries, the IO
+// controllers of logPage the host connects to, and logs the subsystems whose path count
+// changed. ctrls are the controllers on the host, listed again if nil.
+func (w *clusterWorker) reportSubsystemPaths(
+	logPageEntries []*hostapi.NvmeDiscPageEntry,
+	logPage *discoveryLogPage,
+	hostPaths model.HostPaths,
+	ctrls map[string]*nvmeclient.NvmeControllerInfo,
+) {
+	if ctrls == nil {
+		var err error
+		if ctrls, err = nvmeclient.ListNvmeControllersInfo(); err != nil {
+			w.log.WithError(err).Debugf("failed to list nvme controllers, not reporting the subsystem paths")
+			return
+		}
+	}
+	counts := countSubsystemPaths(logPageEntries, logPage.request.Hostnqn, logPage.request.Transport, hostPaths, ctrls)
+	for subsysnqn, count := range counts {
+		metrics.Metrics.SubsystemPaths.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, subsysnqn).Set(float64(count.connected))
+		metrics.Metrics.SubsystemExpectedPaths.WithLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, subsysnqn).Set(float64(count.expected))
+		if prev, ok := w.subsystemPaths[subsysnqn]; ok && prev == count {
+			continue
+		}
+		if count.connected < count.expected {
+			w.log.Warnf("subsystem %s has %d of %d paths connected", subsysnqn, count.connected, count.expected)
+		} else {
+			w.log.Infof("subsystem %s has all its %d paths connected", subsysnqn, count.expected)
+		}
+	}
+	for subsysnqn := range w.subsystemPaths {
+		if _, ok := counts[subsysnqn]; !ok {
+			metrics.Metrics.SubsystemPaths.DeleteLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, subsysnqn)
+			metrics.Metrics.SubsystemExpectedPaths.DeleteLabelValues(w.pair.ClusterNqn, w.pair.HostNqn, subsysnqn)
+		}
+	}
+	w.subsystemPaths = counts
+}
+
+// deleteSubsystemPaths removes the subsystem paths metrics of the cluster.
+func (w *clusterWorker) deleteSubsystemPaths() {
+	labels := prometheus.Labels{"nqn": w.pair.ClusterNqn, "hostnqn": w.pair.HostNqn}
+	metrics.Metrics.SubsystemPaths.DeletePartialMatch(labels)
+	metrics.Metrics.SubsystemExpectedPaths.DeletePartialMatch(labels)
+}
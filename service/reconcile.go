@@ -0,0 +1,176 @@
+// Copyright 2016--2022 Lightbits Labs Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// you may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lightbitslabs/discovery-client/metrics"
+	"github.com/lightbitslabs/discovery-client/model"
+	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+	"github.com/lightbitslabs/discovery-client/pkg/nvmeclient"
+)
+
+// setReconcileInterval (re)starts the reconciliation ticker.
+// a non positive interval stops the reconciliation.
+func (s *service) setReconcileInterval(interval time.Duration) {
+	if s.reconcileTicker != nil {
+		s.reconcileTicker.Stop()
+		s.reconcileTicker = nil
+	}
+	if interval <= 0 {
+		s.log.Infof("IO controllers reconciliation is disabled")
+		return
+	}
+	s.log.Infof("reconciling IO controllers every %s", interval)
+	s.reconcileTicker = time.NewTicker(interval)
+}
+
+// reconcileCh returns the channel of the reconciliation ticker, nil if disabled.
+func (s *service) reconcileCh() <-chan time.Time {
+	if s.reconcileTicker == nil {
+		return nil
+	}
+	return s.reconcileTicker.C
+}
+
+// reconcileIOControllers verifies that every IO controller in the last log page of
+// the cluster is connected, and reconnects the missing ones.
+// controllers may disappear without an AEN, for example when the kernel gives up on
+// a controller after ctrl_loss_tmo or when an admin runs nvme disconnect.
+func (w *clusterWorker) reconcileIOControllers() {
+	logPage := w.lastLogPage
+	if logPage == nil {
+		return
+	}
+	ctrls, err := nvmeclient.ListNvmeControllersInfo()
+	if err != nil {
+		w.log.WithError(err).Errorf("reconcile: failed to list nvme controllers")
+		return
+	}
+	pair := w.pair
+	params := w.s.ioConnectParams(logPage)
+	entries := w.filterIOControllers(logPage, false)
+	missing := missingIOControllers(entries, logPage.request.Hostnqn, logPage.request.Transport, params.HostPaths, ctrls)
+	metrics.Metrics.IOControllersMissing.WithLabelValues(pair.ClusterNqn, pair.HostNqn).Set(float64(len(missing)))
+	if len(missing) == 0 {
+		w.reportSubsystemPaths(entries, logPage, params.HostPaths, ctrls)
+		return
+	}
+	if nvmeclient.IsDryRun() {
+		// the connects of the log page were already reported when it was processed,
+		// reporting them again on every reconciliation would only repeat them.
+		w.log.Debugf("reconcile: dry-run, %d IO controllers of cluster %s (hostnqn %s) are not connected",
+			len(missing), pair.ClusterNqn, pair.HostNqn)
+		w.reportSubsystemPaths(entries, logPage, params.HostPaths, ctrls)
+		return
+	}
+	for _, entry := range missing {
+		w.log.Infof("reconcile: IO controller %s:%d of subsystem %s is in the last log page of cluster %s (hostnqn %s) but is not connected on the host, reconnecting",
+			entry.Traddr, entry.TrsvcID, entry.Subnqn, pair.ClusterNqn, pair.HostNqn)
+	}
+	results := nvmeclient.ConnectAllNVMEDevices(missing, params)
+	failed := 0
+	for _, result := range results {
+		if result.Status == nvmeclient.ConnectStatusFailed {
+			failed++
+		}
+	}
+	metrics.Metrics.IOControllersReconnects.WithLabelValues(pair.ClusterNqn, pair.HostNqn, "success").Add(float64(len(results) - failed))
+	metrics.Metrics.IOControllersReconnects.WithLabelValues(pair.ClusterNqn, pair.HostNqn, "failure").Add(float64(failed))
+	if failed > 0 {
+		w.log.Warnf("reconcile: failed to reconnect %d of %d missing IO controllers of cluster %s (hostnqn %s), will retry in the next reconciliation",
+			failed, len(missing), pair.ClusterNqn, pair.HostNqn)
+	}
+	w.reportSubsystemPaths(entries, logPage, params.HostPaths, nil)
+}
+
+// missingIOControllers returns the IO controller entries of logPageEntries that have
+// no matching controller in ctrls through one of hostPaths, or at all if there are none.
+func missingIOControllers(
+	logPageEntries []*hostapi.NvmeDiscPageEntry,
+	hostnqn string,
+	transport string,
+	hostPaths model.HostPaths,
+	ctrls map[string]*nvmeclient.NvmeControllerInfo,
+) []*hostapi.NvmeDiscPageEntry {
+	controllers := hostControllers(hostnqn, transport, ctrls)
+	missing := []*hostapi.NvmeDiscPageEntry{}
+	for _, entry := range logPageEntries {
+		if entry.SubType != nvme.NVME_NQN_NVME {
+			continue
+		}
+		if connected, expected := connectedPaths(entry, hostPaths, controllers); connected < expected {
+			missing = append(missing, entry)
+		}
+	}
+	return missing
+}
+
+// hostControllers returns the controllers of ctrls connected by hostnqn over transport, by ioControllerKey.
+func hostControllers(hostnqn, transport string, ctrls map[string]*nvmeclient.NvmeControllerInfo) map[string][]*nvmeclient.NvmeControllerInfo {
+	controllers := map[string][]*nvmeclient.NvmeControllerInfo{}
+	for _, ctrl := range ctrls {
+		if ctrl == nil || ctrl.Transport != transport {
+			continue
+		}
+		// hostnqn is not exposed by old kernels, in which case we can't tell which host connected it.
+		if ctrl.Hostnqn != "" && ctrl.Hostnqn != hostnqn {
+			continue
+		}
+		key := ioControllerKey(ctrl.Traddr, ctrl.Trsvcid, ctrl.Subsysnqn)
+		controllers[key] = append(controllers[key], ctrl)
+	}
+	return controllers
+}
+
+// connectedPaths returns the number of hostPaths the IO controller of entry is connected
+// through in controllers and the number it should be connected through. with no host
+// paths the IO controller has a single path, whatever the route the kernel picked.
+func connectedPaths(
+	entry *hostapi.NvmeDiscPageEntry,
+	hostPaths model.HostPaths,
+	controllers map[string][]*nvmeclient.NvmeControllerInfo,
+) (connected, expected int) {
+	entryCtrls := controllers[ioControllerKey(entry.Traddr, int(entry.TrsvcID), entry.Subnqn)]
+	if nvmeclient.AuxSuffix != "" {
+		auxKey := ioControllerKey(entry.Traddr, int(entry.TrsvcID), fmt.Sprintf("%s.%s", entry.Subnqn, nvmeclient.AuxSuffix))
+		entryCtrls = append(entryCtrls, controllers[auxKey]...)
+	}
+	if len(hostPaths) == 0 {
+		if len(entryCtrls) > 0 {
+			return 1, 1
+		}
+		return 0, 1
+	}
+	for _, hostPath := range hostPaths {
+		for _, ctrl := range entryCtrls {
+			if ctrl.OnHostPath(hostPath) {
+				connected++
+				break
+			}
+		}
+	}
+	return connected, len(hostPaths)
+}
+
+func ioControllerKey(traddr string, trsvcid int, subsysnqn string) string {
+	// the controllers of link-local addresses are connected with the zone of the discovery
+	// controller, which the log page entries don't have.
+	traddr, _ = nvme.SplitZone(traddr)
+	return fmt.Sprintf("%s:%d/%s", traddr, trsvcid, subsysnqn)
+}
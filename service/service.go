@@ -24,51 +24,97 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/lightbitslabs/discovery-client/metrics"
 	"github.com/lightbitslabs/discovery-client/model"
 	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
+	"github.com/lightbitslabs/discovery-client/pkg/dhchapkeys"
 	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/hostroute"
+	"github.com/lightbitslabs/discovery-client/pkg/iofilter"
 	"github.com/lightbitslabs/discovery-client/pkg/nvme"
 	"github.com/lightbitslabs/discovery-client/pkg/nvmeclient"
 )
 
 const (
-	kato            = time.Duration(30 * time.Second) //keep alive time out for a persistent connection. TODO: make it configurable
-	nvmeTCPDiscPort = uint16(8009)
+	kato = time.Duration(30 * time.Second) //keep alive time out for a persistent connection. TODO: make it configurable
 )
 
-type aenNotification struct {
-	conn *clientconfig.Connection
-	aen  hostapi.AENStruct
-}
-
 type Service interface {
 	Start() error
 	Stop() error
+	// Reload applies a configuration reloaded while the service is running.
+	// settings are used from the next connect/reconnect attempt on.
+	Reload(cfg model.AppConfig)
+}
+
+// settings of the service that may be changed on reload.
+type settings struct {
+	backoff     model.BackoffConfig
+	maxIOQueues int
+	kato        int
+	// discoveryConnections is the number of persistent discovery connections per cluster.
+	discoveryConnections int
+	// ioFilter is the global IO controllers filter, compiled from cfg.
+	ioFilter *iofilter.Filter
+	// hostTraddrSelector picks the host traddr of the connections, nil if disabled.
+	hostTraddrSelector *hostroute.Selector
+	cfg                model.AppConfig
 }
 
+// the service runs a supervisor goroutine (see Start) that handles cache updates,
+// configuration reloads and reconciliation ticks, and a worker goroutine per
+// client-cluster pair (see clusterWorker) that connects to the cluster and
+// handles its AENs. a slow cluster therefore does not hold up the others.
 type service struct {
-	cache             clientconfig.Cache
-	connections       clientconfig.ConnectionMap
-	ctx               context.Context
-	cancel            context.CancelFunc
-	log               *logrus.Entry
-	aggregateChan     chan *aenNotification
-	hostAPI           hostapi.HostAPI
-	wg                *sync.WaitGroup
-	reconnectInterval time.Duration
-	maxIOQueues       int
-	kato              int
-	cfg               model.AppConfig
+	cache   clientconfig.Cache
+	ctx     context.Context
+	cancel  context.CancelFunc
+	log     *logrus.Entry
+	hostAPI hostapi.HostAPI
+	wg      *sync.WaitGroup
+
+	// mu protects connections, workers and multiplexed.
+	mu          sync.Mutex
+	connections clientconfig.ConnectionMap
+	workers     map[clientconfig.ClientClusterPair]*clusterWorker
+	// multiplexed are the connections whose AENs are forwarded to their worker.
+	multiplexed map[*clientconfig.Connection]bool
+
+	settingsLock sync.RWMutex
+	settings     settings
+
+	reloadCh chan model.AppConfig
+	// crashedCh reports workers that stopped on a panic to the supervisor.
+	crashedCh       chan *clusterWorker
+	reconcileTicker *time.Ticker
+
+	// endpoints is used to pick the discovery endpoint to connect to in each cluster.
+	endpoints   *endpointStats
+	probeTicker *time.Ticker
+
+	// dhChapKeys are the secrets of the DH-CHAP key files, nil if there is no key dir.
+	dhChapKeys *dhchapkeys.Store
+	// dhChapKeysCh reports the key files whose secrets changed.
+	dhChapKeysCh <-chan []string
 }
 
 func NewServiceExtended(ctx context.Context, cache clientconfig.Cache, hostAPI hostapi.HostAPI, cfg model.AppConfig) Service {
-	s := &service{
-		log:               logrus.WithFields(logrus.Fields{}),
-		cache:             cache,
-		hostAPI:           hostAPI,
-		reconnectInterval: cfg.ReconnectInterval,
-		maxIOQueues:       cfg.MaxIOQueues,
-		kato:              cfg.Kato,
+	s := newService(ctx, cache, hostAPI, settings{
+		backoff:              cfg.ReconnectBackoff,
+		maxIOQueues:          cfg.MaxIOQueues,
+		kato:                 cfg.Kato,
+		discoveryConnections: cfg.DiscoveryConnections,
+		ioFilter:             compileIOFilter(&cfg),
+		hostTraddrSelector:   compileHostTraddrSelector(&cfg),
+		cfg:                  cfg,
+	})
+	if cfg.DhChapKeyDir != "" {
+		s.dhChapKeys = dhchapkeys.NewStore(cfg.DhChapKeyDir)
+	}
+	nvmeclient.SetConnectConcurrency(cfg.ConnectConcurrency.PerCluster, cfg.ConnectConcurrency.Global)
+	if cfg.DryRun {
+		nvmeclient.SetDryRun(true)
+		logrus.Warnf("Starting service in dry-run mode, IO controllers will not be connected or disconnected")
 	}
 
 	// Set the auxiliary suffix for NVMe connections
@@ -76,104 +122,229 @@ func NewServiceExtended(ctx context.Context, cache clientconfig.Cache, hostAPI h
 		nvmeclient.SetAuxSuffix(cfg.AuxSuffix)
 		logrus.Infof("Starting service using auxiliary subsystem with suffix %s", cfg.AuxSuffix)
 	}
-	var wg sync.WaitGroup
-	s.wg = &wg
-	s.ctx, s.cancel = context.WithCancel(ctx)
-	s.cfg = cfg
-	s.connections = make(clientconfig.ConnectionMap)
-	s.aggregateChan = make(chan *aenNotification, 16)
 	return s
 }
 
 func NewService(ctx context.Context, cache clientconfig.Cache, hostAPI hostapi.HostAPI, reconnectInterval time.Duration, maxIOQueues int, kato int, aux string) Service {
-	s := &service{
-		log:               logrus.WithFields(logrus.Fields{}),
-		cache:             cache,
-		hostAPI:           hostAPI,
-		reconnectInterval: reconnectInterval,
-		maxIOQueues:       maxIOQueues,
-		kato:              kato,
-	}
+	// reconnect every reconnectInterval, without growing the delay.
+	s := newService(ctx, cache, hostAPI, settings{
+		backoff: model.BackoffConfig{
+			InitialDelay: reconnectInterval,
+			Multiplier:   1,
+			MaxDelay:     reconnectInterval,
+		},
+		maxIOQueues:          maxIOQueues,
+		kato:                 kato,
+		discoveryConnections: 1,
+	})
 
 	// Set the auxiliary suffix for NVMe connections
 	if aux != "" {
 		nvmeclient.SetAuxSuffix(aux)
 		logrus.Infof("Starting service using auxiliary subsystem with suffix %s", aux)
 	}
+	return s
+}
+
+func newService(ctx context.Context, cache clientconfig.Cache, hostAPI hostapi.HostAPI, settings settings) *service {
+	s := &service{
+		log:      logrus.WithFields(logrus.Fields{}),
+		cache:    cache,
+		hostAPI:  hostAPI,
+		settings: settings,
+	}
 	var wg sync.WaitGroup
 	s.wg = &wg
 	s.ctx, s.cancel = context.WithCancel(ctx)
 	s.connections = make(clientconfig.ConnectionMap)
-	s.aggregateChan = make(chan *aenNotification, 16)
+	s.workers = make(map[clientconfig.ClientClusterPair]*clusterWorker)
+	s.multiplexed = make(map[*clientconfig.Connection]bool)
+	s.reloadCh = make(chan model.AppConfig)
+	s.crashedCh = make(chan *clusterWorker)
+	s.endpoints = newEndpointStats()
 	return s
 }
 
-func (s *service) Discover(req *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
-	logPageEntries, id, err := s.hostAPI.Discover(req)
+func (s *service) getSettings() settings {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.settings
+}
+
+func (s *service) Discover(req *hostapi.DiscoverRequest) (*hostapi.LogPage, hostapi.ConnectionID, error) {
+	logPage, id, err := s.hostAPI.Discover(req)
 	if err != nil {
 		var perr *nvmeclient.NvmeClientError
 		if errors.As(err, &perr) {
 			if perr.Status != nvmeclient.DISC_NO_LOG {
 				return nil, id, perr
 			}
-			return logPageEntries, id, nil
+			if logPage == nil {
+				logPage = &hostapi.LogPage{}
+			}
+			return logPage, id, nil
 		}
 		return nil, id, err
 	}
-	return logPageEntries, id, nil
+	return logPage, id, nil
 }
 
-func (s *service) getLogPageEntries(conn *clientconfig.Connection, kato time.Duration) ([]*hostapi.NvmeDiscPageEntry, []*hostapi.NvmeDiscPageEntry, *hostapi.DiscoverRequest, error) {
-	request := conn.GetDiscoveryRequest(kato)
-	logPageEntries, id, err := s.Discover(request)
+// discoveryLogPage is a discovery log page received through conn, split by subtype.
+type discoveryLogPage struct {
+	conn        *clientconfig.Connection
+	request     *hostapi.DiscoverRequest
+	genCtr      uint64
+	nvmeEntries []*hostapi.NvmeDiscPageEntry
+	referrals   []*hostapi.NvmeDiscPageEntry
+	// identify is the Identify Controller data of the discovery controller, nil if unknown.
+	identify *nvme.IdentifyController
+}
+
+func (s *service) getLogPageEntries(conn *clientconfig.Connection, kato time.Duration) (*discoveryLogPage, error) {
+	request, err := s.discoveryRequest(conn, kato)
+	if err != nil {
+		conn.SetState(false)
+		return nil, err
+	}
+	logPage, id, err := s.Discover(request)
 	//In case the connection is persistent keep the connection id
 	if kato > 0 && err == nil {
-		conn.ConnectionID = id
+		conn.SetConnectionID(id)
 		s.log.Debugf("Added ID %v to %s", id, conn)
 	}
 	if err != nil {
 		conn.SetState(false)
-		return nil, nil, nil, err
+		return nil, err
 	}
 	conn.SetState(true)
-	pair := clientconfig.ClientClusterPair{
-		ClusterNqn: conn.Key.Nqn,
-		HostNqn:    conn.Hostnqn,
-	}
-	clientClusterConnections := s.connections[pair]
-	clientClusterConnections.ActiveConnection = conn
-	s.connections[pair] = clientClusterConnections
-	s.log.Debugf("Run Discovery on connection %q and got %d log page entries", conn.Key.Ip, len(logPageEntries))
+	logPageEntries := logPage.Entries
+	s.log.Debugf("Run Discovery on connection %q and got %d log page entries, generation %d", conn.Address(), len(logPageEntries), logPage.GenCtr)
 	nvmeLogPageEntries := []*hostapi.NvmeDiscPageEntry{}
 	discLogPageEntries := []*hostapi.NvmeDiscPageEntry{}
 	for _, entry := range logPageEntries {
 		switch entry.SubType {
 		case nvme.NVME_NQN_NVME:
 			nvmeLogPageEntries = append(nvmeLogPageEntries, entry)
-		case nvme.NVME_NQN_DISC:
+		case nvme.NVME_NQN_DISC, nvme.NVME_NQN_CURR:
 			discLogPageEntries = append(discLogPageEntries, entry)
 		default:
 			s.log.Errorf("Unexpected subtype in logPageEntry: %+v", entry)
 		}
 	}
 	s.log.Debugf("got from tcp client %d nvme entries and %d referrals", len(nvmeLogPageEntries), len(discLogPageEntries))
-	// Add another log page entry of a referral to the sending server as it is not returned by the server
-	selfReferral := &hostapi.NvmeDiscPageEntry{
-		TrsvcID: nvmeTCPDiscPort,
-		Subnqn:  conn.Key.Nqn,
-		Traddr:  conn.Key.Ip,
-		SubType: nvme.NVME_NQN_DISC,
-	}
-	s.log.Debugf("Added self referral %+v", selfReferral)
-	discLogPageEntries = append(discLogPageEntries, selfReferral)
-	s.log.Debugf("After adding self referral, len(discLogPageEntries) = %d", len(discLogPageEntries))
-	return nvmeLogPageEntries, discLogPageEntries, request, nil
+	page := &discoveryLogPage{
+		conn:        conn,
+		request:     request,
+		genCtr:      logPage.GenCtr,
+		nvmeEntries: nvmeLogPageEntries,
+		referrals:   discLogPageEntries,
+		identify:    logPage.Identify,
+	}
+	if !page.hasCurrentEntries() {
+		// targets that predate TP8013 don't report the discovery subsystem that sent the
+		// log page. add a referral to the sending server, so it remains an endpoint of the cluster.
+		selfReferral := &hostapi.NvmeDiscPageEntry{
+			TrsvcID:   uint16(conn.Key.Port()),
+			Subnqn:    conn.Key.Nqn,
+			Traddr:    conn.Key.Ip,
+			SubType:   nvme.NVME_NQN_DISC,
+			Transport: request.Transport,
+		}
+		s.log.Debugf("Added self referral %+v", selfReferral)
+		page.referrals = append(page.referrals, selfReferral)
+	}
+	return page, nil
 }
 
-// On a new connection, add it to the connections that multiplex AEN events to the service AEN channel
+// hasCurrentEntries returns true if the log page reports the ports of the discovery subsystem
+// that sent it (NVME_NQN_CURR entries). the EFLAGS of its entries are only set by such targets.
+func (p *discoveryLogPage) hasCurrentEntries() bool {
+	for _, entry := range p.referrals {
+		if entry.SubType == nvme.NVME_NQN_CURR {
+			return true
+		}
+	}
+	return false
+}
+
+// notifiesChanges returns false if the discovery controller of the log page doesn't send
+// AENs when the log page changes. controllers that were not identified are assumed to.
+func (p *discoveryLogPage) notifiesChanges() bool {
+	return p.identify == nil || p.identify.DiscoveryLogChangeNotices()
+}
+
+// supportsPersistentConnection returns false if the log page reports that the discovery
+// controller of conn doesn't support explicit persistent connections (EPCSD cleared).
+func (p *discoveryLogPage) supportsPersistentConnection(conn *clientconfig.Connection) bool {
+	if !p.hasCurrentEntries() {
+		return true
+	}
+	traddr, _ := nvme.SplitZone(conn.Key.Ip)
+	for _, entry := range p.referrals {
+		if entry.Traddr == traddr && int(entry.TrsvcID) == conn.Key.Port() {
+			return entry.Eflags&nvme.NVMF_DISC_EFLAGS_EPCSD != 0
+		}
+	}
+	return true
+}
+
+// disconnect closes the persistent discovery connection of conn, if it has one.
+func (s *service) disconnect(conn *clientconfig.Connection) {
+	id := conn.ClearConnectionID()
+	if id == "" {
+		return
+	}
+	if err := s.hostAPI.Disconnect(id); err != nil {
+		s.log.WithError(err).Errorf("failed to disconnect %s (id %s)", conn, id)
+	}
+}
+
+// setActiveConnection records conn as the active connection of the cluster, if the cluster was not removed.
+func (s *service) setActiveConnection(pair clientconfig.ClientClusterPair, conn *clientconfig.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if clientClusterConnections, ok := s.connections[pair]; ok {
+		clientClusterConnections.ActiveConnection = conn
+		s.connections[pair] = clientClusterConnections
+	}
+}
+
+// clusterConnectionsList returns the connections of the cluster in the order they
+// should be tried, according to the endpoint selection settings.
+func (s *service) clusterConnectionsList(pair clientconfig.ClientClusterPair) []*clientconfig.Connection {
+	s.mu.Lock()
+	clientClusterConnections, ok := s.connections[pair]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	connections := clientClusterConnections.GetConnectionList()
+	s.mu.Unlock()
+	selection := s.getSettings().cfg.EndpointSelection
+	connections = newEndpointSelector(selection.Policy, s.endpoints).order(pair, connections)
+	return preferLocality(connections, selection.Locality)
+}
+
+// On a new connection, forward the AEN events of the connection to the worker of its cluster
 func (s *service) multiplexNewConnection(conn *clientconfig.Connection) {
+	pair := clientconfig.ClientClusterPair{
+		ClusterNqn: conn.Key.Nqn,
+		HostNqn:    conn.Hostnqn,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.multiplexed[conn] {
+		return
+	}
+	s.multiplexed[conn] = true
+	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.multiplexed, conn)
+			s.mu.Unlock()
+		}()
 		for {
 			select {
 			case <-conn.Ctx.Done():
@@ -187,122 +358,82 @@ func (s *service) multiplexNewConnection(conn *clientconfig.Connection) {
 				if event.ServerChange != nil {
 					s.log.Warnf("%s keep alive failed: %s", conn, event.ServerChange.Error())
 					conn.SetState(false)
-					s.aggregateChan <- &aenNotification{conn, event}
+					s.notifyWorker(pair, func(events *workerEvents) {
+						events.addLost(conn)
+					})
 					return
 				}
 				s.log.Debugf("aen on %s", conn)
-				aen := hostapi.AENStruct{
-					AenChange:    true,
-					ServerChange: nil,
-				}
-				s.aggregateChan <- &aenNotification{conn, aen}
+				s.notifyWorker(pair, func(events *workerEvents) {
+					events.addAEN(conn)
+				})
 			}
 		}
 	}()
 }
 
+// notifyWorker hands events to the worker of the cluster. it never blocks.
+func (s *service) notifyWorker(pair clientconfig.ClientClusterPair, update func(events *workerEvents)) {
+	s.mu.Lock()
+	w, ok := s.workers[pair]
+	s.mu.Unlock()
+	if !ok {
+		s.log.Debugf("ignoring notification on cluster %+v, cluster was removed", pair)
+		return
+	}
+	w.notify(update)
+}
+
 // Start run logic of discovery client
 func (s *service) Start() error {
 	if err := s.cache.Run(true); err != nil {
 		return err
 	}
 
-	triggerReconnectToClusterCh := make(chan clientconfig.ClientClusterPair)
+	cfg := s.getSettings().cfg
+	s.setReconcileInterval(cfg.ReconcileInterval)
+	s.setProbeInterval(cfg.EndpointSelection.Policy, cfg.EndpointSelection.ProbeInterval)
+	if s.dhChapKeys != nil {
+		s.dhChapKeys.Load()
+		ch, err := s.dhChapKeys.Watch(s.ctx)
+		if err != nil {
+			s.log.WithError(err).Errorf("failed to watch DH-CHAP key dir %s, changes of the key files are not applied", cfg.DhChapKeyDir)
+		}
+		s.dhChapKeysCh = ch
+	}
 
 	go func() {
-		var stopCh chan bool
+		defer func() {
+			if s.reconcileTicker != nil {
+				s.reconcileTicker.Stop()
+			}
+			if s.probeTicker != nil {
+				s.probeTicker.Stop()
+			}
+		}()
 		for {
 			select {
-			case clusterMapId := <-triggerReconnectToClusterCh:
-				// first - close any running scheduler for reconnect
-				if stopCh != nil {
-					close(stopCh)
-					stopCh = nil
-				}
-				err := s.reconnectToCluster(clusterMapId)
-				if err != nil {
-					// reconnect failed. will schedule a reconnect goroutine.
-					// create a new goroutine that would try to reconnect.
-					ticker := time.NewTicker(s.reconnectInterval)
-					stopCh = make(chan bool, 1)
-					go func() {
-						defer ticker.Stop()
-						s.log.Infof("%s. schedule reconnect in %s", err, s.reconnectInterval)
-						select {
-						case <-ticker.C:
-							triggerReconnectToClusterCh <- clusterMapId
-						case <-stopCh:
-							return
-						}
-					}()
-				}
 			case connections := <-s.cache.Connections():
 				// this case hit when the cache is updated with new/removed connections.
 				// we would need to refresh the current connection list and invoke connectCluster.
 				s.log.Debug("received notification on changes in connections")
-				// remove from service connections that are no longer in cache
-				modified := make(map[clientconfig.ClientClusterPair]bool)
-				s.removeConnections(connections, modified)
-				// update service connections with new connections
-				s.addConnections(connections, modified)
-				for clusterMapId, clientClusterConnections := range s.connections {
-					if mod, ok := modified[clusterMapId]; !ok || !mod {
-						continue
-					}
-					if clientClusterConnections.ActiveConnection != nil {
-						s.log.Debugf("already connected to cluster %+v", clusterMapId)
-						continue
-					}
-					s.log.Debugf("connecting service to cluster: %v", clusterMapId)
-					go func(clusterMapId clientconfig.ClientClusterPair) {
-						triggerReconnectToClusterCh <- clusterMapId
-					}(clusterMapId)
-				}
-			case aenAlert := <-s.aggregateChan:
-				// this case hit when we got AEN notification and we need to call getLogPage.
-				// this will then iterate over all log-pages and will connect to all.
-				if aenAlert != nil {
-					conn := aenAlert.conn
-					clusterMapId := clientconfig.ClientClusterPair{
-						ClusterNqn: conn.Key.Nqn,
-						HostNqn:    conn.Hostnqn,
-					}
-					aen := aenAlert.aen
-					// meaning we have a new server in the cluster and we would want to invoke reconnect.
-					if aen.ServerChange != nil {
-						go func() {
-							triggerReconnectToClusterCh <- clusterMapId
-						}()
-						continue
-					}
-					s.log.Debugf("received notification through aggregate chan on %s", conn)
-					nvmeLogPageEntries, discLogPageEntries, request, err := s.getLogPageEntries(conn, time.Duration(0))
-					if err != nil {
-						// failed issuing get-log-page command, meaning we should try
-						// to reconnect to the cluster - probably different service, that would provide better answer.
-						s.log.WithError(err).Errorf("error in receiving log page entries through %s. Start reconnect process", conn)
-						conn.SetState(false)
-						go func() {
-							triggerReconnectToClusterCh <- clusterMapId
-						}()
-						continue
-					}
-					nvmeclient.ConnectAllNVMEDevices(nvmeLogPageEntries,
-						request.Hostnqn,
-						conn.Hostid,
-						request.Transport,
-						s.maxIOQueues, s.kato, conn.CtrlLossTMO, &s.cfg)
-					refMap := clientconfig.ReferralMap{}
-					for _, referral := range discLogPageEntries {
-						refKey := clientconfig.ReferralKey{
-							Ip:       referral.Traddr,
-							Port:     referral.TrsvcID,
-							DPSubNqn: conn.Key.Nqn,
-							Hostnqn:  conn.Hostnqn}
-						refMap[refKey] = referral
-					}
-					s.cache.HandleReferrals(refMap)
+				s.handleConnectionsChange(connections)
+			case w := <-s.crashedCh:
+				s.restartWorker(w)
+			case <-s.reconcileCh():
+				s.mu.Lock()
+				for _, w := range s.workers {
+					w.notify(func(events *workerEvents) {
+						events.reconcile = true
+					})
 				}
+				s.mu.Unlock()
+			case <-s.probeCh():
+				s.probeEndpoints()
+			case changed := <-s.dhChapKeysCh:
+				s.dhChapKeysChanged(changed)
+			case cfg := <-s.reloadCh:
+				s.applyConfig(cfg)
 			case <-s.ctx.Done():
 				s.log.Infof("exiting the main func ctx done")
 				return
@@ -312,38 +443,112 @@ func (s *service) Start() error {
 	return nil
 }
 
-// pair would be the identifier of the cluster we want to connect to.
-// the DC support multiple clusters at the same time, and this method will
-// try to connect to single DS service in cluster defined by `pair`
-func (s *service) reconnectToCluster(clusterMapId clientconfig.ClientClusterPair) error {
-	clientClusterConnections, ok := s.connections[clusterMapId]
-	if !ok || len(clientClusterConnections.ClusterConnectionsMap) == 0 {
-		s.log.Errorf("cannot connect to cluster with subsysNQN %s from client with hostnqn %s. no connections found",
-			clusterMapId.ClusterNqn, clusterMapId.HostNqn)
-		return nil
+func (s *service) handleConnectionsChange(connections clientconfig.ConnectionMap) {
+	s.mu.Lock()
+	// remove from service connections that are no longer in cache
+	modified := make(map[clientconfig.ClientClusterPair]bool)
+	removedClusters := s.removeConnections(connections, modified)
+	// update service connections with new connections
+	s.addConnections(connections, modified)
+	for clusterMapId, clientClusterConnections := range s.connections {
+		if mod, ok := modified[clusterMapId]; !ok || !mod {
+			continue
+		}
+		w, ok := s.workers[clusterMapId]
+		if !ok {
+			w = s.startWorker(clusterMapId)
+		}
+		if clientClusterConnections.ActiveConnection != nil {
+			s.log.Debugf("already connected to cluster %+v", clusterMapId)
+			continue
+		}
+		s.log.Debugf("connecting service to cluster: %v", clusterMapId)
+		w.notify(func(events *workerEvents) {
+			events.connect = true
+			events.reapply = true
+		})
+	}
+	s.mu.Unlock()
+	for _, clusterMapId := range removedClusters {
+		s.removeCluster(clusterMapId)
 	}
-	clusterConnectionsList := clientClusterConnections.GetRandomConnectionList()
+}
 
-	s.log.Infof("trying to connect to cluster %s as hostnqn %s", clusterMapId.ClusterNqn, clusterMapId.HostNqn)
-	aen := hostapi.AENStruct{
-		AenChange:    true,
-		ServerChange: nil,
+// startWorker must be called with s.mu held.
+func (s *service) startWorker(clusterMapId clientconfig.ClientClusterPair) *clusterWorker {
+	w := newClusterWorker(s, clusterMapId)
+	s.workers[clusterMapId] = w
+	s.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// restartWorker starts a new worker in place of a worker that crashed,
+// unless the cluster was removed in the meantime.
+func (s *service) restartWorker(crashed *clusterWorker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.workers[crashed.pair] != crashed {
+		return
 	}
-	conn, err := s.getLiveConnection(clusterConnectionsList, clusterMapId.ClusterNqn)
-	if err != nil {
-		return err
+	if _, ok := s.connections[crashed.pair]; !ok {
+		delete(s.workers, crashed.pair)
+		return
 	}
-	s.multiplexNewConnection(conn)
-	s.wg.Add(1)
-	s.log.Debugf("pushing AEN notification to live %s to trigger discovery on new connection", conn)
+	s.log.Warnf("restarting worker of cluster %+v", crashed.pair)
+	w := s.startWorker(crashed.pair)
+	w.notify(func(events *workerEvents) {
+		events.connect = true
+	})
+}
+
+func (s *service) Reload(cfg model.AppConfig) {
 	select {
-	case conn.AENChan <- aen:
-	case <-time.After(5 * time.Second):
-		s.log.Warnf("Failed to send AEN notification to AEN channel after 5 seconds, dropping notification")
+	case s.reloadCh <- cfg:
+	case <-s.ctx.Done():
 	}
+}
 
-	s.log.Debugf("returned from pushing AEN notification to live %s to trigger discovery on new connection", conn)
-	return nil
+// applyConfig is called from the supervisor goroutine of the service.
+// workers pick up the new settings on their next connect.
+func (s *service) applyConfig(cfg model.AppConfig) {
+	s.log.Infof("applying reloaded configuration: reconnectBackoff: %+v, maxIOQueues: %d, kato: %d, ctrlLossTMO: %d, ioControllersOnRemoval: %s",
+		cfg.ReconnectBackoff, cfg.MaxIOQueues, cfg.Kato, cfg.CtrlLossTMO, cfg.IOControllersOnRemoval)
+	s.settingsLock.Lock()
+	previous := s.settings.cfg
+	s.settings = settings{
+		backoff:              cfg.ReconnectBackoff,
+		maxIOQueues:          cfg.MaxIOQueues,
+		kato:                 cfg.Kato,
+		discoveryConnections: cfg.DiscoveryConnections,
+		ioFilter:             compileIOFilter(&cfg),
+		hostTraddrSelector:   compileHostTraddrSelector(&cfg),
+		cfg:                  cfg,
+	}
+	s.settingsLock.Unlock()
+	// clusters that ran out of connect attempts get a new retry budget.
+	s.mu.Lock()
+	for _, w := range s.workers {
+		w.notify(func(events *workerEvents) {
+			events.resume = true
+			events.reapply = true
+		})
+	}
+	s.mu.Unlock()
+	if previous.DhChapSecret != cfg.DhChapSecret || previous.DhChapCtrlSecret != cfg.DhChapCtrlSecret {
+		s.log.Infof("DH-CHAP secrets changed, will be used for the next IO controllers connect")
+	}
+	if previous.ConnectConcurrency != cfg.ConnectConcurrency {
+		s.log.Infof("IO controllers connect concurrency: %+v", cfg.ConnectConcurrency)
+		nvmeclient.SetConnectConcurrency(cfg.ConnectConcurrency.PerCluster, cfg.ConnectConcurrency.Global)
+	}
+	if previous.ReconcileInterval != cfg.ReconcileInterval {
+		s.setReconcileInterval(cfg.ReconcileInterval)
+	}
+	if previous.EndpointSelection != cfg.EndpointSelection {
+		s.log.Infof("discovery endpoint selection: %+v", cfg.EndpointSelection)
+		s.setProbeInterval(cfg.EndpointSelection.Policy, cfg.EndpointSelection.ProbeInterval)
+	}
 }
 
 // this method will iterate over all connections and will try to issue a Discover command.
@@ -351,8 +556,8 @@ func (s *service) reconnectToCluster(clusterMapId clientconfig.ClientClusterPair
 func (s *service) getLiveConnection(connections []*clientconfig.Connection, subsysNqn string) (*clientconfig.Connection, error) {
 	var connectionIPs []string
 	for _, conn := range connections {
-		connectionIPs = append(connectionIPs, conn.Key.Ip)
-		_, _, _, err := s.getLogPageEntries(conn, kato)
+		connectionIPs = append(connectionIPs, conn.Address())
+		_, err := s.getLogPageEntries(conn, kato)
 		if err == nil {
 			s.log.Infof("connected successfully to cluster %s with %s after trying %+v",
 				subsysNqn, conn, connectionIPs)
@@ -366,10 +571,13 @@ func (s *service) getLiveConnection(connections []*clientconfig.Connection, subs
 // iterate over all cluster-connections.
 // for each cluster-connection verify that current connection exists in the new cache-connections Map
 // if exists leave it, if does not exists remove the connection and disconnect it.
+// returns the clusters that have no connections left.
+// must be called with s.mu held.
 func (s *service) removeConnections(
 	fromCache clientconfig.ConnectionMap,
 	modified map[clientconfig.ClientClusterPair]bool,
-) {
+) []clientconfig.ClientClusterPair {
+	removedClusters := []clientconfig.ClientClusterPair{}
 	for clusterMapId, cachedClusterConnections := range fromCache {
 		serviceClusterConnections, ok := s.connections[clusterMapId]
 		if !ok {
@@ -384,28 +592,65 @@ func (s *service) removeConnections(
 			if !cachedClusterConnections.Exists(conn) {
 				log := s.log.WithField("subsys-nqn", conn.Key.Nqn).
 					WithField("ip", conn.Key.Ip).
-					WithField("id", conn.ConnectionID)
+					WithField("id", conn.GetConnectionID())
 
 				log.Infof("remove from service connections")
+				// the connection may be one of the redundant persistent connections of the cluster.
+				s.disconnect(conn)
 				if serviceClusterConnections.ActiveConnection == conn {
-					log.Debugf("disconnecting active connection and setting active connection to nil")
-					if err := s.hostAPI.Disconnect(conn.ConnectionID); err != nil {
-						log.WithError(err).Errorf("disconnecting connection")
-					}
+					log.Debugf("setting active connection to nil")
 					serviceClusterConnections.ActiveConnection = nil
 				}
 				log.Debugf("deleting connection from service connections")
 				delete(serviceClusterConnections.ClusterConnectionsMap, key)
+				s.endpoints.forgetConnection(clusterMapId, conn)
 				conn.Stop()
 				modified[clusterMapId] = true
 			}
 		}
+		if len(serviceClusterConnections.ClusterConnectionsMap) == 0 {
+			delete(s.connections, clusterMapId)
+			if w, ok := s.workers[clusterMapId]; ok {
+				w.stop()
+				delete(s.workers, clusterMapId)
+			}
+			removedClusters = append(removedClusters, clusterMapId)
+			modified[clusterMapId] = false
+			continue
+		}
+		s.connections[clusterMapId] = serviceClusterConnections
+	}
+	return removedClusters
+}
+
+// removeCluster is called once a cluster has no connections left in the cache,
+// i.e. its configuration file was removed. the discovery connections and the worker
+// of the cluster were already stopped by removeConnections, here we apply the
+// configured policy on the IO controllers.
+func (s *service) removeCluster(clusterMapId clientconfig.ClientClusterPair) {
+	metrics.Metrics.IOControllersMissing.DeleteLabelValues(clusterMapId.ClusterNqn, clusterMapId.HostNqn)
+	log := s.log.WithField("subsys-nqn", clusterMapId.ClusterNqn).
+		WithField("hostnqn", clusterMapId.HostNqn)
+	if s.getSettings().cfg.IOControllersOnRemoval != model.IOControllersDisconnect {
+		log.Infof("cluster removed, leaving its IO controllers connected")
+		return
+	}
+	devices, err := nvmeclient.DisconnectSubsystemControllers(clusterMapId.ClusterNqn, clusterMapId.HostNqn)
+	if err != nil {
+		log.WithError(err).Errorf("cluster removed, failed to disconnect its IO controllers")
+		return
+	}
+	if len(devices) == 0 {
+		log.Infof("cluster removed, no IO controllers to disconnect")
+		return
 	}
+	log.Infof("cluster removed, disconnected IO controllers: %v", devices)
 }
 
 // A function for dealing with new connections from cache
 // it will iterate over all cached conn and will look for a conn that does not exist
 // in current-connection map - if found it will add it to current list.
+// must be called with s.mu held.
 func (s *service) addConnections(
 	fromCache clientconfig.ConnectionMap,
 	modified map[clientconfig.ClientClusterPair]bool,
@@ -428,12 +673,13 @@ func (s *service) addConnections(
 // Stop run logic of discovery client
 func (s *service) Stop() error {
 	s.cancel()
+	s.mu.Lock()
 	for clientClusterPair, clusterConnections := range s.connections {
 		for key, conn := range clusterConnections.ClusterConnectionsMap {
 			log := s.log.WithField("subsys-nqn", conn.Key.Nqn).
 				WithField("ip", conn.Key.Ip).
-				WithField("id", conn.ConnectionID)
-			if err := s.hostAPI.Disconnect(conn.ConnectionID); err != nil {
+				WithField("id", conn.GetConnectionID())
+			if err := s.hostAPI.Disconnect(conn.GetConnectionID()); err != nil {
 				log.WithError(err).Errorf("Error in disconnecting connection %s", conn)
 			}
 			s.connections.DeleteConnection(clientClusterPair, key)
@@ -441,18 +687,9 @@ func (s *service) Stop() error {
 			conn.Stop()
 		}
 	}
-	//Clear the service aggregate channel before closing it
-	for i := 0; i < len(s.connections); i++ {
-		select {
-		case <-s.aggregateChan:
-		default:
-			break
-		}
-	}
-	s.log.Debug("Closing agg chan")
-	close(s.aggregateChan)
+	s.mu.Unlock()
 	s.cache.Stop()
-	s.log.Debug("Waiting for all multiplexing functions on all connections to return")
+	s.log.Debug("Waiting for all workers and multiplexing functions on all connections to return")
 	s.wg.Wait()
 	s.log.Debug("Finished stopping discovery client")
 	return nil
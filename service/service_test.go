@@ -15,19 +15,26 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/lightbitslabs/discovery-client/model"
 	"github.com/lightbitslabs/discovery-client/pkg/clientconfig"
 	"github.com/lightbitslabs/discovery-client/pkg/commonstructs"
+	"github.com/lightbitslabs/discovery-client/pkg/dhchapkeys"
 	"github.com/lightbitslabs/discovery-client/pkg/hostapi"
+	"github.com/lightbitslabs/discovery-client/pkg/iofilter"
 	"github.com/lightbitslabs/discovery-client/pkg/nvme"
+	"github.com/lightbitslabs/discovery-client/pkg/nvme/nvmeauth"
 	"github.com/lightbitslabs/discovery-client/pkg/nvmeclient"
 	"github.com/lightbitslabs/discovery-client/pkg/testutils"
 	"github.com/sirupsen/logrus"
@@ -41,6 +48,7 @@ const (
 	firstSubsysNQN           = "subsysnqn1"
 	secondSubsysNQN          = "subsysnqn2"
 	hostnqn                  = "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431"
+	hostid                   = "46f5a7b4-3b3a-4f4c-9a3e-0f3b0c7f4d2a"
 )
 
 type hostAPIMock struct{}
@@ -49,10 +57,30 @@ func NewHostAPIMock() hostapi.HostAPI {
 	return &hostAPIMock{}
 }
 
-var discoverMock func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error)
+type discoverFunc func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error)
 
-func (h *hostAPIMock) Discover(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
-	return discoverMock(discoveryRequest)
+var (
+	discoverMockLock sync.Mutex
+	discoverMock     discoverFunc
+)
+
+// setDiscoverMock replaces the discover implementation of the mock while service workers may be using it.
+func setDiscoverMock(f discoverFunc) {
+	discoverMockLock.Lock()
+	defer discoverMockLock.Unlock()
+	discoverMock = f
+}
+
+// mockGenCtr is the generation counter of the mocked log pages. every discover returns
+// a new generation, so that no log page is skipped as already processed.
+var mockGenCtr atomic.Uint64
+
+func (h *hostAPIMock) Discover(discoveryRequest *hostapi.DiscoverRequest) (*hostapi.LogPage, hostapi.ConnectionID, error) {
+	discoverMockLock.Lock()
+	f := discoverMock
+	discoverMockLock.Unlock()
+	entries, id, err := f(discoveryRequest)
+	return &hostapi.LogPage{GenCtr: mockGenCtr.Add(1), Entries: entries}, id, err
 }
 
 func (h *hostAPIMock) Disconnect(connectionID hostapi.ConnectionID) error {
@@ -79,6 +107,7 @@ func genFileContent(numEntries uint, subsysNQN string) string {
 			Traddr:    fmt.Sprintf("192.168.%d.%d", thirdIPVal, i),
 			Hostnqn:   hostnqn,
 			Nqn:       subsysNQN,
+			HostID:    hostid,
 		}
 		entries[i] = entry
 	}
@@ -101,6 +130,8 @@ func getServiceConnectionsOfCluster(S Service, pair clientconfig.ClientClusterPa
 	if !ok {
 		return nil, errors.New("Failed to convert Service interface to service struct to obtain connections")
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	connections := make([]*clientconfig.Connection, len(s.connections[pair].ClusterConnectionsMap))
 	index := 0
 	for _, conn := range s.connections[pair].ClusterConnectionsMap {
@@ -151,9 +182,9 @@ func getCid(discoveryRequest *hostapi.DiscoverRequest) hostapi.ConnectionID {
 func TestConnectionsExistAtServiceStart(t *testing.T) {
 	numEndpoints := uint(3)
 	//Verifying that connections are recognized when the discovery client starts with files existing in the discovery directory
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		return getReferrals(numEndpoints, discoveryRequest), getCid(discoveryRequest), nil
-	}
+	})
 	userDir := testutils.CreateTempDir(t)
 	defer os.RemoveAll(userDir)
 	internalDir := testutils.CreateTempDir(t)
@@ -166,10 +197,10 @@ func TestConnectionsExistAtServiceStart(t *testing.T) {
 	filePath := filepath.Join(userDir, fileName)
 	testutils.CreateFile(t, filePath, fileContent)
 	hostAPIMock := NewHostAPIMock()
-	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10)
+	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
 	serviceInterface.Start()
 	correctConnections := func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, numEndpoints)
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, numEndpoints)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", numEndpoints)
 	serviceInterface.Stop()
@@ -200,9 +231,9 @@ func TestConnectionsDualCluster(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			numEndpointsPerCluster := uint(3)
 			//Verifying that connections are recognized when the discovery client starts with files existing in the discovery directory
-			discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+			setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 				return getReferrals(numEndpointsPerCluster, discoveryRequest), getCid(discoveryRequest), nil
-			}
+			})
 			userDir := testutils.CreateTempDir(t)
 			defer os.RemoveAll(userDir)
 			internalDir := testutils.CreateTempDir(t)
@@ -218,7 +249,7 @@ func TestConnectionsDualCluster(t *testing.T) {
 				fileIndex += 1
 			}
 			hostAPIMock := NewHostAPIMock()
-			serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10)
+			serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
 			serviceInterface.Start()
 			for _, subsysNqn := range tc.clustersAddedAfterServiceStart {
 				fileContent := genFileContent(numEndpointsPerCluster, subsysNqn)
@@ -231,7 +262,7 @@ func TestConnectionsDualCluster(t *testing.T) {
 			allSubsysNqns = append(allSubsysNqns, tc.clustersAddedAfterServiceStart...)
 			for _, subsysNQN := range allSubsysNqns {
 				correctConnections := func() bool {
-					return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{subsysNQN, hostnqn}, numEndpointsPerCluster)
+					return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: subsysNQN, HostNqn: hostnqn}, numEndpointsPerCluster)
 				}
 				require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", numEndpointsPerCluster)
 			}
@@ -243,9 +274,9 @@ func TestConnectionsDualCluster(t *testing.T) {
 func TestConnectionsCreatedBeforeAndAfterServeiceStart(t *testing.T) {
 	//a case of files existing at monitored directory at service start and more files added later with partially overlapping connections
 	initialNumEndpoints := uint(3)
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		return getReferrals(initialNumEndpoints, discoveryRequest), getCid(discoveryRequest), nil
-	}
+	})
 	userDir := testutils.CreateTempDir(t)
 	defer os.RemoveAll(userDir)
 	internalDir := testutils.CreateTempDir(t)
@@ -257,11 +288,11 @@ func TestConnectionsCreatedBeforeAndAfterServeiceStart(t *testing.T) {
 	fileContent := genFileContent(initialNumEndpoints, firstSubsysNQN)
 	filePath := filepath.Join(userDir, fileName)
 	hostAPIMock := NewHostAPIMock()
-	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10)
+	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
 	testutils.CreateFile(t, filePath, fileContent)
 	serviceInterface.Start()
 	correctConnections := func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, initialNumEndpoints)
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, initialNumEndpoints)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", initialNumEndpoints)
 
@@ -274,6 +305,7 @@ func TestConnectionsCreatedBeforeAndAfterServeiceStart(t *testing.T) {
 			Traddr:    "192.168.1.2",
 			Hostnqn:   "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431",
 			Nqn:       "subsysnqn1",
+			HostID:    hostid,
 		},
 		{ //New endpoint
 			Transport: "tcp",
@@ -281,6 +313,7 @@ func TestConnectionsCreatedBeforeAndAfterServeiceStart(t *testing.T) {
 			Traddr:    "192.168.1.3",
 			Hostnqn:   "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431",
 			Nqn:       "subsysnqn1",
+			HostID:    hostid,
 		},
 		{ //New endpoint
 			Transport: "tcp",
@@ -288,17 +321,18 @@ func TestConnectionsCreatedBeforeAndAfterServeiceStart(t *testing.T) {
 			Traddr:    "192.168.1.4",
 			Hostnqn:   "nqn.2014-08.com.example:nvme:nvm-subsystem-sn-d78431",
 			Nqn:       "subsysnqn1",
+			HostID:    hostid,
 		},
 	}
 	numExpectedConnections := uint(5) // 3 from first file 2 new ones from the second
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		return getReferrals(numExpectedConnections, discoveryRequest), getCid(discoveryRequest), nil
-	}
+	})
 	file2Content := commonstructs.EntriesToString(newEntries)
 	file2Path := filepath.Join(userDir, file2Name)
 	testutils.CreateFile(t, file2Path, file2Content)
 	correctConnections = func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, numExpectedConnections)
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, numExpectedConnections)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", numExpectedConnections)
 	serviceInterface.Stop()
@@ -307,9 +341,9 @@ func TestConnectionsCreatedBeforeAndAfterServeiceStart(t *testing.T) {
 func TestConnectionAENNotification(t *testing.T) {
 	//Testing a case of connection notifying change through its AEN channel
 	numEndpoints := uint(3)
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		return getReferrals(numEndpoints, discoveryRequest), getCid(discoveryRequest), nil
-	}
+	})
 	userDir := testutils.CreateTempDir(t)
 	defer os.RemoveAll(userDir)
 	internalDir := testutils.CreateTempDir(t)
@@ -321,14 +355,14 @@ func TestConnectionAENNotification(t *testing.T) {
 	fileContent := genFileContent(numEndpoints, firstSubsysNQN)
 	filePath := filepath.Join(userDir, fileName)
 	hostAPIMock := NewHostAPIMock()
-	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10)
+	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
 	serviceInterface.Start()
 	testutils.CreateFile(t, filePath, fileContent)
 	correctConnections := func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, numEndpoints)
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, numEndpoints)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", numEndpoints)
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		entries := getReferrals(numEndpoints, discoveryRequest)
 		nvmeEntry := &hostapi.NvmeDiscPageEntry{
 			PortID:  1,
@@ -340,7 +374,7 @@ func TestConnectionAENNotification(t *testing.T) {
 		}
 		entries = append(entries, nvmeEntry)
 		return entries, getCid(discoveryRequest), nil
-	}
+	})
 	pair := clientconfig.ClientClusterPair{
 		ClusterNqn: firstSubsysNQN,
 		HostNqn:    hostnqn,
@@ -348,13 +382,13 @@ func TestConnectionAENNotification(t *testing.T) {
 	connections, _ := getServiceConnectionsOfCluster(serviceInterface, pair)
 	var conn *clientconfig.Connection
 	for _, c := range connections {
-		if c.State == true {
+		if c.GetState() {
 			conn = c
 			break
 		}
 	}
 	require.NotNil(t, conn, "Failed to find a connection with state true")
-	aenStruct := hostapi.AENStruct{true, nil}
+	aenStruct := hostapi.AENStruct{AenChange: true, ServerChange: nil}
 	t.Log("Going to send notification through AENChan")
 	conn.AENChan <- aenStruct
 	t.Log("Going to stop service")
@@ -363,9 +397,9 @@ func TestConnectionAENNotification(t *testing.T) {
 }
 
 func TestDiscoveryNoLogPageEntries(t *testing.T) {
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		return nil, getCid(discoveryRequest), &nvmeclient.NvmeClientError{Status: nvmeclient.DISC_NO_LOG, Msg: "no log entries", Err: nil}
-	}
+	})
 	userDir := testutils.CreateTempDir(t)
 	defer os.RemoveAll(userDir)
 	internalDir := testutils.CreateTempDir(t)
@@ -378,11 +412,11 @@ func TestDiscoveryNoLogPageEntries(t *testing.T) {
 	fileContent := genFileContent(numEndpoints, firstSubsysNQN)
 	filePath := filepath.Join(userDir, fileName)
 	hostAPIMock := NewHostAPIMock()
-	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10)
+	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
 	serviceInterface.Start()
 	testutils.CreateFile(t, filePath, fileContent)
 	correctConnections := func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, 1)
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, 1)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*500, "number of expected connections, 0, not reached")
 	serviceInterface.Stop()
@@ -393,14 +427,14 @@ func TestFailedConnection(t *testing.T) {
 	// Discovery succeeds on 6, on one connection Discovery returns an error
 	// Verify 6 connetions in OK state, one failed
 	numEndpoints := uint(7)
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		if discoveryRequest.Traddr != "192.168.1.0" {
 			return getReferrals(numEndpoints, discoveryRequest), getCid((discoveryRequest)), nil
 		}
 		// on connection to "192.168.1.0" return error
 		err := errors.New("discoverMock is on strike today. Come another time")
 		return nil, getCid(discoveryRequest), &nvmeclient.NvmeClientError{Status: nvmeclient.DISC_GET_LOG, Msg: "get discovery log failed", Err: err}
-	}
+	})
 	userDir := testutils.CreateTempDir(t)
 	defer os.RemoveAll(userDir)
 	internalDir := testutils.CreateTempDir(t)
@@ -412,11 +446,11 @@ func TestFailedConnection(t *testing.T) {
 	fileContent := genFileContent(numEndpoints, firstSubsysNQN)
 	filePath := filepath.Join(userDir, fileName)
 	hostAPIMock := NewHostAPIMock()
-	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10)
+	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
 	serviceInterface.Start()
 	testutils.CreateFile(t, filePath, fileContent)
 	correctConnections := func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, numEndpoints)
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, numEndpoints)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", numEndpoints)
 }
@@ -429,9 +463,9 @@ func TestConnectionsAddedThroughReferrals(t *testing.T) {
 	// Verify 7 connections in service
 	fileNumEndpoints := uint(1)
 	referralNumEndpoints := uint(7)
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		return getReferrals(referralNumEndpoints, discoveryRequest), getCid(discoveryRequest), nil
-	}
+	})
 	userDir := testutils.CreateTempDir(t)
 	defer os.RemoveAll(userDir)
 	internalDir := testutils.CreateTempDir(t)
@@ -442,11 +476,11 @@ func TestConnectionsAddedThroughReferrals(t *testing.T) {
 	fileContent := genFileContent(fileNumEndpoints, firstSubsysNQN)
 	filePath := filepath.Join(userDir, fileName)
 	hostAPIMock := NewHostAPIMock()
-	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10)
+	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
 	testutils.CreateFile(t, filePath, fileContent)
 	serviceInterface.Start()
 	correctConnections := func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, referralNumEndpoints)
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, referralNumEndpoints)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", referralNumEndpoints)
 	cancel()
@@ -454,13 +488,49 @@ func TestConnectionsAddedThroughReferrals(t *testing.T) {
 	newCtx, newCancel := context.WithCancel(context.Background())
 	defer newCancel()
 	newCache := clientconfig.NewCache(newCtx, userDir, internalDir, nil)
-	newServiceInterface := NewService(newCtx, newCache, hostAPIMock, reconnectInterval, 0, 10)
+	newServiceInterface := NewService(newCtx, newCache, hostAPIMock, reconnectInterval, 0, 10, "")
 	newServiceInterface.Start()
 	correctConnections = func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, newServiceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, referralNumEndpoints)
+		return correctNumberOfClusterConnectionsInCache(t, newServiceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, referralNumEndpoints)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*500, "number of expected connections, %d, not reached", referralNumEndpoints)
 }
+func TestCurrentDiscoverySubsystemEntries(t *testing.T) {
+	// the target reports its own ports, with their own nqn, as current discovery subsystem entries.
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+		return []*hostapi.NvmeDiscPageEntry{
+			{TrsvcID: 8009, Traddr: "192.168.1.0", Subnqn: "nqn.2014-08.org.nvmexpress.discovery:uuid:1", SubType: nvme.NVME_NQN_CURR,
+				Eflags: nvme.NVMF_DISC_EFLAGS_DUPRETINFO | nvme.NVMF_DISC_EFLAGS_EPCSD},
+			{TrsvcID: 8010, Traddr: "192.168.1.1", Subnqn: "nqn.2014-08.org.nvmexpress.discovery:uuid:1", SubType: nvme.NVME_NQN_CURR,
+				Eflags: nvme.NVMF_DISC_EFLAGS_DUPRETINFO},
+		}, getCid(discoveryRequest), nil
+	})
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := clientconfig.NewCache(ctx, userDir, internalDir, nil)
+	serviceInterface := NewService(ctx, cache, NewHostAPIMock(), reconnectInterval, 0, 10, "")
+	testutils.CreateFile(t, filepath.Join(userDir, "vol1.conf"), genFileContent(1, firstSubsysNQN))
+	serviceInterface.Start()
+	pair := clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}
+	require.Eventually(t, func() bool {
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, pair, 2)
+	}, obtainConnectionsTimeout, 100*time.Millisecond)
+
+	connections, err := getServiceConnectionsOfCluster(serviceInterface, pair)
+	require.NoError(t, err)
+	for _, conn := range connections {
+		logPage, err := serviceInterface.(*service).getLogPageEntries(conn, 0)
+		require.NoError(t, err)
+		// no self referral is added to the entries of the target.
+		require.Len(t, logPage.referrals, 2)
+		require.Equal(t, conn.Key.Port() == 8009, logPage.supportsPersistentConnection(conn), conn.Address())
+	}
+}
+
 func TestConnectionsAtStartNotFromJson(t *testing.T) {
 	// Scenario:
 	// Populate service with 3 entries
@@ -471,9 +541,9 @@ func TestConnectionsAtStartNotFromJson(t *testing.T) {
 	// Restart service
 	// Verify 2 connections in service
 	numEndpoints := uint(3)
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		return getReferrals(numEndpoints, discoveryRequest), getCid(discoveryRequest), nil
-	}
+	})
 	userDir := testutils.CreateTempDir(t)
 	defer os.RemoveAll(userDir)
 	internalDir := testutils.CreateTempDir(t)
@@ -484,20 +554,20 @@ func TestConnectionsAtStartNotFromJson(t *testing.T) {
 	fileContent := genFileContent(numEndpoints, firstSubsysNQN)
 	filePath := filepath.Join(userDir, fileName)
 	hostAPIMock := NewHostAPIMock()
-	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10)
+	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
 	testutils.CreateFile(t, filePath, fileContent)
 	serviceInterface.Start()
 	correctConnections := func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, numEndpoints)
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, numEndpoints)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", numEndpoints)
 	cancel()
 	t.Log("Stopped first service instance")
 	os.Remove(filePath)
 	numEndpoints = uint(5)
-	discoverMock = func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
 		return getReferrals(numEndpoints, discoveryRequest), getCid(discoveryRequest), nil
-	}
+	})
 	fileName = "vol2.conf"
 	fileContent = genFileContent(numEndpoints, firstSubsysNQN)
 	filePath = filepath.Join(userDir, fileName)
@@ -506,10 +576,374 @@ func TestConnectionsAtStartNotFromJson(t *testing.T) {
 	newCtx, newCancel := context.WithCancel(context.Background())
 	defer newCancel()
 	newCache := clientconfig.NewCache(newCtx, userDir, internalDir, nil)
-	newServiceInterface := NewService(newCtx, newCache, hostAPIMock, reconnectInterval, 0, 10)
+	newServiceInterface := NewService(newCtx, newCache, hostAPIMock, reconnectInterval, 0, 10, "")
 	newServiceInterface.Start()
 	correctConnections = func() bool {
-		return correctNumberOfClusterConnectionsInCache(t, newServiceInterface, clientconfig.ClientClusterPair{firstSubsysNQN, hostnqn}, numEndpoints)
+		return correctNumberOfClusterConnectionsInCache(t, newServiceInterface, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}, numEndpoints)
 	}
 	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*500, "number of expected connections, %d, not reached", numEndpoints)
 }
+
+func TestClusterRemovedWithFile(t *testing.T) {
+	// Scenario:
+	// Two clusters configured in two files
+	// Remove the file of the first cluster
+	// Verify the first cluster is removed from the service while the second is untouched
+	numEndpoints := uint(3)
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+		return getReferrals(numEndpoints, discoveryRequest), getCid(discoveryRequest), nil
+	})
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := clientconfig.NewCache(ctx, userDir, internalDir, nil)
+	file1Path := filepath.Join(userDir, "vol1.conf")
+	testutils.CreateFile(t, file1Path, genFileContent(numEndpoints, firstSubsysNQN))
+	file2Path := filepath.Join(userDir, "vol2.conf")
+	testutils.CreateFile(t, file2Path, genFileContent(numEndpoints, secondSubsysNQN))
+	hostAPIMock := NewHostAPIMock()
+	serviceInterface := NewService(ctx, cache, hostAPIMock, reconnectInterval, 0, 10, "")
+	serviceInterface.Start()
+	firstPair := clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}
+	secondPair := clientconfig.ClientClusterPair{ClusterNqn: secondSubsysNQN, HostNqn: hostnqn}
+	for _, pair := range []clientconfig.ClientClusterPair{firstPair, secondPair} {
+		correctConnections := func() bool {
+			return correctNumberOfClusterConnectionsInCache(t, serviceInterface, pair, numEndpoints)
+		}
+		require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "number of expected connections, %d, not reached", numEndpoints)
+	}
+
+	testutils.DeleteFile(t, file1Path)
+	correctConnections := func() bool {
+		return correctNumberOfClusterConnectionsInCache(t, serviceInterface, firstPair, 0)
+	}
+	require.Eventuallyf(t, correctConnections, obtainConnectionsTimeout, time.Millisecond*100, "connections of removed cluster were not removed")
+	require.True(t, correctNumberOfClusterConnectionsInCache(t, serviceInterface, secondPair, numEndpoints))
+	serviceInterface.Stop()
+}
+
+func TestMissingIOControllers(t *testing.T) {
+	logPageEntries := []*hostapi.NvmeDiscPageEntry{
+		{Traddr: "192.168.1.1", TrsvcID: 4420, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.168.1.2", TrsvcID: 4420, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.168.1.3", TrsvcID: 4420, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.168.1.1", TrsvcID: 8009, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_DISC},
+	}
+	ctrls := map[string]*nvmeclient.NvmeControllerInfo{
+		"nvme0": {Traddr: "192.168.1.1", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN, Hostnqn: hostnqn},
+		// connected by another host nqn
+		"nvme1": {Traddr: "192.168.1.2", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN, Hostnqn: "nqn.2014-08.org.nvmexpress:uuid:other"},
+		// kernel does not expose hostnqn
+		"nvme2": {Traddr: "192.168.1.3", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN},
+		"nvme3": nil,
+	}
+	missing := missingIOControllers(logPageEntries, hostnqn, "tcp", nil, ctrls)
+	require.Len(t, missing, 1)
+	require.Equal(t, "192.168.1.2", missing[0].Traddr)
+
+	missing = missingIOControllers(logPageEntries, hostnqn, "rdma", nil, ctrls)
+	require.Len(t, missing, 3, "controllers of another transport should not match")
+}
+
+func TestMissingIOControllersHostPaths(t *testing.T) {
+	logPageEntries := []*hostapi.NvmeDiscPageEntry{
+		{Traddr: "192.168.1.1", TrsvcID: 4420, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.168.1.2", TrsvcID: 4420, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.168.1.1", TrsvcID: 4420, Subnqn: secondSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+	}
+	ctrls := map[string]*nvmeclient.NvmeControllerInfo{
+		"nvme0": {Traddr: "192.168.1.1", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN, Hostnqn: hostnqn, HostIface: "eth1"},
+		"nvme1": {Traddr: "192.168.1.1", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN, Hostnqn: hostnqn, HostTraddr: "10.0.1.5"},
+		"nvme2": {Traddr: "192.168.1.2", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN, Hostnqn: hostnqn, HostIface: "eth1"},
+		// connected through a path that is not configured
+		"nvme3": {Traddr: "192.168.1.1", Trsvcid: 4420, Transport: "tcp", Subsysnqn: secondSubsysNQN, Hostnqn: hostnqn, HostIface: "eth0"},
+	}
+	hostPaths := model.HostPaths{{Iface: "eth1"}, {Traddr: "10.0.1.5"}}
+	missing := missingIOControllers(logPageEntries, hostnqn, "tcp", hostPaths, ctrls)
+	require.Len(t, missing, 2)
+	require.Equal(t, "192.168.1.2", missing[0].Traddr, "an IO controller missing one of its paths should be reconnected")
+	require.Equal(t, secondSubsysNQN, missing[1].Subnqn)
+
+	counts := countSubsystemPaths(logPageEntries, hostnqn, "tcp", hostPaths, ctrls)
+	require.Equal(t, map[string]pathCount{
+		firstSubsysNQN:  {connected: 3, expected: 4},
+		secondSubsysNQN: {connected: 0, expected: 2},
+	}, counts)
+
+	counts = countSubsystemPaths(logPageEntries, hostnqn, "tcp", nil, ctrls)
+	require.Equal(t, map[string]pathCount{
+		firstSubsysNQN:  {connected: 2, expected: 2},
+		secondSubsysNQN: {connected: 1, expected: 1},
+	}, counts, "without host paths any controller is a path")
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := model.BackoffConfig{
+		InitialDelay: time.Second,
+		Multiplier:   2,
+		MaxDelay:     5 * time.Second,
+	}
+	b := newBackoff()
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		delay, ok := b.failed(cfg)
+		require.True(t, ok)
+		require.Equal(t, expected, delay)
+	}
+
+	b.reset()
+	delay, _ := b.failed(cfg)
+	require.Equal(t, time.Second, delay, "backoff should start over after reset")
+
+	cfg.Jitter = true
+	b.random = func() float64 { return 0.5 }
+	delay, _ = b.failed(cfg)
+	require.Equal(t, 1250*time.Millisecond, delay, "jitter should pick a delay between half the initial delay and the backoff delay")
+	b.random = func() float64 { return 0 }
+	delay, _ = b.failed(cfg)
+	require.Equal(t, 500*time.Millisecond, delay, "jitter should never go below half the initial delay")
+
+	cfg.MaxAttempts = 3
+	b.reset()
+	_, ok := b.failed(cfg)
+	require.True(t, ok)
+	_, ok = b.failed(cfg)
+	require.True(t, ok)
+	_, ok = b.failed(cfg)
+	require.False(t, ok, "connect attempts should run out after MaxAttempts failures")
+}
+
+func TestEndpointSelection(t *testing.T) {
+	pair := clientconfig.ClientClusterPair{ClusterNqn: "subsysnqn1", HostNqn: "hostnqn1"}
+	c1, c2, c3, c4 := &clientconfig.Connection{}, &clientconfig.Connection{}, &clientconfig.Connection{}, &clientconfig.Connection{}
+	connections := []*clientconfig.Connection{c1, c2, c3, c4}
+	stats := newEndpointStats()
+
+	ordered := newEndpointSelector(model.EndpointSelectionRandom, stats).order(pair, connections)
+	require.ElementsMatch(t, connections, ordered)
+
+	stats.connected(pair, c3)
+	for i := 0; i < 10; i++ {
+		ordered = newEndpointSelector(model.EndpointSelectionSticky, stats).order(pair, connections)
+		require.ElementsMatch(t, connections, ordered)
+		require.Equal(t, c3, ordered[0], "the last good endpoint should be tried first")
+	}
+	stats.forgetConnection(pair, c3)
+	require.Nil(t, stats.lastGoodConnection(pair))
+
+	stats.probed(c1, 20*time.Millisecond, nil)
+	stats.probed(c2, time.Second, errors.New("probe failed"))
+	stats.probed(c3, 10*time.Millisecond, nil)
+	ordered = newEndpointSelector(model.EndpointSelectionLatency, stats).order(pair, connections)
+	require.Equal(t, []*clientconfig.Connection{c3, c1, c4, c2}, ordered,
+		"probed endpoints should be ordered by latency, followed by endpoints not probed and endpoints that failed the probe")
+}
+
+func TestRedundantDiscoveryConnections(t *testing.T) {
+	numEndpoints := uint(3)
+	setDiscoverMock(func(discoveryRequest *hostapi.DiscoverRequest) ([]*hostapi.NvmeDiscPageEntry, hostapi.ConnectionID, error) {
+		return getReferrals(numEndpoints, discoveryRequest), getCid(discoveryRequest), nil
+	})
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := clientconfig.NewCache(ctx, userDir, internalDir, nil)
+	testutils.CreateFile(t, filepath.Join(userDir, "vol1.conf"), genFileContent(numEndpoints, firstSubsysNQN))
+	s := newService(ctx, cache, NewHostAPIMock(), settings{
+		backoff:              model.BackoffConfig{InitialDelay: reconnectInterval, Multiplier: 1, MaxDelay: reconnectInterval},
+		kato:                 10,
+		discoveryConnections: 2,
+	})
+	s.Start()
+	defer s.Stop()
+	pair := clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}
+	persistentConnections := func() bool {
+		connections, err := getServiceConnectionsOfCluster(s, pair)
+		require.NoError(t, err)
+		persistent := 0
+		for _, conn := range connections {
+			if conn.GetConnectionID() != "" {
+				persistent++
+			}
+		}
+		t.Logf("found %d persistent discovery connections", persistent)
+		return persistent == 2
+	}
+	require.Eventually(t, persistentConnections, obtainConnectionsTimeout, 100*time.Millisecond,
+		"expected 2 persistent discovery connections to the cluster")
+}
+
+func TestProcessLogPageGenerations(t *testing.T) {
+	userDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(userDir)
+	internalDir := testutils.CreateTempDir(t)
+	defer os.RemoveAll(internalDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := clientconfig.NewCache(ctx, userDir, internalDir, nil)
+	s := newService(ctx, cache, NewHostAPIMock(), settings{discoveryConnections: 1})
+	pair := clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn}
+	w := newClusterWorker(s, pair)
+	defer w.stop()
+	conn := &clientconfig.Connection{Hostnqn: hostnqn}
+	logPage := func(genCtr uint64) *discoveryLogPage {
+		return &discoveryLogPage{conn: conn, request: conn.GetDiscoveryRequest(0), genCtr: genCtr}
+	}
+
+	first := logPage(7)
+	w.processLogPage(first)
+	require.Equal(t, first, w.lastLogPage)
+	require.Equal(t, uint64(7), w.generation)
+
+	// the same generation through another connection is an AEN duplicate.
+	w.processLogPage(logPage(7))
+	require.Equal(t, first, w.lastLogPage, "a log page generation that was processed should be skipped")
+
+	next := logPage(8)
+	w.processLogPage(next)
+	require.Equal(t, next, w.lastLogPage)
+	require.Equal(t, uint64(8), w.generation)
+
+	// a reconnect applies the next log page, even at an unchanged generation.
+	w.connect()
+	reconnected := logPage(8)
+	w.processLogPage(reconnected)
+	require.Equal(t, reconnected, w.lastLogPage, "the first log page after a reconnect should be applied")
+	w.processLogPage(logPage(8))
+	require.Equal(t, reconnected, w.lastLogPage, "a log page generation that was processed should be skipped")
+
+	// a configuration change applies the next log page.
+	w.handleEvents(workerEvents{reapply: true})
+	again := logPage(8)
+	w.processLogPage(again)
+	require.Equal(t, again, w.lastLogPage)
+}
+
+func TestSameIOControllers(t *testing.T) {
+	a := &hostapi.NvmeDiscPageEntry{Traddr: "192.168.1.1", TrsvcID: 4420, Subnqn: firstSubsysNQN}
+	b := &hostapi.NvmeDiscPageEntry{Traddr: "192.168.1.2", TrsvcID: 4420, Subnqn: firstSubsysNQN}
+	require.True(t, sameIOControllers([]*hostapi.NvmeDiscPageEntry{a, b}, []*hostapi.NvmeDiscPageEntry{b, a}))
+	require.False(t, sameIOControllers([]*hostapi.NvmeDiscPageEntry{a, b}, []*hostapi.NvmeDiscPageEntry{a, a}))
+	require.False(t, sameIOControllers([]*hostapi.NvmeDiscPageEntry{a}, []*hostapi.NvmeDiscPageEntry{a, b}))
+}
+
+func TestFilterIOControllers(t *testing.T) {
+	filter, err := iofilter.New([]string{"*:tenant-a-*"}, nil, nil, []string{"10.0.1.*"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newService(ctx, nil, NewHostAPIMock(), settings{ioFilter: filter})
+	w := newClusterWorker(s, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: hostnqn})
+	defer w.stop()
+	tenantA0 := &hostapi.NvmeDiscPageEntry{Traddr: "10.0.0.1", TrsvcID: 4420, Subnqn: "nqn.2016-01.com.example:tenant-a-vol0", SubType: nvme.NVME_NQN_NVME}
+	tenantA1 := &hostapi.NvmeDiscPageEntry{Traddr: "10.0.1.1", TrsvcID: 4420, Subnqn: "nqn.2016-01.com.example:tenant-a-vol1", SubType: nvme.NVME_NQN_NVME}
+	tenantB0 := &hostapi.NvmeDiscPageEntry{Traddr: "10.0.0.1", TrsvcID: 4420, Subnqn: "nqn.2016-01.com.example:tenant-b-vol0", SubType: nvme.NVME_NQN_NVME}
+	logPage := &discoveryLogPage{
+		conn:        &clientconfig.Connection{Hostnqn: hostnqn},
+		nvmeEntries: []*hostapi.NvmeDiscPageEntry{tenantA0, tenantA1, tenantB0},
+	}
+	require.Equal(t, []*hostapi.NvmeDiscPageEntry{tenantA0}, w.filterIOControllers(logPage, true))
+}
+
+func TestDiscoveryRequestDigests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := &clientconfig.Connection{Hostnqn: hostnqn}
+
+	s := newService(ctx, nil, NewHostAPIMock(), settings{})
+	request, err := s.discoveryRequest(conn, 0)
+	require.NoError(t, err)
+	require.False(t, request.HdrDigest)
+	require.False(t, request.DataDigest)
+	require.NotContains(t, request.ToOptions(), "digest")
+
+	s = newService(ctx, nil, NewHostAPIMock(), settings{cfg: model.AppConfig{FabricsOptions: model.FabricsOptions{HdrDigest: true, DataDigest: true}}})
+	request, err = s.discoveryRequest(conn, 0)
+	require.NoError(t, err)
+	require.True(t, request.HdrDigest, "the digests of the fabric apply to the discovery controllers")
+	require.True(t, request.DataDigest)
+	require.Contains(t, request.ToOptions(), ",hdr_digest,data_digest")
+}
+
+func TestDiscoveryRequestDHChap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := &clientconfig.Connection{Hostnqn: hostnqn}
+
+	s := newService(ctx, nil, NewHostAPIMock(), settings{})
+	request, err := s.discoveryRequest(conn, 0)
+	require.NoError(t, err)
+	require.Empty(t, request.DhChapSecret)
+	require.NotContains(t, request.ToOptions(), "dhchap")
+
+	cfg := model.AppConfig{DhChapSecret: "DHHC-1:00:c2VjcmV0MQ==:", DhChapCtrlSecret: "DHHC-1:00:c2VjcmV0Mg==:"}
+	s = newService(ctx, nil, NewHostAPIMock(), settings{cfg: cfg})
+	request, err = s.discoveryRequest(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, cfg.DhChapSecret, request.DhChapSecret, "the secrets of the IO controllers authenticate the discovery controllers")
+	require.Equal(t, cfg.DhChapCtrlSecret, request.DhChapCtrlSecret)
+	require.Contains(t, request.ToOptions(), ",dhchap_secret=DHHC-1:00:c2VjcmV0MQ==:,dhchap_ctrl_secret=DHHC-1:00:c2VjcmV0Mg==:")
+}
+
+func TestDhChapKeyFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keyDir := t.TempDir()
+	secret := func(b byte) string {
+		return (&nvmeauth.Secret{Key: bytes.Repeat([]byte{b}, 32)}).String()
+	}
+	cfg := model.AppConfig{DhChapSecret: secret(0)}
+	s := newService(ctx, nil, NewHostAPIMock(), settings{cfg: cfg})
+	s.dhChapKeys = dhchapkeys.NewStore(keyDir)
+	conn := &clientconfig.Connection{Hostnqn: hostnqn, Key: clientconfig.TKey{Nqn: firstSubsysNQN}}
+
+	request, err := s.discoveryRequest(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, secret(0), request.DhChapSecret, "no key file, the secret of the service configuration is used")
+
+	require.NoError(t, os.WriteFile(filepath.Join(keyDir, hostnqn), []byte(secret(1)+"\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(keyDir, firstSubsysNQN), []byte(secret(2)+" "+secret(3)+"\n"), 0600))
+	require.Equal(t, []string{hostnqn, firstSubsysNQN}, s.dhChapKeys.Load())
+	request, err = s.discoveryRequest(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, secret(2), request.DhChapSecret, "the key file of the cluster takes precedence")
+	require.Equal(t, secret(3), request.DhChapCtrlSecret)
+
+	logPage := &discoveryLogPage{conn: &clientconfig.Connection{Hostnqn: hostnqn, Key: clientconfig.TKey{Nqn: secondSubsysNQN}}, request: request}
+	params := s.ioConnectParams(logPage)
+	require.Equal(t, secret(1), params.DhChapSecret, "the key file of the host applies to its other clusters")
+	require.Empty(t, params.DhChapControllerSecret)
+
+	// the workers of the clusters and the hosts of the changed key files rotate the secrets
+	w1 := newClusterWorker(s, clientconfig.ClientClusterPair{ClusterNqn: firstSubsysNQN, HostNqn: "nqn.2014-08.org.nvmexpress:uuid:other"})
+	w2 := newClusterWorker(s, clientconfig.ClientClusterPair{ClusterNqn: secondSubsysNQN, HostNqn: "nqn.2014-08.org.nvmexpress:uuid:other"})
+	defer w1.stop()
+	defer w2.stop()
+	s.workers[w1.pair] = w1
+	s.workers[w2.pair] = w2
+	s.dhChapKeysChanged([]string{firstSubsysNQN})
+	require.True(t, w1.takeEvents().rotateDhChap)
+	require.False(t, w2.takeEvents().rotateDhChap)
+}
+
+func TestLogPageControllers(t *testing.T) {
+	logPageEntries := []*hostapi.NvmeDiscPageEntry{
+		{Traddr: "192.168.1.1", TrsvcID: 4420, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.168.1.1", TrsvcID: 4420, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+		{Traddr: "192.168.1.2", TrsvcID: 4420, Subnqn: firstSubsysNQN, SubType: nvme.NVME_NQN_NVME},
+	}
+	ctrls := map[string]*nvmeclient.NvmeControllerInfo{
+		"nvme0": {Traddr: "192.168.1.1", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN, Hostnqn: hostnqn, Device: "/dev/nvme0"},
+		// connected by another host nqn
+		"nvme1": {Traddr: "192.168.1.2", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN, Hostnqn: "nqn.2014-08.org.nvmexpress:uuid:other", Device: "/dev/nvme1"},
+		// not in the log page
+		"nvme2": {Traddr: "192.168.1.3", Trsvcid: 4420, Transport: "tcp", Subsysnqn: firstSubsysNQN, Hostnqn: hostnqn, Device: "/dev/nvme2"},
+	}
+	controllers := logPageControllers(logPageEntries, hostnqn, "tcp", ctrls)
+	require.Equal(t, []*nvmeclient.NvmeControllerInfo{ctrls["nvme0"]}, controllers)
+}